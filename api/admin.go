@@ -0,0 +1,354 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+func ListTenants(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenants, err := svcDb.ListTenants()
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list tenants", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list tenants")
+			return
+		}
+
+		// Respond with status OK - response payload is the list of tenants
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, tenants)
+	}
+}
+
+func CreateTenant(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := &CreateTenantRequest{}
+
+		// Parse and validate the request
+		//
+		if err := render.Bind(r, request); err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid tenant")
+			return
+		}
+
+		if err := svcDb.CreateTenant(request.Tenant); err != nil {
+			switch {
+			case errors.Is(err, db.ErrInvalidTenantName):
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid tenant name")
+			case errors.Is(err, db.ErrTenantExists):
+				// Respond with status Conflict - response payload is the error
+				//
+				respondError(w, r, http.StatusConflict, "Tenant already exists")
+			default:
+				// Respond with status Internal Server Error, or Service
+				// Unavailable if the database can't be reached - response
+				// payload is the error
+				//
+				logError(r, "Unable to create tenant", err, "tenant_name", request.Tenant.Name)
+				respondError(w, r, dbFailureStatus(err), "Unable to create tenant")
+			}
+			return
+		}
+
+		// Respond with status Created - response payload is the new tenant
+		//
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, request.Tenant)
+	}
+}
+
+func DeleteTenant(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := svcDb.DeleteTenant(chi.URLParam(r, "tenant")); err != nil {
+			switch {
+			case errors.Is(err, db.ErrInvalidTenantName):
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid tenant name")
+			case errors.Is(err, db.ErrTenantNotFound):
+				// Respond with status Not Found - response payload is the error
+				//
+				respondError(w, r, http.StatusNotFound, "Tenant not found")
+			default:
+				// Respond with status Internal Server Error, or Service
+				// Unavailable if the database can't be reached - response
+				// payload is the error
+				//
+				logError(r, "Unable to delete tenant", err, "tenant_name", chi.URLParam(r, "tenant"))
+				respondError(w, r, dbFailureStatus(err), "Unable to delete tenant")
+			}
+			return
+		}
+
+		// Respond with status No Content - no response payload
+		//
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListAuditRecords(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid audit filter")
+			return
+		}
+
+		limit := ListAuditRecordsLimitQueryParamDefault
+		if limitQueryParam := r.URL.Query().Get("limit"); limitQueryParam != "" {
+			limit, err = strconv.ParseUint(limitQueryParam, 10, 64)
+			if err != nil || limit == 0 || limit > ListAuditRecordsLimitQueryParamMax {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"limit\" query param")
+				return
+			}
+		}
+
+		afterSequence := ListAuditRecordsAfterSequenceQueryParamDefault
+		if afterSequenceQueryParam := r.URL.Query().Get("afterSequence"); afterSequenceQueryParam != "" {
+			afterSequence, err = strconv.ParseUint(afterSequenceQueryParam, 10, 64)
+			if err != nil {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"afterSequence\" query param")
+				return
+			}
+		}
+
+		records, nextAfterSequence, err := svcDb.ListAuditRecords(limit, afterSequence+1, filter)
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list audit records", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list audit records")
+			return
+		}
+
+		// If there are further records to retrieve, we'll return a relative
+		// URL for the next page in an HTTP header. The filters are carried
+		// over as is.
+		//
+		if nextAfterSequence != 0 {
+			query := r.URL.Query()
+			query.Set("afterSequence", strconv.FormatUint(nextAfterSequence, 10))
+			query.Set("limit", strconv.FormatUint(limit, 10))
+			w.Header().Set("x-next-relative-url", r.URL.Path+"?"+query.Encode())
+		}
+
+		// Respond with status OK - response payload is the list of records
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, records)
+	}
+}
+
+func ExportAuditRecords(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid audit filter")
+			return
+		}
+
+		// Streams every matching record as newline delimited JSON. Once the
+		// first record is written the status can no longer be changed, so any
+		// error past that point just cuts the stream short.
+		//
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		written := false
+		err = svcDb.ForEachAuditRecord(filter, func(record *model.AuditRecord) error {
+			written = true
+			return encoder.Encode(record)
+		})
+		if err != nil {
+			logError(r, "Unable to export audit records", err)
+			if !written {
+				// Respond with status Internal Server Error, or Service
+				// Unavailable if the database can't be reached - response
+				// payload is the error
+				//
+				respondError(w, r, dbFailureStatus(err), "Unable to export audit records")
+			}
+		}
+	}
+}
+
+func VerifyAuditLog(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		numRecords, err := svcDb.VerifyAuditLog()
+		if err != nil && !errors.Is(err, db.ErrAuditChainBroken) {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to verify audit log", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to verify audit log")
+			return
+		}
+
+		response := &VerifyAuditLogResponse{Valid: err == nil, Records: numRecords}
+		if err != nil {
+			response.Error = err.Error()
+		}
+
+		// Respond with status OK - response payload is the verification result
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, response)
+	}
+}
+
+func BackupDb(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileName := fmt.Sprintf("%s-%s", filepath.Base(svcDb.FilePath), time.Now().UTC().Format("20060102T150405Z"))
+
+		// Streams a consistent snapshot of the whole database. Once the first
+		// byte is written the status can no longer be changed, so any error
+		// past that point just cuts the stream short.
+		//
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		n, err := svcDb.WithContext(r.Context()).Backup(w)
+		if err != nil {
+			logError(r, "Unable to back up database", err, "bytes_written", n)
+			if n == 0 {
+				respondError(w, r, dbFailureStatus(err), "Unable to back up database")
+			}
+		}
+	}
+}
+
+func RestoreDb(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := svcDb.WithContext(r.Context()).Restore(r.Body); err != nil {
+			if errors.Is(err, db.ErrInvalidSnapshot) {
+				// Respond with status Bad Request - response payload is the
+				// error
+				//
+				respondError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to restore database", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to restore database")
+			return
+		}
+
+		requestLogger(r).Warn("Restored database")
+
+		// Respond with status No Content - no response payload
+		//
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Parses the "from", "to" (both RFC 3339 timestamps) and "principal" query
+// params used to filter audit records
+//
+func parseAuditFilter(r *http.Request) (db.AuditFilter, error) {
+	var err error
+	filter := db.AuditFilter{Principal: r.URL.Query().Get("principal")}
+
+	if fromQueryParam := r.URL.Query().Get("from"); fromQueryParam != "" {
+		if filter.From, err = time.Parse(time.RFC3339, fromQueryParam); err != nil {
+			return filter, err
+		}
+	}
+
+	if toQueryParam := r.URL.Query().Get("to"); toQueryParam != "" {
+		if filter.To, err = time.Parse(time.RFC3339, toQueryParam); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func GetLogLevel(logLevel *slog.LevelVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if logLevel == nil {
+			// Respond with status Not Found - response payload is the error
+			//
+			respondError(w, r, http.StatusNotFound, "Logging isn't configured")
+			return
+		}
+
+		// Respond with status OK - response payload is the current level
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, &LogLevelResponse{Level: logLevel.Level().String()})
+	}
+}
+
+func UpdateLogLevel(logLevel *slog.LevelVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if logLevel == nil {
+			// Respond with status Not Found - response payload is the error
+			//
+			respondError(w, r, http.StatusNotFound, "Logging isn't configured")
+			return
+		}
+
+		request := &UpdateLogLevelRequest{}
+
+		// Parse and validate the request
+		//
+		if err := render.Bind(r, request); err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid log level")
+			return
+		}
+
+		level, err := logging.ParseLevel(request.Level)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		previous := logLevel.Level()
+		logLevel.Set(level)
+		requestLogger(r).Warn("Changed log level", "from", previous.String(), "to", level.String())
+
+		// Respond with status OK - response payload is the new level
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, &LogLevelResponse{Level: level.String()})
+	}
+}
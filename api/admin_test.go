@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTenantRoutes(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	// Only admins can manage tenants
+	//
+	response := doRequest(router, http.MethodPost, "/admin/tenants", "alice-key", `{"name":"red"}`)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodPost, "/admin/tenants", "admin-key", `{"name":"red","maxMessages":1}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/admin/tenants", "admin-key", `{"name":"red"}`)
+	assert.Equal(t, http.StatusConflict, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/admin/tenants", "admin-key", `{"name":"Red!"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	// Tenants don't share messages with each other or the default bucket
+	//
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "alice-key", `{"payload":"red"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "alice-key", `{"payload":"red"}`)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	// Only admins create tenants by writing to them
+	//
+	response = doRequest(router, http.MethodPost, "/tenants/blue/messages", "alice-key", `{"payload":"blue"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/blue/messages", "admin-key", `{"payload":"blue"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	var message model.Message
+	response = doRequest(router, http.MethodGet, "/tenants/blue/messages/1", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &message), "Error decoding json")
+	assert.Equal(t, "blue", message.Payload, "Unexpected message payload")
+
+	response = doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	var tenants ListTenantsResponse
+	response = doRequest(router, http.MethodGet, "/admin/tenants", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &tenants), "Error decoding json")
+	assert.Equal(t, 2, len(tenants), "Unexpected number of tenants")
+
+	response = doRequest(router, http.MethodDelete, "/admin/tenants/red", "admin-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/admin/tenants/red", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/tenants/red/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// Deleted tenants stay deleted until they're explicitly created again
+	//
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "admin-key", `{"payload":"red"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/admin/tenants", "admin-key", `{"name":"red"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "alice-key", `{"payload":"red"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+}
+
+func TestAuditRoutes(t *testing.T) {
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	request := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(`{"payload":"foo"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer alice-key")
+	request.Header.Set("X-Request-Id", "req-42")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	response := doRequest(router, http.MethodDelete, "/messages/1", "admin-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/admin/audit", "alice-key", "")
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	var records ListAuditRecordsResponse
+	response = doRequest(router, http.MethodGet, "/admin/audit?principal=alice", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &records), "Error decoding json")
+	assert.Equal(t, 1, len(records), "Unexpected number of records")
+	assert.Equal(t, "req-42", records[0].RequestId, "Unexpected request ID")
+	assert.Equal(t, db.AuditOperationCreate, records[0].Operation, "Unexpected operation")
+
+	response = doRequest(router, http.MethodGet, "/admin/audit?limit=1", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "/admin/audit?afterSequence=1&limit=1", response.Header().Get("x-next-relative-url"), "Unexpected x-next-relative-url")
+
+	response = doRequest(router, http.MethodGet, "/admin/audit?from=yesterday", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/admin/audit/export?from=2000-01-01T00:00:00Z", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "application/x-ndjson", response.Header().Get("Content-Type"), "Unexpected content-type")
+	assert.Equal(t, 2, strings.Count(response.Body.String(), "\n"), "Unexpected number of records")
+
+	var verifyResponse VerifyAuditLogResponse
+	response = doRequest(router, http.MethodGet, "/admin/audit/verify", "admin-key", "")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &verifyResponse), "Error decoding json")
+	assert.Equal(t, VerifyAuditLogResponse{Valid: true, Records: 2}, verifyResponse, "Unexpected verification result")
+
+	// Failing to read a record past the first one cuts the export short, as
+	// the status was already sent
+	//
+	svcDb.Close()
+	boltDb, err := bolt.Open(svcDb.FilePath, 0600, nil)
+	assert.Nil(t, err, "Unable to open database")
+	assert.Nil(t, boltDb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("_audit")).Put([]byte{0, 0, 0, 0, 0, 0, 0, 2}, []byte("garbage"))
+	}), "Tampering failed")
+	assert.Nil(t, boltDb.Close(), "Unable to close database")
+
+	svcDb = db.NewDb(svcDb.Config)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	router = NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response = doRequest(router, http.MethodGet, "/admin/audit/export", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, 1, strings.Count(response.Body.String(), "\n"), "Unexpected number of records")
+
+	// Failing before that is answered with an error
+	//
+	svcDb.Close()
+	response = doRequest(router, http.MethodGet, "/admin/audit/export", "admin-key", "")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"), "Unexpected content-type")
+}
+
+func TestBackupRoutes(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/admin/backup", "alice-key", "")
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/admin/backup", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "application/octet-stream", response.Header().Get("Content-Type"), "Unexpected content-type")
+	assert.Contains(t, response.Header().Get("Content-Disposition"), `attachment; filename="api-test.db-`, "Unexpected content-disposition")
+	snapshot := response.Body.String()
+
+	// Restoring the backup undoes the changes made since
+	//
+	response = doRequest(router, http.MethodDelete, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodPost, "/admin/restore", "admin-key", snapshot)
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodPost, "/admin/restore", "admin-key", "garbage")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+}
@@ -2,8 +2,10 @@ package api
 
 import (
 	//"fmt"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/brandonto/rest-api-microservice-demo/db"
 	"github.com/brandonto/rest-api-microservice-demo/model"
@@ -13,18 +15,35 @@ import (
 
 func ListMessages(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
 		// Retrieve pagination query params from context
 		//
 		detailed := r.Context().Value("detailed").(bool)
 		limit := r.Context().Value("limit").(uint64)
 		afterId := r.Context().Value("afterId").(uint64)
+		owner := r.Context().Value("owner").(string)
+
+		// Only list messages accessible by the requesting principal, further
+		// narrowed down to the ones it owns if requested
+		//
+		principal := r.Context().Value("principal").(*Principal)
+		filter := func(detailedMessage *model.DetailedMessage) bool {
+			if owner == ListMessagesOwnerQueryParamMe {
+				return detailedMessage.Owner == principal.Name
+			}
+			return principal.CanAccess(detailedMessage)
+		}
 
-		detailedMessages, nextAfterId, err := svcDb.ListMessages(limit, afterId+1)
+		detailedMessages, nextAfterId, err := svcDb.ListMessages(limit, afterId+1, filter)
+		setSpanAttributes(r.Context(), MessageCountAttributeKey.Int(len(detailedMessages)))
 		if err != nil {
 			// Something went wrong with a batch get... respond with status
-			// Unprocessable content - no response payload
+			// Internal Server Error, or Service Unavailable if the database
+			// can't be reached - response payload is the error
 			//
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			logError(r, "Unable to list messages", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list messages")
 			return
 		}
 
@@ -47,19 +66,30 @@ func ListMessages(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 			if detailed {
 				nextRelativeUrl += "&detailed=true"
 			}
+
+			// "owner" is only included if the listing was filtered by it
+			//
+			if owner != ListMessagesOwnerQueryParamDefault {
+				nextRelativeUrl += "&owner=" + owner
+			}
 			w.Header().Set("x-next-relative-url", nextRelativeUrl)
 		}
 
 		// Response with status OK - response payload depends on the "detailed"
 		// query param
 		//
+		// An empty page is still an array
+		//
 		render.Status(r, http.StatusOK)
 		if detailed {
+			if detailedMessages == nil {
+				detailedMessages = []*model.DetailedMessage{}
+			}
 			render.JSON(w, r, detailedMessages)
 		} else {
 			// Transform array of DetailedMessages into array of Messages
 			//
-			var messages []*model.Message
+			messages := make([]*model.Message, 0, len(detailedMessages))
 			for _, v := range detailedMessages {
 				messages = append(messages, v.Message)
 			}
@@ -70,40 +100,66 @@ func ListMessages(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 
 func CreateMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
 		request := &CreateMessageRequest{}
 
 		// Parse and validate the request
 		//
 		if err := render.Bind(r, request); err != nil {
-			// Respond with status Bad Request - no response payload
+			// Respond with status Bad Request - response payload is the error
 			//
-			w.WriteHeader(http.StatusBadRequest)
+			respondError(w, r, http.StatusBadRequest, "Invalid message")
 			return
 		}
 
 		// Transform the Message received in the request into a DetailedMessage
 		// to store in the database. The "id" field of the message will be
-		// ignored in the database layer
+		// ignored in the database layer. The message is owned by whoever
+		// created it.
 		//
 		message := request.Message
 		palindrome := isPalindrome(message.Payload)
 		metadata := &model.MessageMetadata{Palindrome: palindrome}
+		principal := r.Context().Value("principal").(*Principal)
 		detailedMessage := &model.DetailedMessage{
 			Message:  message,
 			Metadata: metadata,
+			Owner:    principal.Name,
 		}
 
 		// Adds the message to the database
 		//
 		if err := svcDb.CreateMessage(detailedMessage); err != nil {
-			// Respond with status Unprocessable content - no response payload
+			if errors.Is(err, db.ErrTenantQuotaExceeded) || errors.Is(err, db.ErrQuotaExceeded) {
+				// Respond with status Forbidden - response payload is the error
+				//
+				respondError(w, r, http.StatusForbidden, "Quota exceeded")
+				return
+			}
+
+			if errors.Is(err, db.ErrTenantNotFound) {
+				// Only admins create tenants... respond with status Not Found
+				// - response payload is the error
+				//
+				respondError(w, r, http.StatusNotFound, "Tenant not found")
+				return
+			}
+
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
 			//
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			logError(r, "Unable to create message", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to create message")
 			return
 		}
+		setSpanAttributes(r.Context(), MessageIdAttributeKey.Int64(int64(detailedMessage.Message.Id)))
 
-		// Respond with status Created - no response payload
+		// Respond with status Created - no response payload, the URL of the
+		// message is in the "Location" header
 		//
+		location := strings.TrimSuffix(r.URL.Path, "/") + "/" + strconv.FormatUint(detailedMessage.Message.Id, 10)
+		w.Header().Set("Location", location)
 		w.WriteHeader(http.StatusCreated)
 		return
 	}
@@ -119,9 +175,10 @@ func GetMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 		if detailedQueryParam := r.URL.Query().Get("detailed"); detailedQueryParam != "" {
 			detailed, err = stringToBool(detailedQueryParam)
 			if err != nil {
-				// Respond with status Bad Request - no response payload
+				// Respond with status Bad Request - response payload
+				// is the error
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Invalid \"detailed\" query param")
 				return
 			}
 		}
@@ -130,6 +187,7 @@ func GetMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 		// query param
 		//
 		detailedMessage := r.Context().Value("detailedMessage").(*model.DetailedMessage)
+		setSpanAttributes(r.Context(), MessageIdAttributeKey.Int64(int64(detailedMessage.Message.Id)))
 		render.Status(r, http.StatusOK)
 		if detailed {
 			render.JSON(w, r, detailedMessage)
@@ -141,14 +199,16 @@ func GetMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 
 func UpdateMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
 		request := &PutMessageRequest{}
 
 		// Parse and validate the request
 		//
 		if err := render.Bind(r, request); err != nil {
-			// Respond with status Bad Request - no response payload
+			// Respond with status Bad Request - response payload is the error
 			//
-			w.WriteHeader(http.StatusBadRequest)
+			respondError(w, r, http.StatusBadRequest, "Invalid message")
 			return
 		}
 
@@ -158,15 +218,34 @@ func UpdateMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 		//
 		message := request.Message
 		detailedMessage := r.Context().Value("detailedMessage").(*model.DetailedMessage)
+		setSpanAttributes(r.Context(), MessageIdAttributeKey.Int64(int64(detailedMessage.Message.Id)))
 		detailedMessage.Message.Payload = message.Payload
 		detailedMessage.Metadata.Palindrome = isPalindrome(message.Payload)
 
 		// Replaces the message in the database
 		//
 		if err := svcDb.UpdateMessage(detailedMessage); err != nil {
-			// Respond with status Unprocessable content - no response payload
+			if errors.Is(err, db.ErrQuotaExceeded) {
+				// Respond with status Forbidden - response payload is the error
+				//
+				respondError(w, r, http.StatusForbidden, "Quota exceeded")
+				return
+			}
+
+			if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrTenantNotFound) {
+				// The message, or its tenant, was deleted since it was
+				// retrieved... respond with status Conflict - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusConflict, "Message was deleted concurrently")
+				return
+			}
+
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
 			//
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			logError(r, "Unable to update message", err, "message_id", detailedMessage.Message.Id)
+			respondError(w, r, dbFailureStatus(err), "Unable to update message")
 			return
 		}
 
@@ -179,13 +258,27 @@ func UpdateMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 
 func DeleteMessage(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
 		detailedMessage := r.Context().Value("detailedMessage").(*model.DetailedMessage)
 		messageId := detailedMessage.Message.Id
+		setSpanAttributes(r.Context(), MessageIdAttributeKey.Int64(int64(messageId)))
+
+		deleted, err := svcDb.DeleteMessage(messageId)
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to delete message", err, "message_id", messageId)
+			respondError(w, r, dbFailureStatus(err), "Unable to delete message")
+			return
+		}
 
-		if err := svcDb.DeleteMessage(messageId); err != nil {
-			// Respond with status Unprocessable content - no response payload
+		if !deleted {
+			// The message was deleted since it was retrieved... respond with
+			// status Conflict - response payload is the error
 			//
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			respondError(w, r, http.StatusConflict, "Message was deleted concurrently")
 			return
 		}
 
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Role granting access to every message regardless of its owner
+//
+const AdminRole = "admin"
+
+// Name of the principal used for every request when authentication is disabled
+//
+const AnonymousPrincipalName = "anonymous"
+
+// Authenticated identity on whose behalf a request is being processed
+//
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// Used when no API keys are configured. The service was historically open to
+// everyone, so the anonymous principal keeps full access to every message.
+//
+var anonymousPrincipal = &Principal{
+	Name:  AnonymousPrincipalName,
+	Roles: []string{AdminRole},
+}
+
+func (principal *Principal) HasRole(role string) bool {
+	for _, v := range principal.Roles {
+		if v == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Messages are only visible to, and modifiable by, their owner or an admin
+//
+func (principal *Principal) CanAccess(detailedMessage *model.DetailedMessage) bool {
+	return principal.HasRole(AdminRole) || detailedMessage.Owner == principal.Name
+}
+
+// Middleware to authenticate the API key presented with the request, either as
+// a bearer token in the "Authorization" header or in the "X-API-Key" header.
+// Failing that, and if "clientCertAuth" is set, the verified TLS client
+// certificate is used instead. The resulting Principal is added to the request
+// context. Authentication is disabled if "apiKeys" is empty and
+// "clientCertAuth" isn't set.
+//
+func Authenticate(apiKeys map[string]*Principal, clientCertAuth bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := anonymousPrincipal
+
+			if len(apiKeys) != 0 || clientCertAuth {
+				apiKey := r.Header.Get("X-API-Key")
+				if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+					apiKey = strings.TrimPrefix(authorization, "Bearer ")
+				}
+
+				var ok bool
+				if apiKey != "" {
+					principal, ok = apiKeys[apiKey]
+				} else if clientCertAuth {
+					principal, ok = clientCertPrincipal(r.TLS)
+				}
+
+				if !ok {
+					// Respond with status Unauthorized - response payload
+					// is the error
+					//
+					w.Header().Set("WWW-Authenticate", `Bearer realm="messages"`)
+					respondError(w, r, http.StatusUnauthorized, "Unauthenticated")
+					return
+				}
+			}
+
+			// Adds principal to the request context and forward to next
+			// http.Handler
+			//
+			ctx := context.WithValue(r.Context(), "principal", principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Maps the verified TLS client certificate of connection "state", if any, to a
+// principal named after the certificate subject's common name, with a role for
+// each of the subject's organizational units
+//
+func clientCertPrincipal(state *tls.ConnectionState) (*Principal, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return nil, false
+	}
+
+	return &Principal{Name: subject.CommonName, Roles: subject.OrganizationalUnit}, true
+}
+
+// Loads API keys from the file at "filePath". Every non-empty line that isn't a
+// comment (starting with '#') is of the form:
+//
+//     <api_key> <principal_name> [role[,role...]]
+//
+func LoadApiKeys(filePath string) (map[string]*Principal, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	apiKeys := make(map[string]*Principal)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<api_key> <principal_name> [roles]\"", filePath, lineNum)
+		}
+
+		if _, exists := apiKeys[fields[0]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate API key", filePath, lineNum)
+		}
+
+		principal := &Principal{Name: fields[1]}
+		if len(fields) == 3 {
+			principal.Roles = strings.Split(fields[2], ",")
+		}
+		apiKeys[fields[0]] = principal
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testApiKeys = map[string]*Principal{
+	"alice-key": {Name: "alice"},
+	"bob-key":   {Name: "bob"},
+	"admin-key": {Name: "root", Roles: []string{AdminRole}},
+}
+
+func newTestDb(t *testing.T) *db.Db {
+	svcDb := db.NewDb(db.Config{
+		FilePath:   filepath.Join(t.TempDir(), "api-test.db"),
+		BucketName: "ApiTestBucket",
+	})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	t.Cleanup(svcDb.Close)
+	return svcDb
+}
+
+func doRequest(router http.Handler, method string, path string, apiKey string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAuthentication(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodGet, "/messages", "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/messages", "wrong-key", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+}
+
+func TestMessageOwnership(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"alice"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "bob-key", `{"payload":"bob"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	// The owner is recorded from the authenticated principal
+	//
+	var detailedMessage model.DetailedMessage
+	response = doRequest(router, http.MethodGet, "/messages/1?detailed=true", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &detailedMessage), "Error decoding json")
+	assert.Equal(t, "alice", detailedMessage.Owner, "Unexpected owner")
+
+	// Foreign messages don't leak their existence
+	//
+	response = doRequest(router, http.MethodGet, "/messages/1", "bob-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPut, "/messages/1", "bob-key", `{"payload":"hijacked"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/messages/1", "bob-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// Admins can access everyone's messages
+	//
+	response = doRequest(router, http.MethodPut, "/messages/1", "admin-key", `{"payload":"moderated"}`)
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+
+	var messages []model.Message
+	response = doRequest(router, http.MethodGet, "/messages", "bob-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &messages), "Error decoding json")
+	assert.Equal(t, 1, len(messages), "Unexpected number of messages in response")
+	assert.Equal(t, "bob", messages[0].Payload, "Unexpected message payload")
+
+	response = doRequest(router, http.MethodGet, "/messages", "admin-key", "")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &messages), "Error decoding json")
+	assert.Equal(t, 2, len(messages), "Unexpected number of messages in response")
+
+	response = doRequest(router, http.MethodGet, "/messages?owner=me", "admin-key", "")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &messages), "Error decoding json")
+	assert.Equal(t, 0, len(messages), "Unexpected number of messages in response")
+
+	response = doRequest(router, http.MethodGet, "/messages?owner=bob", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+func ListChanges(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		limit := ListChangesLimitQueryParamDefault
+		if limitQueryParam := r.URL.Query().Get("limit"); limitQueryParam != "" {
+			limit, err = strconv.ParseUint(limitQueryParam, 10, 64)
+			if err != nil || limit == 0 || limit > ListChangesLimitQueryParamMax {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"limit\" query param")
+				return
+			}
+		}
+
+		since := ListChangesSinceQueryParamDefault
+		sinceQueryParam := r.URL.Query().Get("since")
+		if sinceQueryParam != "" {
+			since, err = strconv.ParseUint(sinceQueryParam, 10, 64)
+			if err != nil {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"since\" query param")
+				return
+			}
+		}
+
+		// A consumer picks up after the offset it last committed
+		//
+		if consumerQueryParam := r.URL.Query().Get("consumer"); consumerQueryParam != "" {
+			if sinceQueryParam != "" {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Only one of \"since\" and \"consumer\" query params allowed")
+				return
+			}
+
+			consumer, err := svcDb.GetChangeConsumer(consumerQueryParam)
+			if err != nil {
+				respondChangeConsumerError(w, r, err, consumerQueryParam, "Unable to retrieve consumer")
+				return
+			}
+			since = consumer.Offset
+		}
+
+		changes, afterSequence, err := svcDb.ReadChangeLog(since, limit)
+		if errors.Is(err, db.ErrChangesExpired) {
+			// Respond with status Gone - response payload is the error
+			//
+			respondError(w, r, http.StatusGone, changesExpiredError(since))
+			return
+		} else if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list changes", err, "since", since)
+			respondError(w, r, dbFailureStatus(err), "Unable to list changes")
+			return
+		}
+
+		// If there are further changes to retrieve, we'll return a relative
+		// URL for the next page in an HTTP header
+		//
+		if afterSequence != 0 {
+			query := r.URL.Query()
+			query.Del("consumer")
+			query.Set("since", strconv.FormatUint(afterSequence, 10))
+			query.Set("limit", strconv.FormatUint(limit, 10))
+			w.Header().Set("x-next-relative-url", r.URL.Path+"?"+query.Encode())
+		}
+
+		// Respond with status OK - response payload is the list of changes
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, changes)
+	}
+}
+
+func ListChangeConsumers(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consumers, err := svcDb.ListChangeConsumers()
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list consumers", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list consumers")
+			return
+		}
+
+		// Respond with status OK - response payload is the list of consumers
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, consumers)
+	}
+}
+
+func GetChangeConsumer(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "consumer")
+
+		consumer, err := svcDb.GetChangeConsumer(name)
+		if err != nil {
+			respondChangeConsumerError(w, r, err, name, "Unable to retrieve consumer")
+			return
+		}
+
+		// Respond with status OK - response payload is the consumer
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, consumer)
+	}
+}
+
+func CommitChangeOffset(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := &CommitChangeOffsetRequest{}
+
+		// Parse and validate the request
+		//
+		if err := render.Bind(r, request); err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid offset")
+			return
+		}
+
+		name := chi.URLParam(r, "consumer")
+
+		consumer, err := svcDb.CommitChangeOffset(name, *request.Offset)
+		if errors.Is(err, db.ErrInvalidOffset) {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Offset is past the last change")
+			return
+		} else if err != nil {
+			respondChangeConsumerError(w, r, err, name, "Unable to commit offset")
+			return
+		}
+
+		// Respond with status OK - response payload is the consumer
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, consumer)
+	}
+}
+
+func DeleteChangeConsumer(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "consumer")
+
+		if err := svcDb.DeleteChangeConsumer(name); err != nil {
+			respondChangeConsumerError(w, r, err, name, "Unable to delete consumer")
+			return
+		}
+
+		// Respond with status No Content - no response payload
+		//
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Responds to a request that failed to access consumer "name" with "err"
+//
+func respondChangeConsumerError(w http.ResponseWriter, r *http.Request, err error, name string, msg string) {
+	switch {
+	case errors.Is(err, db.ErrInvalidConsumerName):
+		// Respond with status Bad Request - response payload is the error
+		//
+		respondError(w, r, http.StatusBadRequest, "Invalid consumer name")
+	case errors.Is(err, db.ErrConsumerNotFound):
+		// Respond with status Not Found - response payload is the error
+		//
+		respondError(w, r, http.StatusNotFound, "Consumer not found")
+	default:
+		// Respond with status Internal Server Error, or Service Unavailable if
+		// the database can't be reached - response payload is the error
+		//
+		logError(r, msg, err, "consumer_name", name)
+		respondError(w, r, dbFailureStatus(err), msg)
+	}
+}
+
+// Error reported to whoever reads changes after sequence number "since" once
+// some of them expired
+//
+func changesExpiredError(since uint64) string {
+	return "Changes since " + strconv.FormatUint(since, 10) + " no longer retained"
+}
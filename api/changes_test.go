@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeRoutes(t *testing.T) {
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPut, "/messages/1", "alice-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/admin/tenants", "admin-key", `{"name":"red"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "bob-key", `{"payload":"baz"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	// Only admins can read the change log, which spans every tenant
+	//
+	response = doRequest(router, http.MethodGet, "/changes", "alice-key", "")
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	var changes ListChangesResponse
+	response = doRequest(router, http.MethodGet, "/changes?limit=2", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "/changes?limit=2&since=2", response.Header().Get("x-next-relative-url"), "Unexpected next page")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &changes), "Error decoding json")
+	assert.Equal(t, 2, len(changes), "Unexpected number of changes")
+	assert.Equal(t, db.ChangeUpdated, changes[1].Type, "Unexpected change type")
+
+	response = doRequest(router, http.MethodGet, "/changes?since=2", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Empty(t, response.Header().Get("x-next-relative-url"), "Unexpected next page")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &changes), "Error decoding json")
+	assert.Equal(t, 1, len(changes), "Unexpected number of changes")
+	assert.Equal(t, "red", changes[0].Tenant, "Unexpected tenant")
+
+	response = doRequest(router, http.MethodGet, "/changes?limit=0", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	// Consumers pick up after the offset they committed
+	//
+	response = doRequest(router, http.MethodGet, "/changes?consumer=indexer", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	var consumer model.ChangeConsumer
+	response = doRequest(router, http.MethodPut, "/changes/consumers/indexer", "admin-key", `{"offset":1}`)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &consumer), "Error decoding json")
+	assert.Equal(t, "indexer", consumer.Name, "Unexpected consumer")
+	assert.Equal(t, uint64(1), consumer.Offset, "Unexpected offset")
+
+	response = doRequest(router, http.MethodGet, "/changes?consumer=indexer", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &changes), "Error decoding json")
+	assert.Equal(t, 2, len(changes), "Unexpected number of changes")
+	assert.Equal(t, uint64(2), changes[0].Sequence, "Unexpected sequence")
+
+	response = doRequest(router, http.MethodGet, "/changes?consumer=indexer&since=0", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPut, "/changes/consumers/indexer", "admin-key", `{"offset":4}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPut, "/changes/consumers/indexer", "admin-key", `{}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPut, "/changes/consumers/Indexer!", "admin-key", `{"offset":1}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	var consumers ListChangeConsumersResponse
+	response = doRequest(router, http.MethodGet, "/changes/consumers", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &consumers), "Error decoding json")
+	assert.Equal(t, 1, len(consumers), "Unexpected number of consumers")
+
+	// Changes consumers haven't read yet are only removed when asked to, after
+	// which consumers that fell behind have to start over
+	//
+	_, err := svcDb.ApplyChangeLogPolicies(db.ChangeLogConfig{MaxChanges: 1}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	response = doRequest(router, http.MethodGet, "/changes?consumer=indexer", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+
+	_, err = svcDb.ApplyChangeLogPolicies(db.ChangeLogConfig{MaxChanges: 1, ExpireUnread: true}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	response = doRequest(router, http.MethodGet, "/changes?consumer=indexer", "admin-key", "")
+	assert.Equal(t, http.StatusGone, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/changes?since=2", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodGet, "/changes/consumers/indexer", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/changes/consumers/indexer", "admin-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/changes/consumers/indexer", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+}
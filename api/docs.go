@@ -0,0 +1,46 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"text/template"
+
+	"github.com/brandonto/rest-api-microservice-demo/docs"
+	"github.com/brandonto/rest-api-microservice-demo/html"
+)
+
+var swaggerInitializerTemplate = template.Must(template.New("swagger-initializer.js").Funcs(template.FuncMap{
+	// Values are written as JSON, which are valid JavaScript literals
+	//
+	"json": func(v interface{}) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+}).Parse(html.SwaggerInitializerTemplate))
+
+func OpenApi() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(docs.OpenApi)
+	}
+}
+
+// Serves the script pointing the Swagger UI at the OpenAPI document, on the
+// same origin the UI was reached on
+//
+func SwaggerInitializer() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		err := swaggerInitializerTemplate.Execute(w, struct{ OpenApiUrl string }{
+			OpenApiUrl: scheme + "://" + r.Host + "/openapi.json",
+		})
+		if err != nil {
+			logError(r, "Unable to render the Swagger UI initializer", err)
+		}
+	}
+}
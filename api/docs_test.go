@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/docs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocsRoutes(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{SwaggerUI: true})
+
+	response := doRequest(router, http.MethodGet, "/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, docs.OpenApi, response.Body.Bytes(), "Unexpected OpenAPI document")
+
+	response = doRequest(router, http.MethodGet, "/swagger/", "", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Contains(t, response.Body.String(), "swagger-initializer.js", "Unexpected Swagger UI page")
+
+	// The Swagger UI is pointed at the origin it was reached on
+	//
+	request := httptest.NewRequest(http.MethodGet, "http://docs.example.com:8080/swagger/swagger-initializer.js", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Contains(t, response.Body.String(), `url: "http://docs.example.com:8080/openapi.json",`, "Unexpected OpenAPI URL")
+
+	// The Swagger UI can be turned off, leaving the OpenAPI document
+	//
+	router = NewRouter(newTestDb(t), Config{})
+	response = doRequest(router, http.MethodGet, "/swagger/", "", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// How often a comment is sent on an otherwise idle event stream, so that
+// proxies don't time it out and clients can tell it's still alive
+//
+const DefaultEventsHeartbeatInterval = 15 * time.Second
+
+// Changes read from the change log at a time
+//
+const streamMessageEventsBatchSize = uint64(100)
+
+const EventStreamContentType = "text/event-stream"
+
+// Builds the predicate matching the changes requested by the query params of
+// "r" that are visible to the requesting principal. Returns an error naming
+// the invalid query param, if any.
+//
+func parseEventFilter(r *http.Request) (db.ChangeFilter, error) {
+	query := r.URL.Query()
+
+	types := query.Get("types")
+	if types == "" {
+		types = StreamMessageEventsTypesQueryParamDefault
+	}
+
+	// Palindromes and non palindromes are both streamed unless one of them is
+	// asked for
+	//
+	var palindrome *bool
+	if palindromeQueryParam := query.Get("palindrome"); palindromeQueryParam != "" {
+		value, err := stringToBool(palindromeQueryParam)
+		if err != nil {
+			return nil, errors.New("Invalid \"palindrome\" query param")
+		}
+		palindrome = &value
+	}
+
+	principal := r.Context().Value("principal").(*Principal)
+	filter, err := newEventFilter(principal, strings.Split(types, ","), palindrome, query.Get("owner"))
+	if err != nil {
+		return nil, fmt.Errorf("%s query param", err)
+	}
+	return filter, nil
+}
+
+// Builds the predicate matching changes of one of "types" that are visible to
+// "principal", narrowed down to palindromes or non palindromes unless
+// "palindrome" is nil, and to the principal's own messages if "owner" is "me".
+// Returns an error naming the invalid param, if any.
+//
+func newEventFilter(principal *Principal, types []string, palindrome *bool, owner string) (db.ChangeFilter, error) {
+	typeSet := make(map[string]bool)
+	for _, changeType := range types {
+		if changeType != db.ChangeCreated && changeType != db.ChangeUpdated && changeType != db.ChangeDeleted {
+			return nil, errors.New("Invalid \"types\"")
+		}
+		typeSet[changeType] = true
+	}
+
+	if owner != StreamMessageEventsOwnerQueryParamDefault && owner != StreamMessageEventsOwnerQueryParamMe {
+		return nil, errors.New("Invalid \"owner\"")
+	}
+
+	return func(change *model.Change) bool {
+		if !typeSet[change.Type] {
+			return false
+		}
+
+		// Messages deleted while corrupt have no metadata, and are never
+		// palindromes
+		//
+		detailedMessage := change.Message
+		if palindrome != nil {
+			isPalindrome := detailedMessage.Metadata != nil && detailedMessage.Metadata.Palindrome
+			if isPalindrome != *palindrome {
+				return false
+			}
+		}
+
+		if owner == StreamMessageEventsOwnerQueryParamMe {
+			return detailedMessage.Owner == principal.Name
+		}
+		return principal.CanAccess(detailedMessage)
+	}, nil
+}
+
+// Streams changes to the messages as Server-Sent Events, starting after the
+// one whose sequence number is in the "Last-Event-ID" header or the
+// "lastEventId" query param, or with the next change if neither is set. The
+// stream goes on until the client goes away or the service shuts down.
+//
+func StreamMessageEvents(svcDb *db.Db, heartbeatInterval time.Duration, readiness *Readiness) func(w http.ResponseWriter, r *http.Request) {
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = DefaultEventsHeartbeatInterval
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
+		filter, err := parseEventFilter(r)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Browsers resume with the header, which they can't set on the first
+		// connection, hence the query param
+		//
+		lastEventId := r.Header.Get("Last-Event-ID")
+		if lastEventId == "" {
+			lastEventId = r.URL.Query().Get("lastEventId")
+		}
+		var sequence uint64
+		if lastEventId != "" {
+			if sequence, err = strconv.ParseUint(lastEventId, 10, 64); err != nil {
+				// Respond with status Bad Request - response payload is the
+				// error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid last event ID")
+				return
+			}
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			respondError(w, r, http.StatusInternalServerError, "Streaming unsupported")
+			return
+		}
+
+		var lastSequence *uint64
+		if lastEventId != "" {
+			lastSequence = &sequence
+		}
+
+		notified, unsubscribe, sequence, err := subscribeChanges(svcDb, lastSequence)
+		if errors.Is(err, db.ErrChangesExpired) {
+			// Respond with status Gone - response payload is the error
+			//
+			respondError(w, r, http.StatusGone, changesExpiredError(sequence))
+			return
+		} else if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to start event stream", err, "lastEventId", lastEventId)
+			respondError(w, r, dbFailureStatus(err), "Unable to start event stream")
+			return
+		}
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", EventStreamContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		// Sends whatever changes were missed since the last event, which may be
+		// none of them if none match. Once the first event is written the
+		// status can no longer be changed, so any error past that point just
+		// cuts the stream short. A client that fell so far behind that the
+		// changes it missed expired gets status Gone once it resumes.
+		//
+		for sendChanges := true; ; {
+			if sendChanges {
+				for more := true; more; {
+					sequence, more, err = sendChangeBatch(svcDb, sequence, filter, streamMessageEventsBatchSize, func(change *model.Change) error {
+						return writeEvent(w, change)
+					})
+					if errors.Is(err, db.ErrChangesExpired) || errors.As(err, new(*changeSendError)) {
+						return
+					} else if err != nil {
+						logError(r, "Unable to stream events", err)
+						return
+					}
+				}
+				flusher.Flush()
+			}
+
+			select {
+			case <-notified:
+				sendChanges = true
+			case <-heartbeat.C:
+				sendChanges = false
+				if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-readiness.ShuttingDown():
+				return
+			}
+		}
+	}
+}
+
+// Writes "change" as an event named after its type, with the change's sequence
+// number as ID
+//
+func writeEvent(w http.ResponseWriter, change *model.Change) error {
+	buf, err := json.Marshal(change.Message)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Sequence, change.Type, buf)
+	return err
+}
+
+// Error returned by sendChangeBatch when sending a change failed, as opposed
+// to reading the changes, e.g. because the client went away
+//
+type changeSendError struct {
+	err error
+}
+
+func (e *changeSendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *changeSendError) Unwrap() error {
+	return e.err
+}
+
+// Subscribes to the changes made through "svcDb", then looks up the sequence
+// number of the change events start after: "lastSequence" unless nil, or else
+// the last change recorded. Subscribing first makes sure that no change
+// committed in between is missed. Returns ErrChangesExpired if the changes
+// after "lastSequence" are no longer retained. The subscription is ended
+// already if an error is returned.
+//
+func subscribeChanges(svcDb *db.Db, lastSequence *uint64) (<-chan struct{}, func(), uint64, error) {
+	notified, unsubscribe := svcDb.SubscribeChanges()
+
+	var sequence uint64
+	var err error
+	if lastSequence != nil {
+		sequence = *lastSequence
+		err = svcDb.CheckChangesRetained(sequence)
+	} else {
+		sequence, err = svcDb.LastChangeSequence()
+	}
+	if err != nil {
+		unsubscribe()
+		return nil, nil, sequence, err
+	}
+
+	return notified, unsubscribe, sequence, nil
+}
+
+// Calls "send" for each of the next "limit" changes after sequence number
+// "sequence" that match "filter". Returns the sequence number the next changes
+// come after, and whether there are changes left to send. Failures to send are
+// returned as a changeSendError.
+//
+func sendChangeBatch(svcDb *db.Db, sequence uint64, filter db.ChangeFilter, limit uint64, send func(*model.Change) error) (uint64, bool, error) {
+	// Changes that don't match are skipped over for good, by picking up from
+	// the last change recorded by the time they were read
+	//
+	lastSequence, err := svcDb.LastChangeSequence()
+	if err != nil {
+		return sequence, false, err
+	}
+
+	changes, afterSequence, err := svcDb.ListChanges(limit, sequence+1, filter)
+	if err != nil {
+		return sequence, false, err
+	}
+
+	for _, change := range changes {
+		if err = send(change); err != nil {
+			return sequence, false, &changeSendError{err: err}
+		}
+		sequence = change.Sequence
+	}
+
+	if afterSequence != 0 {
+		return sequence, true, nil
+	}
+	if lastSequence > sequence {
+		sequence = lastSequence
+	}
+	return sequence, false, nil
+}
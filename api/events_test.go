@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// Event stream opened against "server", read one event at a time
+//
+type testEventStream struct {
+	t        *testing.T
+	response *http.Response
+	reader   *bufio.Reader
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, path string, apiKey string, lastEventId string) *testEventStream {
+	request, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	assert.Nil(t, err, "Error creating HTTP request")
+	request.Header.Set("Authorization", "Bearer "+apiKey)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	// Reading an event that never comes fails the test rather than hang it
+	//
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	assert.Nil(t, err, "Error making HTTP request")
+	t.Cleanup(func() { response.Body.Close() })
+
+	return &testEventStream{t: t, response: response, reader: bufio.NewReader(response.Body)}
+}
+
+// Reads the next event, or heartbeat if "heartbeats" is set
+//
+func (stream *testEventStream) next(heartbeats bool) *testEvent {
+	event := &testEvent{}
+	for {
+		line, err := stream.reader.ReadString('\n')
+		if !assert.Nil(stream.t, err, "Error reading event") {
+			return event
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.event != "":
+			return event
+		case strings.HasPrefix(line, ": ") && heartbeats:
+			event.event = "heartbeat"
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func (stream *testEventStream) nextMessage(expectedId string, expectedEvent string) *model.DetailedMessage {
+	event := stream.next(false)
+	assert.Equal(stream.t, expectedId, event.id, "Unexpected event ID")
+	assert.Equal(stream.t, expectedEvent, event.event, "Unexpected event")
+
+	detailedMessage := &model.DetailedMessage{}
+	assert.Nil(stream.t, json.Unmarshal([]byte(event.data), detailedMessage), "Error decoding event data")
+	return detailedMessage
+}
+
+func TestStreamMessageEvents(t *testing.T) {
+	readiness := NewReadiness()
+	readiness.SetReady()
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict, Readiness: readiness})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	// Only changes to palindromes the principal can access are streamed, from
+	// the next change on
+	//
+	stream := openEventStream(t, server, "/messages/events?palindrome=true", "alice-key", "")
+	assert.Equal(t, http.StatusOK, stream.response.StatusCode, "Unexpected HTTP status code")
+	assert.Equal(t, EventStreamContentType, stream.response.Header.Get("Content-Type"), "Unexpected content type")
+
+	doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"kayak"}`)
+	doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	doRequest(router, http.MethodPost, "/messages", "bob-key", `{"payload":"abba"}`)
+	doRequest(router, http.MethodPost, "/tenants/red/messages", "admin-key", `{"payload":"abba"}`)
+	doRequest(router, http.MethodPut, "/messages/1", "alice-key", `{"payload":"racecar"}`)
+
+	detailedMessage := stream.nextMessage("1", "created")
+	assert.Equal(t, "kayak", detailedMessage.Message.Payload, "Unexpected payload")
+	assert.Equal(t, "alice", detailedMessage.Owner, "Unexpected owner")
+	detailedMessage = stream.nextMessage("5", "updated")
+	assert.Equal(t, "racecar", detailedMessage.Message.Payload, "Unexpected payload")
+
+	// Resuming picks up after the last event received
+	//
+	stream = openEventStream(t, server, "/messages/events?types=updated,deleted", "alice-key", "1")
+	detailedMessage = stream.nextMessage("5", "updated")
+	assert.Equal(t, uint64(1), detailedMessage.Message.Id, "Unexpected message ID")
+	doRequest(router, http.MethodDelete, "/messages/1", "alice-key", "")
+	detailedMessage = stream.nextMessage("6", "deleted")
+	assert.Equal(t, "racecar", detailedMessage.Message.Payload, "Unexpected payload")
+
+	// Tenants have their own stream, in which admins see every message
+	//
+	stream = openEventStream(t, server, "/tenants/red/messages/events?lastEventId=0", "admin-key", "")
+	detailedMessage = stream.nextMessage("4", "created")
+	assert.Equal(t, "abba", detailedMessage.Message.Payload, "Unexpected payload")
+
+	// Resuming after changes that are no longer retained fails, so that the
+	// client knows to start over
+	//
+	_, err := svcDb.ApplyChangeLogPolicies(db.ChangeLogConfig{MaxChanges: 2}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	expired := openEventStream(t, server, "/messages/events", "alice-key", "3")
+	assert.Equal(t, http.StatusGone, expired.response.StatusCode, "Unexpected HTTP status code")
+
+	// Streams end once the service shuts down
+	//
+	readiness.SetShuttingDown()
+	_, err = stream.reader.ReadString('\n')
+	assert.NotNil(t, err, "Stream should have ended")
+
+	for _, path := range []string{"/messages/events?types=moved", "/messages/events?owner=bob", "/messages/events?palindrome=maybe", "/messages/events?lastEventId=last"} {
+		response := doRequest(router, http.MethodGet, path, "alice-key", "")
+		assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code for %s", path)
+	}
+	response := doRequest(router, http.MethodGet, "/messages/events", "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Unexpected HTTP status code")
+}
+
+func TestStreamMessageEventsHeartbeat(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, EventsHeartbeatInterval: 10 * time.Millisecond})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	stream := openEventStream(t, server, "/messages/events", "alice-key", "")
+	assert.Equal(t, "heartbeat", stream.next(true).event, "Expected a heartbeat")
+}
@@ -0,0 +1,563 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+	"github.com/brandonto/rest-api-microservice-demo/messagespb"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata the request ID is read from, and echoed back in, like the
+// "X-Request-ID" header of the REST API
+//
+const GrpcRequestIdMetadata = "x-request-id"
+
+// Messages read from the database at a time when listing them, and changes
+// when watching them
+//
+const grpcBatchSize = ListMessagesLimitQueryParamMax
+
+var grpcChangeTypes = map[string]messagespb.Event_Type{
+	db.ChangeCreated: messagespb.Event_TYPE_CREATED,
+	db.ChangeUpdated: messagespb.Event_TYPE_UPDATED,
+	db.ChangeDeleted: messagespb.Event_TYPE_DELETED,
+}
+
+// Returns a gRPC server serving the MessageService of messages.proto over
+// "svcDb", configured with "opts". Calls are authenticated, rate limited and
+// logged according to "cfg" like requests made against the REST API, although
+// budgets are counted separately. Watch calls end once the service starts
+// shutting down.
+//
+func NewGrpcServer(svcDb *db.Db, cfg Config, opts ...grpc.ServerOption) *grpc.Server {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logging.Discard()
+	}
+
+	readiness := cfg.Readiness
+	if readiness == nil {
+		readiness = NewReadiness()
+		readiness.SetReady()
+	}
+
+	interceptor := &grpcInterceptor{
+		apiKeys:        cfg.ApiKeys,
+		clientCertAuth: cfg.ClientCertAuth,
+		logger:         logger,
+		logRequests:    cfg.EnableLogger,
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(interceptor.unary),
+		grpc.ChainStreamInterceptor(interceptor.stream),
+	)
+
+	service := &grpcMessageService{
+		svcDb:     svcDb,
+		rateLimit: cfg.RateLimit,
+		readiness: readiness,
+	}
+	service.readLimiter, service.writeLimiter = newRateLimiters(cfg.RateLimit)
+
+	server := grpc.NewServer(opts...)
+	messagespb.RegisterMessageServiceServer(server, service)
+	return server
+}
+
+// Tags every call with a request ID and a logger, and authenticates it, before
+// handing it over to the service. The context of the call ends up carrying the
+// same values as the context of a REST request.
+//
+type grpcInterceptor struct {
+	apiKeys        map[string]*Principal
+	clientCertAuth bool
+	logger         *slog.Logger
+	logRequests    bool
+}
+
+func (interceptor *grpcInterceptor) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	ctx, err := interceptor.intercept(ctx)
+	if err == nil {
+		var resp any
+		resp, err = handler(ctx, req)
+		interceptor.logCall(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+
+	interceptor.logCall(ctx, info.FullMethod, start, err)
+	return nil, err
+}
+
+func (interceptor *grpcInterceptor) stream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	ctx, err := interceptor.intercept(stream.Context())
+	if err == nil {
+		err = handler(srv, &grpcServerStream{ServerStream: stream, ctx: ctx})
+	}
+
+	interceptor.logCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// Returns the context the call is handled under, or an Unauthenticated error
+// if the call doesn't carry valid credentials
+//
+func (interceptor *grpcInterceptor) intercept(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// Reuses the request ID sent by the client if there is one, and echoes it
+	// back. Generated IDs share their counter with the ones of REST requests.
+	//
+	requestId := ""
+	if values := md.Get(GrpcRequestIdMetadata); len(values) != 0 {
+		requestId = values[0]
+	}
+	if requestId == "" {
+		requestId = "grpc-" + strconv.FormatUint(middleware.NextRequestID(), 10)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(GrpcRequestIdMetadata, requestId))
+
+	ctx = context.WithValue(ctx, middleware.RequestIDKey, requestId)
+	ctx = context.WithValue(ctx, "logger", interceptor.logger.With("request_id", requestId))
+
+	principal := anonymousPrincipal
+	if len(interceptor.apiKeys) != 0 || interceptor.clientCertAuth {
+		apiKey := ""
+		if values := md.Get("x-api-key"); len(values) != 0 {
+			apiKey = values[0]
+		}
+		if values := md.Get("authorization"); len(values) != 0 && strings.HasPrefix(values[0], "Bearer ") {
+			apiKey = strings.TrimPrefix(values[0], "Bearer ")
+		}
+
+		var ok bool
+		if apiKey != "" {
+			principal, ok = interceptor.apiKeys[apiKey]
+		} else if interceptor.clientCertAuth {
+			principal, ok = grpcClientCertPrincipal(ctx)
+		}
+
+		if !ok {
+			return ctx, status.Error(codes.Unauthenticated, "Unauthenticated")
+		}
+	}
+
+	return context.WithValue(ctx, "principal", principal), nil
+}
+
+// Logs the call to "method" started at "start", which failed with "err" unless
+// nil, if calls are logged
+//
+func (interceptor *grpcInterceptor) logCall(ctx context.Context, method string, start time.Time, err error) {
+	if !interceptor.logRequests {
+		return
+	}
+
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	grpcLogger(ctx).LogAttrs(ctx, slog.LevelInfo, "Handled call",
+		slog.String("method", method),
+		slog.String("code", status.Code(err).String()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("remote_addr", remoteAddr),
+	)
+}
+
+// Stream whose context is replaced with the one the call is handled under
+//
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *grpcServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// Maps the verified TLS client certificate of the call, if any, to a principal
+// the same way as Authenticate does
+//
+func grpcClientCertPrincipal(ctx context.Context) (*Principal, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, false
+	}
+
+	return clientCertPrincipal(&tlsInfo.State)
+}
+
+// Returns the logger of the call, tagged with its request ID
+//
+func grpcLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value("logger").(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+type grpcMessageService struct {
+	messagespb.UnimplementedMessageServiceServer
+
+	svcDb        *db.Db
+	rateLimit    RateLimitConfig
+	readLimiter  *RateLimiter
+	writeLimiter *RateLimiter
+	readiness    *Readiness
+}
+
+func (service *grpcMessageService) List(request *messagespb.ListRequest, stream messagespb.MessageService_ListServer) error {
+	ctx := stream.Context()
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), false)
+	if err != nil {
+		return err
+	}
+
+	// Only list messages accessible by the calling principal, further narrowed
+	// down to the ones it owns if requested
+	//
+	filter := func(detailedMessage *model.DetailedMessage) bool {
+		if request.GetMine() {
+			return detailedMessage.Owner == principal.Name
+		}
+		return principal.CanAccess(detailedMessage)
+	}
+
+	// Messages are sent as they're read, one page at a time
+	//
+	for afterId := request.GetAfterId(); ; {
+		detailedMessages, nextAfterId, err := svcDb.ListMessages(grpcBatchSize, afterId+1, filter)
+		if err != nil {
+			return grpcDbError(ctx, "Unable to list messages", err)
+		}
+
+		for _, detailedMessage := range detailedMessages {
+			if err = stream.Send(toGrpcMessage(detailedMessage)); err != nil {
+				return err
+			}
+		}
+
+		if nextAfterId == 0 {
+			return nil
+		}
+		afterId = nextAfterId
+	}
+}
+
+func (service *grpcMessageService) Create(ctx context.Context, request *messagespb.CreateRequest) (*messagespb.Message, error) {
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.GetPayload() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid message")
+	}
+
+	// The message is owned by whoever created it
+	//
+	detailedMessage := &model.DetailedMessage{
+		Message:  &model.Message{Payload: request.GetPayload()},
+		Metadata: &model.MessageMetadata{Palindrome: isPalindrome(request.GetPayload())},
+		Owner:    principal.Name,
+	}
+
+	if err = svcDb.CreateMessage(detailedMessage); err != nil {
+		return nil, grpcDbError(ctx, "Unable to create message", err)
+	}
+
+	return toGrpcMessage(detailedMessage), nil
+}
+
+func (service *grpcMessageService) Get(ctx context.Context, request *messagespb.GetRequest) (*messagespb.Message, error) {
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	detailedMessage, err := getGrpcMessage(ctx, svcDb, principal, request.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	return toGrpcMessage(detailedMessage), nil
+}
+
+func (service *grpcMessageService) Update(ctx context.Context, request *messagespb.UpdateRequest) (*messagespb.Message, error) {
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.GetPayload() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid message")
+	}
+
+	detailedMessage, err := getGrpcMessage(ctx, svcDb, principal, request.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	// Replaces the payload of the message, along with any relevant metadata
+	//
+	detailedMessage.Message.Payload = request.GetPayload()
+	detailedMessage.Metadata.Palindrome = isPalindrome(request.GetPayload())
+
+	if err = svcDb.UpdateMessage(detailedMessage); errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrTenantNotFound) {
+		// The message, or its tenant, was deleted since it was retrieved
+		//
+		return nil, status.Error(codes.Aborted, "Message was deleted concurrently")
+	} else if err != nil {
+		return nil, grpcDbError(ctx, "Unable to update message", err, "message_id", request.GetId())
+	}
+
+	return toGrpcMessage(detailedMessage), nil
+}
+
+func (service *grpcMessageService) Delete(ctx context.Context, request *messagespb.DeleteRequest) (*messagespb.DeleteResponse, error) {
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = getGrpcMessage(ctx, svcDb, principal, request.GetId()); err != nil {
+		return nil, err
+	}
+
+	deleted, err := svcDb.DeleteMessage(request.GetId())
+	if err != nil {
+		return nil, grpcDbError(ctx, "Unable to delete message", err, "message_id", request.GetId())
+	}
+
+	// The message was deleted since it was retrieved
+	//
+	if !deleted {
+		return nil, status.Error(codes.Aborted, "Message was deleted concurrently")
+	}
+
+	return &messagespb.DeleteResponse{}, nil
+}
+
+// Sends changes to the messages like StreamMessageEvents, reading them from the
+// change log as they're committed
+//
+func (service *grpcMessageService) Watch(request *messagespb.WatchRequest, stream messagespb.MessageService_WatchServer) error {
+	ctx := stream.Context()
+	svcDb, principal, err := service.scopedDb(ctx, request.GetTenant(), false)
+	if err != nil {
+		return err
+	}
+
+	types := make([]string, 0, len(request.GetTypes()))
+	for _, eventType := range request.GetTypes() {
+		changeType, ok := fromGrpcChangeType(eventType)
+		if !ok {
+			return status.Error(codes.InvalidArgument, "Invalid \"types\"")
+		}
+		types = append(types, changeType)
+	}
+	if len(types) == 0 {
+		types = strings.Split(StreamMessageEventsTypesQueryParamDefault, ",")
+	}
+
+	owner := StreamMessageEventsOwnerQueryParamDefault
+	if request.GetMine() {
+		owner = StreamMessageEventsOwnerQueryParamMe
+	}
+
+	filter, err := newEventFilter(principal, types, nil, owner)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	notified, unsubscribe, sequence, err := subscribeChanges(svcDb, request.LastSequence)
+	if errors.Is(err, db.ErrChangesExpired) {
+		return status.Error(codes.OutOfRange, changesExpiredError(sequence))
+	} else if err != nil {
+		return grpcDbError(ctx, "Unable to start watching", err)
+	}
+	defer unsubscribe()
+
+	// Sends headers right away so that the caller knows it's watching before
+	// the first change is made
+	//
+	if err = stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	send := func(change *model.Change) error {
+		return stream.Send(&messagespb.Event{
+			Sequence: change.Sequence,
+			Type:     grpcChangeTypes[change.Type],
+			Message:  toGrpcMessage(change.Message),
+		})
+	}
+
+	var sendErr *changeSendError
+	for {
+		for more := true; more; {
+			sequence, more, err = sendChangeBatch(svcDb, sequence, filter, grpcBatchSize, send)
+			if errors.As(err, &sendErr) {
+				// The stream breaks off when the caller goes away, which is no
+				// failure of ours
+				//
+				if ctx.Err() != nil {
+					return nil
+				}
+				return sendErr.err
+			} else if errors.Is(err, db.ErrChangesExpired) {
+				return status.Error(codes.OutOfRange, changesExpiredError(sequence))
+			} else if err != nil {
+				return grpcDbError(ctx, "Unable to watch messages", err)
+			}
+		}
+
+		select {
+		case <-notified:
+		case <-ctx.Done():
+			return nil
+		case <-service.readiness.ShuttingDown():
+			return status.Error(codes.Unavailable, "Shutting down")
+		}
+	}
+}
+
+// Returns a handle into the database scoped to "tenant", or to the default
+// messages if empty, audited on behalf of the calling principal. Only admins
+// create the tenant by writing to it. Fails if the tenant is invalid, or if the
+// principal exhausted its budget for reads or writes depending on "write".
+//
+func (service *grpcMessageService) scopedDb(ctx context.Context, tenant string, write bool) (*db.Db, *Principal, error) {
+	if tenant != "" && !db.ValidTenantName(tenant) {
+		return nil, nil, status.Error(codes.InvalidArgument, "Invalid tenant name")
+	}
+
+	principal := ctx.Value("principal").(*Principal)
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	limiter := service.readLimiter
+	if write {
+		limiter = service.writeLimiter
+	}
+	if limiter != nil {
+		if allowed, _, _ := limiter.Allow(rateLimitKeyOf(service.rateLimit.KeyBy, principal, tenant, remoteAddr)); !allowed {
+			return nil, nil, status.Error(codes.ResourceExhausted, "Too many requests")
+		}
+	}
+
+	svcDb := service.svcDb.WithContext(ctx)
+	if tenant != "" {
+		svcDb = svcDb.ForTenant(tenant)
+		if !principal.HasRole(AdminRole) {
+			svcDb = svcDb.WithoutTenantCreation()
+		}
+	}
+
+	// Every change made on behalf of a principal ends up in the audit log
+	//
+	svcDb = svcDb.WithAuditContext(&db.AuditContext{
+		Principal:  principal.Name,
+		RemoteAddr: remoteAddr,
+		RequestId:  middleware.GetReqID(ctx),
+	})
+
+	return svcDb, principal, nil
+}
+
+// Retrieves message "id" on behalf of "principal". Messages that belong to
+// someone else are reported as not found so that their existence isn't leaked.
+//
+func getGrpcMessage(ctx context.Context, svcDb *db.Db, principal *Principal, id uint64) (*model.DetailedMessage, error) {
+	detailedMessage, err := svcDb.GetMessage(id)
+	if err != nil {
+		return nil, grpcDbError(ctx, "Unable to retrieve message", err, "message_id", id)
+	}
+
+	if !principal.CanAccess(detailedMessage) {
+		return nil, status.Error(codes.NotFound, "Message not found")
+	}
+
+	return detailedMessage, nil
+}
+
+// Returns the status a call fails with when a database operation failed with
+// "err". Unexpected failures are logged along with "args", and reported as
+// "msg".
+//
+func grpcDbError(ctx context.Context, msg string, err error, args ...any) error {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return status.Error(codes.NotFound, "Message not found")
+	case errors.Is(err, db.ErrTenantNotFound):
+		return status.Error(codes.NotFound, "Tenant not found")
+	case errors.Is(err, db.ErrTenantQuotaExceeded) || errors.Is(err, db.ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, "Quota exceeded")
+	}
+
+	if principal, ok := ctx.Value("principal").(*Principal); ok {
+		args = append(args, "principal", principal.Name)
+	}
+	args = append(args, "error", err)
+	grpcLogger(ctx).ErrorContext(ctx, msg, args...)
+
+	if errors.Is(err, db.ErrUnavailable) {
+		return status.Error(codes.Unavailable, msg)
+	}
+	return status.Error(codes.Internal, msg)
+}
+
+func toGrpcMessage(detailedMessage *model.DetailedMessage) *messagespb.Message {
+	message := &messagespb.Message{
+		Id:      detailedMessage.Message.Id,
+		Payload: detailedMessage.Message.Payload,
+		Owner:   detailedMessage.Owner,
+	}
+
+	// Messages deleted while corrupt have no metadata, and are never
+	// palindromes
+	//
+	if detailedMessage.Metadata != nil {
+		message.Palindrome = detailedMessage.Metadata.Palindrome
+	}
+
+	return message
+}
+
+func fromGrpcChangeType(eventType messagespb.Event_Type) (string, bool) {
+	for changeType, v := range grpcChangeTypes {
+		if v == eventType {
+			return changeType, true
+		}
+	}
+
+	return "", false
+}
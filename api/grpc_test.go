@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/messagespb"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Starts "server" on an in-memory listener and returns a client connected to
+// it, both of which are stopped once the test is done
+//
+func newTestGrpcClient(t *testing.T, server *grpc.Server) messagespb.MessageServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err, "NewClient() failed")
+	t.Cleanup(func() { conn.Close() })
+
+	return messagespb.NewMessageServiceClient(conn)
+}
+
+func withApiKey(apiKey string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+apiKey)
+}
+
+func listGrpcMessages(t *testing.T, client messagespb.MessageServiceClient, ctx context.Context, request *messagespb.ListRequest) []*messagespb.Message {
+	stream, err := client.List(ctx, request)
+	assert.Nil(t, err, "List() failed")
+
+	var messages []*messagespb.Message
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return messages
+		}
+		if !assert.Nil(t, err, "Recv() failed") {
+			return messages
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestGrpcMessageService(t *testing.T) {
+	svcDb := newTestDb(t)
+	client := newTestGrpcClient(t, NewGrpcServer(svcDb, Config{ApiKeys: testApiKeys}))
+	alice, bob, admin := withApiKey("alice-key"), withApiKey("bob-key"), withApiKey("admin-key")
+
+	// Calls are authenticated with the same API keys as the REST API
+	//
+	_, err := client.Get(context.Background(), &messagespb.GetRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "Unexpected status code")
+	_, err = client.Get(withApiKey("mallory-key"), &messagespb.GetRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "Unexpected status code")
+
+	var header metadata.MD
+	message, err := client.Create(alice, &messagespb.CreateRequest{Payload: "Taco cat"}, grpc.Header(&header))
+	assert.Nil(t, err, "Create() failed")
+	assert.Equal(t, uint64(1), message.Id, "Unexpected message ID")
+	assert.True(t, message.Palindrome, "Message should be a palindrome")
+	assert.Equal(t, "alice", message.Owner, "Unexpected owner")
+	assert.NotEmpty(t, header.Get(GrpcRequestIdMetadata), "Missing request ID")
+
+	_, err = client.Create(bob, &messagespb.CreateRequest{Payload: "foo"})
+	assert.Nil(t, err, "Create() failed")
+	_, err = client.Create(bob, &messagespb.CreateRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Unexpected status code")
+	_, err = client.Create(bob, &messagespb.CreateRequest{Tenant: "Red!", Payload: "foo"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Unexpected status code")
+
+	// Messages of others don't exist as far as their caller is concerned
+	//
+	_, err = client.Get(bob, &messagespb.GetRequest{Id: 1})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+	_, err = client.Update(bob, &messagespb.UpdateRequest{Id: 1, Payload: "bar"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+	_, err = client.Delete(bob, &messagespb.DeleteRequest{Id: 1})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+	_, err = client.Get(admin, &messagespb.GetRequest{Id: 3})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+
+	message, err = client.Update(alice, &messagespb.UpdateRequest{Id: 1, Payload: "bar"})
+	assert.Nil(t, err, "Update() failed")
+	assert.False(t, message.Palindrome, "Message shouldn't be a palindrome")
+	message, err = client.Get(admin, &messagespb.GetRequest{Id: 1})
+	assert.Nil(t, err, "Get() failed")
+	assert.Equal(t, "bar", message.Payload, "Unexpected payload")
+
+	// Listings are streamed, and only include accessible messages
+	//
+	messages := listGrpcMessages(t, client, bob, &messagespb.ListRequest{})
+	assert.Equal(t, 1, len(messages), "Unexpected number of messages")
+	messages = listGrpcMessages(t, client, admin, &messagespb.ListRequest{})
+	assert.Equal(t, 2, len(messages), "Unexpected number of messages")
+	messages = listGrpcMessages(t, client, admin, &messagespb.ListRequest{AfterId: 1})
+	assert.Equal(t, 1, len(messages), "Unexpected number of messages")
+	messages = listGrpcMessages(t, client, admin, &messagespb.ListRequest{Mine: true})
+	assert.Empty(t, messages, "Unexpected messages")
+
+	// Tenants are kept apart, and only admins create them by writing
+	//
+	_, err = client.Create(alice, &messagespb.CreateRequest{Tenant: "red", Payload: "baz"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+	_, err = client.Create(admin, &messagespb.CreateRequest{Tenant: "red", Payload: "baz"})
+	assert.Nil(t, err, "Create() failed")
+	messages = listGrpcMessages(t, client, admin, &messagespb.ListRequest{Tenant: "red"})
+	assert.Equal(t, 1, len(messages), "Unexpected number of messages")
+	assert.Equal(t, "baz", messages[0].Payload, "Unexpected payload")
+
+	_, err = client.Delete(alice, &messagespb.DeleteRequest{Id: 1})
+	assert.Nil(t, err, "Delete() failed")
+	_, err = client.Delete(alice, &messagespb.DeleteRequest{Id: 1})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Unexpected status code")
+
+	// Changes are audited on behalf of the caller
+	//
+	records, _, err := svcDb.ListAuditRecords(10, 1, db.AuditFilter{})
+	assert.Nil(t, err, "ListAuditRecords() failed")
+	assert.Equal(t, 5, len(records), "Unexpected number of audit records")
+	assert.Equal(t, "alice", records[0].Principal, "Unexpected principal")
+	assert.NotEmpty(t, records[0].RequestId, "Missing request ID")
+}
+
+func TestGrpcWatch(t *testing.T) {
+	svcDb := newTestDb(t)
+	readiness := NewReadiness()
+	readiness.SetReady()
+	client := newTestGrpcClient(t, NewGrpcServer(svcDb, Config{ApiKeys: testApiKeys, Readiness: readiness}))
+	alice, bob := withApiKey("alice-key"), withApiKey("bob-key")
+
+	_, err := client.Create(alice, &messagespb.CreateRequest{Payload: "foo"})
+	assert.Nil(t, err, "Create() failed")
+
+	ctx, cancel := context.WithTimeout(bob, 5*time.Second)
+	defer cancel()
+
+	// Watching starts with the next change unless told where to pick up from,
+	// and only covers accessible messages of the requested types
+	//
+	stream, err := client.Watch(ctx, &messagespb.WatchRequest{})
+	assert.Nil(t, err, "Watch() failed")
+	_, err = stream.Header()
+	assert.Nil(t, err, "Header() failed")
+
+	_, err = client.Update(alice, &messagespb.UpdateRequest{Id: 1, Payload: "bar"})
+	assert.Nil(t, err, "Update() failed")
+	_, err = client.Create(bob, &messagespb.CreateRequest{Payload: "level"})
+	assert.Nil(t, err, "Create() failed")
+
+	event, err := stream.Recv()
+	assert.Nil(t, err, "Recv() failed")
+	assert.Equal(t, uint64(3), event.Sequence, "Unexpected sequence")
+	assert.Equal(t, messagespb.Event_TYPE_CREATED, event.Type, "Unexpected event type")
+	assert.True(t, event.Message.Palindrome, "Message should be a palindrome")
+
+	lastSequence := uint64(0)
+	types := []messagespb.Event_Type{messagespb.Event_TYPE_UPDATED, messagespb.Event_TYPE_DELETED}
+	stream, err = client.Watch(withApiKey("admin-key"), &messagespb.WatchRequest{Types: types, LastSequence: &lastSequence})
+	assert.Nil(t, err, "Watch() failed")
+	event, err = stream.Recv()
+	assert.Nil(t, err, "Recv() failed")
+	assert.Equal(t, uint64(2), event.Sequence, "Unexpected sequence")
+	assert.Equal(t, messagespb.Event_TYPE_UPDATED, event.Type, "Unexpected event type")
+	assert.Equal(t, "alice", event.Message.Owner, "Unexpected owner")
+
+	stream, err = client.Watch(ctx, &messagespb.WatchRequest{Types: []messagespb.Event_Type{messagespb.Event_TYPE_UNSPECIFIED}})
+	assert.Nil(t, err, "Watch() failed")
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Unexpected status code")
+
+	// Watches can't pick up from before changes that are no longer retained
+	//
+	_, err = svcDb.ApplyChangeLogPolicies(db.ChangeLogConfig{MaxChanges: 1}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	lastSequence = 1
+	stream, err = client.Watch(ctx, &messagespb.WatchRequest{LastSequence: &lastSequence})
+	assert.Nil(t, err, "Watch() failed")
+	_, err = stream.Recv()
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "Unexpected status code")
+
+	// Watches end once the service starts shutting down
+	//
+	stream, err = client.Watch(ctx, &messagespb.WatchRequest{})
+	assert.Nil(t, err, "Watch() failed")
+	_, err = stream.Header()
+	assert.Nil(t, err, "Header() failed")
+	readiness.SetShuttingDown()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "Unexpected status code")
+}
+
+// Stream of a caller that went away, failing every send
+//
+type brokenWatchStream struct {
+	messagespb.MessageService_WatchServer
+
+	ctx context.Context
+}
+
+func (stream *brokenWatchStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *brokenWatchStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (stream *brokenWatchStream) Send(*messagespb.Event) error {
+	return io.EOF
+}
+
+func TestGrpcWatchDisconnect(t *testing.T) {
+	svcDb := newTestDb(t)
+	detailedMessage := &model.DetailedMessage{Message: &model.Message{Payload: "foo"}, Metadata: &model.MessageMetadata{}, Owner: "alice"}
+	assert.Nil(t, svcDb.CreateMessage(detailedMessage), "CreateMessage() failed")
+
+	service := &grpcMessageService{svcDb: svcDb, readiness: NewReadiness()}
+	ctx := context.WithValue(context.Background(), "principal", testApiKeys["admin-key"])
+	lastSequence := uint64(0)
+
+	// Failing to send to a caller that went away ends the watch quietly,
+	// otherwise the failure is passed on
+	//
+	err := service.Watch(&messagespb.WatchRequest{LastSequence: &lastSequence}, &brokenWatchStream{ctx: ctx})
+	assert.Equal(t, io.EOF, err, "Unexpected error")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = service.Watch(&messagespb.WatchRequest{LastSequence: &lastSequence}, &brokenWatchStream{ctx: ctx})
+	assert.Nil(t, err, "Watch() failed")
+}
+
+func TestGrpcRateLimit(t *testing.T) {
+	rateLimit := RateLimitConfig{KeyBy: RateLimitKeyPrincipal, WriteRate: 0.001, WriteBurst: 1}
+	client := newTestGrpcClient(t, NewGrpcServer(newTestDb(t), Config{ApiKeys: testApiKeys, RateLimit: rateLimit}))
+
+	_, err := client.Create(withApiKey("alice-key"), &messagespb.CreateRequest{Payload: "foo"})
+	assert.Nil(t, err, "Create() failed")
+	_, err = client.Create(withApiKey("alice-key"), &messagespb.CreateRequest{Payload: "foo"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "Unexpected status code")
+
+	// Budgets are per principal, and reads are budgeted separately
+	//
+	_, err = client.Create(withApiKey("bob-key"), &messagespb.CreateRequest{Payload: "foo"})
+	assert.Nil(t, err, "Create() failed")
+	_, err = client.Get(withApiKey("alice-key"), &messagespb.GetRequest{Id: 1})
+	assert.Nil(t, err, "Get() failed")
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+
+	"github.com/go-chi/render"
+)
+
+// Lifecycle states reported by the readiness endpoint
+//
+const (
+	ReadinessStarting int32 = iota
+	ReadinessReady
+	ReadinessShuttingDown
+)
+
+const HealthStatusOk = "ok"
+const HealthStatusFailing = "failing"
+
+var errStarting = errors.New("starting up")
+var errShuttingDown = errors.New("shutting down")
+
+// Tracks whether the service should be sent traffic. The service is only ready
+// between startup completing and graceful shutdown beginning. Safe for
+// concurrent use.
+//
+type Readiness struct {
+	state        int32
+	shuttingDown chan struct{}
+	once         sync.Once
+
+	// Hijacked connections, such as WebSockets, which the HTTP server stops
+	// keeping track of and therefore doesn't wait for when shutting down
+	//
+	mu          sync.Mutex
+	connections sync.WaitGroup
+}
+
+// Constructor for Readiness object. Starts out in the starting state.
+//
+func NewReadiness() *Readiness {
+	return &Readiness{state: ReadinessStarting, shuttingDown: make(chan struct{})}
+}
+
+func (readiness *Readiness) SetReady() {
+	atomic.StoreInt32(&readiness.state, ReadinessReady)
+}
+
+func (readiness *Readiness) SetShuttingDown() {
+	atomic.StoreInt32(&readiness.state, ReadinessShuttingDown)
+	readiness.once.Do(func() {
+		readiness.mu.Lock()
+		defer readiness.mu.Unlock()
+		close(readiness.shuttingDown)
+	})
+}
+
+// Closed once graceful shutdown begins, so that long-lived responses such as
+// event streams end rather than hold up the server's shutdown
+//
+func (readiness *Readiness) ShuttingDown() <-chan struct{} {
+	return readiness.shuttingDown
+}
+
+// Keeps track of a hijacked connection until the returned function is called.
+// Returns false, and doesn't track anything, once graceful shutdown began.
+//
+func (readiness *Readiness) trackConnection() (func(), bool) {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	select {
+	case <-readiness.shuttingDown:
+		return nil, false
+	default:
+	}
+
+	readiness.connections.Add(1)
+	return readiness.connections.Done, true
+}
+
+// Waits for every hijacked connection to close, which they do by themselves
+// once graceful shutdown begins, or for "ctx" to be done. Must be called after
+// SetShuttingDown.
+//
+func (readiness *Readiness) WaitForConnections(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		readiness.connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (readiness *Readiness) State() int32 {
+	return atomic.LoadInt32(&readiness.state)
+}
+
+// GET /healthz
+//
+// Liveness only reflects whether the process is able to serve requests at all,
+// so it never checks any dependency
+//
+func Healthz() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Respond with status OK - response payload is the health status
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, &HealthResponse{Status: HealthStatusOk})
+	}
+}
+
+// GET /readyz
+//
+// Readiness checks every dependency the service needs to handle requests. With
+// "detailed" set, the result and latency of each check is included.
+//
+func Readyz(svcDb *db.Db, readiness *Readiness) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		detailed, ok := parseHealthDetailed(w, r)
+		if !ok {
+			return
+		}
+
+		checks := []*HealthCheck{
+			runHealthCheck("lifecycle", func() error {
+				switch readiness.State() {
+				case ReadinessStarting:
+					return errStarting
+				case ReadinessShuttingDown:
+					return errShuttingDown
+				}
+				return nil
+			}),
+			runHealthCheck("db", svcDb.WithContext(r.Context()).Ping),
+		}
+
+		response := &HealthResponse{Status: HealthStatusOk}
+		status := http.StatusOK
+		for _, check := range checks {
+			if check.Status != HealthStatusOk {
+				response.Status = HealthStatusFailing
+				status = http.StatusServiceUnavailable
+			}
+		}
+		if detailed {
+			response.Checks = checks
+		}
+
+		// Respond with status OK or Service Unavailable - response payload is
+		// the readiness status
+		//
+		render.Status(r, status)
+		render.JSON(w, r, response)
+	}
+}
+
+// Runs "check", timing how long it takes
+//
+func runHealthCheck(name string, check func() error) *HealthCheck {
+	start := time.Now()
+	err := check()
+
+	result := &HealthCheck{
+		Name:      name,
+		Status:    HealthStatusOk,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = HealthStatusFailing
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// Parses the "detailed" query param of the health endpoints. Responds with
+// status Bad Request if it's invalid.
+//
+func parseHealthDetailed(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	detailedStr := r.URL.Query().Get("detailed")
+	if detailedStr == "" {
+		return HealthDetailedQueryParamDefault, true
+	}
+
+	detailed, err := stringToBool(detailedStr)
+	if err != nil {
+		// Respond with status Bad Request - response payload is the error
+		//
+		respondError(w, r, http.StatusBadRequest, "Invalid \"detailed\" query param")
+		return false, false
+	}
+
+	return detailed, true
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	svcDb := newTestDb(t)
+	readiness := NewReadiness()
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict, Readiness: readiness})
+
+	getHealth := func(path string, expectedStatusCode int) *HealthResponse {
+		response := doRequest(router, http.MethodGet, path, "", "")
+		assert.Equal(t, expectedStatusCode, response.Code, "Unexpected HTTP status code")
+
+		health := &HealthResponse{}
+		assert.Nil(t, json.Unmarshal(response.Body.Bytes(), health), "Error decoding json")
+		return health
+	}
+
+	// Liveness doesn't depend on anything, and neither route requires an API
+	// key
+	//
+	assert.Equal(t, HealthStatusOk, getHealth("/healthz", http.StatusOK).Status, "Unexpected status")
+
+	// Not ready until startup completes
+	//
+	health := getHealth("/readyz", http.StatusServiceUnavailable)
+	assert.Equal(t, HealthStatusFailing, health.Status, "Unexpected status")
+	assert.Nil(t, health.Checks, "Checks should only be listed when detailed")
+
+	readiness.SetReady()
+	health = getHealth("/readyz?detailed=true", http.StatusOK)
+	assert.Equal(t, HealthStatusOk, health.Status, "Unexpected status")
+	assert.Equal(t, 2, len(health.Checks), "Unexpected number of checks")
+	for _, check := range health.Checks {
+		assert.Equal(t, HealthStatusOk, check.Status, "Unexpected status for check %s", check.Name)
+		assert.GreaterOrEqual(t, check.LatencyMs, float64(0), "Unexpected latency for check %s", check.Name)
+	}
+
+	response := doRequest(router, http.MethodGet, "/readyz?detailed=maybe", "", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	// Not ready once shutting down
+	//
+	readiness.SetShuttingDown()
+	health = getHealth("/readyz?detailed=true", http.StatusServiceUnavailable)
+	assert.Equal(t, "lifecycle", health.Checks[0].Name, "Unexpected check")
+	assert.Equal(t, HealthStatusFailing, health.Checks[0].Status, "Unexpected status")
+	assert.Equal(t, "shutting down", health.Checks[0].Error, "Unexpected error")
+
+	// Nor if the database can't be read
+	//
+	readiness.SetReady()
+	svcDb.Close()
+	health = getHealth("/readyz?detailed=true", http.StatusServiceUnavailable)
+	assert.Equal(t, "db", health.Checks[1].Name, "Unexpected check")
+	assert.Equal(t, HealthStatusFailing, health.Checks[1].Status, "Unexpected status")
+	assert.NotEmpty(t, health.Checks[1].Error, "Missing error")
+	assert.Equal(t, HealthStatusOk, getHealth("/healthz", http.StatusOK).Status, "Unexpected status")
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header the request ID is echoed back in. Incoming requests can set it to
+// have their ID propagated rather than generated.
+//
+const RequestIdHeader = "X-Request-ID"
+
+// Middleware to attach a logger tagged with the request ID to the request
+// context, and echo the request ID back to the client. Must be used after
+// middleware.RequestID. If "logRequests" is set, every request is also logged
+// once handled.
+//
+func RequestLogger(logger *slog.Logger, logRequests bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestId := middleware.GetReqID(r.Context())
+			w.Header().Set(RequestIdHeader, requestId)
+
+			// Adds logger to the request context and forward to next
+			// http.Handler
+			//
+			requestLogger := logger.With("request_id", requestId)
+
+			// Log lines can be correlated with the trace of the request too
+			//
+			if spanCtx := trace.SpanContextFromContext(r.Context()); spanCtx.IsValid() {
+				requestLogger = requestLogger.With("trace_id", spanCtx.TraceID().String())
+			}
+			ctx := context.WithValue(r.Context(), "logger", requestLogger)
+
+			if !logRequests {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			requestLogger.LogAttrs(r.Context(), slog.LevelInfo, "Handled request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("route", route),
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+		})
+	}
+}
+
+// Returns the logger of the request, tagged with its request ID
+//
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value("logger").(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// Logs "err", which caused the request to fail, along with who made the
+// request and against which tenant
+//
+func logError(r *http.Request, msg string, err error, args ...any) {
+	if principal, ok := r.Context().Value("principal").(*Principal); ok {
+		args = append(args, "principal", principal.Name)
+	}
+	if tenant, ok := r.Context().Value("tenant").(string); ok {
+		args = append(args, "tenant", tenant)
+	}
+	args = append(args, "error", err)
+
+	requestLogger(r).ErrorContext(r.Context(), msg, args...)
+}
+
+// Responds with status "status" - response payload is an ErrorResponse
+// describing the error, along with the request ID to quote when reporting it
+//
+func respondError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	render.Status(r, status)
+	render.JSON(w, r, &ErrorResponse{
+		Error:     msg,
+		RequestId: middleware.GetReqID(r.Context()),
+	})
+}
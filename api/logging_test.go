@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Decodes every JSON log line written to "buf"
+//
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := make(map[string]any)
+		assert.Nil(t, json.Unmarshal([]byte(line), &fields), "Log line isn't JSON: %s", line)
+		lines = append(lines, fields)
+	}
+
+	return lines
+}
+
+func TestRequestLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, logLevel, err := logging.New(buf, logging.Config{Level: "info", Format: logging.FormatJSON})
+	assert.Nil(t, err, "logging.New() failed")
+
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{
+		EnableLogger: true,
+		ApiKeys:      testApiKeys,
+		Logger:       logger,
+		LogLevel:     logLevel,
+	})
+
+	// A request ID sent by the client is propagated...
+	//
+	request := httptest.NewRequest(http.MethodGet, "/messages", nil)
+	request.Header.Set("Authorization", "Bearer alice-key")
+	request.Header.Set(RequestIdHeader, "client-request-id")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "client-request-id", response.Header().Get(RequestIdHeader), "Request ID wasn't propagated")
+
+	lines := logLines(t, buf)
+	assert.Equal(t, 1, len(lines), "Unexpected number of log lines")
+	assert.Equal(t, "client-request-id", lines[0]["request_id"], "Unexpected request ID")
+	assert.Equal(t, "/messages", lines[0]["route"], "Unexpected route")
+	assert.Equal(t, float64(http.StatusOK), lines[0]["status"], "Unexpected status")
+
+	// ...otherwise one is generated, and quoted in error responses
+	//
+	buf.Reset()
+	response = doRequest(router, http.MethodGet, "/messages?limit=oops", "alice-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	requestId := response.Header().Get(RequestIdHeader)
+	assert.NotEmpty(t, requestId, "Request ID wasn't generated")
+
+	errorResponse := &ErrorResponse{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), errorResponse), "Error decoding json")
+	assert.Equal(t, requestId, errorResponse.RequestId, "Unexpected request ID")
+	assert.Equal(t, `Invalid "limit" query param`, errorResponse.Error, "Unexpected error")
+	assert.Equal(t, requestId, logLines(t, buf)[0]["request_id"], "Unexpected request ID")
+
+	// Database errors are logged along with who ran into them
+	//
+	buf.Reset()
+	svcDb.Close()
+	response = doRequest(router, http.MethodGet, "/tenants/red/messages", "alice-key", "")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Unexpected HTTP status code")
+
+	lines = logLines(t, buf)
+	assert.Equal(t, 2, len(lines), "Unexpected number of log lines")
+	assert.Equal(t, "ERROR", lines[0]["level"], "Unexpected level")
+	assert.Equal(t, "Unable to list messages", lines[0]["msg"], "Unexpected message")
+	assert.Equal(t, "alice", lines[0]["principal"], "Unexpected principal")
+	assert.Equal(t, "red", lines[0]["tenant"], "Unexpected tenant")
+	assert.NotEmpty(t, lines[0]["error"], "Missing error")
+	assert.Equal(t, lines[1]["request_id"], lines[0]["request_id"], "Log lines of a request should share its ID")
+}
+
+func TestLogLevelRoutes(t *testing.T) {
+	logger, logLevel, err := logging.New(&bytes.Buffer{}, logging.Config{Level: "info"})
+	assert.Nil(t, err, "logging.New() failed")
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict, Logger: logger, LogLevel: logLevel})
+
+	response := doRequest(router, http.MethodPut, "/admin/log-level", "alice-key", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	response = doRequest(router, http.MethodPut, "/admin/log-level", "admin-key", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, slog.LevelDebug, logLevel.Level(), "Level wasn't changed")
+
+	response = doRequest(router, http.MethodPut, "/admin/log-level", "admin-key", `{"level":"loud"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, slog.LevelDebug, logLevel.Level(), "Level shouldn't have changed")
+
+	response = doRequest(router, http.MethodGet, "/admin/log-level", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	levelResponse := &LogLevelResponse{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), levelResponse), "Error decoding json")
+	assert.Equal(t, "DEBUG", levelResponse.Level, "Unexpected level")
+}
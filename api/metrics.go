@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/metrics"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Prefix of every metric exposed by the service
+//
+const MetricsNamespace = "rdemo_"
+
+// Route label of requests that didn't match any route, so that arbitrary paths
+// don't each end up with their own time series
+//
+const MetricsUnmatchedRoute = "unmatched"
+
+// Middleware to count and time every request by method, chi route pattern and
+// status code. The metrics are registered on "registry" when the middleware is
+// created.
+//
+func Instrument(registry *metrics.Registry) func(next http.Handler) http.Handler {
+	requests := registry.NewCounterVec(MetricsNamespace+"http_requests_total",
+		"HTTP requests handled, by method, route and status code.",
+		"method", "route", "code")
+	durations := registry.NewHistogramVec(MetricsNamespace+"http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by method, route and status code.",
+		metrics.DefaultBuckets, "method", "route", "code")
+	inFlight := registry.NewGaugeVec(MetricsNamespace+"http_requests_in_flight",
+		"HTTP requests currently being handled, by method.",
+		"method")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			inFlight.WithLabelValues(r.Method).Inc()
+			defer inFlight.WithLabelValues(r.Method).Dec()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			// The route pattern is only known once the request has been routed
+			//
+			route := MetricsUnmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+
+			// Handlers that never write anything implicitly respond with
+			// status OK
+			//
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			code := strconv.Itoa(status)
+
+			requests.WithLabelValues(r.Method, route, code).Inc()
+			durations.WithLabelValues(r.Method, route, code).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// Registers metrics describing "svcDb" on "registry": a latency histogram of
+// every operation, bbolt statistics and message counts. Sets the operation
+// observer of "svcDb", so it must be called before any handle is derived from
+// it.
+//
+func InstrumentDb(registry *metrics.Registry, svcDb *db.Db) {
+	durations := registry.NewHistogramVec(MetricsNamespace+"db_operation_duration_seconds",
+		"Time taken by database operations, by operation and result.",
+		metrics.DefaultBuckets, "operation", "result")
+	writeTxs := registry.NewCounterVec(MetricsNamespace+"bbolt_write_tx_total",
+		"Write transactions run by database operations.")
+	writeTxs.WithLabelValues()
+
+	svcDb.SetOperationObserver(func(operation string, writable bool, duration time.Duration, err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		durations.WithLabelValues(operation, result).Observe(duration.Seconds())
+
+		if writable {
+			writeTxs.WithLabelValues().Inc()
+		}
+	})
+
+	// Statistics are snapshotted once per scrape. Scrapes are serialized, so
+	// the snapshot is never read and written concurrently.
+	//
+	stats := &db.Stats{}
+	messages := registry.NewGaugeVec(MetricsNamespace+"messages",
+		"Messages stored, by tenant. The default bucket is reported as tenant \""+db.DefaultBucketStatsName+"\".",
+		"tenant")
+	registry.OnScrape(func() {
+		latest, err := svcDb.Stats()
+		if err != nil {
+			// Keep reporting the last known values
+			//
+			return
+		}
+
+		stats = latest
+		messages.Reset()
+		for tenant, count := range stats.Messages {
+			messages.WithLabelValues(tenant).Set(float64(count))
+		}
+	})
+
+	registry.NewCounterFunc(MetricsNamespace+"bbolt_read_tx_total",
+		"Read transactions started.",
+		func() float64 { return float64(stats.ReadTxN) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_open_read_tx",
+		"Read transactions currently open.",
+		func() float64 { return float64(stats.OpenReadTxN) })
+	registry.NewCounterFunc(MetricsNamespace+"bbolt_page_allocations_total",
+		"Pages allocated.",
+		func() float64 { return float64(stats.PageCount) })
+	registry.NewCounterFunc(MetricsNamespace+"bbolt_page_allocated_bytes_total",
+		"Bytes allocated to pages.",
+		func() float64 { return float64(stats.PageAllocBytes) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_free_pages",
+		"Pages on the freelist.",
+		func() float64 { return float64(stats.FreePageN) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_pending_pages",
+		"Pages freed but still in use by an open transaction.",
+		func() float64 { return float64(stats.PendingPageN) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_free_allocated_bytes",
+		"Bytes allocated to free pages.",
+		func() float64 { return float64(stats.FreeAllocBytes) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_freelist_inuse_bytes",
+		"Bytes used by the freelist.",
+		func() float64 { return float64(stats.FreelistInuseBytes) })
+	registry.NewGaugeFunc(MetricsNamespace+"bbolt_file_size_bytes",
+		"Size of the database file.",
+		func() float64 { return float64(stats.FileSizeBytes) })
+}
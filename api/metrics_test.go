@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRoute(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "admin-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/no/such/route", "", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// Scraping doesn't require an API key
+	//
+	response = doRequest(router, http.MethodGet, "/metrics", "", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	body := response.Body.String()
+
+	// Requests are labelled by route pattern rather than by path
+	//
+	assert.Contains(t, body, `rdemo_http_requests_total{method="POST",route="/messages",code="201"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_http_requests_total{method="GET",route="/messages/{messageId}",code="200"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_http_requests_total{method="POST",route="/tenants/{tenant}/messages",code="201"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_http_requests_total{method="GET",route="unmatched",code="404"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_http_request_duration_seconds_count{method="GET",route="/messages/{messageId}",code="200"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_http_requests_in_flight{method="GET"} 1`+"\n", "The scrape itself should be in flight")
+
+	// Database operations and state
+	//
+	assert.Contains(t, body, `rdemo_db_operation_duration_seconds_count{operation="create_message",result="ok"} 2`+"\n")
+	assert.Contains(t, body, `rdemo_db_operation_duration_seconds_count{operation="get_message",result="ok"} 1`+"\n")
+	assert.Contains(t, body, "rdemo_bbolt_write_tx_total 2\n")
+	assert.Contains(t, body, `rdemo_messages{tenant="_default"} 1`+"\n")
+	assert.Contains(t, body, `rdemo_messages{tenant="red"} 1`+"\n")
+	assert.Contains(t, body, "# TYPE rdemo_bbolt_read_tx_total counter\n")
+	assert.Contains(t, body, "# TYPE rdemo_bbolt_free_pages gauge\n")
+	assert.Regexp(t, `\nrdemo_bbolt_file_size_bytes [1-9][0-9]*\n`, body, "Missing file size")
+}
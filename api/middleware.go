@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -26,22 +28,39 @@ func Paginate(next http.Handler) http.Handler {
 			//
 			detailed, err = stringToBool(detailedQueryParam)
 			if err != nil {
-				// Respond with status Bad Request - no response payload
+				// Respond with status Bad Request - response payload
+				// is the error
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Invalid \"detailed\" query param")
 				return
 			}
 		}
 
+		// "owner" can only be used to restrict the listing to messages owned by
+		// the requesting principal
+		//
+		owner := ListMessagesOwnerQueryParamDefault
+		if ownerQueryParam := r.URL.Query().Get("owner"); ownerQueryParam != "" {
+			if ownerQueryParam != ListMessagesOwnerQueryParamMe {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"owner\" query param")
+				return
+			}
+			owner = ownerQueryParam
+		}
+
 		limit := ListMessagesLimitQueryParamDefault
 		if limitQueryParam := r.URL.Query().Get("limit"); limitQueryParam != "" {
 			// Converts "limit" query param to a uint64 value
 			//
 			limit, err = strconv.ParseUint(limitQueryParam, 10, 64)
 			if err != nil {
-				// Respond with status Bad Request - no response payload
+				// Respond with status Bad Request - response payload
+				// is the error
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Invalid \"limit\" query param")
 				return
 			}
 
@@ -49,9 +68,10 @@ func Paginate(next http.Handler) http.Handler {
 			// the ParseUint function above
 			//
 			if limit > ListMessagesLimitQueryParamMax {
-				// Respond with status Bad Request - no response payload
+				// Respond with status Bad Request - response payload
+				// is the error
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Invalid \"limit\" query param")
 				return
 			}
 
@@ -71,9 +91,10 @@ func Paginate(next http.Handler) http.Handler {
 			//
 			afterId, err = strconv.ParseUint(afterIdQueryParam, 10, 64)
 			if err != nil {
-				// Respond with status Bad Request - no response payload
+				// Respond with status Bad Request - response payload
+				// is the error
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Invalid \"afterId\" query param")
 				return
 			}
 		}
@@ -84,17 +105,21 @@ func Paginate(next http.Handler) http.Handler {
 		ctx := context.WithValue(r.Context(), "detailed", detailed)
 		ctx = context.WithValue(ctx, "limit", limit)
 		ctx = context.WithValue(ctx, "afterId", afterId)
+		ctx = context.WithValue(ctx, "owner", owner)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // Middleware to load message specified by ID {messageId} prior to processing.
-// Also bails out early with 404 Not Found if message does not exist.
+// Also bails out early with 404 Not Found if message does not exist, or if it
+// isn't accessible by the requesting principal so that its existence isn't
+// leaked.
 //
 func GetMessageCtxFunc(svcDb *db.Db) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var detailedMessage *model.DetailedMessage
+			svcDb := scopedDb(r, svcDb)
 
 			if messageIdParam := chi.URLParam(r, "messageId"); messageIdParam != "" {
 				// Converts messageId URL param to a uint64 id
@@ -102,27 +127,44 @@ func GetMessageCtxFunc(svcDb *db.Db) func(next http.Handler) http.Handler {
 				messageId, err := strconv.ParseUint(messageIdParam, 10, 64)
 				if err != nil {
 					// Bails out early with a 400 if messageId in the URL params
-					// is not an integer - no response payload.
+					// is not an integer - response payload is the error.
 					//
-					w.WriteHeader(http.StatusBadRequest)
+					respondError(w, r, http.StatusBadRequest, "Invalid message ID")
 					return
 				}
 
 				// Retrieves message from the database
 				//
+				setSpanAttributes(r.Context(), MessageIdAttributeKey.Int64(int64(messageId)))
 				detailedMessage, err = svcDb.GetMessage(messageId)
-				if err != nil {
+				if errors.Is(err, db.ErrNotFound) {
 					// Bails out early with a 404 if message does not exist in
-					// the database - no response payload.
+					// the database - response payload is the error.
+					//
+					respondError(w, r, http.StatusNotFound, "Message not found")
+					return
+				} else if err != nil {
+					// Bails out early with a 500, or a 503 if the database
+					// can't be reached - response payload is the error.
 					//
-					w.WriteHeader(http.StatusNotFound)
+					logError(r, "Unable to retrieve message", err, "message_id", messageId)
+					respondError(w, r, dbFailureStatus(err), "Unable to retrieve message")
+					return
+				}
+
+				// Bails out early with a 404 if message belongs to someone
+				// else - response payload is the error.
+				//
+				principal := r.Context().Value("principal").(*Principal)
+				if !principal.CanAccess(detailedMessage) {
+					respondError(w, r, http.StatusNotFound, "Message not found")
 					return
 				}
 			} else {
 				// Bails out early with a 404 if messageId does not exist in the
-				// URL params - no response payload.
+				// URL params - response payload is the error.
 				//
-				w.WriteHeader(http.StatusBadRequest)
+				respondError(w, r, http.StatusBadRequest, "Missing message ID")
 				return
 			}
 
@@ -134,3 +176,42 @@ func GetMessageCtxFunc(svcDb *db.Db) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// Middleware to validate the tenant specified by {tenant} prior to processing.
+// Bails out early with 400 Bad Request if the name isn't a valid tenant name.
+//
+func TenantCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := chi.URLParam(r, "tenant")
+		if !db.ValidTenantName(tenant) {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid tenant name")
+			return
+		}
+
+		// Adds tenant to the request context and forward to next http.Handler
+		//
+		ctx := context.WithValue(r.Context(), "tenant", tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Middleware to only allow principals with role "role" through. Must be used
+// after Authenticate.
+//
+func RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := r.Context().Value("principal").(*Principal)
+			if !principal.HasRole(role) {
+				// Respond with status Forbidden - response payload is the error
+				//
+				respondError(w, r, http.StatusForbidden, fmt.Sprintf("Requires the %q role", role))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
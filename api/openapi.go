@@ -0,0 +1,500 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-chi/chi/v5"
+)
+
+// Describes what a route expects and responds with in the OpenAPI document.
+// Routes are annotated with one when they're registered, see Documented, and
+// the document is generated from them by GenerateOpenApi.
+//
+type Operation struct {
+	Id      string
+	Summary string
+	Tag     string
+	Public  bool // Reachable without credentials
+
+	// Path params are described by openApiPathParams, so only the query
+	// params of the route are listed here
+	//
+	Params []*openapi3.Parameter
+
+	Body            interface{} // Zero value of the request body, nil if none
+	BodyContentType string      // "application/json" if empty
+	BodyDescription string
+
+	Responses []*Response
+}
+
+type Response struct {
+	Status      int
+	Description string
+	Headers     openapi3.Headers
+	Body        interface{} // Zero value of the response body, nil if none
+	ContentType string      // "application/json" if empty
+}
+
+// A body which can be any one of these
+//
+type AnyOf []interface{}
+
+// Routes not described by the OpenAPI document, since they serve it
+//
+var undocumentedRoutes = map[string]bool{
+	"/openapi.json":                   true,
+	"/swagger":                        true,
+	"/swagger/*":                      true,
+	"/swagger/swagger-initializer.js": true,
+}
+
+var pathParamRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+var bodyTypeBinary = reflect.TypeOf([]byte(nil))
+var bodyTypeTime = reflect.TypeOf(time.Time{})
+
+// Route handler annotated with the Operation it implements
+//
+type documentedHandler struct {
+	http.Handler
+	operation *Operation
+}
+
+// Annotates "handler" with "operation", to be registered as the handler of a
+// route with chi's Method()
+//
+func Documented(operation *Operation, handler http.HandlerFunc) http.Handler {
+	return &documentedHandler{Handler: handler, operation: operation}
+}
+
+// Generates the OpenAPI document, as found in docs/openapi.json, from the
+// routes registered by NewRouter and the Operations they're annotated with.
+// Fails if a route isn't annotated.
+//
+func GenerateOpenApi() ([]byte, error) {
+	router := NewRouter(db.NewDb(db.Config{}), Config{SwaggerUI: true})
+
+	schemas, err := newSchemaGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &openapi3.T{
+		OpenAPI: "3.0.0",
+		Info: &openapi3.Info{
+			Version: "1.0.0",
+			Title:   "REST API for Demo",
+			License: &openapi3.License{
+				Name: "BSD-3-Clause",
+				URL:  "https://opensource.org/license/BSD-3-Clause",
+			},
+		},
+		Security: openapi3.SecurityRequirements{
+			{"bearerAuth": []string{}},
+			{"apiKeyAuth": []string{}},
+		},
+		Paths: openapi3.NewPaths(),
+		Components: &openapi3.Components{
+			Schemas: schemas.schemas,
+			SecuritySchemes: openapi3.SecuritySchemes{
+				"bearerAuth": &openapi3.SecuritySchemeRef{
+					Value: openapi3.NewSecurityScheme().WithType("http").WithScheme("bearer"),
+				},
+				"apiKeyAuth": &openapi3.SecuritySchemeRef{
+					Value: openapi3.NewSecurityScheme().WithType("apiKey").WithIn("header").WithName("X-API-Key"),
+				},
+			},
+		},
+	}
+
+	err = chi.Walk(router, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if undocumentedRoutes[route] {
+			return nil
+		}
+
+		documented, ok := handler.(*documentedHandler)
+		if !ok {
+			return fmt.Errorf("Route %s %s isn't documented", method, route)
+		}
+
+		// Routes of a router mounted on "/" are registered with a trailing
+		// slash, which isn't part of the path
+		//
+		path := route
+		if path != "/" {
+			path = strings.TrimSuffix(path, "/")
+		}
+
+		operation, err := documented.operation.openApi(path, schemas)
+		if err != nil {
+			return fmt.Errorf("Route %s %s: %w", method, route, err)
+		}
+
+		pathItem := doc.Paths.Value(path)
+		if pathItem == nil {
+			pathItem = &openapi3.PathItem{}
+			doc.Paths.Set(path, pathItem)
+		}
+		pathItem.SetOperation(method, operation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err = encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+
+	// References are only resolved when loading a document, so it's validated
+	// the way it'll be loaded
+	//
+	loadedDoc, err := openapi3.NewLoader().LoadFromData(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err = loadedDoc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Builds the OpenAPI operation of this Operation served at "path". The message
+// routes are served again under /tenants/{tenant}, where they're described as
+// separate, tenant scoped, operations.
+//
+func (o *Operation) openApi(path string, schemas *schemaGenerator) (*openapi3.Operation, error) {
+	operation := openapi3.NewOperation()
+	operation.OperationID = o.Id
+	operation.Summary = o.Summary
+	operation.Tags = []string{o.Tag}
+	if o.Public {
+		operation.Security = &openapi3.SecurityRequirements{}
+	}
+
+	responses := o.Responses
+	if strings.HasPrefix(path, "/tenants/{tenant}/") {
+		operation.OperationID = tenantScopedOperationId(o.Id)
+		operation.Tags = []string{"tenants"}
+
+		// An invalid tenant name is rejected
+		//
+		if !hasResponse(responses, http.StatusBadRequest) {
+			responses = append([]*Response{invalidRequestResponse}, responses...)
+		}
+	}
+
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(path, -1) {
+		param, ok := openApiPathParams[match[1]]
+		if !ok {
+			return nil, fmt.Errorf("Undocumented path param %q", match[1])
+		}
+		operation.AddParameter(param)
+	}
+	for _, param := range o.Params {
+		operation.AddParameter(param)
+	}
+
+	if o.Body != nil {
+		schema, err := schemas.bodySchemaRef(o.Body)
+		if err != nil {
+			return nil, err
+		}
+		requestBody := openapi3.NewRequestBody().WithRequired(true).WithDescription(o.BodyDescription)
+		requestBody.Content = openapi3.NewContentWithSchemaRef(schema, []string{contentTypeOrJson(o.BodyContentType)})
+		operation.RequestBody = &openapi3.RequestBodyRef{Value: requestBody}
+	}
+
+	// Anything taking params or a body can be rejected by ValidateOpenApi
+	//
+	validated := len(operation.Parameters) != 0 || operation.RequestBody != nil
+	if validated && !hasResponse(responses, http.StatusBadRequest) {
+		responses = append([]*Response{{
+			Status:      http.StatusBadRequest,
+			Description: "Failure (Invalid Request): Returns the problem",
+		}}, responses...)
+	}
+
+	operation.Responses = openapi3.NewResponses()
+	operation.Responses.Delete("default")
+	for _, r := range responses {
+		response := openapi3.NewResponse().WithDescription(r.Description)
+		response.Headers = r.Headers
+
+		if r.Body != nil {
+			schema, err := schemas.bodySchemaRef(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			response.Content = openapi3.NewContentWithSchemaRef(schema, []string{contentTypeOrJson(r.ContentType)})
+		}
+		if validated && r.Status == http.StatusBadRequest {
+			if response.Content == nil {
+				response.Content = openapi3.Content{}
+			}
+			response.Content[ProblemContentType] = openapi3.NewMediaType().WithSchemaRef(componentSchemaRef("Problem"))
+		}
+
+		operation.AddResponse(r.Status, response)
+	}
+
+	return operation, nil
+}
+
+// "listMessages" is "listTenantMessages"
+//
+func tenantScopedOperationId(id string) string {
+	i := strings.IndexFunc(id, func(c rune) bool { return c >= 'A' && c <= 'Z' })
+	if i < 0 {
+		return id + "Tenant"
+	}
+	return id[:i] + "Tenant" + id[i:]
+}
+
+func hasResponse(responses []*Response, status int) bool {
+	for _, r := range responses {
+		if r.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+func contentTypeOrJson(contentType string) string {
+	if contentType == "" {
+		return "application/json"
+	}
+	return contentType
+}
+
+func componentSchemaRef(name string) *openapi3.SchemaRef {
+	return openapi3.NewSchemaRef("#/components/schemas/"+name, nil)
+}
+
+// Derives schemas from Go types, the way encoding/json encodes them. Types
+// registered in openApiComponents are referred to by name rather than inlined.
+//
+// Struct fields are required unless tagged "omitempty", and may be further
+// described with the "description" tag and an "openapi" tag holding a comma
+// separated list of:
+//
+//     optional       Not required, even though it's always encoded
+//     readOnly       Ignored in requests
+//     writeOnly      Never returned in responses
+//     ref=<name>     Described by the component named <name>
+//     enum=<a>|<b>   Only ever one of these values
+//     example=<v>    Example value
+//
+type schemaGenerator struct {
+	components map[reflect.Type]string
+	schemas    openapi3.Schemas
+}
+
+func newSchemaGenerator() (*schemaGenerator, error) {
+	g := &schemaGenerator{
+		components: map[reflect.Type]string{},
+		schemas:    openapi3.Schemas{},
+	}
+
+	for _, component := range openApiComponents {
+		if component.Value != nil {
+			g.components[reflect.TypeOf(component.Value)] = component.Name
+		}
+	}
+
+	for _, component := range openApiComponents {
+		if _, ok := g.schemas[component.Name]; ok {
+			continue
+		}
+
+		schema := component.Schema
+		if schema == nil {
+			schemaRef, err := g.inlineSchemaRef(reflect.TypeOf(component.Value))
+			if err != nil {
+				return nil, fmt.Errorf("Component %s: %w", component.Name, err)
+			}
+			schema = schemaRef.Value
+		}
+		if component.Description != "" {
+			schema.Description = component.Description
+		}
+		if component.MaxItems != 0 {
+			schema.WithMaxItems(int64(component.MaxItems))
+		}
+		g.schemas[component.Name] = schema.NewRef()
+	}
+
+	return g, nil
+}
+
+// Schema of a request or response body. Unlike JSON, raw bytes are binary.
+//
+func (g *schemaGenerator) bodySchemaRef(body interface{}) (*openapi3.SchemaRef, error) {
+	if alternatives, ok := body.(AnyOf); ok {
+		schema := openapi3.NewSchema()
+		for _, alternative := range alternatives {
+			schemaRef, err := g.schemaRef(reflect.TypeOf(alternative))
+			if err != nil {
+				return nil, err
+			}
+			schema.AnyOf = append(schema.AnyOf, schemaRef)
+		}
+		return schema.NewRef(), nil
+	}
+
+	if reflect.TypeOf(body) == bodyTypeBinary {
+		return openapi3.NewStringSchema().WithFormat("binary").NewRef(), nil
+	}
+	return g.schemaRef(reflect.TypeOf(body))
+}
+
+func (g *schemaGenerator) schemaRef(t reflect.Type) (*openapi3.SchemaRef, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if name, ok := g.components[t]; ok {
+		return componentSchemaRef(name), nil
+	}
+	return g.inlineSchemaRef(t)
+}
+
+func (g *schemaGenerator) inlineSchemaRef(t reflect.Type) (*openapi3.SchemaRef, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return openapi3.NewBoolSchema().NewRef(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return openapi3.NewIntegerSchema().NewRef(), nil
+	case reflect.Int64:
+		return openapi3.NewInt64Schema().NewRef(), nil
+	case reflect.Uint64:
+		return openapi3.NewIntegerSchema().WithFormat("uint64").NewRef(), nil
+	case reflect.Float32, reflect.Float64:
+		return openapi3.NewFloat64Schema().WithFormat("double").NewRef(), nil
+	case reflect.String:
+		return openapi3.NewStringSchema().NewRef(), nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openapi3.NewBytesSchema().NewRef(), nil
+		}
+		items, err := g.schemaRef(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		schema := openapi3.NewArraySchema()
+		schema.Items = items
+		return schema.NewRef(), nil
+	case reflect.Struct:
+		if t == bodyTypeTime {
+			return openapi3.NewDateTimeSchema().NewRef(), nil
+		}
+		return g.structSchemaRef(t)
+	}
+
+	return nil, fmt.Errorf("Unsupported type %s", t)
+}
+
+func (g *schemaGenerator) structSchemaRef(t reflect.Type) (*openapi3.SchemaRef, error) {
+	// A struct only embedding another one, such as a request wrapping a
+	// model, is encoded as the embedded one
+	//
+	if t.NumField() == 1 && t.Field(0).Anonymous && t.Field(0).Tag.Get("json") == "" {
+		return g.schemaRef(t.Field(0).Type)
+	}
+
+	schema := openapi3.NewObjectSchema()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			return nil, fmt.Errorf("Unsupported embedded field %s.%s", t, field.Name)
+		}
+
+		jsonOptions := strings.Split(field.Tag.Get("json"), ",")
+		name := jsonOptions[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		options := map[string]string{}
+		for _, option := range strings.Split(field.Tag.Get("openapi"), ",") {
+			key, value, _ := strings.Cut(option, "=")
+			options[key] = value
+		}
+
+		var property *openapi3.SchemaRef
+		if ref, ok := options["ref"]; ok {
+			property = componentSchemaRef(ref)
+		} else {
+			var err error
+			property, err = g.schemaRef(field.Type)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Siblings of a reference are ignored, so only inlined schemas are
+		// described further
+		//
+		if property.Ref == "" {
+			property.Value.Description = field.Tag.Get("description")
+			if _, ok := options["readOnly"]; ok {
+				property.Value.ReadOnly = true
+			}
+			if _, ok := options["writeOnly"]; ok {
+				property.Value.WriteOnly = true
+			}
+			if enum, ok := options["enum"]; ok {
+				for _, value := range strings.Split(enum, "|") {
+					property.Value.Enum = append(property.Value.Enum, value)
+				}
+			}
+			if example, ok := options["example"]; ok {
+				property.Value.Example = example
+			}
+		}
+
+		schema.WithPropertyRef(name, property)
+		_, optional := options["optional"]
+		if !optional && !containsString(jsonOptions[1:], "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return schema.NewRef(), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
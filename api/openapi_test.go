@@ -0,0 +1,21 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/docs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateOpenApi(t *testing.T) {
+	// The committed document has to be regenerated whenever a route or a type
+	// it describes changes
+	//
+	generated, err := GenerateOpenApi()
+	assert.Nil(t, err, "GenerateOpenApi() failed")
+	assert.Equal(t, string(docs.OpenApi), string(generated), "docs/openapi.json is out of date, run \"go generate ./docs\"")
+
+	assert.Equal(t, "listTenantMessages", tenantScopedOperationId("listMessages"), "Unexpected operation ID")
+	assert.Equal(t, "getTenantMessageById", tenantScopedOperationId("getMessageById"), "Unexpected operation ID")
+}
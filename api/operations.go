@@ -0,0 +1,839 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// Named schemas of the OpenAPI document, referred to wherever their type is
+// used. A component is either derived from the type of Value, or is Schema.
+// Several types can share a component, which is derived from the first one.
+//
+var openApiComponents = []struct {
+	Name        string
+	Value       interface{}
+	Schema      *openapi3.Schema
+	Description string
+	MaxItems    uint64
+}{
+	{Name: "Message", Value: model.Message{}},
+	{Name: "DetailedMessage", Value: model.DetailedMessage{}},
+	{Name: "Messages", Value: ListMessagesResponse{}, MaxItems: ListMessagesLimitQueryParamMax},
+	{Name: "DetailedMessages", Value: ListDetailedMessagesResponse{}, MaxItems: ListMessagesLimitQueryParamMax},
+	{Name: "ImportReport", Value: ImportMessagesResponse{}},
+	{Name: "ImportFailure", Value: ImportFailure{}},
+	{Name: "TenantName", Schema: openapi3.NewStringSchema().WithPattern(db.TenantNamePattern)},
+	{Name: "Tenant", Value: model.Tenant{}},
+	{Name: "Tenants", Value: ListTenantsResponse{}},
+	{Name: "AuditRecord", Value: model.AuditRecord{}},
+	{Name: "AuditVerification", Value: VerifyAuditLogResponse{}},
+	{Name: "Webhook", Value: model.Webhook{}},
+	{Name: "Webhooks", Value: ListWebhooksResponse{}},
+	{Name: "WebhookDelivery", Value: model.WebhookDelivery{}, Description: "Change queued for delivery to a webhook"},
+	{Name: "Change", Value: model.Change{}},
+	{Name: "Changes", Value: ListChangesResponse{}, MaxItems: ListChangesLimitQueryParamMax},
+	{Name: "ConsumerName", Schema: openapi3.NewStringSchema().WithPattern(db.ConsumerNamePattern)},
+	{Name: "ChangeConsumer", Value: model.ChangeConsumer{}, Description: "Named reader of the change log, along with the offset it committed"},
+	{Name: "Health", Value: HealthResponse{}},
+	{Name: "HealthCheck", Value: HealthCheck{}},
+	{Name: "LogLevel", Value: LogLevelResponse{}},
+	{Name: "LogLevel", Value: UpdateLogLevelRequest{}},
+	{Name: "WebSocketCommand", Value: WebSocketCommand{}, Description: "Command sent over the WebSocket of GET /ws"},
+	{Name: "WebSocketReply", Value: WebSocketReply{}, Description: "Reply to a command, or event, sent over the WebSocket of GET /ws"},
+	{Name: "Error", Value: ErrorResponse{}},
+	{Name: "Problem", Value: ProblemResponse{}, Description: "Problem details (RFC 7807) returned when a request doesn't match this document"},
+}
+
+// Path params, described once for every route they're part of
+//
+var openApiPathParams = map[string]*openapi3.Parameter{
+	"messageId": openapi3.NewPathParameter("messageId").
+		WithDescription("The ID of the message").
+		WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64")),
+	"tenant": &openapi3.Parameter{
+		Name:        "tenant",
+		In:          openapi3.ParameterInPath,
+		Required:    true,
+		Description: "The name of the tenant",
+		Schema:      componentSchemaRef("TenantName"),
+	},
+	"consumer": &openapi3.Parameter{
+		Name:        "consumer",
+		In:          openapi3.ParameterInPath,
+		Required:    true,
+		Description: "The name of the consumer",
+		Schema:      componentSchemaRef("ConsumerName"),
+	},
+	"webhookId": openapi3.NewPathParameter("webhookId").
+		WithDescription("The ID of the webhook").
+		WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64")),
+	"deliveryId": openapi3.NewPathParameter("deliveryId").
+		WithDescription("The ID of the dead lettered delivery").
+		WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64")),
+}
+
+// Responses shared by many routes
+//
+var invalidRequestResponse = errorResponse(http.StatusBadRequest, "Invalid Request")
+var unauthenticatedResponse = errorResponse(http.StatusUnauthorized, "Unauthenticated")
+var notAdminResponse = errorResponse(http.StatusForbidden, "Not an admin")
+var quotaExceededResponse = errorResponse(http.StatusForbidden, "Quota exceeded")
+var messageNotFoundResponse = errorResponse(http.StatusNotFound, "Not found or owned by someone else")
+var tenantNotFoundResponse = errorResponse(http.StatusNotFound, "Tenant not found, and only created by admins")
+var messageConflictResponse = errorResponse(http.StatusConflict, "Deleted while the request was being processed")
+var dbErrorResponse = errorResponse(http.StatusInternalServerError, "Database error")
+var dbUnavailableResponse = errorResponse(http.StatusServiceUnavailable, "Database unavailable")
+var noContentResponse = &Response{Status: http.StatusNoContent, Description: "Success: Returns null response"}
+
+var rateLimitedResponse = &Response{
+	Status:      http.StatusTooManyRequests,
+	Description: "Failure (Rate limited): Returns the error",
+	Body:        ErrorResponse{},
+	Headers: openapi3.Headers{
+		"Retry-After":         header("Seconds to wait before retrying", openapi3.NewIntegerSchema()),
+		"RateLimit-Limit":     header("Request budget of the client", openapi3.NewIntegerSchema()),
+		"RateLimit-Remaining": header("Requests left in the budget", openapi3.NewIntegerSchema()),
+		"RateLimit-Reset":     header("Seconds until the budget refills", openapi3.NewIntegerSchema()),
+	},
+}
+
+func errorResponse(status int, reason string) *Response {
+	return &Response{
+		Status:      status,
+		Description: "Failure (" + reason + "): Returns the error",
+		Body:        ErrorResponse{},
+	}
+}
+
+func header(description string, schema *openapi3.Schema) *openapi3.HeaderRef {
+	return &openapi3.HeaderRef{Value: &openapi3.Header{Parameter: openapi3.Parameter{
+		Description: description,
+		Schema:      schema.NewRef(),
+	}}}
+}
+
+// Query params
+//
+var detailedParam = openapi3.NewQueryParameter("detailed").
+	WithDescription("Include metadata").
+	WithSchema(openapi3.NewBoolSchema().WithDefault(ListMessagesDetailedQueryParamDefault))
+
+// GET /messages
+//
+var listMessagesOperation = &Operation{
+	Id:      "listMessages",
+	Summary: "List all messages",
+	Tag:     "messages",
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("limit").
+			WithDescription("How many messages to return at one time (max 100)").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListMessagesLimitQueryParamDefault).
+				WithMin(float64(ListMessagesLimitQueryParamMin)).
+				WithMax(float64(ListMessagesLimitQueryParamMax))),
+		openapi3.NewQueryParameter("afterId").
+			WithDescription("Show messages after a specified ID").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListMessagesAfterIdQueryParamDefault)),
+		detailedParam,
+		openapi3.NewQueryParameter("owner").
+			WithDescription("Only show messages owned by the requesting principal").
+			WithSchema(openapi3.NewStringSchema().WithEnum(ListMessagesOwnerQueryParamMe)),
+	},
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns a paged array of messages",
+			Headers: openapi3.Headers{
+				"x-next-relative-url": header("A relative URL for the next page of messages", openapi3.NewStringSchema()),
+			},
+			Body: AnyOf{ListMessagesResponse{}, ListDetailedMessagesResponse{}},
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /messages
+//
+var createMessageOperation = &Operation{
+	Id:      "createMessage",
+	Summary: "Create a message",
+	Tag:     "messages",
+	Body:    CreateMessageRequest{},
+	Responses: []*Response{
+		{
+			Status:      http.StatusCreated,
+			Description: "Success: Returns null response",
+			Headers: openapi3.Headers{
+				"Location": header("The URL of the created message", openapi3.NewStringSchema()),
+			},
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		quotaExceededResponse,
+		tenantNotFoundResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /messages/{messageId}
+//
+var getMessageOperation = &Operation{
+	Id:      "getMessageById",
+	Summary: "Get a specific message by ID",
+	Tag:     "messages",
+	Params:  []*openapi3.Parameter{detailedParam},
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns specified message",
+			Body:        AnyOf{model.Message{}, model.DetailedMessage{}},
+		},
+		unauthenticatedResponse,
+		messageNotFoundResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// PUT /messages/{messageId}
+//
+var updateMessageOperation = &Operation{
+	Id:      "updateMessageById",
+	Summary: "Update a specific message by ID",
+	Tag:     "messages",
+	Body:    PutMessageRequest{},
+	Responses: []*Response{
+		noContentResponse,
+		unauthenticatedResponse,
+		quotaExceededResponse,
+		messageNotFoundResponse,
+		messageConflictResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// DELETE /messages/{messageId}
+//
+var deleteMessageOperation = &Operation{
+	Id:      "deleteMessageById",
+	Summary: "Delete a specific message by ID",
+	Tag:     "messages",
+	Responses: []*Response{
+		noContentResponse,
+		unauthenticatedResponse,
+		messageNotFoundResponse,
+		messageConflictResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /messages/events
+//
+var streamMessageEventsOperation = &Operation{
+	Id:      "streamMessageEvents",
+	Summary: "Stream changes to messages as Server-Sent Events",
+	Tag:     "messages",
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("types").
+			WithDescription("Comma separated types of changes to stream").
+			WithSchema(openapi3.NewStringSchema().
+				WithPattern(`^(created|updated|deleted)(,(created|updated|deleted))*$`).
+				WithDefault(StreamMessageEventsTypesQueryParamDefault)),
+		openapi3.NewQueryParameter("palindrome").
+			WithDescription("Only stream changes to palindromes, or to messages that aren't").
+			WithSchema(openapi3.NewBoolSchema()),
+		openapi3.NewQueryParameter("owner").
+			WithDescription("Only stream changes to messages owned by the requesting principal").
+			WithSchema(openapi3.NewStringSchema().WithEnum(StreamMessageEventsOwnerQueryParamMe)),
+		openapi3.NewQueryParameter("lastEventId").
+			WithDescription("Resume after the event with this ID, for clients that can't set the Last-Event-ID header").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64")),
+		openapi3.NewHeaderParameter("Last-Event-ID").
+			WithDescription("Resume after the event with this ID, rather than with the next change").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64")),
+	},
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Streams an event per change until the client disconnects, with the sequence number of the change as ID, its type as event name and the detailed message as data. A comment is sent as a heartbeat while idle.",
+			Body:        "",
+			ContentType: EventStreamContentType,
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		rateLimitedResponse,
+		errorResponse(http.StatusGone, "Changes since the last event ID no longer retained, start over without it"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /ws
+//
+var webSocketOperation = &Operation{
+	Id:      "webSocket",
+	Summary: "Operate on messages and subscribe to their changes over a WebSocket",
+	Tag:     "messages",
+	Responses: []*Response{
+		{
+			Status:      http.StatusSwitchingProtocols,
+			Description: "Success: Switches to the WebSocket protocol. Each text frame sent is a WebSocketCommand, answered with a WebSocketReply carrying the same ID. Commands are processed in order, with the credentials of the handshake, exactly like the REST request they map to. Browsers, which can't set headers on the handshake, can offer the subprotocols \"messages\" and \"bearer.\" followed by their API key base64url encoded without padding instead. A subscription sends a WebSocketReply event per change, like GET /messages/events, until unsubscribing. A subscription that falls behind changes that are no longer retained ends with an error with status 410.",
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		errorResponse(http.StatusForbidden, "Cross-origin request"),
+		rateLimitedResponse,
+		errorResponse(http.StatusServiceUnavailable, "Shutting down"),
+	},
+}
+
+// GET /messages:export
+//
+var exportMessagesOperation = &Operation{
+	Id:      "exportMessages",
+	Summary: "Export messages as newline delimited JSON",
+	Tag:     "messages",
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Streams every message accessible by the principal, one per line",
+			Body:        model.DetailedMessage{},
+			ContentType: "application/x-ndjson",
+		},
+		unauthenticatedResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /messages:import
+//
+var importMessagesOperation = &Operation{
+	Id:      "importMessages",
+	Summary: "Import messages from newline delimited JSON",
+	Tag:     "messages",
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("ids").
+			WithDescription("Whether the IDs of the messages are preserved, or new ones assigned").
+			WithSchema(openapi3.NewStringSchema().
+				WithEnum(ImportMessagesIdsQueryParamPreserve, ImportMessagesIdsQueryParamReassign).
+				WithDefault(ImportMessagesIdsQueryParamDefault)),
+		openapi3.NewQueryParameter("dryRun").
+			WithDescription("Report what importing would do without importing anything").
+			WithSchema(openapi3.NewBoolSchema().WithDefault(ImportMessagesDryRunQueryParamDefault)),
+	},
+	Body:            model.DetailedMessage{},
+	BodyContentType: "application/x-ndjson",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the import report", Body: ImportMessagesResponse{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		rateLimitedResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/tenants
+//
+var listTenantsOperation = &Operation{
+	Id:      "listTenants",
+	Summary: "List all tenants",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns every tenant", Body: ListTenantsResponse{}},
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /admin/tenants
+//
+var createTenantOperation = &Operation{
+	Id:      "createTenant",
+	Summary: "Create a tenant",
+	Tag:     "admin",
+	Body:    CreateTenantRequest{},
+	Responses: []*Response{
+		{Status: http.StatusCreated, Description: "Success: Returns the created tenant", Body: model.Tenant{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusConflict, "Tenant already exists"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// DELETE /admin/tenants/{tenant}
+//
+var deleteTenantOperation = &Operation{
+	Id:      "deleteTenant",
+	Summary: "Delete a tenant and all of its messages",
+	Tag:     "admin",
+	Responses: []*Response{
+		noContentResponse,
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// Filters of the audit log
+//
+var auditRecordsParams = []*openapi3.Parameter{
+	openapi3.NewQueryParameter("from").
+		WithDescription("Only show records at or after this time").
+		WithSchema(openapi3.NewDateTimeSchema()),
+	openapi3.NewQueryParameter("to").
+		WithDescription("Only show records before this time").
+		WithSchema(openapi3.NewDateTimeSchema()),
+	openapi3.NewQueryParameter("principal").
+		WithDescription("Only show records of changes made by this principal").
+		WithSchema(openapi3.NewStringSchema()),
+}
+
+// GET /admin/audit
+//
+var listAuditRecordsOperation = &Operation{
+	Id:      "listAuditRecords",
+	Summary: "List audit records",
+	Tag:     "admin",
+	Params: append(auditRecordsParams[:len(auditRecordsParams):len(auditRecordsParams)],
+		openapi3.NewQueryParameter("limit").
+			WithDescription("How many records to return at one time (max 1000)").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListAuditRecordsLimitQueryParamDefault).
+				WithMin(1).
+				WithMax(float64(ListAuditRecordsLimitQueryParamMax))),
+		openapi3.NewQueryParameter("afterSequence").
+			WithDescription("Show records after a specified sequence number").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListAuditRecordsAfterSequenceQueryParamDefault)),
+	),
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns a paged array of audit records",
+			Headers: openapi3.Headers{
+				"x-next-relative-url": header("A relative URL for the next page of records", openapi3.NewStringSchema()),
+			},
+			Body: ListAuditRecordsResponse{},
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/audit/export
+//
+var exportAuditRecordsOperation = &Operation{
+	Id:      "exportAuditRecords",
+	Summary: "Export audit records as newline delimited JSON",
+	Tag:     "admin",
+	Params:  auditRecordsParams,
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Streams every matching audit record, one per line",
+			Body:        model.AuditRecord{},
+			ContentType: "application/x-ndjson",
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/audit/verify
+//
+var verifyAuditLogOperation = &Operation{
+	Id:      "verifyAuditLog",
+	Summary: "Verify the hash chain of the audit log",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the verification result", Body: VerifyAuditLogResponse{}},
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /changes
+//
+var listChangesOperation = &Operation{
+	Id:      "listChanges",
+	Summary: "Read the change log of every tenant",
+	Tag:     "changes",
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("since").
+			WithDescription("Show changes after a specified sequence number").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListChangesSinceQueryParamDefault)),
+		&openapi3.Parameter{
+			Name:        "consumer",
+			In:          openapi3.ParameterInQuery,
+			Description: "Show changes after the offset committed by this consumer, instead of \"since\"",
+			Schema:      componentSchemaRef("ConsumerName"),
+		},
+		openapi3.NewQueryParameter("limit").
+			WithDescription("How many changes to return at one time (max 1000)").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListChangesLimitQueryParamDefault).
+				WithMin(1).
+				WithMax(float64(ListChangesLimitQueryParamMax))),
+	},
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns a paged array of changes, ordered by sequence number",
+			Headers: openapi3.Headers{
+				"x-next-relative-url": header("A relative URL for the next page of changes", openapi3.NewStringSchema()),
+			},
+			Body: ListChangesResponse{},
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Consumer not found"),
+		errorResponse(http.StatusGone, "Changes no longer retained, start over from 0"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /changes/consumers
+//
+var listChangeConsumersOperation = &Operation{
+	Id:      "listChangeConsumers",
+	Summary: "List all consumers of the change log",
+	Tag:     "changes",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns every consumer", Body: ListChangeConsumersResponse{}},
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /changes/consumers/{consumer}
+//
+var getChangeConsumerOperation = &Operation{
+	Id:      "getChangeConsumer",
+	Summary: "Info for a specific consumer of the change log",
+	Tag:     "changes",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the consumer", Body: model.ChangeConsumer{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// PUT /changes/consumers/{consumer}
+//
+var commitChangeOffsetOperation = &Operation{
+	Id:      "commitChangeOffset",
+	Summary: "Commit the offset of a consumer of the change log, creating it if needed",
+	Tag:     "changes",
+	Body:    CommitChangeOffsetRequest{},
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the consumer", Body: model.ChangeConsumer{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// DELETE /changes/consumers/{consumer}
+//
+var deleteChangeConsumerOperation = &Operation{
+	Id:      "deleteChangeConsumer",
+	Summary: "Delete a consumer of the change log along with its offset",
+	Tag:     "changes",
+	Responses: []*Response{
+		noContentResponse,
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/webhooks
+//
+var listWebhooksOperation = &Operation{
+	Id:      "listWebhooks",
+	Summary: "List all webhooks",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns every webhook, without its secret", Body: ListWebhooksResponse{}},
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /admin/webhooks
+//
+var createWebhookOperation = &Operation{
+	Id:      "createWebhook",
+	Summary: "Subscribe a webhook to message changes",
+	Tag:     "admin",
+	Body:    CreateWebhookRequest{},
+	Responses: []*Response{
+		{Status: http.StatusCreated, Description: "Success: Returns the created webhook, without its secret", Body: model.Webhook{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/webhooks/{webhookId}
+//
+var getWebhookOperation = &Operation{
+	Id:      "getWebhook",
+	Summary: "Info for a specific webhook",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the webhook, without its secret", Body: model.Webhook{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// DELETE /admin/webhooks/{webhookId}
+//
+var deleteWebhookOperation = &Operation{
+	Id:      "deleteWebhook",
+	Summary: "Delete a webhook and the deliveries queued for it",
+	Tag:     "admin",
+	Responses: []*Response{
+		noContentResponse,
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /admin/webhooks/deadletters
+//
+var listDeadLettersOperation = &Operation{
+	Id:      "listDeadLetters",
+	Summary: "List webhook deliveries that failed every attempt",
+	Tag:     "admin",
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("limit").
+			WithDescription("How many dead letters to return at one time (max 1000)").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListDeadLettersLimitQueryParamDefault).
+				WithMin(1).
+				WithMax(float64(ListDeadLettersLimitQueryParamMax))),
+		openapi3.NewQueryParameter("afterId").
+			WithDescription("Show dead letters after a specified ID").
+			WithSchema(openapi3.NewIntegerSchema().WithFormat("uint64").
+				WithDefault(ListDeadLettersAfterIdQueryParamDefault)),
+	},
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns a paged array of dead letters",
+			Headers: openapi3.Headers{
+				"x-next-relative-url": header("A relative URL for the next page of dead letters", openapi3.NewStringSchema()),
+			},
+			Body: ListDeadLettersResponse{},
+		},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /admin/webhooks/deadletters/{deliveryId}/redeliver
+//
+var redeliverDeadLetterOperation = &Operation{
+	Id:      "redeliverDeadLetter",
+	Summary: "Queue a dead letter for delivery again",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusAccepted, Description: "Success: Returns the delivery, due right away", Body: model.WebhookDelivery{}},
+		invalidRequestResponse,
+		unauthenticatedResponse,
+		notAdminResponse,
+		errorResponse(http.StatusNotFound, "Dead letter or its webhook not found"),
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// GET /healthz
+//
+var getLivenessOperation = &Operation{
+	Id:      "getLiveness",
+	Summary: "Liveness probe",
+	Tag:     "health",
+	Public:  true,
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: The service is alive", Body: HealthResponse{}},
+	},
+}
+
+// GET /readyz
+//
+var getReadinessOperation = &Operation{
+	Id:      "getReadiness",
+	Summary: "Readiness probe",
+	Tag:     "health",
+	Public:  true,
+	Params: []*openapi3.Parameter{
+		openapi3.NewQueryParameter("detailed").
+			WithDescription("Include the result and latency of each check").
+			WithSchema(openapi3.NewBoolSchema().WithDefault(HealthDetailedQueryParamDefault)),
+	},
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: The service is ready to handle requests", Body: HealthResponse{}},
+		errorResponse(http.StatusBadRequest, "Bad request"),
+		{
+			Status:      http.StatusServiceUnavailable,
+			Description: "Failure (Not ready): The service is starting up, shutting down or a dependency is failing",
+			Body:        HealthResponse{},
+		},
+	},
+}
+
+// GET /metrics
+//
+var getMetricsOperation = &Operation{
+	Id:      "getMetrics",
+	Summary: "Prometheus metrics",
+	Tag:     "health",
+	Public:  true,
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Returns every metric in the Prometheus text exposition format",
+			Body:        "",
+			ContentType: "text/plain",
+		},
+	},
+}
+
+var logLevelNotConfiguredResponse = errorResponse(http.StatusNotFound, "Logging isn't configured")
+
+// GET /admin/log-level
+//
+var getLogLevelOperation = &Operation{
+	Id:      "getLogLevel",
+	Summary: "Get the current log level",
+	Tag:     "admin",
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the current log level", Body: LogLevelResponse{}},
+		unauthenticatedResponse,
+		notAdminResponse,
+		logLevelNotConfiguredResponse,
+	},
+}
+
+// PUT /admin/log-level
+//
+var updateLogLevelOperation = &Operation{
+	Id:      "updateLogLevel",
+	Summary: "Change the log level",
+	Tag:     "admin",
+	Body:    UpdateLogLevelRequest{},
+	Responses: []*Response{
+		{Status: http.StatusOK, Description: "Success: Returns the new log level", Body: LogLevelResponse{}},
+		errorResponse(http.StatusBadRequest, "Bad request"),
+		unauthenticatedResponse,
+		notAdminResponse,
+		logLevelNotConfiguredResponse,
+	},
+}
+
+// GET /admin/backup
+//
+var backupDbOperation = &Operation{
+	Id:      "backupDb",
+	Summary: "Download a consistent snapshot of the whole database",
+	Tag:     "admin",
+	Responses: []*Response{
+		{
+			Status:      http.StatusOK,
+			Description: "Success: Streams the snapshot, a bbolt database file",
+			Body:        []byte(nil),
+			ContentType: "application/octet-stream",
+		},
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
+
+// POST /admin/restore
+//
+var restoreDbOperation = &Operation{
+	Id:              "restoreDb",
+	Summary:         "Replace the whole database with a snapshot",
+	Tag:             "admin",
+	Body:            []byte(nil),
+	BodyContentType: "application/octet-stream",
+	BodyDescription: "Snapshot taken by GET /admin/backup or a scheduled backup",
+	Responses: []*Response{
+		noContentResponse,
+		errorResponse(http.StatusBadRequest, "Invalid snapshot"),
+		unauthenticatedResponse,
+		notAdminResponse,
+		dbErrorResponse,
+		dbUnavailableResponse,
+	},
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What requests are grouped by when rate limiting
+//
+const RateLimitKeyPrincipal = "principal"
+const RateLimitKeyTenant = "tenant"
+const RateLimitKeyIp = "ip"
+
+// Structure to encapsulate the rate limiting configuration. Reads (GET and
+// HEAD) and writes are budgeted separately. A 0 rate disables rate limiting
+// for that kind of request.
+//
+type RateLimitConfig struct {
+	KeyBy      string  `yaml:"keyBy"`
+	ReadRate   float64 `yaml:"readRate"` // Requests per second
+	ReadBurst  uint64  `yaml:"readBurst"`
+	WriteRate  float64 `yaml:"writeRate"` // Requests per second
+	WriteBurst uint64  `yaml:"writeBurst"`
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// Token bucket rate limiter. Every key starts out with a full bucket of
+// "burst" tokens which refills at "rate" tokens per second.
+//
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+// Constructor for RateLimiter object
+//
+func NewRateLimiter(rate float64, burst uint64) *RateLimiter {
+	if burst == 0 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Takes a token from the bucket of "key". Returns whether the request is
+// allowed, the number of tokens left and how long until the next token is
+// available.
+//
+func (limiter *RateLimiter) Allow(key string) (bool, uint64, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		// Buckets of idle keys are full and therefore indistinguishable from
+		// new ones... drop them whenever a new key shows up so the map doesn't
+		// grow without bounds
+		//
+		limiter.prune(now)
+		bucket = &tokenBucket{tokens: limiter.burst, lastFill: now}
+		limiter.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.lastFill).Seconds()
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+	bucket.lastFill = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	bucket.tokens -= 1
+	wait := time.Duration(0)
+	if bucket.tokens < 1 {
+		wait = time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+
+	return true, uint64(bucket.tokens), wait
+}
+
+// Returns the number of requests allowed in a burst. A configured burst of 0
+// allows a single request.
+//
+func (limiter *RateLimiter) Burst() uint64 {
+	return uint64(limiter.burst)
+}
+
+func (limiter *RateLimiter) prune(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.lastFill).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Returns the limiters for reads and writes configured by "cfg", nil for the
+// ones that are disabled
+//
+func newRateLimiters(cfg RateLimitConfig) (*RateLimiter, *RateLimiter) {
+	var readLimiter, writeLimiter *RateLimiter
+	if cfg.ReadRate > 0 {
+		readLimiter = NewRateLimiter(cfg.ReadRate, cfg.ReadBurst)
+	}
+	if cfg.WriteRate > 0 {
+		writeLimiter = NewRateLimiter(cfg.WriteRate, cfg.WriteBurst)
+	}
+
+	return readLimiter, writeLimiter
+}
+
+// Middleware to rate limit requests according to "cfg". Must be used after
+// Authenticate when keying by principal. Responds with 429 Too Many Requests
+// once a key has exhausted its budget.
+//
+func RateLimit(cfg RateLimitConfig) func(next http.Handler) http.Handler {
+	readLimiter, writeLimiter := newRateLimiters(cfg)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter := writeLimiter
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				limiter = readLimiter
+			}
+
+			if limiter == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, remaining, wait := limiter.Allow(rateLimitKey(r, cfg.KeyBy))
+			resetSeconds := strconv.FormatFloat(math.Ceil(wait.Seconds()), 'f', 0, 64)
+			w.Header().Set("RateLimit-Limit", strconv.FormatUint(limiter.Burst(), 10))
+			w.Header().Set("RateLimit-Remaining", strconv.FormatUint(remaining, 10))
+			w.Header().Set("RateLimit-Reset", resetSeconds)
+
+			if !allowed {
+				// Respond with status Too Many Requests - response payload
+				// is the error
+				//
+				w.Header().Set("Retry-After", resetSeconds)
+				respondError(w, r, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the key a request is rate limited under. Falls back on the client IP
+// if the request doesn't carry the configured key.
+//
+func rateLimitKey(r *http.Request, keyBy string) string {
+	principal, _ := r.Context().Value("principal").(*Principal)
+	tenant, _ := r.Context().Value("tenant").(string)
+	return rateLimitKeyOf(keyBy, principal, tenant, r.RemoteAddr)
+}
+
+// Returns the key a request made by "principal" from "remoteAddr" against
+// "tenant" is rate limited under. Falls back on the client IP if "principal"
+// is nil when keying by principal.
+//
+func rateLimitKeyOf(keyBy string, principal *Principal, tenant string, remoteAddr string) string {
+	switch keyBy {
+	case RateLimitKeyPrincipal:
+		if principal != nil {
+			return "principal:" + principal.Name
+		}
+	case RateLimitKeyTenant:
+		return "tenant:" + tenant
+	}
+
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	return "ip:" + ip
+}
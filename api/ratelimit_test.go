@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available straight away
+	//
+	for i := 2; i >= 0; i-- {
+		allowed, remaining, _ := limiter.Allow("alice")
+		assert.True(t, allowed, "request should have been allowed")
+		assert.Equal(t, uint64(i), remaining, "unexpected remaining tokens")
+	}
+
+	allowed, _, wait := limiter.Allow("alice")
+	assert.False(t, allowed, "request should have been limited")
+	assert.Equal(t, 500*time.Millisecond, wait, "unexpected wait")
+
+	// Other keys have their own bucket
+	//
+	allowed, _, _ = limiter.Allow("bob")
+	assert.True(t, allowed, "request should have been allowed")
+
+	// Tokens refill over time
+	//
+	now = now.Add(500 * time.Millisecond)
+	allowed, _, _ = limiter.Allow("alice")
+	assert.True(t, allowed, "request should have been allowed")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{
+		ApiKeys: testApiKeys,
+		RateLimit: RateLimitConfig{
+			KeyBy:      RateLimitKeyPrincipal,
+			ReadRate:   0.001,
+			ReadBurst:  2,
+			WriteRate:  0.001,
+			WriteBurst: 1,
+		},
+	})
+
+	response := doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "2", response.Header().Get("RateLimit-Limit"), "Unexpected RateLimit-Limit")
+	assert.Equal(t, "1", response.Header().Get("RateLimit-Remaining"), "Unexpected RateLimit-Remaining")
+
+	// Writes are budgeted separately from reads
+	//
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Unexpected HTTP status code")
+	assert.NotEmpty(t, response.Header().Get("Retry-After"), "Missing Retry-After")
+
+	response = doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Unexpected HTTP status code")
+
+	// Every principal has its own budget
+	//
+	response = doRequest(router, http.MethodGet, "/messages", "bob-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+}
+
+func TestRateLimitMiddlewareZeroBurst(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{
+		ApiKeys:   testApiKeys,
+		RateLimit: RateLimitConfig{KeyBy: RateLimitKeyPrincipal, ReadRate: 0.001},
+	})
+
+	// A burst of 0 still allows a single request and is reported as such
+	//
+	response := doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "1", response.Header().Get("RateLimit-Limit"), "Unexpected RateLimit-Limit")
+	assert.Equal(t, "0", response.Header().Get("RateLimit-Remaining"), "Unexpected RateLimit-Remaining")
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Middleware to turn a panic while handling a request into a 500, rather than
+// a dropped connection, so that a single bad request can't take the service
+// down with it
+//
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// Aborting a handler is done by panicking with this sentinel, which
+			// the HTTP server expects to see
+			//
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logError(r, "Recovered from panic", fmt.Errorf("%v", recovered), "stack", string(debug.Stack()))
+
+			// Respond with status 500 - response payload is the error. Nothing
+			// can be done if the response was already on its way.
+			//
+			if ww.Status() == 0 {
+				respondError(ww, r, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
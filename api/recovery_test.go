@@ -0,0 +1,51 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecover(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, _, err := logging.New(buf, logging.Config{Level: "info", Format: logging.FormatJSON})
+	assert.Nil(t, err, "logging.New() failed")
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID, RequestLogger(logger, false), Recover)
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	router.Get("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("boom")
+	})
+
+	// A panic is answered with a 500 and logged along with its stack
+	//
+	response := doRequest(router, http.MethodGet, "/panic", "", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Unexpected HTTP status code")
+
+	errorResponse := &ErrorResponse{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), errorResponse), "Error decoding json")
+	assert.Equal(t, response.Header().Get(RequestIdHeader), errorResponse.RequestId, "Unexpected request ID")
+
+	lines := logLines(t, buf)
+	assert.Equal(t, 1, len(lines), "Unexpected number of log lines")
+	assert.Equal(t, "Recovered from panic", lines[0]["msg"], "Unexpected message")
+	assert.Equal(t, "boom", lines[0]["error"], "Unexpected error")
+	assert.Contains(t, lines[0]["stack"], "TestRecover", "Unexpected stack")
+
+	// The status of a response already on its way is left alone
+	//
+	response = doRequest(router, http.MethodGet, "/partial", "", "")
+	assert.Equal(t, http.StatusAccepted, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, 0, response.Body.Len(), "Unexpected response payload")
+}
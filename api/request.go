@@ -3,7 +3,9 @@ package api
 import (
 	"errors"
 	"net/http"
+	"net/url"
 
+	"github.com/brandonto/rest-api-microservice-demo/db"
 	"github.com/brandonto/rest-api-microservice-demo/model"
 )
 
@@ -17,6 +19,9 @@ const ListMessagesAfterIdQueryParamDefault = uint64(0)
 
 const ListMessagesDetailedQueryParamDefault = false
 
+const ListMessagesOwnerQueryParamDefault = ""
+const ListMessagesOwnerQueryParamMe = "me"
+
 // CreateMessageRequest
 //
 type CreateMessageRequest struct {
@@ -48,3 +53,135 @@ func (decodedReq *PutMessageRequest) Bind(r *http.Request) error {
 
 	return nil
 }
+
+// CreateTenantRequest
+//
+type CreateTenantRequest struct {
+	*model.Tenant
+}
+
+func (decodedReq *CreateTenantRequest) Bind(r *http.Request) error {
+	if decodedReq.Tenant == nil || decodedReq.Tenant.Name == "" {
+		return errors.New("Missing required fields")
+	}
+
+	return nil
+}
+
+// StreamMessageEventsRequest
+//
+const StreamMessageEventsTypesQueryParamDefault = db.ChangeCreated + "," + db.ChangeUpdated + "," + db.ChangeDeleted
+
+const StreamMessageEventsOwnerQueryParamDefault = ""
+const StreamMessageEventsOwnerQueryParamMe = "me"
+
+// WebSocketCommand, sent as a text frame. Every command is answered with a
+// WebSocketReply carrying the same "id".
+//
+const WebSocketCommandSubscribe = "subscribe"
+const WebSocketCommandUnsubscribe = "unsubscribe"
+const WebSocketCommandCreate = "create"
+const WebSocketCommandGet = "get"
+const WebSocketCommandUpdate = "update"
+const WebSocketCommandDelete = "delete"
+
+type WebSocketCommand struct {
+	Id          string   `json:"id" description:"Correlation ID, echoed back in the reply to the command"`
+	Type        string   `json:"type" openapi:"enum=subscribe|unsubscribe|create|get|update|delete"`
+	MessageId   uint64   `json:"messageId,omitempty" description:"The ID of the message to get, update or delete"`
+	Payload     string   `json:"payload,omitempty" description:"The payload of the message to create or update"`
+	Types       []string `json:"types,omitempty" description:"Types of changes to subscribe to: created, updated and/or deleted. Every type if empty."`
+	Palindrome  *bool    `json:"palindrome,omitempty" description:"Only subscribe to changes to palindromes, or to messages that aren't"`
+	Owner       string   `json:"owner,omitempty" openapi:"enum=me" description:"Only subscribe to changes to messages owned by the requesting principal"`
+	LastEventId *uint64  `json:"lastEventId,omitempty" description:"Resume after the event with this sequence number rather than with the next change"`
+}
+
+// ListAuditRecordsRequest
+//
+const ListAuditRecordsLimitQueryParamDefault = uint64(100)
+const ListAuditRecordsLimitQueryParamMax = uint64(1000)
+
+const ListAuditRecordsAfterSequenceQueryParamDefault = uint64(0)
+
+// CreateWebhookRequest
+//
+type CreateWebhookRequest struct {
+	*model.Webhook
+}
+
+func (decodedReq *CreateWebhookRequest) Bind(r *http.Request) error {
+	if decodedReq.Webhook == nil || decodedReq.Webhook.Url == "" || decodedReq.Webhook.Secret == "" {
+		return errors.New("Missing required fields")
+	}
+
+	// Deliveries are POSTed over HTTP(S) only
+	//
+	target, err := url.Parse(decodedReq.Webhook.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("Invalid URL")
+	}
+
+	for _, changeType := range decodedReq.Webhook.Types {
+		switch changeType {
+		case db.ChangeCreated, db.ChangeUpdated, db.ChangeDeleted:
+		default:
+			return errors.New("Invalid type")
+		}
+	}
+
+	return nil
+}
+
+// ListDeadLettersRequest
+//
+const ListDeadLettersLimitQueryParamDefault = uint64(100)
+const ListDeadLettersLimitQueryParamMax = uint64(1000)
+
+const ListDeadLettersAfterIdQueryParamDefault = uint64(0)
+
+// ListChangesRequest
+//
+const ListChangesLimitQueryParamDefault = uint64(100)
+const ListChangesLimitQueryParamMax = uint64(1000)
+
+const ListChangesSinceQueryParamDefault = uint64(0)
+
+// CommitChangeOffsetRequest
+//
+type CommitChangeOffsetRequest struct {
+	Offset *uint64 `json:"offset" description:"Sequence number of the last change the consumer processed"`
+}
+
+func (decodedReq *CommitChangeOffsetRequest) Bind(r *http.Request) error {
+	if decodedReq.Offset == nil {
+		return errors.New("Missing required fields")
+	}
+
+	return nil
+}
+
+// UpdateLogLevelRequest
+//
+type UpdateLogLevelRequest struct {
+	Level string `json:"level" openapi:"example=INFO" description:"debug, info, warn or error, optionally with an offset such as info+2"`
+}
+
+func (decodedReq *UpdateLogLevelRequest) Bind(r *http.Request) error {
+	if decodedReq.Level == "" {
+		return errors.New("Missing required fields")
+	}
+
+	return nil
+}
+
+// ImportMessagesRequest
+//
+const ImportMessagesIdsQueryParamPreserve = "preserve"
+const ImportMessagesIdsQueryParamReassign = "reassign"
+const ImportMessagesIdsQueryParamDefault = ImportMessagesIdsQueryParamReassign
+
+const ImportMessagesDryRunQueryParamDefault = false
+
+// HealthRequest
+//
+const HealthDetailedQueryParamDefault = false
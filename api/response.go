@@ -8,8 +8,116 @@ import (
 //
 type ListMessagesResponse []model.Message
 
+// ListDetailedMessagesResponse
+//
+type ListDetailedMessagesResponse []model.DetailedMessage
+
 // GetMessageResponse
 //
 type GetMessageResponse struct {
 	*model.Message
 }
+
+// ImportMessagesResponse
+//
+type ImportMessagesResponse struct {
+	DryRun    bool             `json:"dryRun"`
+	Imported  uint64           `json:"imported"`
+	Conflicts []*ImportFailure `json:"conflicts"` // IDs already taken
+	Failures  []*ImportFailure `json:"failures"`  // Invalid or refused messages
+}
+
+type ImportFailure struct {
+	Line  uint64 `json:"line"`
+	Id    uint64 `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// ListTenantsResponse
+//
+type ListTenantsResponse []model.Tenant
+
+// ListAuditRecordsResponse
+//
+type ListAuditRecordsResponse []model.AuditRecord
+
+// VerifyAuditLogResponse
+//
+type VerifyAuditLogResponse struct {
+	Valid   bool   `json:"valid"`
+	Records uint64 `json:"records"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ListChangesResponse
+//
+type ListChangesResponse []model.Change
+
+// ListChangeConsumersResponse
+//
+type ListChangeConsumersResponse []model.ChangeConsumer
+
+// ListWebhooksResponse
+//
+type ListWebhooksResponse []model.Webhook
+
+// ListDeadLettersResponse
+//
+type ListDeadLettersResponse []model.WebhookDelivery
+
+// HealthResponse
+//
+type HealthResponse struct {
+	Status string         `json:"status" openapi:"enum=ok|failing"`
+	Checks []*HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status" openapi:"enum=ok|failing"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// LogLevelResponse
+//
+type LogLevelResponse struct {
+	Level string `json:"level" openapi:"example=INFO" description:"debug, info, warn or error, optionally with an offset such as info+2"`
+}
+
+// WebSocketReply, sent as a text frame either in reply to a WebSocketCommand
+// or as an event of the subscription
+//
+const WebSocketReplyResult = "result"
+const WebSocketReplyError = "error"
+const WebSocketReplyEvent = "event"
+
+type WebSocketReply struct {
+	Id        string                 `json:"id,omitempty" description:"Correlation ID of the command replied to"`
+	Type      string                 `json:"type" openapi:"enum=result|error|event"`
+	Status    int                    `json:"status,omitempty" description:"HTTP status code the command would have been answered with over REST"`
+	Error     string                 `json:"error,omitempty" description:"What went wrong"`
+	Detail    string                 `json:"detail,omitempty" description:"Every way in which the command is invalid"`
+	RequestId string                 `json:"requestId,omitempty" description:"ID of the request the command was processed as"`
+	MessageId uint64                 `json:"messageId,omitempty" description:"The ID of the message created, updated or deleted"`
+	Sequence  uint64                 `json:"sequence,omitempty" description:"Sequence number of the change of an event, or of the last change before a subscription starts"`
+	Event     string                 `json:"event,omitempty" openapi:"enum=created|updated|deleted"`
+	Message   *model.DetailedMessage `json:"message,omitempty" description:"The message retrieved, or changed by an event"`
+}
+
+// ErrorResponse
+//
+type ErrorResponse struct {
+	Error     string `json:"error" description:"What went wrong"`
+	RequestId string `json:"requestId,omitempty" description:"ID of the request, also returned in the X-Request-ID header"`
+}
+
+// ProblemResponse, as described by RFC 7807
+//
+type ProblemResponse struct {
+	Type      string `json:"type" description:"URI identifying the kind of problem"`
+	Title     string `json:"title" description:"What went wrong"`
+	Status    int    `json:"status" description:"HTTP status code of the response"`
+	Detail    string `json:"detail,omitempty" description:"Every way in which the request doesn't match this document"`
+	RequestId string `json:"requestId,omitempty" description:"ID of the request, also returned in the X-Request-ID header"`
+}
@@ -1,29 +1,121 @@
 package api
 
 import (
-	"errors"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/html"
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+	"github.com/brandonto/rest-api-microservice-demo/metrics"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 )
 
-func NewRouter(svcDb *db.Db, enableLogger bool, standalone bool) chi.Router {
+// Structure to encapsulate configuration needed to set up the HTTP routes
+//
+type Config struct {
+	EnableLogger bool // Whether every request is logged
+	SwaggerUI    bool // Whether the Swagger UI is served under /swagger
+
+	// How much of the API is validated against the OpenAPI document, one of
+	// the OpenApiValidation* modes. Nothing is validated if empty.
+	//
+	OpenApiValidation string
+
+	// Logger every request logs to, tagged with the request ID. Nothing is
+	// logged if nil.
+	//
+	Logger *slog.Logger
+
+	// Level of Logger, adjustable through the admin routes. The level can't
+	// be adjusted if nil.
+	//
+	LogLevel *slog.LevelVar
+
+	// API keys accepted by the service along with the principal each one
+	// authenticates as. Authentication is disabled if empty.
+	//
+	ApiKeys map[string]*Principal
+
+	// Whether verified client certificates authenticate principals. Enabling
+	// it also enables authentication.
+	//
+	ClientCertAuth bool
+
+	// Budgets for requests made against the message routes
+	//
+	RateLimit RateLimitConfig
+
+	// How often a heartbeat is sent on idle event streams.
+	// DefaultEventsHeartbeatInterval is used if 0.
+	//
+	EventsHeartbeatInterval time.Duration
+
+	// How often idle WebSockets are pinged. DefaultWebSocketPingInterval is
+	// used if 0.
+	//
+	WebSocketPingInterval time.Duration
+
+	// Lifecycle reported by the readiness endpoint. The service is considered
+	// ready if nil.
+	//
+	Readiness *Readiness
+
+	// Registry the HTTP and database metrics are registered on and exposed
+	// from. A new registry is used if nil.
+	//
+	Metrics *metrics.Registry
+}
+
+func NewRouter(svcDb *db.Db, cfg Config) chi.Router {
 	r := chi.NewRouter()
 
-	// Use go-chi's built in Logger middleware to enable lightweight logging of
-	// HTTP requests and responses
+	// Tags every request with an ID, reusing the one sent by the client in the
+	// "X-Request-Id" header if there is one
+	//
+	r.Use(middleware.RequestID)
+
+	// Trace every request, as part of the caller's trace if there is one
+	//
+	r.Use(Trace)
+
+	// Every log line of a request carries its ID, which is also echoed back to
+	// the client
 	//
-	if enableLogger {
-		r.Use(middleware.Logger)
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	r.Use(RequestLogger(logger, cfg.EnableLogger))
+
+	// Count and time every request, and every database operation
+	//
+	registry := cfg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	r.Use(Instrument(registry))
+	InstrumentDb(registry, svcDb)
+
+	// A panicking request is answered with a 500, after which it's logged,
+	// traced and counted like any other failed request
+	//
+	r.Use(Recover)
+
+	// Requests, and in strict mode responses, have to match the OpenAPI
+	// document. The embedded document is known to be valid, see the tests.
+	//
+	if cfg.OpenApiValidation != "" && cfg.OpenApiValidation != OpenApiValidationOff {
+		validateOpenApi, err := ValidateOpenApi(cfg.OpenApiValidation)
+		if err != nil {
+			panic(err)
+		}
+		r.Use(validateOpenApi)
 	}
 
 	// All HTTP responses in this API with a payload is JSON formatted. This is
@@ -32,47 +124,141 @@ func NewRouter(svcDb *db.Db, enableLogger bool, standalone bool) chi.Router {
 	//
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 
-	// These swagger UI routes don't need to be configured when running the core
-	// application in test suites
+	// GET /openapi.json
 	//
-	if standalone {
-		// Reads openapi.json
-		//
-		openApiFileBytes, err := ioutil.ReadFile("docs/openapi.json")
-		if err != nil {
-			log.Fatal(errors.New("Unable to open openapi.json file"))
-		}
+	r.Get("/openapi.json", OpenApi())
 
-		// GET /openapi.json
-		//
-		r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
-			w.Write(openApiFileBytes)
-		})
+	// GET /swagger
+	//
+	if cfg.SwaggerUI {
+		r.Get("/swagger/swagger-initializer.js", SwaggerInitializer())
+		FileServer(r, "/swagger", http.FS(html.SwaggerUI))
+	}
 
-		// GET /swagger
-		//
-		workDir, _ := os.Getwd()
-		htmlDir := http.Dir(filepath.Join(workDir, "html"))
-		FileServer(r, "/swagger", htmlDir)
+	// Health and metrics routes are left unauthenticated and unlimited so that
+	// orchestrators and scrapers can always reach them
+	//
+	readiness := cfg.Readiness
+	if readiness == nil {
+		readiness = NewReadiness()
+		readiness.SetReady()
 	}
+	r.Method(http.MethodGet, "/healthz", Documented(getLivenessOperation, Healthz()))                   // GET /healthz
+	r.Method(http.MethodGet, "/readyz", Documented(getReadinessOperation, Readyz(svcDb, readiness)))    // GET /readyz
+	r.Method(http.MethodGet, "/metrics", Documented(getMetricsOperation, registry.Handler().ServeHTTP)) // GET /metrics
 
-	// Configure API routes
+	// Configure API routes. The same message routes are served for the
+	// default bucket and for every tenant. Budgets are shared between both.
 	//
-	r.Route("/messages", func(r chi.Router) {
-		r.With(Paginate).Get("/", ListMessages(svcDb)) // GET /messages
-		r.Post("/", CreateMessage(svcDb))              // POST /messages
+	authenticate := Authenticate(cfg.ApiKeys, cfg.ClientCertAuth)
+	rateLimit := RateLimit(cfg.RateLimit)
 
-		r.Route("/{messageId}", func(r chi.Router) {
-			r.Use(GetMessageCtxFunc(svcDb))
-			r.Get("/", GetMessage(svcDb))       // GET /messages/{messageId}
-			r.Put("/", UpdateMessage(svcDb))    // PUT /messages/{messageId}
-			r.Delete("/", DeleteMessage(svcDb)) // DELETE /messages/{messageId}
-		})
+	tracedAuthenticate := Traced("Authenticate", authenticate)
+	tracedRateLimit := Traced("RateLimit", rateLimit)
+
+	// Event streams end when the service starts shutting down
+	//
+	streamMessageEvents := StreamMessageEvents(svcDb, cfg.EventsHeartbeatInterval, readiness)
+
+	// WebSockets close when the service starts shutting down, and have their
+	// commands processed by the router itself
+	//
+	webSocket := WebSocket(svcDb, r, cfg.WebSocketPingInterval, readiness)
+
+	r.Route("/messages", messageRoutes(svcDb, streamMessageEvents, tracedAuthenticate, tracedRateLimit))
+	r.Group(transferRoutes(svcDb, tracedAuthenticate, tracedRateLimit))
+	r.Group(webSocketRoutes(webSocket, tracedAuthenticate, tracedRateLimit))
+	r.Route("/tenants/{tenant}", func(r chi.Router) {
+		r.Use(Traced("TenantCtx", TenantCtx))
+		r.Route("/messages", messageRoutes(svcDb, streamMessageEvents, tracedAuthenticate, tracedRateLimit)) // /tenants/{tenant}/messages
+		r.Group(transferRoutes(svcDb, tracedAuthenticate, tracedRateLimit))
+		r.Group(webSocketRoutes(webSocket, tracedAuthenticate, tracedRateLimit))
+	})
+
+	// The change log, read by admins only since it carries every message of
+	// every tenant
+	//
+	r.Route("/changes", func(r chi.Router) {
+		r.Use(authenticate)
+		r.Use(RequireRole(AdminRole))
+
+		r.Method(http.MethodGet, "/", Documented(listChangesOperation, ListChanges(svcDb)))                                          // GET /changes
+		r.Method(http.MethodGet, "/consumers", Documented(listChangeConsumersOperation, ListChangeConsumers(svcDb)))                 // GET /changes/consumers
+		r.Method(http.MethodGet, "/consumers/{consumer}", Documented(getChangeConsumerOperation, GetChangeConsumer(svcDb)))          // GET /changes/consumers/{consumer}
+		r.Method(http.MethodPut, "/consumers/{consumer}", Documented(commitChangeOffsetOperation, CommitChangeOffset(svcDb)))        // PUT /changes/consumers/{consumer}
+		r.Method(http.MethodDelete, "/consumers/{consumer}", Documented(deleteChangeConsumerOperation, DeleteChangeConsumer(svcDb))) // DELETE /changes/consumers/{consumer}
+	})
+
+	// Configure admin routes
+	//
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(authenticate)
+		r.Use(RequireRole(AdminRole))
+
+		r.Method(http.MethodGet, "/tenants", Documented(listTenantsOperation, ListTenants(svcDb)))               // GET /admin/tenants
+		r.Method(http.MethodPost, "/tenants", Documented(createTenantOperation, CreateTenant(svcDb)))            // POST /admin/tenants
+		r.Method(http.MethodDelete, "/tenants/{tenant}", Documented(deleteTenantOperation, DeleteTenant(svcDb))) // DELETE /admin/tenants/{tenant}
+
+		r.Method(http.MethodGet, "/audit", Documented(listAuditRecordsOperation, ListAuditRecords(svcDb)))            // GET /admin/audit
+		r.Method(http.MethodGet, "/audit/export", Documented(exportAuditRecordsOperation, ExportAuditRecords(svcDb))) // GET /admin/audit/export
+		r.Method(http.MethodGet, "/audit/verify", Documented(verifyAuditLogOperation, VerifyAuditLog(svcDb)))         // GET /admin/audit/verify
+
+		r.Method(http.MethodGet, "/log-level", Documented(getLogLevelOperation, GetLogLevel(cfg.LogLevel)))       // GET /admin/log-level
+		r.Method(http.MethodPut, "/log-level", Documented(updateLogLevelOperation, UpdateLogLevel(cfg.LogLevel))) // PUT /admin/log-level
+
+		r.Method(http.MethodGet, "/backup", Documented(backupDbOperation, BackupDb(svcDb)))     // GET /admin/backup
+		r.Method(http.MethodPost, "/restore", Documented(restoreDbOperation, RestoreDb(svcDb))) // POST /admin/restore
+
+		r.Method(http.MethodGet, "/webhooks", Documented(listWebhooksOperation, ListWebhooks(svcDb)))                                                   // GET /admin/webhooks
+		r.Method(http.MethodPost, "/webhooks", Documented(createWebhookOperation, CreateWebhook(svcDb)))                                                // POST /admin/webhooks
+		r.Method(http.MethodGet, "/webhooks/{webhookId}", Documented(getWebhookOperation, GetWebhook(svcDb)))                                           // GET /admin/webhooks/{webhookId}
+		r.Method(http.MethodDelete, "/webhooks/{webhookId}", Documented(deleteWebhookOperation, DeleteWebhook(svcDb)))                                  // DELETE /admin/webhooks/{webhookId}
+		r.Method(http.MethodGet, "/webhooks/deadletters", Documented(listDeadLettersOperation, ListDeadLetters(svcDb)))                                 // GET /admin/webhooks/deadletters
+		r.Method(http.MethodPost, "/webhooks/deadletters/{deliveryId}/redeliver", Documented(redeliverDeadLetterOperation, RedeliverDeadLetter(svcDb))) // POST /admin/webhooks/deadletters/{deliveryId}/redeliver
 	})
 
 	return r
 }
 
+func messageRoutes(svcDb *db.Db, streamMessageEvents http.HandlerFunc, middlewares ...func(http.Handler) http.Handler) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(middlewares...)
+		r.With(Traced("Paginate", Paginate)).Method(http.MethodGet, "/", Documented(listMessagesOperation, tracedHandler("ListMessages", ListMessages(svcDb)))) // GET /messages
+		r.Method(http.MethodPost, "/", Documented(createMessageOperation, tracedHandler("CreateMessage", CreateMessage(svcDb))))                                // POST /messages
+		r.Method(http.MethodGet, "/events", Documented(streamMessageEventsOperation, tracedHandler("StreamMessageEvents", streamMessageEvents)))                // GET /messages/events
+
+		r.Route("/{messageId}", func(r chi.Router) {
+			r.Use(Traced("GetMessageCtxFunc", GetMessageCtxFunc(svcDb)))
+			r.Method(http.MethodGet, "/", Documented(getMessageOperation, tracedHandler("GetMessage", GetMessage(svcDb))))             // GET /messages/{messageId}
+			r.Method(http.MethodPut, "/", Documented(updateMessageOperation, tracedHandler("UpdateMessage", UpdateMessage(svcDb))))    // PUT /messages/{messageId}
+			r.Method(http.MethodDelete, "/", Documented(deleteMessageOperation, tracedHandler("DeleteMessage", DeleteMessage(svcDb)))) // DELETE /messages/{messageId}
+		})
+	}
+}
+
+// Bulk export and import of every message. Only admins may import, since
+// imported messages can be owned by anyone.
+//
+func transferRoutes(svcDb *db.Db, middlewares ...func(http.Handler) http.Handler) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(middlewares...)
+		r.Method(http.MethodGet, "/messages:export", Documented(exportMessagesOperation, tracedHandler("ExportMessages", ExportMessages(svcDb))))                               // GET /messages:export
+		r.With(RequireRole(AdminRole)).Method(http.MethodPost, "/messages:import", Documented(importMessagesOperation, tracedHandler("ImportMessages", ImportMessages(svcDb)))) // POST /messages:import
+	}
+}
+
+// WebSocket carrying message commands and change events, over a single
+// connection. Browsers may offer their API key as a subprotocol instead of a
+// header.
+//
+func webSocketRoutes(webSocket http.HandlerFunc, middlewares ...func(http.Handler) http.Handler) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(Traced("WebSocketCredentials", WebSocketCredentials))
+		r.Use(middlewares...)
+		r.Method(http.MethodGet, "/ws", Documented(webSocketOperation, tracedHandler("WebSocket", webSocket))) // GET /ws
+	}
+}
+
 // FileServer conveniently sets up a http.FileServer handler to serve
 // static files from a http.FileSystem.
 //
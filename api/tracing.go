@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/brandonto/rest-api-microservice-demo/tracing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes describing what a request operated on
+//
+const MessageIdAttributeKey = attribute.Key("rdemo.message.id")
+const MessageCountAttributeKey = attribute.Key("rdemo.message.count")
+
+// Middleware to trace every request in a server span, continuing the trace of
+// the caller if the request carries a W3C "traceparent" header. The span is
+// named after the route once the request has been routed.
+//
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(r.RemoteAddr),
+				semconv.UserAgentOriginal(r.UserAgent()),
+				attribute.String("http.request.id", middleware.GetReqID(r.Context())),
+			),
+		)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+		// Client errors are the client's problem, only server errors mark the
+		// span as failed
+		//
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// Wraps middleware "mw" so that it's traced in a span of its own, named "name".
+// The span only covers the middleware itself: it ends once the middleware
+// hands the request over, and the rest of the chain is traced under the
+// parent span.
+//
+func Traced(name string, mw func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent := trace.SpanFromContext(r.Context())
+			ctx, span := tracing.Tracer().Start(r.Context(), name)
+			defer span.End()
+
+			passedOn := false
+			handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passedOn = true
+				span.End()
+				next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(r.Context(), parent)))
+			}))
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			handler.ServeHTTP(ww, r.WithContext(ctx))
+
+			// The middleware responded by itself, most likely to reject the
+			// request
+			//
+			if !passedOn && ww.Status() != 0 {
+				span.SetAttributes(semconv.HTTPResponseStatusCode(ww.Status()))
+			}
+		})
+	}
+}
+
+// Wraps handler "h" so that it's traced in a span of its own, named "name"
+//
+func tracedHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Tracer().Start(r.Context(), name)
+		defer span.End()
+
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// Adds attributes to the span the request is currently traced in
+//
+func setSpanAttributes(ctx context.Context, attributes ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attributes...)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Records every span ended while the test runs, propagating trace context the
+// way tracing.Setup() does
+//
+func newSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return recorder
+}
+
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+// Returns the spans belonging to trace "traceId"
+//
+func traceSpans(spans []sdktrace.ReadOnlySpan, traceId trace.TraceID) []sdktrace.ReadOnlySpan {
+	var traced []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.SpanContext().TraceID() == traceId {
+			traced = append(traced, span)
+		}
+	}
+
+	return traced
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := newSpanRecorder(t)
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	// The caller's trace is continued
+	//
+	traceId, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	request := httptest.NewRequest(http.MethodGet, "/messages/2", nil)
+	request.Header.Set("Authorization", "Bearer alice-key")
+	request.Header.Set("traceparent", "00-"+traceId.String()+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := traceSpans(recorder.Ended(), traceId)
+	server := findSpan(spans, "GET /messages/{messageId}")
+	assert.NotNil(t, server, "Trace wasn't continued")
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind(), "Unexpected span kind")
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String(), "Unexpected parent")
+	assert.Equal(t, int64(http.StatusOK), spanAttribute(server, "http.response.status_code").AsInt64(), "Unexpected status")
+
+	// Middlewares and the handler are children of the server span, and the
+	// database transaction a child of the middleware that ran it
+	//
+	for _, name := range []string{"Authenticate", "RateLimit", "GetMessageCtxFunc", "GetMessage"} {
+		span := findSpan(spans, name)
+		assert.NotNil(t, span, "Missing span %s", name)
+		assert.Equal(t, server.SpanContext().SpanID(), span.Parent().SpanID(), "Unexpected parent of span %s", name)
+	}
+
+	middleware := findSpan(spans, "GetMessageCtxFunc")
+	assert.Equal(t, int64(2), spanAttribute(middleware, MessageIdAttributeKey).AsInt64(), "Unexpected message ID")
+
+	transaction := findSpan(spans, "bbolt get_message")
+	assert.NotNil(t, transaction, "Missing transaction span")
+	assert.Equal(t, middleware.SpanContext().SpanID(), transaction.Parent().SpanID(), "Unexpected parent of transaction span")
+	assert.Equal(t, "bbolt", spanAttribute(transaction, "db.system").AsString(), "Unexpected db system")
+
+	// Listing records how many messages were returned
+	//
+	response = doRequest(router, http.MethodGet, "/messages?limit=1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	list := findSpan(recorder.Ended(), "ListMessages")
+	assert.NotNil(t, list, "Missing handler span")
+	assert.Equal(t, int64(1), spanAttribute(list, MessageCountAttributeKey).AsInt64(), "Unexpected message count")
+
+	// A rejected request is traced up to the middleware that rejected it
+	//
+	response = doRequest(router, http.MethodGet, "/tenants/Bad!/messages", "alice-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	tenantCtx := findSpan(recorder.Ended(), "TenantCtx")
+	assert.NotNil(t, tenantCtx, "Missing middleware span")
+	assert.Equal(t, int64(http.StatusBadRequest), spanAttribute(tenantCtx, "http.response.status_code").AsInt64(), "Unexpected status")
+	assert.Nil(t, findSpan(traceSpans(recorder.Ended(), tenantCtx.SpanContext().TraceID()), "ListMessages"), "Rejected request reached the handler")
+}
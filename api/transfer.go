@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/go-chi/render"
+)
+
+// Messages exported between each flush of the response
+//
+const exportMessagesFlushInterval = 100
+
+// Messages imported in each transaction
+//
+const importMessagesBatchSize = 500
+
+var ErrImportRead = errors.New("Unable to read messages")
+
+func ExportMessages(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
+		// Only export messages accessible by the requesting principal
+		//
+		principal := r.Context().Value("principal").(*Principal)
+
+		// Streams every message as newline delimited JSON, flushed as it goes
+		// so that the response is sent in chunks. Once the first message is
+		// written the status can no longer be changed, so any error past that
+		// point just cuts the stream short.
+		//
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		count := 0
+		err := svcDb.ForEachMessage(principal.CanAccess, func(detailedMessage *model.DetailedMessage) error {
+			if err := encoder.Encode(detailedMessage); err != nil {
+				return err
+			}
+
+			count += 1
+			if flusher != nil && count%exportMessagesFlushInterval == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+		setSpanAttributes(r.Context(), MessageCountAttributeKey.Int(count))
+		if err != nil {
+			logError(r, "Unable to export messages", err, "exported", count)
+			if count == 0 {
+				// Respond with status Internal Server Error, or Service
+				// Unavailable if the database can't be reached - response
+				// payload is the error
+				//
+				respondError(w, r, dbFailureStatus(err), "Unable to export messages")
+			}
+		}
+	}
+}
+
+// A message read from an import, along with the line it was read from
+//
+type importedMessage struct {
+	line            uint64
+	detailedMessage *model.DetailedMessage
+}
+
+func ImportMessages(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcDb := scopedDb(r, svcDb)
+
+		ids := ImportMessagesIdsQueryParamDefault
+		if idsQueryParam := r.URL.Query().Get("ids"); idsQueryParam != "" {
+			if idsQueryParam != ImportMessagesIdsQueryParamPreserve && idsQueryParam != ImportMessagesIdsQueryParamReassign {
+				// Respond with status Bad Request - response payload is the
+				// error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"ids\" query param")
+				return
+			}
+			ids = idsQueryParam
+		}
+
+		dryRun := ImportMessagesDryRunQueryParamDefault
+		if dryRunQueryParam := r.URL.Query().Get("dryRun"); dryRunQueryParam != "" {
+			var err error
+			dryRun, err = stringToBool(dryRunQueryParam)
+			if err != nil {
+				// Respond with status Bad Request - response payload is the
+				// error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"dryRun\" query param")
+				return
+			}
+		}
+
+		options := db.ImportOptions{PreserveIds: ids == ImportMessagesIdsQueryParamPreserve, DryRun: dryRun}
+		principal := r.Context().Value("principal").(*Principal)
+		response, err := ImportNDJSON(svcDb, r.Body, options, principal.Name)
+		if errors.Is(err, ErrImportRead) {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Unable to read messages")
+			return
+		}
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error.
+			// Batches imported beforehand are kept.
+			//
+			logError(r, "Unable to import messages", err, "imported", response.Imported)
+			respondError(w, r, dbFailureStatus(err), "Unable to import messages")
+			return
+		}
+		setSpanAttributes(r.Context(), MessageCountAttributeKey.Int(int(response.Imported)))
+
+		// Respond with status OK - response payload is the import report
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, response)
+	}
+}
+
+// Imports the messages read from "r", one JSON encoded DetailedMessage per
+// line, in transactions of importMessagesBatchSize messages. Messages without
+// an owner are owned by "owner". Lines that can't be imported are reported
+// without failing the others. Returns ErrImportRead if "r" can't be read, or
+// the error a transaction failed with, in which case the batches imported
+// beforehand are kept.
+//
+func ImportNDJSON(svcDb *db.Db, r io.Reader, options db.ImportOptions, owner string) (*ImportMessagesResponse, error) {
+	response := &ImportMessagesResponse{
+		DryRun:    options.DryRun,
+		Conflicts: []*ImportFailure{},
+		Failures:  []*ImportFailure{},
+	}
+
+	// Imports the messages read so far in a single transaction, reporting the
+	// ones that were refused
+	//
+	var batch []*importedMessage
+	importBatch := func() error {
+		detailedMessages := make([]*model.DetailedMessage, len(batch))
+		for i, v := range batch {
+			detailedMessages[i] = v.detailedMessage
+		}
+
+		results, err := svcDb.ImportMessages(detailedMessages, options)
+		if err != nil {
+			return err
+		}
+
+		for i, err := range results {
+			failure := &ImportFailure{Line: batch[i].line, Id: batch[i].detailedMessage.Message.Id}
+			switch {
+			case err == nil:
+				response.Imported += 1
+			case errors.Is(err, db.ErrMessageExists):
+				failure.Error = "Message already exists"
+				response.Conflicts = append(response.Conflicts, failure)
+			default:
+				failure.Error = "Quota exceeded"
+				response.Failures = append(response.Failures, failure)
+			}
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	seenIds := make(map[uint64]uint64)
+	reader := bufio.NewReader(r)
+	for line := uint64(1); ; line++ {
+		buf, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return response, fmt.Errorf("%w: %w", ErrImportRead, readErr)
+		}
+
+		if buf = bytes.TrimSpace(buf); len(buf) != 0 {
+			detailedMessage := &model.DetailedMessage{}
+			failure := &ImportFailure{Line: line}
+			if err := json.Unmarshal(buf, detailedMessage); err != nil {
+				failure.Error = "Invalid JSON"
+			} else if detailedMessage.Message == nil || detailedMessage.Message.Payload == "" {
+				failure.Error = "Missing required fields"
+			} else if options.PreserveIds && detailedMessage.Message.Id == 0 {
+				failure.Error = "Missing message ID"
+			}
+
+			if failure.Error != "" {
+				response.Failures = append(response.Failures, failure)
+			} else if seenLine, ok := seenIds[detailedMessage.Message.Id]; options.PreserveIds && ok {
+				failure.Id = detailedMessage.Message.Id
+				failure.Error = "Message ID already used on line " + strconv.FormatUint(seenLine, 10)
+				response.Conflicts = append(response.Conflicts, failure)
+			} else {
+				if options.PreserveIds {
+					seenIds[detailedMessage.Message.Id] = line
+				}
+
+				// The metadata is derived from the payload rather than
+				// trusted
+				//
+				detailedMessage.Metadata = &model.MessageMetadata{Palindrome: isPalindrome(detailedMessage.Message.Payload)}
+				if detailedMessage.Owner == "" {
+					detailedMessage.Owner = owner
+				}
+				batch = append(batch, &importedMessage{line: line, detailedMessage: detailedMessage})
+			}
+		}
+
+		if len(batch) == importMessagesBatchSize || (readErr == io.EOF && len(batch) != 0) {
+			if err := importBatch(); err != nil {
+				return response, err
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	// Lines refused by the database are only known once their batch is
+	// imported
+	//
+	sortImportFailures(response.Conflicts)
+	sortImportFailures(response.Failures)
+
+	return response, nil
+}
+
+func sortImportFailures(failures []*ImportFailure) {
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Line < failures[j].Line
+	})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRoutes(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "bob-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	// Principals only export the messages they can access
+	//
+	response = doRequest(router, http.MethodGet, "/messages:export", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "application/x-ndjson", response.Header().Get("Content-Type"), "Unexpected content-type")
+	assert.Equal(t, 1, strings.Count(response.Body.String(), "\n"), "Unexpected number of messages")
+
+	response = doRequest(router, http.MethodGet, "/messages:export", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, 2, strings.Count(response.Body.String(), "\n"), "Unexpected number of messages")
+	export := response.Body.String()
+
+	// Only admins can import
+	//
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages:import", "alice-key", export)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages:import?ids=keep", "admin-key", export)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	// A dry run reports conflicts and invalid lines without importing anything
+	//
+	body := export + "\n" + `{"message":{"id":2,"payload":"baz"}}` + "\n" + `{"message":{"id":3}}` + "\n" + "garbage"
+	var importResponse ImportMessagesResponse
+	response = doRequest(router, http.MethodPost, "/messages:import?ids=preserve&dryRun=true", "admin-key", body)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &importResponse), "Error decoding json")
+	assert.Equal(t, ImportMessagesResponse{
+		DryRun:   true,
+		Imported: 0,
+		Conflicts: []*ImportFailure{
+			{Line: 1, Id: 1, Error: "Message already exists"},
+			{Line: 2, Id: 2, Error: "Message already exists"},
+			{Line: 4, Id: 2, Error: "Message ID already used on line 2"},
+		},
+		Failures: []*ImportFailure{
+			{Line: 5, Error: "Missing required fields"},
+			{Line: 6, Error: "Invalid JSON"},
+		},
+	}, importResponse, "Unexpected import report")
+
+	// The IDs are preserved in an empty tenant
+	//
+	response = doRequest(router, http.MethodPost, "/tenants/red/messages:import?ids=preserve", "admin-key", export)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &importResponse), "Error decoding json")
+	assert.Equal(t, uint64(2), importResponse.Imported, "Unexpected number of imported messages")
+
+	var detailedMessage model.DetailedMessage
+	response = doRequest(router, http.MethodGet, "/tenants/red/messages/2?detailed=true", "bob-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &detailedMessage), "Error decoding json")
+	assert.Equal(t, "bar", detailedMessage.Message.Payload, "Unexpected message payload")
+	assert.Equal(t, "bob", detailedMessage.Owner, "Unexpected message owner")
+
+	// Reassigned IDs follow the existing messages
+	//
+	response = doRequest(router, http.MethodPost, "/messages:import", "admin-key", export)
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &importResponse), "Error decoding json")
+	assert.Equal(t, uint64(2), importResponse.Imported, "Unexpected number of imported messages")
+
+	response = doRequest(router, http.MethodGet, "/messages/4", "bob-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+}
@@ -2,10 +2,56 @@ package api
 
 import (
 	"errors"
+	"net/http"
 	"strings"
 	"unicode"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+// Returns a handle into the database scoped to the tenant the request was made
+// against, if any, audited on behalf of the requesting principal and traced as
+// part of the request. Only admins create the tenant by writing to it.
+//
+func scopedDb(r *http.Request, svcDb *db.Db) *db.Db {
+	svcDb = svcDb.WithContext(r.Context())
+
+	principal, ok := r.Context().Value("principal").(*Principal)
+	if tenant, isTenant := r.Context().Value("tenant").(string); isTenant {
+		svcDb = svcDb.ForTenant(tenant)
+		if !ok || !principal.HasRole(AdminRole) {
+			svcDb = svcDb.WithoutTenantCreation()
+		}
+	}
+
+	// Every change made on behalf of a principal ends up in the audit log
+	//
+	if ok {
+		svcDb = svcDb.WithAuditContext(&db.AuditContext{
+			Principal:  principal.Name,
+			RemoteAddr: r.RemoteAddr,
+			RequestId:  middleware.GetReqID(r.Context()),
+		})
+	}
+
+	return svcDb
+}
+
+// Returns the status to respond with when a database operation failed for a
+// reason other than the ones a handler expects: 503 Service Unavailable if the
+// database can't be reached at the moment, 500 Internal Server Error if it's
+// broken
+//
+func dbFailureStatus(err error) int {
+	if errors.Is(err, db.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
 // Evaluates: "1" and "true" to true
 //            "0" and "false" to false
 //            anything else is invalid
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestPalindrome(t *testing.T) {
@@ -18,3 +28,82 @@ func TestPalindrome(t *testing.T) {
 	assert.True(t, isPalindrome("r!ac.ecar"), "incorrect result")
 	assert.True(t, isPalindrome("r!ac.ec  ar"), "incorrect result")
 }
+
+func TestDbFailureStatus(t *testing.T) {
+	unavailable := fmt.Errorf("%w: %w", db.ErrUnavailable, bolt.ErrDatabaseNotOpen)
+	assert.Equal(t, http.StatusServiceUnavailable, dbFailureStatus(unavailable), "incorrect result")
+	assert.Equal(t, http.StatusServiceUnavailable, dbFailureStatus(&db.MessageError{Id: 1, Err: unavailable}), "incorrect result")
+	assert.Equal(t, http.StatusInternalServerError, dbFailureStatus(&db.MessageError{Id: 1, Err: db.ErrCorruptRecord}), "incorrect result")
+	assert.Equal(t, http.StatusInternalServerError, dbFailureStatus(errors.New("disk on fire")), "incorrect result")
+}
+
+func TestMessageErrorStatuses(t *testing.T) {
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response := doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	// Missing messages are told apart from broken ones
+	//
+	response = doRequest(router, http.MethodGet, "/messages/3", "alice-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	svcDb.Close()
+	boltDb, err := bolt.Open(svcDb.FilePath, 0600, nil)
+	assert.Nil(t, err, "Unable to open database")
+	assert.Nil(t, boltDb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(svcDb.BucketName)).Put([]byte{0, 0, 0, 0, 0, 0, 0, 2}, []byte("garbage"))
+	}), "Tampering failed")
+	assert.Nil(t, boltDb.Close(), "Unable to close database")
+
+	svcDb = db.NewDb(svcDb.Config)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	router = NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	response = doRequest(router, http.MethodGet, "/messages/2", "alice-key", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/messages", "alice-key", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Unexpected HTTP status code")
+
+	// Other messages are unaffected, and are gone once deleted
+	//
+	response = doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// The database being closed is a temporary condition
+	//
+	svcDb.Close()
+	response = doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"baz"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Unexpected HTTP status code")
+}
+
+func TestMessageConflictStatuses(t *testing.T) {
+	svcDb := newTestDb(t)
+
+	// Messages deleted between being retrieved and being written to conflict
+	// with the request
+	//
+	withDeletedMessage := func(r *http.Request) *http.Request {
+		message := &model.DetailedMessage{Message: &model.Message{Id: 1}, Metadata: &model.MessageMetadata{}, Owner: "alice"}
+		return r.WithContext(context.WithValue(r.Context(), "detailedMessage", message))
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "/messages/1", strings.NewReader(`{"payload":"foo"}`))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	UpdateMessage(svcDb)(response, withDeletedMessage(request))
+	assert.Equal(t, http.StatusConflict, response.Code, "Unexpected HTTP status code")
+
+	response = httptest.NewRecorder()
+	DeleteMessage(svcDb)(response, withDeletedMessage(httptest.NewRequest(http.MethodDelete, "/messages/1", nil)))
+	assert.Equal(t, http.StatusConflict, response.Code, "Unexpected HTTP status code")
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/brandonto/rest-api-microservice-demo/docs"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// How much of the API is checked against the OpenAPI document at runtime
+//
+const OpenApiValidationOff = "off"           // Nothing
+const OpenApiValidationRequests = "requests" // Request params and bodies
+const OpenApiValidationStrict = "strict"     // Responses too, meant for tests
+
+const ProblemContentType = "application/problem+json"
+
+// Responses of these content types are written as they're produced rather than
+// held back until they're validated, so only their status is validated
+//
+var streamingContentTypes = map[string]bool{
+	"application/x-ndjson":     true,
+	"application/octet-stream": true,
+	"text/event-stream":        true,
+}
+
+// Returns the routes of the embedded OpenAPI document
+//
+func loadOpenApiRouter() (routers.Router, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(docs.OpenApi)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// The document is served from wherever the service is reached
+	//
+	doc.Servers = openapi3.Servers{{URL: "/"}}
+
+	return gorillamux.NewRouter(doc)
+}
+
+// Middleware to validate the params and body of every request described by the
+// OpenAPI document against it, responding with status Bad Request and a
+// ProblemResponse if they don't match. In strict mode, responses are validated
+// too, and replaced with an Internal Server Error if they don't match, so that
+// the document drifting from the handlers fails the tests. Requests the
+// document doesn't describe are let through untouched.
+//
+func ValidateOpenApi(mode string) (func(next http.Handler) http.Handler, error) {
+	openApiRouter, err := loadOpenApiRouter()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := openApiRouter.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Authentication is left to the Authenticate middleware, and
+			// bodies that aren't JSON may be too large to be read up front
+			//
+			requestInput := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+					ExcludeRequestBody:  !hasJsonContent(route.Operation.RequestBody),
+					SkipSettingDefaults: true,
+					MultiError:          true,
+				},
+			}
+			if err = openapi3filter.ValidateRequest(r.Context(), requestInput); err != nil {
+				// Respond with status Bad Request - response payload is the
+				// problem
+				//
+				respondProblem(w, r, http.StatusBadRequest, "Request doesn't match the OpenAPI document", err.Error())
+				return
+			}
+
+			if mode != OpenApiValidationStrict {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			vw := &validatingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(vw, r)
+			if vw.hijacked {
+				return
+			}
+			if !vw.wroteHeader {
+				vw.WriteHeader(http.StatusOK)
+			}
+
+			responseInput := &openapi3filter.ResponseValidationInput{
+				RequestValidationInput: requestInput,
+				Status:                 vw.status,
+				Header:                 w.Header(),
+				Options: &openapi3filter.Options{
+					ExcludeResponseBody:   vw.streaming,
+					IncludeResponseStatus: true,
+					MultiError:            true,
+				},
+			}
+			responseInput.SetBodyBytes(vw.buf.Bytes())
+			err = openapi3filter.ValidateResponse(r.Context(), responseInput)
+
+			// Streamed responses have already been sent, so there's nothing
+			// left but to report them
+			//
+			if err != nil {
+				logError(r, "Response doesn't match the OpenAPI document", err, "status", vw.status)
+			}
+			if vw.streaming {
+				return
+			}
+
+			if err != nil {
+				// Respond with status Internal Server Error - response payload
+				// is the problem
+				//
+				w.Header().Del("Content-Length")
+				respondProblem(w, r, http.StatusInternalServerError, "Response doesn't match the OpenAPI document", err.Error())
+				return
+			}
+
+			w.WriteHeader(vw.status)
+			w.Write(vw.buf.Bytes())
+		})
+	}, nil
+}
+
+// Whether "requestBody" can be JSON
+//
+func hasJsonContent(requestBody *openapi3.RequestBodyRef) bool {
+	return requestBody != nil && requestBody.Value != nil && requestBody.Value.Content.Get("application/json") != nil
+}
+
+// Responds with status "status" - response payload is a ProblemResponse
+// describing the problem, along with the request ID to quote when reporting it
+//
+func respondProblem(w http.ResponseWriter, r *http.Request, status int, title string, detail string) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ProblemResponse{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		RequestId: middleware.GetReqID(r.Context()),
+	})
+}
+
+// Holds back the response until it's validated, unless its content type is
+// one of streamingContentTypes
+//
+type validatingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	streaming   bool
+	hijacked    bool
+	buf         bytes.Buffer
+}
+
+func (w *validatingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	contentType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if streamingContentTypes[contentType] {
+		w.streaming = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *validatingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *validatingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.streaming {
+		flusher.Flush()
+	}
+}
+
+// Hands the connection over to the handler, e.g. to speak WebSocket over it,
+// after which there's no response left to validate
+//
+func (w *validatingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking unsupported")
+	}
+
+	w.hijacked = true
+	return hijacker.Hijack()
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOpenApi(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationRequests})
+
+	// Params and bodies not matching the document are answered with a problem
+	//
+	var problem ProblemResponse
+	response := doRequest(router, http.MethodGet, "/messages?limit=many", "alice-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, ProblemContentType, response.Header().Get("Content-Type"), "Unexpected content type")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &problem), "Error decoding json")
+	assert.Equal(t, http.StatusBadRequest, problem.Status, "Unexpected problem status")
+	assert.Contains(t, problem.Detail, "limit", "Unexpected problem detail")
+	assert.NotEmpty(t, problem.RequestId, "Missing request ID")
+
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":42}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, ProblemContentType, response.Header().Get("Content-Type"), "Unexpected content type")
+
+	// Matching requests reach the handlers, as do the ones the document
+	// doesn't describe
+	//
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/messages?limit=1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/undocumented", "alice-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// Nothing is validated when turned off
+	//
+	router = NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationOff})
+	response = doRequest(router, http.MethodGet, "/messages?limit=many", "alice-key", "")
+	assert.NotEqual(t, ProblemContentType, response.Header().Get("Content-Type"), "Unexpected problem")
+}
+
+func TestValidateOpenApiStrict(t *testing.T) {
+	validateOpenApi, err := ValidateOpenApi(OpenApiValidationStrict)
+	assert.Nil(t, err, "ValidateOpenApi() failed")
+
+	// A response matching the document goes through untouched...
+	//
+	health := `{"status":"ok"}`
+	handler := validateOpenApi(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(health))
+	}))
+	response := doRequest(handler, http.MethodGet, "/healthz", "", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, health, response.Body.String(), "Unexpected response")
+
+	// ...but one that drifted from it is replaced with a problem, as is an
+	// undocumented status
+	//
+	health = `{"status":"great"}`
+	response = doRequest(handler, http.MethodGet, "/healthz", "", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, ProblemContentType, response.Header().Get("Content-Type"), "Unexpected content type")
+
+	handler = validateOpenApi(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	response = doRequest(handler, http.MethodGet, "/healthz", "", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code, "Unexpected HTTP status code")
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+func ListWebhooks(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhooks, err := svcDb.ListWebhooks()
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list webhooks", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list webhooks")
+			return
+		}
+
+		for _, webhook := range webhooks {
+			redactWebhook(webhook)
+		}
+
+		// Respond with status OK - response payload is the list of webhooks
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, webhooks)
+	}
+}
+
+func CreateWebhook(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := &CreateWebhookRequest{}
+
+		// Parse and validate the request
+		//
+		if err := render.Bind(r, request); err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid webhook")
+			return
+		}
+
+		if err := svcDb.CreateWebhook(request.Webhook); err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to create webhook", err, "webhook_url", request.Webhook.Url)
+			respondError(w, r, dbFailureStatus(err), "Unable to create webhook")
+			return
+		}
+
+		// Respond with status Created - response payload is the new webhook
+		//
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, redactWebhook(request.Webhook))
+	}
+}
+
+func GetWebhook(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookId, err := strconv.ParseUint(chi.URLParam(r, "webhookId"), 10, 64)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+			return
+		}
+
+		webhook, err := svcDb.GetWebhook(webhookId)
+		if errors.Is(err, db.ErrWebhookNotFound) {
+			// Respond with status Not Found - response payload is the error
+			//
+			respondError(w, r, http.StatusNotFound, "Webhook not found")
+			return
+		} else if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to retrieve webhook", err, "webhook_id", webhookId)
+			respondError(w, r, dbFailureStatus(err), "Unable to retrieve webhook")
+			return
+		}
+
+		// Respond with status OK - response payload is the webhook
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, redactWebhook(webhook))
+	}
+}
+
+func DeleteWebhook(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookId, err := strconv.ParseUint(chi.URLParam(r, "webhookId"), 10, 64)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+			return
+		}
+
+		if err = svcDb.DeleteWebhook(webhookId); errors.Is(err, db.ErrWebhookNotFound) {
+			// Respond with status Not Found - response payload is the error
+			//
+			respondError(w, r, http.StatusNotFound, "Webhook not found")
+			return
+		} else if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to delete webhook", err, "webhook_id", webhookId)
+			respondError(w, r, dbFailureStatus(err), "Unable to delete webhook")
+			return
+		}
+
+		// Respond with status No Content - no response payload
+		//
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func ListDeadLetters(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		limit := ListDeadLettersLimitQueryParamDefault
+		if limitQueryParam := r.URL.Query().Get("limit"); limitQueryParam != "" {
+			limit, err = strconv.ParseUint(limitQueryParam, 10, 64)
+			if err != nil || limit == 0 || limit > ListDeadLettersLimitQueryParamMax {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"limit\" query param")
+				return
+			}
+		}
+
+		afterId := ListDeadLettersAfterIdQueryParamDefault
+		if afterIdQueryParam := r.URL.Query().Get("afterId"); afterIdQueryParam != "" {
+			afterId, err = strconv.ParseUint(afterIdQueryParam, 10, 64)
+			if err != nil {
+				// Respond with status Bad Request - response payload
+				// is the error
+				//
+				respondError(w, r, http.StatusBadRequest, "Invalid \"afterId\" query param")
+				return
+			}
+		}
+
+		deliveries, nextAfterId, err := svcDb.ListDeadLetters(limit, afterId+1)
+		if err != nil {
+			// Respond with status Internal Server Error, or Service Unavailable
+			// if the database can't be reached - response payload is the error
+			//
+			logError(r, "Unable to list dead letters", err)
+			respondError(w, r, dbFailureStatus(err), "Unable to list dead letters")
+			return
+		}
+
+		// If there are further dead letters to retrieve, we'll return a
+		// relative URL for the next page in an HTTP header
+		//
+		if nextAfterId != 0 {
+			query := r.URL.Query()
+			query.Set("afterId", strconv.FormatUint(nextAfterId, 10))
+			query.Set("limit", strconv.FormatUint(limit, 10))
+			w.Header().Set("x-next-relative-url", r.URL.Path+"?"+query.Encode())
+		}
+
+		// Respond with status OK - response payload is the list of dead
+		// letters
+		//
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, deliveries)
+	}
+}
+
+func RedeliverDeadLetter(svcDb *db.Db) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deliveryId, err := strconv.ParseUint(chi.URLParam(r, "deliveryId"), 10, 64)
+		if err != nil {
+			// Respond with status Bad Request - response payload is the error
+			//
+			respondError(w, r, http.StatusBadRequest, "Invalid delivery ID")
+			return
+		}
+
+		delivery, err := svcDb.RedeliverDeadLetter(deliveryId)
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrDeliveryNotFound):
+				// Respond with status Not Found - response payload is the error
+				//
+				respondError(w, r, http.StatusNotFound, "Dead letter not found")
+			case errors.Is(err, db.ErrWebhookNotFound):
+				// Respond with status Not Found - response payload is the
+				// error. The dead letter was dropped along the way.
+				//
+				respondError(w, r, http.StatusNotFound, "Webhook not found")
+			default:
+				// Respond with status Internal Server Error, or Service
+				// Unavailable if the database can't be reached - response
+				// payload is the error
+				//
+				logError(r, "Unable to redeliver dead letter", err, "delivery_id", deliveryId)
+				respondError(w, r, dbFailureStatus(err), "Unable to redeliver dead letter")
+			}
+			return
+		}
+
+		// Respond with status Accepted - response payload is the delivery,
+		// queued again
+		//
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, delivery)
+	}
+}
+
+// Blanks out the secret of "webhook", which is never returned
+//
+func redactWebhook(webhook *model.Webhook) *model.Webhook {
+	webhook.Secret = ""
+	return webhook
+}
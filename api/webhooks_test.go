@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookRoutes(t *testing.T) {
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+
+	// Only admins can manage webhooks
+	//
+	body := `{"url":"http://localhost:8080/hooks","types":["created"],"secret":"s3cret"}`
+	response := doRequest(router, http.MethodPost, "/admin/webhooks", "alice-key", body)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Unexpected HTTP status code")
+
+	// Secrets are never returned
+	//
+	var webhook model.Webhook
+	response = doRequest(router, http.MethodPost, "/admin/webhooks", "admin-key", body)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &webhook), "Error decoding json")
+	assert.Equal(t, uint64(1), webhook.Id, "Unexpected webhook ID")
+	assert.Equal(t, []string{"created"}, webhook.Types, "Unexpected webhook types")
+	assert.Empty(t, webhook.Secret, "Secret shouldn't be returned")
+	assert.NotContains(t, response.Body.String(), "s3cret", "Secret shouldn't be returned")
+
+	for _, invalid := range []string{
+		`{"url":"http://localhost:8080/hooks"}`,
+		`{"url":"ftp://localhost/hooks","secret":"s3cret"}`,
+		`{"url":"/hooks","secret":"s3cret"}`,
+		`{"url":"http://localhost:8080/hooks","types":["frobnicated"],"secret":"s3cret"}`,
+	} {
+		response = doRequest(router, http.MethodPost, "/admin/webhooks", "admin-key", invalid)
+		assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code for %s", invalid)
+	}
+
+	var webhooks ListWebhooksResponse
+	response = doRequest(router, http.MethodGet, "/admin/webhooks", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &webhooks), "Error decoding json")
+	assert.Equal(t, 1, len(webhooks), "Unexpected number of webhooks")
+	assert.Empty(t, webhooks[0].Secret, "Secret shouldn't be returned")
+
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/1", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/2", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/foo", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	// Deliveries that failed every attempt can be listed, and redelivered
+	//
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"foo"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodPost, "/messages", "alice-key", `{"payload":"bar"}`)
+	assert.Equal(t, http.StatusCreated, response.Code, "Unexpected HTTP status code")
+
+	deliveries, _, err := svcDb.DueDeliveries(webhook.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	for _, delivery := range deliveries {
+		delivery.Attempts = 8
+		delivery.LastError = "unexpected HTTP status 503"
+		assert.Nil(t, svcDb.DeadLetterDelivery(delivery), "DeadLetterDelivery() failed")
+	}
+
+	var deadLetters ListDeadLettersResponse
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/deadletters?limit=1", "admin-key", "")
+	assert.Equal(t, http.StatusOK, response.Code, "Unexpected HTTP status code")
+	assert.Equal(t, "/admin/webhooks/deadletters?afterId=1&limit=1", response.Header().Get("x-next-relative-url"), "Unexpected next page")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &deadLetters), "Error decoding json")
+	assert.Equal(t, 1, len(deadLetters), "Unexpected number of dead letters")
+	assert.Equal(t, "foo", deadLetters[0].Change.Message.Message.Payload, "Unexpected payload")
+
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/deadletters?limit=0", "admin-key", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Unexpected HTTP status code")
+
+	var delivery model.WebhookDelivery
+	response = doRequest(router, http.MethodPost, "/admin/webhooks/deadletters/1/redeliver", "admin-key", "")
+	assert.Equal(t, http.StatusAccepted, response.Code, "Unexpected HTTP status code")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &delivery), "Error decoding json")
+	assert.Equal(t, uint64(0), delivery.Attempts, "Unexpected number of attempts")
+	response = doRequest(router, http.MethodPost, "/admin/webhooks/deadletters/1/redeliver", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	// Deleting the webhook drops its queued deliveries, and its dead letters
+	// once redelivered
+	//
+	response = doRequest(router, http.MethodDelete, "/admin/webhooks/1", "admin-key", "")
+	assert.Equal(t, http.StatusNoContent, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodDelete, "/admin/webhooks/1", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+
+	deliveries, _, err = svcDb.DueDeliveries(webhook.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Empty(t, deliveries, "Outbox should be empty")
+
+	response = doRequest(router, http.MethodPost, "/admin/webhooks/deadletters/2/redeliver", "admin-key", "")
+	assert.Equal(t, http.StatusNotFound, response.Code, "Unexpected HTTP status code")
+	response = doRequest(router, http.MethodGet, "/admin/webhooks/deadletters", "admin-key", "")
+	assert.Equal(t, "[]\n", response.Body.String(), "Dead letters should be empty")
+}
@@ -0,0 +1,549 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// How often an idle WebSocket is pinged. A client that doesn't answer within
+// two intervals is disconnected.
+//
+const DefaultWebSocketPingInterval = 30 * time.Second
+
+// Commands larger than this close the connection
+//
+const webSocketMaxCommandBytes = 1 << 20
+
+// Replies waiting to be written. Once full, no more commands are read until
+// the client catches up.
+//
+const webSocketOutboxSize = 16
+
+// How long writing a frame may take before the client is given up on
+//
+const webSocketWriteTimeout = 10 * time.Second
+
+// Subprotocol selected for clients that offer it. Browsers, which can't set
+// headers on the handshake, offer it along with their API key as a
+// WebSocketBearerProtocolPrefix entry, and refuse handshakes that don't select
+// one of the subprotocols they offered.
+//
+const WebSocketProtocol = "messages"
+
+// Prefix of the subprotocol entry carrying an API key, base64url encoded
+// without padding, e.g. "bearer.YWxpY2Uta2V5"
+//
+const WebSocketBearerProtocolPrefix = "bearer."
+
+// GET /ws
+//
+// Upgrades the connection to a WebSocket speaking the protocol described by
+// WebSocketCommand and WebSocketReply. Commands are processed one at a time, in
+// order, as requests made through "router" on behalf of whoever opened the
+// connection, so that they're authenticated, validated, rate limited and
+// logged exactly like their REST counterparts. Events of the subscription, if
+// any, are read from the change log like those of StreamMessageEvents.
+//
+func WebSocket(svcDb *db.Db, router http.Handler, pingInterval time.Duration, readiness *Readiness) func(w http.ResponseWriter, r *http.Request) {
+	if pingInterval <= 0 {
+		pingInterval = DefaultWebSocketPingInterval
+	}
+
+	upgrader := &websocket.Upgrader{
+		Subprotocols: []string{WebSocketProtocol},
+
+		// Failed handshakes are answered like any other invalid request
+		//
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			respondError(w, r, status, reason.Error())
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The server doesn't keep track of hijacked connections, so they're
+		// tracked here for shutdown to wait on
+		//
+		closed, ok := readiness.trackConnection()
+		if !ok {
+			// Respond with status Service Unavailable - response payload is
+			// the error
+			//
+			respondError(w, r, http.StatusServiceUnavailable, "Shutting down")
+			return
+		}
+		defer closed()
+
+		// The upgrader writes the handshake response by itself, so the
+		// request ID has to be passed along
+		//
+		conn, err := upgrader.Upgrade(w, r, http.Header{RequestIdHeader: {middleware.GetReqID(r.Context())}})
+		if err != nil {
+			return
+		}
+
+		newWebSocketSession(conn, scopedDb(r, svcDb), router, r, pingInterval).run(readiness.ShuttingDown())
+	}
+}
+
+// Middleware to pass the API key a browser offers as a subprotocol of the
+// WebSocket handshake on as a bearer token, for Authenticate and for the
+// commands of the connection, unless the request carries one already
+//
+func WebSocketCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, protocol := range websocket.Subprotocols(r) {
+			if !strings.HasPrefix(protocol, WebSocketBearerProtocolPrefix) {
+				continue
+			}
+
+			apiKey, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(protocol, WebSocketBearerProtocolPrefix))
+			if err != nil {
+				break
+			}
+
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+string(apiKey))
+			break
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// State of a WebSocket connection. Frames are only ever read by run's
+// goroutine and written by writeLoop's, as the connection requires.
+//
+type webSocketSession struct {
+	conn         *websocket.Conn
+	svcDb        *db.Db
+	router       http.Handler
+	upgrade      *http.Request // Request that opened the connection
+	prefix       string        // Path the message routes are under
+	pingInterval time.Duration
+	commands     uint64 // Commands read so far
+
+	// Commands are processed under the span of the connection, but not on
+	// behalf of the request that opened it, and are canceled once it closes
+	//
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	outbox     chan *webSocketOutgoing
+	readerDone chan struct{}
+	writerDone chan struct{}
+}
+
+// Reply queued for the writer, along with the subscription it starts or ends
+//
+type webSocketOutgoing struct {
+	reply        *WebSocketReply
+	subscribe    bool // Whether "subscription" replaces the current one
+	subscription *webSocketSubscription
+}
+
+type webSocketSubscription struct {
+	filter      db.ChangeFilter
+	sequence    uint64 // Of the last change sent, or skipped over
+	notified    <-chan struct{}
+	unsubscribe func()
+}
+
+func newWebSocketSession(conn *websocket.Conn, svcDb *db.Db, router http.Handler, upgrade *http.Request, pingInterval time.Duration) *webSocketSession {
+	ctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(upgrade.Context())))
+
+	return &webSocketSession{
+		conn:         conn,
+		svcDb:        svcDb,
+		router:       router,
+		upgrade:      upgrade,
+		prefix:       strings.TrimSuffix(upgrade.URL.Path, "/ws"),
+		pingInterval: pingInterval,
+		ctx:          ctx,
+		cancel:       cancel,
+		outbox:       make(chan *webSocketOutgoing, webSocketOutboxSize),
+		readerDone:   make(chan struct{}),
+		writerDone:   make(chan struct{}),
+	}
+}
+
+// Serves the connection until either end closes it, or "shuttingDown" is
+// closed
+//
+func (session *webSocketSession) run(shuttingDown <-chan struct{}) {
+	defer session.cancel()
+
+	// Closing the connection is what unblocks the reader once the writer is
+	// done
+	//
+	go func() {
+		defer close(session.writerDone)
+		defer session.conn.Close()
+		session.writeLoop(shuttingDown)
+	}()
+
+	session.readLoop()
+	close(session.readerDone)
+	<-session.writerDone
+}
+
+// Reads and processes commands until the connection closes. Pongs, and
+// commands, show the client is still there.
+//
+func (session *webSocketSession) readLoop() {
+	pongWait := 2 * session.pingInterval
+	session.conn.SetReadLimit(webSocketMaxCommandBytes)
+	session.conn.SetReadDeadline(time.Now().Add(pongWait))
+	session.conn.SetPongHandler(func(string) error {
+		return session.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		messageType, data, err := session.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		session.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		command := &WebSocketCommand{}
+		if messageType != websocket.TextMessage || json.Unmarshal(data, command) != nil {
+			// Reply with status Bad Request - reply is the error
+			//
+			reply := &WebSocketReply{Type: WebSocketReplyError, Status: http.StatusBadRequest, Error: "Invalid command"}
+			if !session.send(&webSocketOutgoing{reply: reply}) {
+				return
+			}
+			continue
+		}
+
+		if !session.send(session.process(command)) {
+			return
+		}
+	}
+}
+
+// Queues "outgoing" for the writer, waiting for room if need be. Returns false
+// if the writer is gone.
+//
+func (session *webSocketSession) send(outgoing *webSocketOutgoing) bool {
+	select {
+	case session.outbox <- outgoing:
+		return true
+	case <-session.writerDone:
+		if outgoing.subscription != nil {
+			outgoing.subscription.unsubscribe()
+		}
+		return false
+	}
+}
+
+func (session *webSocketSession) process(command *WebSocketCommand) *webSocketOutgoing {
+	messagePath := "/messages/" + strconv.FormatUint(command.MessageId, 10)
+	payload := map[string]string{"payload": command.Payload}
+
+	switch command.Type {
+	case WebSocketCommandSubscribe:
+		return session.subscribe(command)
+	case WebSocketCommandUnsubscribe:
+		reply := &WebSocketReply{Id: command.Id, Type: WebSocketReplyResult, Status: http.StatusOK}
+		return &webSocketOutgoing{reply: reply, subscribe: true}
+	case WebSocketCommandCreate:
+		return &webSocketOutgoing{reply: session.dispatch(command, http.MethodPost, "/messages", payload)}
+	case WebSocketCommandGet:
+		return &webSocketOutgoing{reply: session.dispatch(command, http.MethodGet, messagePath+"?detailed=true", nil)}
+	case WebSocketCommandUpdate:
+		return &webSocketOutgoing{reply: session.dispatch(command, http.MethodPut, messagePath, payload)}
+	case WebSocketCommandDelete:
+		return &webSocketOutgoing{reply: session.dispatch(command, http.MethodDelete, messagePath, nil)}
+	}
+
+	// Reply with status Bad Request - reply is the error
+	//
+	reply := &WebSocketReply{Id: command.Id, Type: WebSocketReplyError, Status: http.StatusBadRequest, Error: "Invalid command type"}
+	return &webSocketOutgoing{reply: reply}
+}
+
+// Starts a subscription replacing the current one, if any. The reply carries
+// the sequence number events start after.
+//
+func (session *webSocketSession) subscribe(command *WebSocketCommand) *webSocketOutgoing {
+	types := command.Types
+	if len(types) == 0 {
+		types = strings.Split(StreamMessageEventsTypesQueryParamDefault, ",")
+	}
+
+	principal := session.upgrade.Context().Value("principal").(*Principal)
+	filter, err := newEventFilter(principal, types, command.Palindrome, command.Owner)
+	if err != nil {
+		// Reply with status Bad Request - reply is the error
+		//
+		reply := &WebSocketReply{Id: command.Id, Type: WebSocketReplyError, Status: http.StatusBadRequest, Error: err.Error()}
+		return &webSocketOutgoing{reply: reply}
+	}
+
+	notified, unsubscribe, sequence, err := subscribeChanges(session.svcDb, command.LastEventId)
+	if errors.Is(err, db.ErrChangesExpired) {
+		// Reply with status Gone - reply is the error
+		//
+		reply := &WebSocketReply{Id: command.Id, Type: WebSocketReplyError, Status: http.StatusGone, Error: changesExpiredError(sequence)}
+		return &webSocketOutgoing{reply: reply}
+	} else if err != nil {
+		// Reply with status Internal Server Error, or Service Unavailable if
+		// the database can't be reached - reply is the error
+		//
+		logError(session.upgrade, "Unable to subscribe", err)
+		reply := &WebSocketReply{Id: command.Id, Type: WebSocketReplyError, Status: dbFailureStatus(err), Error: "Unable to subscribe"}
+		return &webSocketOutgoing{reply: reply}
+	}
+
+	return &webSocketOutgoing{
+		reply:     &WebSocketReply{Id: command.Id, Type: WebSocketReplyResult, Status: http.StatusOK, Sequence: sequence},
+		subscribe: true,
+		subscription: &webSocketSubscription{
+			filter:      filter,
+			sequence:    sequence,
+			notified:    notified,
+			unsubscribe: unsubscribe,
+		},
+	}
+}
+
+// Processes "command" as a request made with "method" against "target",
+// relative to the message routes, with "body" as JSON payload unless nil. The request
+// carries the credentials the connection was opened with.
+//
+func (session *webSocketSession) dispatch(command *WebSocketCommand, method string, target string, body interface{}) *WebSocketReply {
+	reply := &WebSocketReply{Id: command.Id, MessageId: command.MessageId}
+
+	var requestBody io.Reader = http.NoBody
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			// Reply with status Internal Server Error - reply is the error
+			//
+			reply.Type, reply.Status, reply.Error = WebSocketReplyError, http.StatusInternalServerError, "Unable to process command"
+			return reply
+		}
+		requestBody = bytes.NewReader(buf)
+	}
+
+	request, err := http.NewRequestWithContext(session.ctx, method, session.prefix+target, requestBody)
+	if err != nil {
+		// Reply with status Bad Request - reply is the error
+		//
+		reply.Type, reply.Status, reply.Error = WebSocketReplyError, http.StatusBadRequest, "Invalid command"
+		return reply
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		if value := session.upgrade.Header.Get(header); value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+	request.Host = session.upgrade.Host
+	request.RemoteAddr = session.upgrade.RemoteAddr
+	request.TLS = session.upgrade.TLS
+
+	// Commands are logged under the request ID of the connection, suffixed
+	// with their number
+	//
+	session.commands++
+	request.Header.Set(middleware.RequestIDHeader, fmt.Sprintf("%s-%d", middleware.GetReqID(session.upgrade.Context()), session.commands))
+
+	response := &webSocketResponse{header: http.Header{}}
+	session.router.ServeHTTP(response, request)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+
+	reply.Status = response.status
+	reply.RequestId = response.header.Get(RequestIdHeader)
+
+	// Errors are either an ErrorResponse or, if the command didn't match the
+	// OpenAPI document, a ProblemResponse
+	//
+	if response.status >= http.StatusBadRequest {
+		failure := &struct {
+			Error  string `json:"error"`
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		}{}
+		json.Unmarshal(response.body.Bytes(), failure)
+
+		reply.Type = WebSocketReplyError
+		reply.Error, reply.Detail = failure.Error, failure.Detail
+		if reply.Error == "" {
+			reply.Error = failure.Title
+		}
+		return reply
+	}
+
+	reply.Type = WebSocketReplyResult
+	switch command.Type {
+	case WebSocketCommandCreate:
+		reply.MessageId, _ = strconv.ParseUint(path.Base(response.header.Get("Location")), 10, 64)
+	case WebSocketCommandGet:
+		reply.Message = &model.DetailedMessage{}
+		if err = json.Unmarshal(response.body.Bytes(), reply.Message); err != nil {
+			// Reply with status Internal Server Error - reply is the error
+			//
+			reply.Type, reply.Status, reply.Error, reply.Message = WebSocketReplyError, http.StatusInternalServerError, "Unable to process command", nil
+		}
+	}
+
+	return reply
+}
+
+// Writes replies, events and pings until the reader is done, writing fails or
+// "shuttingDown" is closed
+//
+func (session *webSocketSession) writeLoop(shuttingDown <-chan struct{}) {
+	ping := time.NewTicker(session.pingInterval)
+	defer ping.Stop()
+
+	var subscription *webSocketSubscription
+	defer func() {
+		if subscription != nil {
+			subscription.unsubscribe()
+		}
+	}()
+
+	// Signaled while changes are left to send, so that a long backlog is sent
+	// a batch at a time in between replies rather than hold them up
+	//
+	pending := make(chan struct{}, 1)
+	wakeUp := func() {
+		select {
+		case pending <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		var notified <-chan struct{}
+		if subscription != nil {
+			notified = subscription.notified
+		}
+
+		select {
+		case outgoing := <-session.outbox:
+			if outgoing.subscribe {
+				if subscription != nil {
+					subscription.unsubscribe()
+				}
+				subscription = outgoing.subscription
+				wakeUp()
+			}
+			if err := session.write(outgoing.reply); err != nil {
+				return
+			}
+		case <-notified:
+			wakeUp()
+		case <-pending:
+			if subscription == nil {
+				continue
+			}
+			more, err := session.writeEvents(subscription)
+			if errors.Is(err, db.ErrChangesExpired) {
+				// The subscription fell so far behind that the changes it
+				// missed expired, so it ends with an error - with status Gone
+				// - and has to start over
+				//
+				reply := &WebSocketReply{Type: WebSocketReplyError, Status: http.StatusGone, Sequence: subscription.sequence, Error: changesExpiredError(subscription.sequence)}
+				subscription.unsubscribe()
+				subscription = nil
+				if err = session.write(reply); err != nil {
+					return
+				}
+				continue
+			} else if errors.As(err, new(*changeSendError)) {
+				return
+			} else if err != nil {
+				logError(session.upgrade, "Unable to send events", err)
+				return
+			}
+			if more {
+				wakeUp()
+			}
+		case <-ping.C:
+			if err := session.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteTimeout)); err != nil {
+				return
+			}
+		case <-session.readerDone:
+			return
+		case <-shuttingDown:
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Shutting down")
+			session.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(webSocketWriteTimeout))
+			return
+		}
+	}
+}
+
+// Writes an event for each of the next batch of changes matching
+// "subscription". Returns whether there are more changes left to send.
+//
+func (session *webSocketSession) writeEvents(subscription *webSocketSubscription) (bool, error) {
+	sequence, more, err := sendChangeBatch(session.svcDb, subscription.sequence, subscription.filter, streamMessageEventsBatchSize, func(change *model.Change) error {
+		return session.write(&WebSocketReply{
+			Type:     WebSocketReplyEvent,
+			Sequence: change.Sequence,
+			Event:    change.Type,
+			Message:  change.Message,
+		})
+	})
+	subscription.sequence = sequence
+	return more, err
+}
+
+func (session *webSocketSession) write(reply *WebSocketReply) error {
+	session.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	return session.conn.WriteJSON(reply)
+}
+
+// Response to a command, recorded rather than written to the connection
+//
+type webSocketResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *webSocketResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *webSocketResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *webSocketResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type testWebSocket struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, apiKey string) (*testWebSocket, *http.Response, error) {
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	if err != nil {
+		return nil, response, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testWebSocket{t: t, conn: conn}, response, nil
+}
+
+// Sends "command" then reads "frames" frames, the reply to the command along
+// with events of the subscription sent in the meantime. Returns the reply and
+// the events, in order.
+//
+func (ws *testWebSocket) do(command *WebSocketCommand, frames int) (*WebSocketReply, []*WebSocketReply) {
+	assert.Nil(ws.t, ws.conn.WriteJSON(command), "Error sending command")
+
+	var reply *WebSocketReply
+	events := []*WebSocketReply{}
+	for _, frame := range ws.read(frames) {
+		if frame.Type == WebSocketReplyEvent {
+			events = append(events, frame)
+		} else {
+			assert.Equal(ws.t, command.Id, frame.Id, "Unexpected reply ID")
+			reply = frame
+		}
+	}
+	assert.NotNil(ws.t, reply, "No reply to %s", command.Id)
+	if reply == nil {
+		reply = &WebSocketReply{}
+	}
+
+	return reply, events
+}
+
+func (ws *testWebSocket) read(frames int) []*WebSocketReply {
+	ws.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	replies := []*WebSocketReply{}
+	for i := 0; i < frames; i++ {
+		reply := &WebSocketReply{}
+		if !assert.Nil(ws.t, ws.conn.ReadJSON(reply), "Error reading reply") {
+			break
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func TestWebSocket(t *testing.T) {
+	svcDb := newTestDb(t)
+	router := NewRouter(svcDb, Config{ApiKeys: testApiKeys, OpenApiValidation: OpenApiValidationStrict})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	_, response, err := dialWebSocket(t, server, "/ws", "")
+	assert.Equal(t, websocket.ErrBadHandshake, err, "Handshake should have failed")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "Unexpected HTTP status code")
+
+	alice, response, err := dialWebSocket(t, server, "/ws", "alice-key")
+	assert.Nil(t, err, "Handshake failed")
+	assert.NotEmpty(t, response.Header.Get(RequestIdHeader), "Missing request ID")
+	bob, _, err := dialWebSocket(t, server, "/ws", "bob-key")
+	assert.Nil(t, err, "Handshake failed")
+
+	// Commands map onto the message routes
+	//
+	truthy := true
+	reply, _ := alice.do(&WebSocketCommand{Id: "s1", Type: WebSocketCommandSubscribe, Palindrome: &truthy}, 1)
+	assert.Equal(t, &WebSocketReply{Id: "s1", Type: WebSocketReplyResult, Status: http.StatusOK}, reply, "Unexpected reply")
+
+	reply, events := alice.do(&WebSocketCommand{Id: "c1", Type: WebSocketCommandCreate, Payload: "kayak"}, 2)
+	assert.Equal(t, WebSocketReplyResult, reply.Type, "Unexpected reply type")
+	assert.Equal(t, http.StatusCreated, reply.Status, "Unexpected status")
+	assert.Equal(t, uint64(1), reply.MessageId, "Unexpected message ID")
+	assert.NotEmpty(t, reply.RequestId, "Missing request ID")
+	assert.Equal(t, uint64(1), events[0].Sequence, "Unexpected event sequence")
+	assert.Equal(t, "created", events[0].Event, "Unexpected event")
+	assert.Equal(t, "kayak", events[0].Message.Message.Payload, "Unexpected payload")
+
+	reply, _ = alice.do(&WebSocketCommand{Id: "c2", Type: WebSocketCommandCreate, Payload: "foo"}, 1)
+	assert.Equal(t, uint64(2), reply.MessageId, "Unexpected message ID")
+
+	reply, _ = alice.do(&WebSocketCommand{Id: "g1", Type: WebSocketCommandGet, MessageId: 1}, 1)
+	assert.Equal(t, http.StatusOK, reply.Status, "Unexpected status")
+	assert.Equal(t, "alice", reply.Message.Owner, "Unexpected owner")
+	assert.True(t, reply.Message.Metadata.Palindrome, "Should be a palindrome")
+
+	// Only the owner can see, and change, the message
+	//
+	reply, _ = bob.do(&WebSocketCommand{Id: "u1", Type: WebSocketCommandUpdate, MessageId: 1, Payload: "bar"}, 1)
+	assert.Equal(t, WebSocketReplyError, reply.Type, "Unexpected reply type")
+	assert.Equal(t, http.StatusNotFound, reply.Status, "Unexpected status")
+	assert.Equal(t, "Message not found", reply.Error, "Unexpected error")
+
+	reply, events = alice.do(&WebSocketCommand{Id: "u2", Type: WebSocketCommandUpdate, MessageId: 1, Payload: "racecar"}, 2)
+	assert.Equal(t, http.StatusNoContent, reply.Status, "Unexpected status")
+	assert.Equal(t, uint64(3), events[0].Sequence, "Unexpected event sequence")
+	assert.Equal(t, "updated", events[0].Event, "Unexpected event")
+
+	// Commands are validated like requests
+	//
+	reply, _ = alice.do(&WebSocketCommand{Id: "c3", Type: WebSocketCommandCreate}, 1)
+	assert.Equal(t, http.StatusBadRequest, reply.Status, "Unexpected status")
+	assert.Equal(t, "Invalid message", reply.Error, "Unexpected error")
+	reply, _ = alice.do(&WebSocketCommand{Id: "x1", Type: "frobnicate"}, 1)
+	assert.Equal(t, http.StatusBadRequest, reply.Status, "Unexpected status")
+	reply, _ = alice.do(&WebSocketCommand{Id: "s2", Type: WebSocketCommandSubscribe, Owner: "bob"}, 1)
+	assert.Equal(t, http.StatusBadRequest, reply.Status, "Unexpected status")
+	assert.Nil(t, alice.conn.WriteMessage(websocket.TextMessage, []byte("{")), "Error sending command")
+	assert.Equal(t, http.StatusBadRequest, alice.read(1)[0].Status, "Unexpected status")
+
+	// Resubscribing replaces the subscription, here with one picking up from
+	// the start of the change log
+	//
+	zero := uint64(0)
+	command := &WebSocketCommand{Id: "s3", Type: WebSocketCommandSubscribe, Types: []string{"created", "deleted"}, LastEventId: &zero}
+	reply, events = alice.do(command, 3)
+	assert.Equal(t, http.StatusOK, reply.Status, "Unexpected status")
+	assert.Equal(t, uint64(1), events[0].Sequence, "Unexpected event sequence")
+	assert.Equal(t, uint64(2), events[1].Sequence, "Unexpected event sequence")
+
+	reply, events = alice.do(&WebSocketCommand{Id: "d1", Type: WebSocketCommandDelete, MessageId: 2}, 2)
+	assert.Equal(t, http.StatusNoContent, reply.Status, "Unexpected status")
+	assert.Equal(t, "deleted", events[0].Event, "Unexpected event")
+	assert.Equal(t, "foo", events[0].Message.Message.Payload, "Unexpected payload")
+
+	reply, _ = alice.do(&WebSocketCommand{Id: "s4", Type: WebSocketCommandUnsubscribe}, 1)
+	assert.Equal(t, http.StatusOK, reply.Status, "Unexpected status")
+	reply, _ = alice.do(&WebSocketCommand{Id: "c4", Type: WebSocketCommandCreate, Payload: "abba"}, 1)
+	assert.Equal(t, http.StatusCreated, reply.Status, "Unexpected status")
+
+	// Tenants have their own WebSocket
+	//
+	assert.Nil(t, svcDb.CreateTenant(&model.Tenant{Name: "red"}), "CreateTenant() failed")
+	red, _, err := dialWebSocket(t, server, "/tenants/red/ws", "alice-key")
+	assert.Nil(t, err, "Handshake failed")
+	reply, _ = red.do(&WebSocketCommand{Id: "c1", Type: WebSocketCommandCreate, Payload: "bar"}, 1)
+	assert.Equal(t, uint64(1), reply.MessageId, "Unexpected message ID")
+	recorder := doRequest(router, http.MethodGet, "/tenants/red/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, recorder.Code, "Unexpected HTTP status code")
+
+	// Subscriptions can't pick up from before changes that are no longer
+	// retained
+	//
+	_, err = svcDb.ApplyChangeLogPolicies(db.ChangeLogConfig{MaxChanges: 2}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	one := uint64(1)
+	reply, _ = red.do(&WebSocketCommand{Id: "s1", Type: WebSocketCommandSubscribe, LastEventId: &one}, 1)
+	assert.Equal(t, WebSocketReplyError, reply.Type, "Unexpected reply type")
+	assert.Equal(t, http.StatusGone, reply.Status, "Unexpected status")
+	assert.Equal(t, "Changes since 1 no longer retained", reply.Error, "Unexpected error")
+}
+
+func TestWebSocketRateLimit(t *testing.T) {
+	rateLimit := RateLimitConfig{KeyBy: RateLimitKeyPrincipal, WriteRate: 0.001, WriteBurst: 1}
+	server := httptest.NewServer(NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys, RateLimit: rateLimit}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := dialWebSocket(t, server, "/ws", "alice-key")
+	assert.Nil(t, err, "Handshake failed")
+
+	reply, _ := ws.do(&WebSocketCommand{Id: "c1", Type: WebSocketCommandCreate, Payload: "foo"}, 1)
+	assert.Equal(t, http.StatusCreated, reply.Status, "Unexpected status")
+	reply, _ = ws.do(&WebSocketCommand{Id: "c2", Type: WebSocketCommandCreate, Payload: "bar"}, 1)
+	assert.Equal(t, http.StatusTooManyRequests, reply.Status, "Unexpected status")
+}
+
+func TestWebSocketBrowserCredentials(t *testing.T) {
+	router := NewRouter(newTestDb(t), Config{ApiKeys: testApiKeys})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	dial := func(apiKey string) (*websocket.Conn, *http.Response, error) {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = []string{WebSocketProtocol, WebSocketBearerProtocolPrefix + base64.RawURLEncoding.EncodeToString([]byte(apiKey))}
+		return dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	}
+
+	_, response, err := dial("mallory-key")
+	assert.NotNil(t, err, "Handshake should have failed")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "Unexpected HTTP status code")
+
+	// The API key offered as a subprotocol authenticates the handshake and
+	// every command, and is never selected
+	//
+	conn, _, err := dial("alice-key")
+	assert.Nil(t, err, "Handshake failed")
+	t.Cleanup(func() { conn.Close() })
+	assert.Equal(t, WebSocketProtocol, conn.Subprotocol(), "Unexpected subprotocol")
+
+	ws := &testWebSocket{t: t, conn: conn}
+	reply, _ := ws.do(&WebSocketCommand{Id: "c1", Type: WebSocketCommandCreate, Payload: "foo"}, 1)
+	assert.Equal(t, http.StatusCreated, reply.Status, "Unexpected status")
+
+	recorder := doRequest(router, http.MethodGet, "/messages/1", "alice-key", "")
+	assert.Equal(t, http.StatusOK, recorder.Code, "Unexpected HTTP status code")
+	recorder = doRequest(router, http.MethodGet, "/messages/1", "bob-key", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code, "Unexpected HTTP status code")
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	server := httptest.NewServer(NewRouter(newTestDb(t), Config{WebSocketPingInterval: 10 * time.Millisecond}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := dialWebSocket(t, server, "/ws", "")
+	assert.Nil(t, err, "Handshake failed")
+
+	// A client that never answers pings is disconnected
+	//
+	pings := 0
+	ws.conn.SetPingHandler(func(string) error {
+		pings++
+		return nil
+	})
+	ws.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = ws.conn.ReadMessage()
+	assert.NotNil(t, err, "Connection should have been closed")
+	assert.NotZero(t, pings, "Should have been pinged")
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	readiness := NewReadiness()
+	readiness.SetReady()
+	server := httptest.NewServer(NewRouter(newTestDb(t), Config{Readiness: readiness}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := dialWebSocket(t, server, "/ws", "")
+	assert.Nil(t, err, "Handshake failed")
+
+	// Connections are closed as the service goes away, and no new one is
+	// accepted
+	//
+	readiness.SetShuttingDown()
+	ws.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = ws.conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "Unexpected error %v", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, readiness.WaitForConnections(ctx), "Connections should have been closed")
+
+	_, response, err := dialWebSocket(t, server, "/ws", "")
+	assert.NotNil(t, err, "Handshake should have failed")
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode, "Unexpected HTTP status code")
+}
@@ -0,0 +1,231 @@
+// Package client is a Go client of the messages API
+//
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultMaxRetries = 3
+const DefaultMinBackoff = 100 * time.Millisecond
+const DefaultMaxBackoff = 5 * time.Second
+
+type Client struct {
+	baseUrl    *url.URL
+	httpClient *http.Client
+	tenant     string
+
+	// Sets the credentials of every request
+	//
+	authenticate func(r *http.Request)
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(c *Client)
+
+// Authenticates with "apiKey" in the "Authorization: Bearer" header
+//
+func WithBearerToken(apiKey string) Option {
+	return func(c *Client) {
+		c.authenticate = func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+	}
+}
+
+// Authenticates with "apiKey" in the "X-API-Key" header
+//
+func WithApiKey(apiKey string) Option {
+	return func(c *Client) {
+		c.authenticate = func(r *http.Request) {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+	}
+}
+
+// Sends requests with "httpClient", such as one presenting a client
+// certificate
+//
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// Works on the messages of tenant "name" rather than the default ones
+//
+func WithTenant(name string) Option {
+	return func(c *Client) {
+		c.tenant = name
+	}
+}
+
+// Retries failed requests up to "maxRetries" times, waiting exponentially
+// longer between attempts, from "minBackoff" up to "maxBackoff". Retries are
+// disabled with 0.
+//
+func WithRetries(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// Returns a client of the service reached at "baseUrl", such as
+// "http://localhost:55555"
+//
+func New(baseUrl string, options ...Option) (*Client, error) {
+	parsedUrl, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	parsedUrl.Path = strings.TrimSuffix(parsedUrl.Path, "/")
+
+	c := &Client{
+		baseUrl:      parsedUrl,
+		httpClient:   http.DefaultClient,
+		authenticate: func(r *http.Request) {},
+		maxRetries:   DefaultMaxRetries,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+	}
+	for _, option := range options {
+		option(c)
+	}
+
+	return c, nil
+}
+
+// Path of the messages of the client's tenant
+//
+func (c *Client) messagesPath() string {
+	if c.tenant != "" {
+		return "/tenants/" + url.PathEscape(c.tenant) + "/messages"
+	}
+	return "/messages"
+}
+
+// Sends a request for "pathAndQuery", relative to the base URL, with "body"
+// encoded as JSON if it isn't nil. A response with a status other than 2xx is
+// returned as an *Error. Otherwise, the response is decoded into "result" if
+// it isn't nil.
+//
+func (c *Client) do(ctx context.Context, method string, pathAndQuery string, body interface{}, result interface{}) (*http.Response, error) {
+	requestUrl, err := url.Parse(c.baseUrl.String() + pathAndQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	if body != nil {
+		if buf, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, method, requestUrl.String(), bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		request.Header.Set("Accept", "application/json")
+		c.authenticate(request)
+
+		response, err := c.httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			defer response.Body.Close()
+			if result != nil {
+				if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+					return response, err
+				}
+			}
+			return response, nil
+		}
+
+		apiErr := newError(response)
+		if attempt >= c.maxRetries || !retryable(method, apiErr) {
+			return response, apiErr
+		}
+
+		// Wait for as long as the service asked to, if it did
+		//
+		backoff := c.backoff(attempt)
+		if apiErr.RetryAfter > backoff {
+			backoff = apiErr.RetryAfter
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return response, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Rate limited requests are always retried, as are those the service itself
+// answered as unavailable, with its own error payload rather than a proxy's.
+// Other server errors are only retried if the request can safely be sent twice,
+// which creating a message can't: a proxy giving up on the service doesn't
+// mean the message wasn't created.
+//
+func retryable(method string, apiErr *Error) bool {
+	switch {
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return true
+	case apiErr.StatusCode == http.StatusServiceUnavailable && apiErr.Message != "":
+		return true
+	}
+	return apiErr.StatusCode >= 500 && method != http.MethodPost
+}
+
+// Exponential backoff with full jitter
+//
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.maxBackoff
+	if attempt < 32 && c.minBackoff<<attempt < c.maxBackoff {
+		backoff = c.minBackoff << attempt
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff))) + 1
+}
+
+// Parses the "Retry-After" header, in seconds
+//
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.ParseUint(header, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Reads what's left of "body" so that its connection can be reused
+//
+func drain(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testApiKeys = map[string]*api.Principal{
+	"alice-key": {Name: "alice"},
+	"bob-key":   {Name: "bob"},
+	"admin-key": {Name: "root", Roles: []string{api.AdminRole}},
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	svcDb := db.NewDb(db.Config{
+		FilePath:   filepath.Join(t.TempDir(), "client-test.db"),
+		BucketName: "ClientTestBucket",
+	})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	t.Cleanup(svcDb.Close)
+
+	server := httptest.NewServer(api.NewRouter(svcDb, api.Config{ApiKeys: testApiKeys, OpenApiValidation: api.OpenApiValidationStrict}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestClient(t *testing.T, baseUrl string, options ...Option) *Client {
+	c, err := New(baseUrl, options...)
+	assert.Nil(t, err, "New() failed")
+	return c
+}
+
+func TestMessages(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	c := newTestClient(t, server.URL, WithBearerToken("alice-key"))
+
+	id, err := c.CreateMessage(ctx, "kayak")
+	assert.Nil(t, err, "CreateMessage() failed")
+	assert.Equal(t, uint64(1), id, "Unexpected message id")
+
+	message, err := c.GetMessage(ctx, id)
+	assert.Nil(t, err, "GetMessage() failed")
+	assert.Equal(t, "kayak", message.Payload, "Unexpected message payload")
+
+	assert.Nil(t, c.UpdateMessage(ctx, id, "foo"), "UpdateMessage() failed")
+	detailedMessage, err := c.GetDetailedMessage(ctx, id)
+	assert.Nil(t, err, "GetDetailedMessage() failed")
+	assert.Equal(t, "foo", detailedMessage.Message.Payload, "Unexpected message payload")
+	assert.False(t, detailedMessage.Metadata.Palindrome, "Unexpected palindrome")
+	assert.Equal(t, "alice", detailedMessage.Owner, "Unexpected owner")
+
+	assert.Nil(t, c.DeleteMessage(ctx, id), "DeleteMessage() failed")
+	_, err = c.GetMessage(ctx, id)
+	assert.True(t, errors.Is(err, ErrNotFound), "Unexpected error %v", err)
+	var apiErr *Error
+	assert.True(t, errors.As(err, &apiErr), "Unexpected error type")
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode, "Unexpected status code")
+	assert.NotEmpty(t, apiErr.RequestId, "Missing request ID")
+
+	// Requests not matching the API come back as problems
+	//
+	_, err = c.CreateMessage(ctx, "")
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "Unexpected error %v", err)
+
+	// The API key can be sent in either header
+	//
+	_, err = newTestClient(t, server.URL).GetMessage(ctx, 1)
+	assert.True(t, errors.Is(err, ErrUnauthenticated), "Unexpected error %v", err)
+	_, err = newTestClient(t, server.URL, WithApiKey("bob-key")).CreateMessage(ctx, "bar")
+	assert.Nil(t, err, "CreateMessage() failed")
+}
+
+func TestIterate(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	c := newTestClient(t, server.URL, WithBearerToken("alice-key"))
+
+	for i := 0; i < 5; i++ {
+		_, err := c.CreateMessage(ctx, "foo")
+		assert.Nil(t, err, "CreateMessage() failed")
+	}
+
+	page, err := c.ListMessages(ctx, ListOptions{Limit: 2})
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Len(t, page.Messages, 2, "Unexpected number of messages")
+	assert.Equal(t, "/messages?afterId=2&limit=2", page.NextRelativeUrl, "Unexpected next relative URL")
+
+	// Every page is followed
+	//
+	var ids []uint64
+	it := c.Iterate(ctx, ListOptions{Limit: 2, AfterId: 1, Detailed: true})
+	for it.Next() {
+		ids = append(ids, it.Message().Id)
+		assert.Equal(t, "alice", it.DetailedMessage().Owner, "Unexpected owner")
+	}
+	assert.Nil(t, it.Err(), "Unexpected iteration error")
+	assert.Equal(t, []uint64{2, 3, 4, 5}, ids, "Unexpected messages")
+
+	// An empty listing isn't an error
+	//
+	it = newTestClient(t, server.URL, WithBearerToken("bob-key")).Iterate(ctx, ListOptions{Owner: "me"})
+	assert.False(t, it.Next(), "Unexpected message")
+	assert.Nil(t, it.Err(), "Unexpected iteration error")
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	c := newTestClient(t, server.URL, WithBearerToken("alice-key"), WithTenant("acme"))
+
+	// Only admins create a tenant by writing to it
+	//
+	_, err := c.CreateMessage(ctx, "foo")
+	assert.True(t, errors.Is(err, ErrNotFound), "Unexpected error %v", err)
+	_, err = newTestClient(t, server.URL, WithBearerToken("admin-key"), WithTenant("acme")).CreateMessage(ctx, "foo")
+	assert.Nil(t, err, "CreateMessage() failed")
+
+	// Messages of a tenant are kept apart from the default ones
+	//
+	id, err := c.CreateMessage(ctx, "foo")
+	assert.Nil(t, err, "CreateMessage() failed")
+	_, err = c.GetMessage(ctx, id)
+	assert.Nil(t, err, "GetMessage() failed")
+	_, err = newTestClient(t, server.URL, WithBearerToken("alice-key")).GetMessage(ctx, id)
+	assert.True(t, errors.Is(err, ErrNotFound), "Unexpected error %v", err)
+
+	_, err = newTestClient(t, server.URL, WithBearerToken("alice-key"), WithTenant("Bad!")).CreateMessage(ctx, "foo")
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "Unexpected error %v", err)
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	// Fails twice before succeeding
+	//
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"Database unavailable","requestId":"abc"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"payload":"foo"}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	message, err := c.GetMessage(ctx, 1)
+	assert.Nil(t, err, "GetMessage() failed")
+	assert.Equal(t, "foo", message.Payload, "Unexpected message payload")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts), "Unexpected number of attempts")
+
+	// The last error is returned once out of retries
+	//
+	atomic.StoreInt32(&attempts, 0)
+	c = newTestClient(t, server.URL, WithRetries(1, time.Millisecond, 10*time.Millisecond))
+	_, err = c.GetMessage(ctx, 1)
+	assert.True(t, errors.Is(err, ErrUnavailable), "Unexpected error %v", err)
+	var apiErr *Error
+	assert.True(t, errors.As(err, &apiErr), "Unexpected error type")
+	assert.Equal(t, "Database unavailable", apiErr.Message, "Unexpected error message")
+	assert.Equal(t, "abc", apiErr.RequestId, "Unexpected request ID")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts), "Unexpected number of attempts")
+
+	// Waiting between attempts stops with the context
+	//
+	atomic.StoreInt32(&attempts, 0)
+	c = newTestClient(t, server.URL, WithRetries(3, time.Hour, time.Hour))
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = c.GetMessage(ctx, 1)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Unexpected error %v", err)
+}
+
+func TestRetryable(t *testing.T) {
+	unavailable := &Error{StatusCode: http.StatusServiceUnavailable, Message: "Database unavailable"}
+	assert.True(t, retryable(http.MethodPost, &Error{StatusCode: http.StatusTooManyRequests}), "429 not retried")
+	assert.True(t, retryable(http.MethodPost, unavailable), "503 not retried")
+	assert.False(t, retryable(http.MethodPost, &Error{StatusCode: http.StatusServiceUnavailable}), "503 from a proxy retried for POST")
+	assert.False(t, retryable(http.MethodPost, &Error{StatusCode: http.StatusBadGateway}), "502 retried for POST")
+	assert.False(t, retryable(http.MethodPost, &Error{StatusCode: http.StatusGatewayTimeout}), "504 retried for POST")
+	assert.False(t, retryable(http.MethodPost, &Error{StatusCode: http.StatusInternalServerError}), "500 retried for POST")
+	assert.True(t, retryable(http.MethodGet, &Error{StatusCode: http.StatusGatewayTimeout}), "504 not retried for GET")
+	assert.True(t, retryable(http.MethodGet, &Error{StatusCode: http.StatusInternalServerError}), "500 not retried for GET")
+	assert.False(t, retryable(http.MethodGet, &Error{StatusCode: http.StatusNotFound}), "404 retried")
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Compare an *Error against these with errors.Is() to tell what went wrong
+//
+var ErrInvalidRequest = errors.New("Invalid request")
+var ErrUnauthenticated = errors.New("Unauthenticated")
+var ErrForbidden = errors.New("Forbidden")
+var ErrNotFound = errors.New("Not found")
+var ErrConflict = errors.New("Conflict")
+var ErrRateLimited = errors.New("Rate limited")
+var ErrServer = errors.New("Server error")
+var ErrUnavailable = errors.New("Service unavailable")
+
+// Response of the service with a status other than 2xx
+//
+type Error struct {
+	StatusCode int
+	Message    string // What went wrong, as reported by the service
+	Detail     string // Further details, for a request not matching the API
+	RequestId  string // ID to quote when reporting the error
+
+	// How long the service asked to wait before retrying, for a rate limited
+	// request
+	//
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.RequestId != "" {
+		msg += " (request ID " + e.RequestId + ")"
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthenticated:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Builds the *Error of "response", from its payload if it's one of the API's
+// errors or problems. Consumes the payload.
+//
+func newError(response *http.Response) *Error {
+	defer drain(response.Body)
+
+	apiErr := &Error{
+		StatusCode: response.StatusCode,
+		RequestId:  response.Header.Get("X-Request-Id"),
+		RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+
+	var payload struct {
+		Error     string `json:"error"`
+		Title     string `json:"title"`
+		Detail    string `json:"detail"`
+		RequestId string `json:"requestId"`
+	}
+	contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if contentType != "application/json" && contentType != "application/problem+json" {
+		return apiErr
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&payload); err != nil {
+		return apiErr
+	}
+
+	apiErr.Message = payload.Error
+	if apiErr.Message == "" {
+		apiErr.Message = payload.Title
+	}
+	apiErr.Detail = payload.Detail
+	if payload.RequestId != "" {
+		apiErr.RequestId = payload.RequestId
+	}
+	return apiErr
+}
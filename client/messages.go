@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Query params of a listing, left to the service's defaults when zero
+//
+type ListOptions struct {
+	Limit    uint64
+	AfterId  uint64
+	Detailed bool
+	Owner    string // Name of a principal, or "me"
+}
+
+func (opts *ListOptions) query() string {
+	query := url.Values{}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.FormatUint(opts.Limit, 10))
+	}
+	if opts.AfterId != 0 {
+		query.Set("afterId", strconv.FormatUint(opts.AfterId, 10))
+	}
+	if opts.Detailed {
+		query.Set("detailed", "true")
+	}
+	if opts.Owner != "" {
+		query.Set("owner", opts.Owner)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// A page of a listing. Only one of "Messages" and "DetailedMessages" is set,
+// depending on whether the listing is detailed.
+//
+type Page struct {
+	Messages         []*model.Message
+	DetailedMessages []*model.DetailedMessage
+
+	// Relative URL of the next page, empty on the last page
+	//
+	NextRelativeUrl string
+}
+
+// Lists a single page of messages
+//
+func (c *Client) ListMessages(ctx context.Context, opts ListOptions) (*Page, error) {
+	return c.listPage(ctx, c.messagesPath()+opts.query(), opts.Detailed)
+}
+
+func (c *Client) listPage(ctx context.Context, pathAndQuery string, detailed bool) (*Page, error) {
+	page := &Page{}
+
+	var result interface{} = &page.Messages
+	if detailed {
+		result = &page.DetailedMessages
+	}
+
+	response, err := c.do(ctx, http.MethodGet, pathAndQuery, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	page.NextRelativeUrl = response.Header.Get("x-next-relative-url")
+
+	return page, nil
+}
+
+// Iterates over every message of a listing, one page at a time
+//
+type Iterator struct {
+	ctx      context.Context
+	client   *Client
+	detailed bool
+
+	// Relative URL of the page to fetch once the current one is exhausted,
+	// empty once the last one was fetched
+	//
+	next string
+
+	messages         []*model.Message
+	detailedMessages []*model.DetailedMessage
+	index            int
+	err              error
+}
+
+// Returns an iterator over the messages matching "opts", starting after
+// "opts.AfterId" and fetching "opts.Limit" messages at a time. Pages are
+// fetched as the iterator advances.
+//
+//   it := c.Iterate(ctx, client.ListOptions{})
+//   for it.Next() {
+//       fmt.Println(it.Message().Payload)
+//   }
+//   if err := it.Err(); err != nil {
+//       ...
+//   }
+//
+func (c *Client) Iterate(ctx context.Context, opts ListOptions) *Iterator {
+	return &Iterator{
+		ctx:      ctx,
+		client:   c,
+		detailed: opts.Detailed,
+		next:     c.messagesPath() + opts.query(),
+		index:    -1,
+	}
+}
+
+// Advances to the next message, fetching the next page if needed. Returns
+// false once there are no more messages or an error occurred.
+//
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.index++
+	for it.index >= it.len() {
+		if it.next == "" {
+			return false
+		}
+
+		page, err := it.client.listPage(it.ctx, it.next, it.detailed)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.messages = page.Messages
+		it.detailedMessages = page.DetailedMessages
+		it.next = page.NextRelativeUrl
+		it.index = 0
+	}
+
+	return true
+}
+
+func (it *Iterator) len() int {
+	if it.detailed {
+		return len(it.detailedMessages)
+	}
+	return len(it.messages)
+}
+
+// Current message, of a listing that isn't detailed
+//
+func (it *Iterator) Message() *model.Message {
+	if it.detailed {
+		return it.detailedMessages[it.index].Message
+	}
+	return it.messages[it.index]
+}
+
+// Current message, of a detailed listing
+//
+func (it *Iterator) DetailedMessage() *model.DetailedMessage {
+	return it.detailedMessages[it.index]
+}
+
+// Error that stopped the iteration, if any
+//
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Creates a message and returns its ID
+//
+func (c *Client) CreateMessage(ctx context.Context, payload string) (uint64, error) {
+	response, err := c.do(ctx, http.MethodPost, c.messagesPath(), &model.Message{Payload: payload}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// The ID is the last segment of the URL of the message
+	//
+	location := response.Header.Get("Location")
+	id, err := strconv.ParseUint(path.Base(location), 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid \"Location\" header: " + location)
+	}
+	return id, nil
+}
+
+func (c *Client) messagePath(id uint64) string {
+	return c.messagesPath() + "/" + strconv.FormatUint(id, 10)
+}
+
+func (c *Client) GetMessage(ctx context.Context, id uint64) (*model.Message, error) {
+	message := &model.Message{}
+	if _, err := c.do(ctx, http.MethodGet, c.messagePath(id), nil, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *Client) GetDetailedMessage(ctx context.Context, id uint64) (*model.DetailedMessage, error) {
+	detailedMessage := &model.DetailedMessage{}
+	if _, err := c.do(ctx, http.MethodGet, c.messagePath(id)+"?detailed=true", nil, detailedMessage); err != nil {
+		return nil, err
+	}
+	return detailedMessage, nil
+}
+
+// Replaces the payload of a message
+//
+func (c *Client) UpdateMessage(ctx context.Context, id uint64, payload string) error {
+	_, err := c.do(ctx, http.MethodPut, c.messagePath(id), &model.Message{Payload: payload}, nil)
+	return err
+}
+
+func (c *Client) DeleteMessage(ctx context.Context, id uint64) error {
+	_, err := c.do(ctx, http.MethodDelete, c.messagePath(id), nil, nil)
+	return err
+}
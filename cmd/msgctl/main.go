@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/brandonto/rest-api-microservice-demo/msgctl"
+)
+
+func main() {
+	// Interrupting stops "tail", and cancels whatever request is in flight
+	// for the other commands
+	//
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := msgctl.Run(ctx, "msgctl", os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv)
+	stop()
+	os.Exit(code)
+}
@@ -0,0 +1,372 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Subcommands of the binary. Every one of them but "serve" works on the
+// database file directly, and so can't run while the service is using it.
+//
+const CommandServe = "serve"
+const CommandInspect = "inspect"
+const CommandDump = "dump"
+const CommandExport = "export"
+const CommandImport = "import"
+const CommandCompact = "compact"
+const CommandVerify = "verify"
+const CommandClear = "clear"
+const CommandRestore = "restore"
+
+// Passed in place of a file to export to stdout, or import from stdin
+//
+const StdioFileName = "-"
+
+var ErrAborted = errors.New("Aborted")
+
+// Subcommand to run, as parsed from the command line by ParseCommand
+//
+type Command struct {
+	Name string
+	Args []string // Positional arguments
+
+	Tenant string // Tenant the command is scoped to, none if empty
+	Ids    string // Whether "import" preserves or reassigns IDs
+	DryRun bool   // Whether "import" only reports what it would do
+	Yes    bool   // Whether "clear" skips asking for confirmation
+}
+
+type commandSpec struct {
+	args     []string // Names of the positional arguments
+	flags    func(flagSet *flag.FlagSet, command *Command)
+	readOnly bool // Whether the database file is opened read-only, as is
+}
+
+func tenantFlag(flagSet *flag.FlagSet, command *Command) {
+	flagSet.StringVar(&command.Tenant, "tenant", "", "")
+}
+
+var commandSpecs = map[string]*commandSpec{
+	CommandServe:   {},
+	CommandInspect: {readOnly: true},
+	CommandDump:    {args: []string{"id"}, flags: tenantFlag, readOnly: true},
+	CommandExport:  {args: []string{"file"}, flags: tenantFlag, readOnly: true},
+	CommandImport: {args: []string{"file"}, flags: func(flagSet *flag.FlagSet, command *Command) {
+		tenantFlag(flagSet, command)
+		flagSet.StringVar(&command.Ids, "ids", api.ImportMessagesIdsQueryParamDefault, "")
+		flagSet.BoolVar(&command.DryRun, "dry-run", false, "")
+	}},
+	CommandCompact: {},
+	CommandVerify:  {readOnly: true},
+	CommandClear: {flags: func(flagSet *flag.FlagSet, command *Command) {
+		tenantFlag(flagSet, command)
+		flagSet.BoolVar(&command.Yes, "yes", false, "")
+	}},
+	CommandRestore: {args: []string{"snapshot"}},
+}
+
+// Writes the synopsis of every subcommand to "w"
+//
+func printCommandUsage(w io.Writer, name string) {
+	fmt.Fprintf(w, "usage: %s [serve] [flags]\n", name)
+	fmt.Fprintf(w, "       %s inspect [flags]\n", name)
+	fmt.Fprintf(w, "       %s dump [--tenant name] <id> [flags]\n", name)
+	fmt.Fprintf(w, "       %s export [--tenant name] <file|-> [flags]\n", name)
+	fmt.Fprintf(w, "       %s import [--tenant name] [--ids preserve|reassign] [--dry-run] <file|-> [flags]\n", name)
+	fmt.Fprintf(w, "       %s compact [flags]\n", name)
+	fmt.Fprintf(w, "       %s verify [flags]\n", name)
+	fmt.Fprintf(w, "       %s clear [--tenant name] [--yes] [flags]\n", name)
+	fmt.Fprintf(w, "       %s restore <snapshot> [flags]\n\n", name)
+}
+
+// Parses the subcommand at the start of "args", along with its own flags and
+// positional arguments, which come before any other flag. Returns the
+// remaining arguments, to be passed to LoadConfig(). Without a subcommand, the
+// service is served.
+//
+func ParseCommand(args []string) (*Command, []string, error) {
+	command := &Command{Name: CommandServe}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return command, args, nil
+	}
+
+	command.Name = args[0]
+	spec, ok := commandSpecs[command.Name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", command.Name)
+	}
+	args = args[1:]
+
+	if spec.flags != nil {
+		flagSet := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+		spec.flags(flagSet, command)
+
+		var err error
+		if args, err = parseLeadingFlags(flagSet, args); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", command.Name, err)
+		}
+	}
+
+	for _, argName := range spec.args {
+		if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != StdioFileName) {
+			return nil, nil, fmt.Errorf("%s requires the %s argument", command.Name, argName)
+		}
+		command.Args = append(command.Args, args[0])
+		args = args[1:]
+	}
+
+	if command.Name == CommandImport && command.Ids != api.ImportMessagesIdsQueryParamPreserve && command.Ids != api.ImportMessagesIdsQueryParamReassign {
+		return nil, nil, fmt.Errorf("import: invalid value %q for --ids", command.Ids)
+	}
+	if command.Tenant != "" && !db.ValidTenantName(command.Tenant) {
+		return nil, nil, fmt.Errorf("%s: invalid tenant name %q", command.Name, command.Tenant)
+	}
+
+	return command, args, nil
+}
+
+// Sets the flags at the start of "args" that are defined by "flagSet", leaving
+// any other flag to whoever parses the remaining arguments
+//
+func parseLeadingFlags(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != StdioFileName {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+		f := flagSet.Lookup(name)
+		if f == nil {
+			break
+		}
+		args = args[1:]
+
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && ok && boolFlag.IsBoolFlag() {
+			value = "true"
+		} else if !hasValue {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("flag needs an argument: --%s", name)
+			}
+			value, args = args[0], args[1:]
+		}
+
+		if err := flagSet.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for --%s: %w", value, name, err)
+		}
+	}
+
+	return args, nil
+}
+
+// Runs subcommand "command" against the database configured in "coreCfg",
+// reading from "stdin" and writing to "stdout". Not meant for "serve", which
+// is what Run() does.
+//
+func RunCommand(coreCfg Config, command *Command, stdin io.Reader, stdout io.Writer) error {
+	if command.Name == CommandRestore {
+		return Restore(coreCfg, command.Args[0])
+	}
+
+	// Commands that only read the database report on the file as it is, rather
+	// than on what initializing it would make of it, e.g. by creating missing
+	// buckets or repairing corrupt records
+	//
+	svcDb := db.NewDb(coreCfg.DbCfg)
+	initialize := svcDb.Initialize
+	if spec, ok := commandSpecs[command.Name]; ok && spec.readOnly {
+		initialize = svcDb.InitializeReadOnly
+	}
+	if err := initialize(); err != nil {
+		return err
+	}
+	defer svcDb.Close()
+
+	bucketName := coreCfg.DbCfg.BucketName
+	if command.Tenant != "" {
+		svcDb = svcDb.ForTenant(command.Tenant)
+		bucketName = "tenant " + command.Tenant
+	}
+
+	switch command.Name {
+	case CommandInspect:
+		return inspect(svcDb, stdout)
+	case CommandDump:
+		id, err := strconv.ParseUint(command.Args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message ID %q", command.Args[0])
+		}
+		return dump(svcDb, id, stdout)
+	case CommandExport:
+		return exportMessages(svcDb, command.Args[0], stdout)
+	case CommandImport:
+		options := db.ImportOptions{PreserveIds: command.Ids == api.ImportMessagesIdsQueryParamPreserve, DryRun: command.DryRun}
+		return importMessages(svcDb, command.Args[0], options, stdin, stdout)
+	case CommandCompact:
+		before, after, err := svcDb.Compact()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Compacted %s from %d to %d bytes\n", coreCfg.DbCfg.FilePath, before, after)
+		return nil
+	case CommandVerify:
+		return verify(svcDb, stdout)
+	case CommandClear:
+		return clear(svcDb, bucketName, command.Yes, stdin, stdout)
+	}
+
+	return fmt.Errorf("unknown command %q", command.Name)
+}
+
+func inspect(svcDb *db.Db, stdout io.Writer) error {
+	stats, err := svcDb.Stats()
+	if err != nil {
+		return err
+	}
+
+	buckets, err := svcDb.Inspect()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "File: %s (%d bytes, %d free pages)\n\n", svcDb.FilePath, stats.FileSizeBytes, stats.FreePageN)
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUCKET\tKEYS\tSEQUENCE\tDEPTH\tPAGES\tIN USE (BYTES)")
+	for _, bucket := range buckets {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", bucket.Name, bucket.Keys, bucket.Sequence, bucket.Depth, bucket.Pages, bucket.InuseBytes)
+	}
+
+	return tw.Flush()
+}
+
+// Prints the message with ID "id" as stored, indented if it's valid JSON
+//
+func dump(svcDb *db.Db, id uint64, stdout io.Writer) error {
+	buf, err := svcDb.GetRawMessage(id)
+	if err != nil {
+		return err
+	}
+
+	indented := &bytes.Buffer{}
+	if err = json.Indent(indented, buf, "", "    "); err != nil {
+		fmt.Fprintf(stdout, "%s\n", buf)
+		return fmt.Errorf("message %d isn't valid JSON: %w", id, err)
+	}
+
+	fmt.Fprintln(stdout, indented.String())
+	return nil
+}
+
+// Exports every message to "fileName", in the NDJSON format served by
+// GET /messages:export
+//
+func exportMessages(svcDb *db.Db, fileName string, stdout io.Writer) error {
+	w := stdout
+	if fileName != StdioFileName {
+		file, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	bufWriter := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bufWriter)
+	count := 0
+	err := svcDb.ForEachMessage(nil, func(detailedMessage *model.DetailedMessage) error {
+		count += 1
+		return encoder.Encode(detailedMessage)
+	})
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	if fileName != StdioFileName {
+		fmt.Fprintf(stdout, "Exported %d messages to %s\n", count, fileName)
+	}
+	return nil
+}
+
+// Imports the messages in "fileName", in the NDJSON format accepted by
+// POST /messages:import. Prints the import report.
+//
+func importMessages(svcDb *db.Db, fileName string, options db.ImportOptions, stdin io.Reader, stdout io.Writer) error {
+	r := stdin
+	if fileName != StdioFileName {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	// Messages without an owner are owned by the principal the service runs
+	// as when authentication is disabled
+	//
+	report, err := api.ImportNDJSON(svcDb, r, options, api.AnonymousPrincipalName)
+	if err != nil {
+		return fmt.Errorf("imported %d messages before failing: %w", report.Imported, err)
+	}
+
+	buf, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, string(buf))
+
+	return nil
+}
+
+func verify(svcDb *db.Db, stdout io.Writer) error {
+	report, err := svcDb.Verify()
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	fmt.Fprintf(stdout, "Checked %d records, found %d problems\n", report.Records, len(report.Problems))
+
+	if len(report.Problems) != 0 {
+		return errors.New("database verification failed")
+	}
+	return nil
+}
+
+// Deletes every message of "bucketName", once confirmed on "stdin" unless
+// "yes" is set
+//
+func clear(svcDb *db.Db, bucketName string, yes bool, stdin io.Reader, stdout io.Writer) error {
+	if !yes {
+		fmt.Fprintf(stdout, "Delete every message in %s? [y/N] ", bucketName)
+		answer, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return ErrAborted
+		}
+	}
+
+	if err := svcDb.ClearMessages(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Deleted every message in %s\n", bucketName)
+	return nil
+}
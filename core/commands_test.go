@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestParseCommand(t *testing.T) {
+	command, args, err := ParseCommand([]string{"--db-path", "x.db"})
+	assert.Nil(t, err, "ParseCommand() failed")
+	assert.Equal(t, CommandServe, command.Name, "Unexpected command")
+	assert.Equal(t, []string{"--db-path", "x.db"}, args, "Unexpected remaining args")
+
+	// The command's own flags and arguments come first, the rest is left for
+	// LoadConfig()
+	//
+	command, args, err = ParseCommand([]string{"import", "--tenant", "red", "--ids=preserve", "--dry-run", "-", "--db-path", "x.db"})
+	assert.Nil(t, err, "ParseCommand() failed")
+	assert.Equal(t, &Command{Name: CommandImport, Args: []string{"-"}, Tenant: "red", Ids: "preserve", DryRun: true}, command, "Unexpected command")
+	assert.Equal(t, []string{"--db-path", "x.db"}, args, "Unexpected remaining args")
+
+	_, _, err = ParseCommand([]string{"dump", "--db-path", "x.db"})
+	assert.NotNil(t, err, "dump without an ID should be rejected")
+	_, _, err = ParseCommand([]string{"import", "--ids", "keep", "in.ndjson"})
+	assert.NotNil(t, err, "Invalid --ids should be rejected")
+	_, _, err = ParseCommand([]string{"clear", "--tenant", "Red!"})
+	assert.NotNil(t, err, "Invalid tenant name should be rejected")
+	_, _, err = ParseCommand([]string{"frobnicate"})
+	assert.NotNil(t, err, "Unknown command should be rejected")
+}
+
+func TestRunCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DbCfg.FilePath = filepath.Join(t.TempDir(), "commands.db")
+
+	svcDb := db.NewDb(cfg.DbCfg)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	message := &model.Message{Payload: "foo"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	assert.Nil(t, svcDb.CreateMessage(&model.DetailedMessage{Message: message, Metadata: metadata, Owner: "alice"}), "CreateMessage() failed")
+	svcDb.Close()
+
+	run := func(stdin string, args ...string) (string, error) {
+		command, _, err := ParseCommand(args)
+		assert.Nil(t, err, "ParseCommand() failed")
+
+		stdout := &bytes.Buffer{}
+		err = RunCommand(cfg, command, strings.NewReader(stdin), stdout)
+		return stdout.String(), err
+	}
+
+	stdout, err := run("", "inspect")
+	assert.Nil(t, err, "inspect failed")
+	assert.Regexp(t, `DetailedMessageBucket +1 +1 `, stdout, "Unexpected inspect output")
+
+	stdout, err = run("", "dump", "1")
+	assert.Nil(t, err, "dump failed")
+	assert.Contains(t, stdout, `"owner": "alice"`, "Unexpected dump output")
+	_, err = run("", "dump", "2")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	// Messages exported from the default bucket can be imported into a tenant
+	//
+	exportFile := filepath.Join(t.TempDir(), "messages.ndjson")
+	_, err = run("", "export", exportFile)
+	assert.Nil(t, err, "export failed")
+	exported, err := os.ReadFile(exportFile)
+	assert.Nil(t, err, "Unable to read export")
+
+	stdout, err = run(string(exported), "import", "--tenant", "red", "--ids", "preserve", "-")
+	assert.Nil(t, err, "import failed")
+	assert.Contains(t, stdout, `"imported": 1`, "Unexpected import output")
+	stdout, err = run("", "dump", "--tenant", "red", "1")
+	assert.Nil(t, err, "dump failed")
+	assert.Contains(t, stdout, `"payload": "foo"`, "Unexpected dump output")
+
+	_, err = run("", "compact")
+	assert.Nil(t, err, "compact failed")
+	stdout, err = run("", "verify")
+	assert.Nil(t, err, "verify failed")
+	assert.Contains(t, stdout, "found 0 problems", "Unexpected verify output")
+
+	// Clearing a bucket has to be confirmed
+	//
+	_, err = run("n\n", "clear")
+	assert.ErrorIs(t, err, ErrAborted)
+	_, err = run("y\n", "clear")
+	assert.Nil(t, err, "clear failed")
+	_, err = run("", "dump", "1")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	_, err = run("", "dump", "--tenant", "red", "1")
+	assert.Nil(t, err, "Other buckets should have been left alone")
+}
+
+func TestVerifyCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DbCfg.FilePath = filepath.Join(t.TempDir(), "verify.db")
+	cfg.DbCfg.RepairMode = true
+
+	svcDb := db.NewDb(cfg.DbCfg)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	message := &model.Message{Payload: "foo"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	assert.Nil(t, svcDb.ForTenant("red").CreateMessage(&model.DetailedMessage{Message: message, Metadata: metadata, Owner: "alice"}), "CreateMessage() failed")
+	svcDb.Close()
+
+	// Lose the default bucket and corrupt a message behind the database's back
+	//
+	boltDb, err := bolt.Open(cfg.DbCfg.FilePath, 0600, nil)
+	assert.Nil(t, err, "Unable to open database file")
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(cfg.DbCfg.BucketName)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("_tenant/red")).Put([]byte{0, 0, 0, 0, 0, 0, 0, 1}, []byte("{"))
+	})
+	assert.Nil(t, err, "Unable to tamper with database file")
+	assert.Nil(t, boltDb.Close(), "Unable to close database file")
+
+	// Both are reported rather than fixed, even in repair mode
+	//
+	for i := 0; i < 2; i++ {
+		command, _, err := ParseCommand([]string{"verify"})
+		assert.Nil(t, err, "ParseCommand() failed")
+
+		stdout := &bytes.Buffer{}
+		err = RunCommand(cfg, command, strings.NewReader(""), stdout)
+		assert.NotNil(t, err, "verify should have failed")
+		assert.Contains(t, stdout.String(), `bucket "DetailedMessageBucket" is missing`, "Unexpected verify output")
+		assert.Contains(t, stdout.String(), `bucket "_tenant/red", key 1`, "Unexpected verify output")
+	}
+}
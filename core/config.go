@@ -0,0 +1,342 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+	"github.com/brandonto/rest-api-microservice-demo/tracing"
+	"github.com/brandonto/rest-api-microservice-demo/webhook"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables overriding a setting are named after its flag, e.g.
+// "--listen-addr" is overridden by "RDEMO_LISTEN_ADDR"
+//
+const EnvVarPrefix = "RDEMO_"
+
+const DefaultListenAddr = "localhost:55555"
+const DefaultDbBucketName = "DetailedMessageBucket"
+const DefaultDbBackupRetain = 7
+const DefaultDbChangeLogInterval = time.Hour
+
+// Returns the configuration used when nothing is overridden
+//
+func DefaultConfig() Config {
+	cfg := Config{
+		ListenAddr:   DefaultListenAddr,
+		EnableLogger: true,
+		Standalone:   true,
+		SwaggerUI:    true,
+	}
+	cfg.DbCfg.BucketName = DefaultDbBucketName
+	cfg.DbCfg.Backup.Retain = DefaultDbBackupRetain
+	cfg.DbCfg.ChangeLog.Interval = DefaultDbChangeLogInterval
+	cfg.RateLimit.KeyBy = api.RateLimitKeyPrincipal
+	cfg.OpenApiValidation = api.OpenApiValidationRequests
+	cfg.EventsHeartbeatInterval = api.DefaultEventsHeartbeatInterval
+	cfg.WebSocketPingInterval = api.DefaultWebSocketPingInterval
+	cfg.TLS.ReloadInterval = DefaultTLSReloadInterval
+	cfg.Log.Level = logging.DefaultLevel
+	cfg.Log.Format = logging.DefaultFormat
+	cfg.Tracing.Exporter = tracing.ExporterNone
+	cfg.Tracing.SampleRatio = 1
+	cfg.Tracing.ServiceName = tracing.DefaultServiceName
+	cfg.Webhooks.MaxAttempts = webhook.DefaultMaxAttempts
+	cfg.Webhooks.InitialBackoff = webhook.DefaultInitialBackoff
+	cfg.Webhooks.MaxBackoff = webhook.DefaultMaxBackoff
+	cfg.Webhooks.Timeout = webhook.DefaultTimeout
+	cfg.Webhooks.Concurrency = webhook.DefaultConcurrency
+
+	return cfg
+}
+
+// Registers a flag on "flagSet" for every setting of "cfg". The current value
+// of each setting is used as the flag's default value so that registering the
+// flags leaves "cfg" untouched.
+//
+func bindFlags(flagSet *flag.FlagSet, cfg *Config) {
+	flagSet.StringVar(&cfg.ListenAddr, "listen-addr", cfg.ListenAddr, "`host:port` to listen on")
+	flagSet.StringVar(&cfg.GrpcListenAddr, "grpc-listen-addr", cfg.GrpcListenAddr, "`host:port` to serve the gRPC API on, disabled if empty")
+	flagSet.BoolVar(&cfg.EnableLogger, "enable-logger", cfg.EnableLogger, "log every HTTP request and gRPC call")
+	flagSet.BoolVar(&cfg.SwaggerUI, "swagger-ui", cfg.SwaggerUI, "serve the Swagger UI under /swagger")
+	flagSet.StringVar(&cfg.OpenApiValidation, "openapi-validation", cfg.OpenApiValidation, "what is validated against the OpenAPI document: `off|requests|strict`")
+	flagSet.DurationVar(&cfg.EventsHeartbeatInterval, "events-heartbeat-interval", cfg.EventsHeartbeatInterval, "how often idle event streams are sent a heartbeat")
+	flagSet.DurationVar(&cfg.WebSocketPingInterval, "websocket-ping-interval", cfg.WebSocketPingInterval, "how often idle WebSockets are pinged, clients not answering within two intervals are disconnected")
+	flagSet.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "minimum `level` logged: debug, info, warn or error")
+	flagSet.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log `format`: json or text")
+	flagSet.StringVar(&cfg.ApiKeysFile, "api-keys-file", cfg.ApiKeysFile, "`path` of the API keys file, authentication is disabled if empty")
+
+	flagSet.StringVar(&cfg.DbCfg.FilePath, "db-path", cfg.DbCfg.FilePath, "`path` of the database file (required)")
+	flagSet.StringVar(&cfg.DbCfg.BucketName, "db-bucket", cfg.DbCfg.BucketName, "`name` of the database bucket holding messages")
+	flagSet.Uint64Var(&cfg.DbCfg.DefaultTenantMaxMessages, "db-default-tenant-max-messages", cfg.DbCfg.DefaultTenantMaxMessages, "message quota of lazily created tenants, 0 for unlimited")
+	flagSet.Uint64Var(&cfg.DbCfg.Quota.MaxMessages, "db-quota-max-messages", cfg.DbCfg.Quota.MaxMessages, "messages each principal may store, 0 for unlimited")
+	flagSet.Uint64Var(&cfg.DbCfg.Quota.MaxPayloadBytes, "db-quota-max-payload-bytes", cfg.DbCfg.Quota.MaxPayloadBytes, "payload bytes each principal may store, 0 for unlimited")
+	flagSet.BoolVar(&cfg.DbCfg.RepairMode, "db-repair-mode", cfg.DbCfg.RepairMode, "recreate missing buckets and quarantine corrupt records rather than failing")
+	flagSet.StringVar(&cfg.DbCfg.Backup.Dir, "db-backup-dir", cfg.DbCfg.Backup.Dir, "`path` of the directory scheduled backups are written to")
+	flagSet.DurationVar(&cfg.DbCfg.Backup.Interval, "db-backup-interval", cfg.DbCfg.Backup.Interval, "how often the database is backed up, 0 to disable scheduled backups")
+	flagSet.IntVar(&cfg.DbCfg.Backup.Retain, "db-backup-retain", cfg.DbCfg.Backup.Retain, "scheduled backups kept, 0 to keep them all")
+	flagSet.DurationVar(&cfg.DbCfg.ChangeLog.Retention, "db-change-log-retention", cfg.DbCfg.ChangeLog.Retention, "age past which changes are removed from the change log, 0 to keep them forever")
+	flagSet.Uint64Var(&cfg.DbCfg.ChangeLog.MaxChanges, "db-change-log-max-changes", cfg.DbCfg.ChangeLog.MaxChanges, "most recent changes kept in the change log, 0 to keep them all")
+	flagSet.BoolVar(&cfg.DbCfg.ChangeLog.Compact, "db-change-log-compact", cfg.DbCfg.ChangeLog.Compact, "only keep the last change of every message in the change log")
+	flagSet.DurationVar(&cfg.DbCfg.ChangeLog.Interval, "db-change-log-interval", cfg.DbCfg.ChangeLog.Interval, "how often the change log retention and compaction are applied")
+
+	flagSet.StringVar(&cfg.TLS.CertFile, "tls-cert-file", cfg.TLS.CertFile, "`path` of the PEM encoded server certificate, TLS is disabled if empty")
+	flagSet.StringVar(&cfg.TLS.KeyFile, "tls-key-file", cfg.TLS.KeyFile, "`path` of the PEM encoded server private key")
+	flagSet.StringVar(&cfg.TLS.ClientCAFile, "tls-client-ca-file", cfg.TLS.ClientCAFile, "`path` of the PEM encoded CA bundle client certificates are verified against")
+	flagSet.BoolVar(&cfg.TLS.RequireClientCert, "tls-require-client-cert", cfg.TLS.RequireClientCert, "reject clients without a verified certificate")
+	flagSet.DurationVar(&cfg.TLS.ReloadInterval, "tls-reload-interval", cfg.TLS.ReloadInterval, "how often the certificate files are checked for changes")
+
+	flagSet.StringVar(&cfg.Tracing.Exporter, "tracing-exporter", cfg.Tracing.Exporter, "where spans are exported: `none|stdout|file|otlp`")
+	flagSet.StringVar(&cfg.Tracing.FilePath, "tracing-file-path", cfg.Tracing.FilePath, "`path` of the file spans are appended to by the file exporter")
+	flagSet.StringVar(&cfg.Tracing.OtlpEndpoint, "tracing-otlp-endpoint", cfg.Tracing.OtlpEndpoint, "`host:port` of the OTLP/HTTP collector")
+	flagSet.BoolVar(&cfg.Tracing.OtlpInsecure, "tracing-otlp-insecure", cfg.Tracing.OtlpInsecure, "export to the OTLP collector over plain HTTP")
+	flagSet.Float64Var(&cfg.Tracing.SampleRatio, "tracing-sample-ratio", cfg.Tracing.SampleRatio, "fraction of traces started by this service that are sampled")
+	flagSet.StringVar(&cfg.Tracing.ServiceName, "tracing-service-name", cfg.Tracing.ServiceName, "service name spans are reported under")
+
+	flagSet.Uint64Var(&cfg.Webhooks.MaxAttempts, "webhooks-max-attempts", cfg.Webhooks.MaxAttempts, "attempts at a webhook delivery before it's dead lettered")
+	flagSet.DurationVar(&cfg.Webhooks.InitialBackoff, "webhooks-initial-backoff", cfg.Webhooks.InitialBackoff, "wait before retrying a failed webhook delivery, doubled every attempt")
+	flagSet.DurationVar(&cfg.Webhooks.MaxBackoff, "webhooks-max-backoff", cfg.Webhooks.MaxBackoff, "longest wait before retrying a failed webhook delivery")
+	flagSet.DurationVar(&cfg.Webhooks.Timeout, "webhooks-timeout", cfg.Webhooks.Timeout, "time allowed for every webhook delivery attempt")
+	flagSet.IntVar(&cfg.Webhooks.Concurrency, "webhooks-concurrency", cfg.Webhooks.Concurrency, "webhooks delivered to at the same time")
+
+	flagSet.StringVar(&cfg.RateLimit.KeyBy, "rate-limit-key-by", cfg.RateLimit.KeyBy, "group rate limited requests by `principal|tenant|ip`")
+	flagSet.Float64Var(&cfg.RateLimit.ReadRate, "rate-limit-read-rate", cfg.RateLimit.ReadRate, "reads per second allowed, 0 for unlimited")
+	flagSet.Uint64Var(&cfg.RateLimit.ReadBurst, "rate-limit-read-burst", cfg.RateLimit.ReadBurst, "reads allowed in a burst")
+	flagSet.Float64Var(&cfg.RateLimit.WriteRate, "rate-limit-write-rate", cfg.RateLimit.WriteRate, "writes per second allowed, 0 for unlimited")
+	flagSet.Uint64Var(&cfg.RateLimit.WriteBurst, "rate-limit-write-burst", cfg.RateLimit.WriteBurst, "writes allowed in a burst")
+}
+
+// Flags accepted on the command line: every setting, plus the ones controlling
+// where the configuration comes from and what to do with it
+//
+func newCommandLine(name string, cfg *Config, configFile *string, printConfig *bool) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagSet.StringVar(configFile, "config", "", "`path` of a YAML config file")
+	flagSet.BoolVar(printConfig, "print-config", false, "print the effective config and exit")
+	bindFlags(flagSet, cfg)
+
+	return flagSet
+}
+
+// Builds the effective configuration from, in increasing order of precedence:
+// the defaults, the YAML config file, "RDEMO_*" environment variables and the
+// command line flags in "args". Returns whether the effective configuration
+// should be printed rather than run. The returned configuration is validated.
+//
+func LoadConfig(args []string, getenv func(string) string) (Config, bool, error) {
+	// First pass over the command line, only to find out what was set. The
+	// values are applied last since flags take precedence over everything.
+	//
+	var configFile string
+	var printConfig bool
+	scratchCfg := DefaultConfig()
+	cliFlags := newCommandLine("", &scratchCfg, &configFile, &printConfig)
+	cliFlags.SetOutput(io.Discard)
+
+	if err := cliFlags.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+	if cliFlags.NArg() != 0 {
+		return Config{}, false, fmt.Errorf("unexpected argument %q", cliFlags.Arg(0))
+	}
+	if configFile == "" {
+		configFile = getenv(EnvVarPrefix + "CONFIG")
+	}
+
+	// Defaults are overlaid by the config file, if any
+	//
+	cfg := DefaultConfig()
+	if configFile != "" {
+		if err := loadConfigFile(configFile, &cfg); err != nil {
+			return Config{}, false, err
+		}
+	}
+
+	// Then by environment variables
+	//
+	settings := flag.NewFlagSet("settings", flag.ContinueOnError)
+	bindFlags(settings, &cfg)
+
+	var err error
+	settings.VisitAll(func(f *flag.Flag) {
+		envVar := EnvVarPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value := getenv(envVar); value != "" && err == nil {
+			if setErr := settings.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, envVar, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	// And finally by the flags that were explicitly set
+	//
+	cliFlags.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) != nil && err == nil {
+			err = settings.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return Config{}, false, err
+	}
+
+	// The API keys themselves are never part of the config so that they don't
+	// end up printed
+	//
+	if cfg.ApiKeysFile != "" {
+		if cfg.ApiKeys, err = api.LoadApiKeys(cfg.ApiKeysFile); err != nil {
+			return Config{}, false, fmt.Errorf("unable to load API keys: %w", err)
+		}
+	}
+
+	return cfg, printConfig, nil
+}
+
+func loadConfigFile(filePath string, cfg *Config) error {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	// Unknown fields are rejected so that typos don't go unnoticed
+	//
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// Checks that "addr" is a "host:port" that can be listened on
+//
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid listen address %q: port must be between 0-65535", addr)
+	}
+
+	return nil
+}
+
+// Checks that the configuration is usable
+//
+func (cfg *Config) Validate() error {
+	err := validateListenAddr(cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if cfg.GrpcListenAddr != "" {
+		if err = validateListenAddr(cfg.GrpcListenAddr); err != nil {
+			return err
+		}
+		if cfg.GrpcListenAddr == cfg.ListenAddr {
+			return errors.New("gRPC API can't be served on the listen address")
+		}
+	}
+
+	if cfg.DbCfg.FilePath == "" {
+		return errors.New("database path is required")
+	}
+	if cfg.DbCfg.BucketName == "" {
+		return errors.New("database bucket name can't be empty")
+	}
+	if strings.HasPrefix(cfg.DbCfg.BucketName, db.ReservedBucketPrefix) {
+		return fmt.Errorf("database bucket name can't start with %q, which is reserved", db.ReservedBucketPrefix)
+	}
+	if cfg.DbCfg.Backup.Interval > 0 && cfg.DbCfg.Backup.Dir == "" {
+		return errors.New("scheduled backups require a backup directory")
+	}
+	if cfg.DbCfg.Backup.Interval < 0 || cfg.DbCfg.Backup.Retain < 0 {
+		return errors.New("backup interval and retention can't be negative")
+	}
+	if cfg.DbCfg.ChangeLog.Interval < 0 || cfg.DbCfg.ChangeLog.Retention < 0 {
+		return errors.New("change log interval and retention can't be negative")
+	}
+
+	switch cfg.RateLimit.KeyBy {
+	case api.RateLimitKeyPrincipal, api.RateLimitKeyTenant, api.RateLimitKeyIp:
+	default:
+		return fmt.Errorf("invalid rate limit key %q", cfg.RateLimit.KeyBy)
+	}
+	if cfg.RateLimit.ReadRate < 0 || cfg.RateLimit.WriteRate < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+
+	switch cfg.OpenApiValidation {
+	case api.OpenApiValidationOff, api.OpenApiValidationRequests, api.OpenApiValidationStrict:
+	default:
+		return fmt.Errorf("invalid OpenAPI validation mode %q", cfg.OpenApiValidation)
+	}
+	if cfg.EventsHeartbeatInterval <= 0 {
+		return errors.New("events heartbeat interval must be positive")
+	}
+	if cfg.WebSocketPingInterval <= 0 {
+		return errors.New("WebSocket ping interval must be positive")
+	}
+
+	if err = cfg.TLS.Validate(); err != nil {
+		return err
+	}
+
+	if err = cfg.Log.Validate(); err != nil {
+		return err
+	}
+
+	if err = cfg.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if err = cfg.Webhooks.Validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the configuration in the same YAML format as the config file
+//
+func (cfg *Config) String() string {
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(buf)
+}
+
+// Outputs usage of the command line flags to "w"
+//
+func PrintUsage(w io.Writer, name string) {
+	var configFile string
+	var printConfig bool
+	cfg := DefaultConfig()
+	flagSet := newCommandLine(name, &cfg, &configFile, &printConfig)
+	flagSet.SetOutput(w)
+
+	printCommandUsage(w, name)
+	fmt.Fprintf(w, "Every flag can also be set in the config file, or with an environment variable\n")
+	fmt.Fprintf(w, "named after it (e.g. --db-path can be set with %sDB_PATH).\n\n", EnvVarPrefix)
+	flagSet.PrintDefaults()
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(strings.Join([]string{
+		"listenAddr: 0.0.0.0:8080",
+		"db:",
+		"  path: /data/from-file.db",
+		"  bucket: FileBucket",
+		"rateLimit:",
+		"  readRate: 10",
+	}, "\n")), 0600)
+	assert.Nil(t, err, "Unable to write config file")
+
+	env := map[string]string{
+		"RDEMO_CONFIG":        configFile,
+		"RDEMO_DB_BUCKET":     "EnvBucket",
+		"RDEMO_DB_PATH":       "/data/from-env.db",
+		"RDEMO_ENABLE_LOGGER": "false",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	cfg, printConfig, err := LoadConfig([]string{"--db-path", "/data/from-flag.db", "--print-config"}, getenv)
+	assert.Nil(t, err, "LoadConfig() failed")
+	assert.True(t, printConfig, "print-config should have been set")
+
+	// Flags take precedence over environment variables, which take precedence
+	// over the config file, which takes precedence over the defaults
+	//
+	assert.Equal(t, "/data/from-flag.db", cfg.DbCfg.FilePath, "Unexpected db path")
+	assert.Equal(t, "EnvBucket", cfg.DbCfg.BucketName, "Unexpected db bucket")
+	assert.Equal(t, "0.0.0.0:8080", cfg.ListenAddr, "Unexpected listen address")
+	assert.Equal(t, float64(10), cfg.RateLimit.ReadRate, "Unexpected read rate")
+	assert.Equal(t, api.RateLimitKeyPrincipal, cfg.RateLimit.KeyBy, "Unexpected rate limit key")
+	assert.False(t, cfg.EnableLogger, "Logger should have been disabled")
+	assert.True(t, cfg.Standalone, "Standalone should be the default")
+
+	// The printed config can be read back in as a config file
+	//
+	printedConfigFile := filepath.Join(t.TempDir(), "printed.yaml")
+	assert.Nil(t, os.WriteFile(printedConfigFile, []byte(cfg.String()), 0600), "Unable to write config file")
+	reloadedCfg, _, err := LoadConfig([]string{"--config", printedConfigFile}, func(string) string { return "" })
+	assert.Nil(t, err, "LoadConfig() failed")
+	assert.Equal(t, cfg, reloadedCfg, "Unexpected reloaded config")
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	_, _, err := LoadConfig([]string{}, noEnv)
+	assert.NotNil(t, err, "Missing db path should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--listen-addr", "localhost"}, noEnv)
+	assert.NotNil(t, err, "Missing port should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--listen-addr", ":99999"}, noEnv)
+	assert.NotNil(t, err, "Out of range port should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--grpc-listen-addr", "localhost"}, noEnv)
+	assert.NotNil(t, err, "Missing gRPC port should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--grpc-listen-addr", DefaultListenAddr}, noEnv)
+	assert.NotNil(t, err, "gRPC API on the listen address should be rejected")
+
+	for _, bucket := range []string{"_tenants", "_tenant/red", "_changes", "_audit", "_usage", "_outbox"} {
+		_, _, err = LoadConfig([]string{"--db-path", "x.db", "--db-bucket", bucket}, noEnv)
+		assert.NotNil(t, err, "Reserved bucket name %s should be rejected", bucket)
+	}
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--rate-limit-key-by", "moon"}, noEnv)
+	assert.NotNil(t, err, "Unknown rate limit key should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--openapi-validation", "lax"}, noEnv)
+	assert.NotNil(t, err, "Unknown OpenAPI validation mode should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--log-level", "loud"}, noEnv)
+	assert.NotNil(t, err, "Unknown log level should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--log-format", "xml"}, noEnv)
+	assert.NotNil(t, err, "Unknown log format should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--db-backup-interval", "1h"}, noEnv)
+	assert.NotNil(t, err, "Scheduled backups without a directory should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--webhooks-max-backoff", "1ms"}, noEnv)
+	assert.NotNil(t, err, "Webhook maximum backoff below the initial backoff should be rejected")
+
+	_, _, err = LoadConfig([]string{"x.db"}, noEnv)
+	assert.NotNil(t, err, "Positional arguments should be rejected")
+
+	_, _, err = LoadConfig([]string{"--db-path", "x.db"}, func(key string) string {
+		if key == "RDEMO_DB_QUOTA_MAX_MESSAGES" {
+			return "lots"
+		}
+		return ""
+	})
+	assert.NotNil(t, err, "Invalid environment variable should be rejected")
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte("listenAdr: :8080\n"), 0600), "Unable to write config file")
+	_, _, err = LoadConfig([]string{"--db-path", "x.db", "--config", configFile}, noEnv)
+	assert.NotNil(t, err, "Unknown config file field should be rejected")
+
+	cfg, _, err := LoadConfig([]string{"--db-path", "x.db", "--listen-addr", "0.0.0.0:8080"}, noEnv)
+	assert.Nil(t, err, "LoadConfig() failed")
+	assert.Equal(t, "0.0.0.0:8080", cfg.ListenAddr, "Unexpected listen address")
+}
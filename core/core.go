@@ -4,22 +4,48 @@ import (
 	"context"
 	"errors"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/brandonto/rest-api-microservice-demo/api"
 	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/logging"
+	"github.com/brandonto/rest-api-microservice-demo/tracing"
+	"github.com/brandonto/rest-api-microservice-demo/webhook"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type Config struct {
-	DbCfg        db.Config
-	Port         uint64
-	EnableLogger bool
-	Standalone   bool
+	DbCfg        db.Config           `yaml:"db"`
+	ListenAddr   string              `yaml:"listenAddr"`
+	EnableLogger bool                `yaml:"enableLogger"`
+	Standalone   bool                `yaml:"-"`
+	SwaggerUI    bool                `yaml:"swaggerUI"`
+	ApiKeysFile  string              `yaml:"apiKeysFile"`
+	RateLimit    api.RateLimitConfig `yaml:"rateLimit"`
+	TLS          TLSConfig           `yaml:"tls"`
+	Log          logging.Config      `yaml:"log"`
+	Tracing      tracing.Config      `yaml:"tracing"`
+	Webhooks     webhook.Config      `yaml:"webhooks"`
+
+	OpenApiValidation       string        `yaml:"openApiValidation"`
+	EventsHeartbeatInterval time.Duration `yaml:"eventsHeartbeatInterval"`
+	WebSocketPingInterval   time.Duration `yaml:"webSocketPingInterval"`
+
+	// The gRPC API is only served if set
+	//
+	GrpcListenAddr string `yaml:"grpcListenAddr"`
+
+	// Loaded from ApiKeysFile by LoadConfig
+	//
+	ApiKeys map[string]*api.Principal `yaml:"-"`
 }
 
 const ServerShutdownTimeoutInSeconds = 3
@@ -27,6 +53,29 @@ const ServerShutdownTimeoutInSeconds = 3
 func Run(coreCfg Config) {
 	var err error
 
+	// Everything, including the standard library's logger, logs through the
+	// configured structured logger
+	//
+	logger, logLevel, err := logging.New(os.Stderr, coreCfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Spans still buffered when shutting down are flushed on the way out
+	//
+	shutdownTracing, err := tracing.Setup(coreCfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ServerShutdownTimeoutInSeconds*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Unable to flush traces", "error", err)
+		}
+	}()
+
 	// Create and configure Db
 	//
 	svcDb := db.NewDb(coreCfg.DbCfg)
@@ -38,14 +87,73 @@ func Run(coreCfg Config) {
 	}
 	defer svcDb.Close()
 
+	// Back up the database on a schedule if configured
+	//
+	if coreCfg.DbCfg.Backup.Enabled() {
+		scheduler, err := svcDb.ScheduleBackups(coreCfg.DbCfg.Backup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer scheduler.Close()
+	}
+
+	// Apply the change log retention and compaction policies on a schedule if
+	// configured
+	//
+	if coreCfg.DbCfg.ChangeLog.Enabled() {
+		scheduler := svcDb.ScheduleChangeLogPolicies(coreCfg.DbCfg.ChangeLog)
+		defer scheduler.Close()
+	}
+
+	// Deliver changes to webhooks as they're made, picking up from where the
+	// outbox was left off
+	//
+	dispatcher := webhook.Start(svcDb, coreCfg.Webhooks)
+	defer dispatcher.Close()
+
 	// Set up HTTP routes
 	//
-	router := api.NewRouter(svcDb, coreCfg.EnableLogger, coreCfg.Standalone)
+	apiCfg := api.Config{
+		EnableLogger: coreCfg.EnableLogger,
+		SwaggerUI:    coreCfg.SwaggerUI,
+		Logger:       logger,
+		LogLevel:     logLevel,
+		ApiKeys:      coreCfg.ApiKeys,
+		RateLimit:    coreCfg.RateLimit,
+
+		OpenApiValidation:       coreCfg.OpenApiValidation,
+		EventsHeartbeatInterval: coreCfg.EventsHeartbeatInterval,
+		WebSocketPingInterval:   coreCfg.WebSocketPingInterval,
+
+		// Client certificates can only authenticate principals if they are
+		// verified
+		//
+		ClientCertAuth: coreCfg.TLS.ClientCAFile != "",
+	}
+	// Not ready until the server is listening
+	//
+	readiness := api.NewReadiness()
+	apiCfg.Readiness = readiness
+
+	router := api.NewRouter(svcDb, apiCfg)
 
 	// Create and configure the server and start accepting connections
 	//
-	portStr := strconv.FormatUint(coreCfg.Port, 10)
-	server := &http.Server{Addr: "localhost:" + portStr, Handler: router}
+	server := &http.Server{Addr: coreCfg.ListenAddr, Handler: router}
+
+	// Serve over TLS if configured, picking up renewed certificates as they are
+	// written to disk
+	//
+	var reloader *certReloader
+	if coreCfg.TLS.Enabled() {
+		reloader, err = newCertReloader(coreCfg.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reloader.Close()
+
+		server.TLSConfig = reloader.TLSConfig("h2", "http/1.1")
+	}
 
 	// Start server in goroutine so we can attempt to perform a graceful shutdown
 	// when sent a signal. Most commonly SIGTERM and SIGINT when running the
@@ -57,20 +165,63 @@ func Run(coreCfg Config) {
 	// https://dev.to/mokiat/proper-http-shutdown-in-go-3fji
 	// https://medium.com/honestbee-tw-engineer/gracefully-shutdown-in-go-http-server-5f5e6b83da5a
 	//
+	// The listener is opened up front so that the service only reports ready
+	// once connections can actually be accepted.
+	//
+	listener, err := net.Listen("tcp", coreCfg.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
-		err := server.ListenAndServe()
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
 		if !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
 	}()
 
-	sigChan := make(chan os.Signal)
+	// Serve the gRPC API on its own port if configured, over TLS if the REST
+	// API is
+	//
+	var grpcServer *grpc.Server
+	if coreCfg.GrpcListenAddr != "" {
+		var grpcOpts []grpc.ServerOption
+		if reloader != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(reloader.TLSConfig("h2"))))
+		}
+		grpcServer = api.NewGrpcServer(svcDb, apiCfg, grpcOpts...)
+
+		grpcListener, err := net.Listen("tcp", coreCfg.GrpcListenAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	readiness.SetReady()
+
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGUSR1)
 	if coreCfg.Standalone {
 		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 	}
 	<-sigChan
 
+	// Stop advertising readiness before draining connections so that no new
+	// traffic is routed here
+	//
+	readiness.SetShuttingDown()
+
 	// Small timeout to prevent http.ShutDown from hanging indefinitely if any
 	// client can't be gracefully shut down.
 	//
@@ -80,4 +231,29 @@ func Run(coreCfg Config) {
 	if err = server.Shutdown(shutdownCtx); err != nil {
 		log.Fatal(err)
 	}
+
+	// Watch calls end by themselves once shutting down, other calls are given
+	// until the same timeout to complete
+	//
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+
+	// The server doesn't wait for WebSocket connections, which close by
+	// themselves once shutting down, so they're waited for separately before
+	// the database is closed
+	//
+	if err = readiness.WaitForConnections(shutdownCtx); err != nil {
+		log.Fatal(err)
+	}
 }
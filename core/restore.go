@@ -0,0 +1,28 @@
+package core
+
+import (
+	"os"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+)
+
+// Replaces the database configured in "coreCfg" with the snapshot at
+// "snapshotPath", as taken by GET /admin/backup or a scheduled backup. The
+// service must not be running, a running service is restored with
+// POST /admin/restore instead.
+//
+func Restore(coreCfg Config, snapshotPath string) error {
+	snapshot, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	svcDb := db.NewDb(coreCfg.DbCfg)
+	if err = svcDb.Initialize(); err != nil {
+		return err
+	}
+	defer svcDb.Close()
+
+	return svcDb.Restore(snapshot)
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DbCfg.FilePath = filepath.Join(t.TempDir(), "restore.db")
+
+	svcDb := db.NewDb(cfg.DbCfg)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+
+	message := &model.Message{Payload: "foo"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	assert.Nil(t, svcDb.CreateMessage(&model.DetailedMessage{Message: message, Metadata: metadata}), "CreateMessage() failed")
+
+	snapshotPath, err := svcDb.BackupToDir(t.TempDir(), 0)
+	assert.Nil(t, err, "BackupToDir() failed")
+
+	_, err = svcDb.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+
+	svcDb.Close()
+
+	assert.Nil(t, Restore(cfg, snapshotPath), "Restore() failed")
+	assert.NotNil(t, Restore(cfg, filepath.Join(t.TempDir(), "missing.db")), "Restore() should have failed")
+
+	svcDb = db.NewDb(cfg.DbCfg)
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	defer svcDb.Close()
+
+	_, err = svcDb.GetMessage(1)
+	assert.Nil(t, err, "Message should have been restored")
+
+	_, err = os.Stat(snapshotPath)
+	assert.Nil(t, err, "Snapshot should have been left in place")
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const DefaultTLSReloadInterval = 10 * time.Second
+
+// Structure to encapsulate TLS configuration. TLS is enabled if a certificate
+// and key are configured. Client certificates are verified against the CA
+// bundle if one is configured.
+//
+type TLSConfig struct {
+	CertFile          string        `yaml:"certFile"`
+	KeyFile           string        `yaml:"keyFile"`
+	ClientCAFile      string        `yaml:"clientCAFile"`
+	RequireClientCert bool          `yaml:"requireClientCert"`
+	ReloadInterval    time.Duration `yaml:"reloadInterval"`
+}
+
+func (tlsCfg *TLSConfig) Enabled() bool {
+	return tlsCfg.CertFile != "" || tlsCfg.KeyFile != ""
+}
+
+func (tlsCfg *TLSConfig) Validate() error {
+	if !tlsCfg.Enabled() {
+		if tlsCfg.ClientCAFile != "" || tlsCfg.RequireClientCert {
+			return errors.New("client certificate verification requires TLS to be enabled")
+		}
+		return nil
+	}
+
+	if tlsCfg.CertFile == "" || tlsCfg.KeyFile == "" {
+		return errors.New("TLS requires both a certificate and a key")
+	}
+	if tlsCfg.RequireClientCert && tlsCfg.ClientCAFile == "" {
+		return errors.New("requiring client certificates requires a client CA bundle")
+	}
+	if tlsCfg.ReloadInterval < 0 {
+		return errors.New("TLS reload interval can't be negative")
+	}
+
+	return nil
+}
+
+// Keeps the server certificate and client CA bundle up to date with the files
+// on disk so that certificates can be rotated without restarting the server
+//
+type certReloader struct {
+	cfg TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+
+	stop chan struct{}
+}
+
+// Loads the files referred to by "tlsCfg" and starts watching them for changes
+//
+func newCertReloader(tlsCfg TLSConfig) (*certReloader, error) {
+	reloader := &certReloader{cfg: tlsCfg, stop: make(chan struct{})}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	interval := tlsCfg.ReloadInterval
+	if interval == 0 {
+		interval = DefaultTLSReloadInterval
+	}
+	go reloader.watch(interval)
+
+	return reloader, nil
+}
+
+// Reloads every file if the modification time of any of them changed since
+// they were last loaded, whether forward or back, as files copied or restored
+// along with their modification time may well be older. The previous
+// certificate stays in use if the new one can't be loaded, e.g. when the
+// certificate was replaced but the key hasn't been yet.
+//
+func (reloader *certReloader) reload() error {
+	modTimes, err := reloader.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	reloader.mu.RLock()
+	upToDate := reloader.cert != nil && slices.EqualFunc(modTimes, reloader.modTimes, time.Time.Equal)
+	reloader.mu.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.cfg.CertFile, reloader.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if reloader.cfg.ClientCAFile != "" {
+		buf, err := os.ReadFile(reloader.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificates found in %s", reloader.cfg.ClientCAFile)
+		}
+	}
+
+	reloader.mu.Lock()
+	reloader.cert = &cert
+	reloader.clientCAs = clientCAs
+	reloader.modTimes = modTimes
+	reloader.mu.Unlock()
+
+	return nil
+}
+
+func (reloader *certReloader) fileModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, filePath := range []string{reloader.cfg.CertFile, reloader.cfg.KeyFile, reloader.cfg.ClientCAFile} {
+		if filePath == "" {
+			continue
+		}
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	return modTimes, nil
+}
+
+func (reloader *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := reloader.reload(); err != nil {
+				slog.Warn("Unable to reload TLS certificates, keeping the current ones", "error", err)
+			}
+		case <-reloader.stop:
+			return
+		}
+	}
+}
+
+func (reloader *certReloader) Close() {
+	close(reloader.stop)
+}
+
+// Returns the server TLS configuration, negotiating one of "nextProtos" via
+// ALPN. Every handshake picks up the latest certificate and client CA bundle.
+//
+// The configuration returned for a handshake replaces this one entirely, so it
+// has to advertise the protocols itself: servers adding theirs to this one,
+// e.g. "h2", would otherwise end up negotiating none.
+//
+func (reloader *certReloader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			reloader.mu.RLock()
+			defer reloader.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*reloader.cert},
+				ClientCAs:    reloader.clientCAs,
+			}
+
+			switch {
+			case reloader.cfg.RequireClientCert:
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case reloader.clientCAs != nil:
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+
+			return cfg, nil
+		},
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/messagespb"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Issues a certificate for "subject", signed by "issuer" or self-signed if nil
+//
+func newTestCert(t *testing.T, subject pkix.Name, serial int64, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "Unable to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.Nil(t, err, "Unable to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "Unable to parse certificate")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err, "Unable to marshal key")
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, pkix.Name{CommonName: "Test CA"}, 1, nil)
+	server := newTestCert(t, pkix.Name{CommonName: "localhost"}, 2, ca)
+	client := newTestCert(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"admin"}}, 3, ca)
+
+	tlsCfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	assert.Nil(t, os.WriteFile(tlsCfg.CertFile, server.certPEM, 0600), "Unable to write certificate")
+	assert.Nil(t, os.WriteFile(tlsCfg.KeyFile, server.keyPEM, 0600), "Unable to write key")
+	assert.Nil(t, os.WriteFile(tlsCfg.ClientCAFile, ca.certPEM, 0600), "Unable to write CA bundle")
+	assert.Nil(t, tlsCfg.Validate(), "Validate() failed")
+
+	reloader, err := newCertReloader(tlsCfg)
+	assert.Nil(t, err, "newCertReloader() failed")
+	defer reloader.Close()
+
+	svcDb := db.NewDb(db.Config{FilePath: filepath.Join(dir, "tls.db"), BucketName: "TLSTestBucket"})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	defer svcDb.Close()
+
+	ts := httptest.NewUnstartedServer(api.NewRouter(svcDb, api.Config{ClientCertAuth: true}))
+	ts.TLS = reloader.TLSConfig("http/1.1")
+	ts.StartTLS()
+	defer ts.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	assert.Nil(t, err, "Unable to load client certificate")
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: certs,
+			ServerName:   "localhost",
+		}}}
+	}
+
+	// Without a client certificate the request isn't authenticated
+	//
+	response, err := newClient().Get(ts.URL + "/messages")
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "Unexpected HTTP status code")
+	assert.Equal(t, big.NewInt(2), response.TLS.PeerCertificates[0].SerialNumber, "Unexpected server certificate")
+
+	// With one, the certificate subject becomes the principal
+	//
+	response, err = newClient(clientCert).Post(ts.URL+"/messages", "application/json", strings.NewReader(`{"payload":"foo"}`))
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Equal(t, http.StatusCreated, response.StatusCode, "Unexpected HTTP status code")
+
+	var detailedMessage model.DetailedMessage
+	response, err = newClient(clientCert).Get(ts.URL + "/messages/1?detailed=true")
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&detailedMessage), "Error decoding json")
+	response.Body.Close()
+	assert.Equal(t, "alice", detailedMessage.Owner, "Unexpected owner")
+
+	// The organizational unit grants the admin role
+	//
+	response, err = newClient(clientCert).Get(ts.URL + "/admin/tenants")
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Equal(t, http.StatusOK, response.StatusCode, "Unexpected HTTP status code")
+
+	// A renewed server certificate is picked up without a restart
+	//
+	renewed := newTestCert(t, pkix.Name{CommonName: "localhost"}, 4, ca)
+	assert.Nil(t, os.WriteFile(tlsCfg.CertFile, renewed.certPEM, 0600), "Unable to write certificate")
+	assert.Nil(t, os.WriteFile(tlsCfg.KeyFile, renewed.keyPEM, 0600), "Unable to write key")
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(tlsCfg.KeyFile, future, future), "Unable to touch key")
+	assert.Nil(t, reloader.reload(), "reload() failed")
+
+	response, err = newClient(clientCert).Get(ts.URL + "/messages")
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Equal(t, big.NewInt(4), response.TLS.PeerCertificates[0].SerialNumber, "Unexpected server certificate")
+
+	// So is one older than the current one, as when copied along with its
+	// modification time
+	//
+	restored := newTestCert(t, pkix.Name{CommonName: "localhost"}, 5, ca)
+	assert.Nil(t, os.WriteFile(tlsCfg.CertFile, restored.certPEM, 0600), "Unable to write certificate")
+	assert.Nil(t, os.WriteFile(tlsCfg.KeyFile, restored.keyPEM, 0600), "Unable to write key")
+	past := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(tlsCfg.CertFile, past, past), "Unable to touch certificate")
+	assert.Nil(t, os.Chtimes(tlsCfg.KeyFile, past, past), "Unable to touch key")
+	assert.Nil(t, reloader.reload(), "reload() failed")
+
+	response, err = newClient(clientCert).Get(ts.URL + "/messages")
+	assert.Nil(t, err, "Error making HTTP request")
+	assert.Equal(t, big.NewInt(5), response.TLS.PeerCertificates[0].SerialNumber, "Unexpected server certificate")
+}
+
+func TestGrpcTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, pkix.Name{CommonName: "Test CA"}, 1, nil)
+	server := newTestCert(t, pkix.Name{CommonName: "localhost"}, 2, ca)
+	client := newTestCert(t, pkix.Name{CommonName: "alice"}, 3, ca)
+
+	tlsCfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	assert.Nil(t, os.WriteFile(tlsCfg.CertFile, server.certPEM, 0600), "Unable to write certificate")
+	assert.Nil(t, os.WriteFile(tlsCfg.KeyFile, server.keyPEM, 0600), "Unable to write key")
+	assert.Nil(t, os.WriteFile(tlsCfg.ClientCAFile, ca.certPEM, 0600), "Unable to write CA bundle")
+
+	reloader, err := newCertReloader(tlsCfg)
+	assert.Nil(t, err, "newCertReloader() failed")
+	defer reloader.Close()
+
+	svcDb := db.NewDb(db.Config{FilePath: filepath.Join(dir, "tls.db"), BucketName: "TLSTestBucket"})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	defer svcDb.Close()
+
+	grpcServer := api.NewGrpcServer(svcDb, api.Config{ClientCertAuth: true}, grpc.Creds(credentials.NewTLS(reloader.TLSConfig("h2"))))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Unable to listen")
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	assert.Nil(t, err, "Unable to load client certificate")
+	clientTLS := &tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{clientCert}, ServerName: "localhost"}
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	assert.Nil(t, err, "NewClient() failed")
+	defer conn.Close()
+
+	// Calls go through with the client certificate as the principal, over a
+	// connection that negotiated HTTP/2, which gRPC clients insist on
+	//
+	var callPeer peer.Peer
+	message, err := messagespb.NewMessageServiceClient(conn).Create(context.Background(), &messagespb.CreateRequest{Payload: "foo"}, grpc.Peer(&callPeer))
+	assert.Nil(t, err, "Create() failed")
+	assert.Equal(t, "alice", message.GetOwner(), "Unexpected owner")
+
+	tlsInfo, ok := callPeer.AuthInfo.(credentials.TLSInfo)
+	assert.True(t, ok, "Connection should be over TLS")
+	assert.Equal(t, "h2", tlsInfo.State.NegotiatedProtocol, "Unexpected negotiated protocol")
+
+	// The REST API advertises HTTP/2 as well, falling back on HTTP/1.1
+	//
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Unable to listen")
+	restListener := tls.NewListener(tcpListener, reloader.TLSConfig("h2", "http/1.1"))
+	defer restListener.Close()
+	go func() {
+		for {
+			conn, err := restListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	for _, protos := range [][]string{{"h2", "http/1.1"}, {"http/1.1"}} {
+		restTLS := clientTLS.Clone()
+		restTLS.NextProtos = protos
+		restConn, err := tls.Dial("tcp", restListener.Addr().String(), restTLS)
+		assert.Nil(t, err, "Unable to dial")
+		assert.Equal(t, protos[0], restConn.ConnectionState().NegotiatedProtocol, "Unexpected negotiated protocol")
+		restConn.Close()
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	assert.Nil(t, (&TLSConfig{}).Validate(), "TLS should be optional")
+	assert.NotNil(t, (&TLSConfig{CertFile: "cert.pem"}).Validate(), "Missing key should be rejected")
+	assert.NotNil(t, (&TLSConfig{ClientCAFile: "ca.pem"}).Validate(), "mTLS without TLS should be rejected")
+	assert.NotNil(t, (&TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", RequireClientCert: true}).Validate(), "Requiring client certificates without a CA should be rejected")
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Append-only log of every mutation, shared by the default bucket and every
+// tenant. Records are keyed by sequence number and chained together by hash.
+//
+var auditBucketKey = []byte("_audit")
+
+const AuditOperationCreate = "create"
+const AuditOperationUpdate = "update"
+const AuditOperationDelete = "delete"
+
+var ErrAuditChainBroken = errors.New("Audit log hash chain is broken")
+
+// Describes who is making changes through a Db handle, recorded alongside
+// every mutation in the audit log
+//
+type AuditContext struct {
+	Principal  string
+	RemoteAddr string
+	RequestId  string
+}
+
+// Criteria used to narrow down audit records. Zero values match everything.
+//
+type AuditFilter struct {
+	From      time.Time
+	To        time.Time
+	Principal string
+}
+
+func (filter *AuditFilter) matches(record *model.AuditRecord) bool {
+	if !filter.From.IsZero() && record.Timestamp.Before(filter.From) {
+		return false
+	}
+
+	if !filter.To.IsZero() && !record.Timestamp.Before(filter.To) {
+		return false
+	}
+
+	return filter.Principal == "" || record.Principal == filter.Principal
+}
+
+// Returns a handle into the database that appends a record to the audit log,
+// on behalf of "auditCtx", for every mutation made through it. The handle
+// shares the underlying bbolt DB and must not be closed.
+//
+func (db *Db) WithAuditContext(auditCtx *AuditContext) *Db {
+	auditedDb := *db
+	auditedDb.auditCtx = auditCtx
+	return &auditedDb
+}
+
+// Returns a list of up to "limit" number of audit records matching "filter",
+// starting with sequence number "sequence". A non-0 "afterSequence" returned
+// indicates that there are more matching records left to retrieve.
+//
+func (db *Db) ListAuditRecords(limit uint64, sequence uint64, filter AuditFilter) ([]*model.AuditRecord, uint64, error) {
+	records := []*model.AuditRecord{}
+	afterSequence := uint64(0)
+
+	err := db.view("list_audit_records", func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(auditBucketKey).Cursor()
+		for k, v := cursor.Seek(uint64ToBytes(sequence)); k != nil; k, v = cursor.Next() {
+			record := &model.AuditRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+
+			if !filter.matches(record) {
+				continue
+			}
+
+			// Found the first matching record of the next page
+			//
+			if limit != 0 && uint64(len(records)) == limit {
+				afterSequence = records[len(records)-1].Sequence
+				break
+			}
+
+			records = append(records, record)
+		}
+
+		return nil
+	})
+
+	return records, afterSequence, err
+}
+
+// Calls "fn" for every audit record matching "filter", in order. Iteration
+// stops at the first error returned by "fn".
+//
+func (db *Db) ForEachAuditRecord(filter AuditFilter, fn func(record *model.AuditRecord) error) error {
+	return db.view("for_each_audit_record", func(tx *bolt.Tx) error {
+		return tx.Bucket(auditBucketKey).ForEach(func(k, v []byte) error {
+			record := &model.AuditRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+
+			if !filter.matches(record) {
+				return nil
+			}
+
+			return fn(record)
+		})
+	})
+}
+
+// Walks the whole audit log checking that every record hashes to its recorded
+// hash and links to the hash of the record before it. Returns the number of
+// records verified, along with an error wrapping ErrAuditChainBroken if
+// tampering was detected.
+//
+func (db *Db) VerifyAuditLog() (uint64, error) {
+	numRecords := uint64(0)
+
+	err := db.view("verify_audit_log", func(tx *bolt.Tx) error {
+		prevHash := ""
+		return tx.Bucket(auditBucketKey).ForEach(func(k, v []byte) error {
+			record := &model.AuditRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("%w: undecodable record (key=%x)", ErrAuditChainBroken, k)
+			}
+
+			hash, err := hashAuditRecord(record)
+			if err != nil {
+				return err
+			}
+
+			if record.PrevHash != prevHash || record.Hash != hash {
+				return fmt.Errorf("%w: at sequence %d", ErrAuditChainBroken, record.Sequence)
+			}
+
+			prevHash = record.Hash
+			numRecords += 1
+			return nil
+		})
+	})
+
+	return numRecords, err
+}
+
+// Appends a record of operation "op" on message "id" to the audit log within
+// transaction "tx", if the Db handle is being audited. "before" and "after"
+// are the payloads of the message on either side of the operation, nil if the
+// message didn't exist.
+//
+func (db *Db) appendAuditRecord(tx *bolt.Tx, op string, id uint64, before *string, after *string) error {
+	if db.auditCtx == nil {
+		return nil
+	}
+
+	bucket := tx.Bucket(auditBucketKey)
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	record := &model.AuditRecord{
+		Sequence:   sequence,
+		Timestamp:  time.Now().UTC(),
+		Principal:  db.auditCtx.Principal,
+		RemoteAddr: db.auditCtx.RemoteAddr,
+		RequestId:  db.auditCtx.RequestId,
+		Tenant:     db.tenant,
+		MessageId:  id,
+		Operation:  op,
+		BeforeHash: hashPayload(before),
+		AfterHash:  hashPayload(after),
+	}
+
+	// Links the new record to the last one in the log
+	//
+	if _, v := bucket.Cursor().Last(); v != nil {
+		prevRecord := &model.AuditRecord{}
+		if err = json.Unmarshal(v, prevRecord); err != nil {
+			return err
+		}
+		record.PrevHash = prevRecord.Hash
+	}
+
+	if record.Hash, err = hashAuditRecord(record); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(uint64ToBytes(sequence), buf)
+}
+
+// Hash of a record is computed over its JSON encoding, including the hash of
+// the previous record, but excluding its own hash
+//
+func hashAuditRecord(record *model.AuditRecord) (string, error) {
+	unhashedRecord := *record
+	unhashedRecord.Hash = ""
+
+	buf, err := json.Marshal(&unhashedRecord)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func hashPayload(payload *string) string {
+	if payload == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(*payload))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backups written to a directory are named after the database file, followed by
+// the time they were taken, so that sorting them by name sorts them by age
+//
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+var ErrInvalidSnapshot = errors.New("Invalid snapshot")
+
+// Structure to encapsulate the configuration of scheduled backups. Backups
+// aren't scheduled unless both a directory and an interval are configured.
+//
+type BackupConfig struct {
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	Retain   int           `yaml:"retain"` // Backups kept in Dir, 0 keeps them all
+}
+
+func (cfg *BackupConfig) Enabled() bool {
+	return cfg.Dir != "" && cfg.Interval > 0
+}
+
+// Writes a consistent snapshot of the whole database to "w". The snapshot is
+// taken in a read transaction, so writers aren't blocked while it's taken, and
+// is spooled to a temporary file next to the database before being copied to
+// "w". A slow "w", e.g. a client downloading the backup, therefore doesn't
+// hold up a restore or compaction waiting for the database, nor every
+// transaction queued up behind it. Returns the number of bytes written.
+//
+func (db *Db) Backup(w io.Writer) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(db.FilePath), "."+filepath.Base(db.FilePath)+".backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err = db.writeSnapshot(file); err != nil {
+		return 0, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(w, file)
+}
+
+// Writes a consistent snapshot of the whole database to "w" within a read
+// transaction. Returns the number of bytes written.
+//
+func (db *Db) writeSnapshot(w io.Writer) (int64, error) {
+	var n int64
+
+	err := db.view("backup", func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// Writes a snapshot of the whole database to a new file in directory "dir",
+// then removes the oldest backups in "dir" so that at most "retain" are left,
+// unless "retain" is 0. Returns the path of the new backup.
+//
+func (db *Db) BackupToDir(dir string, retain int) (string, error) {
+	base := filepath.Base(db.FilePath)
+	name := fmt.Sprintf("%s-%s", base, time.Now().UTC().Format(backupTimeFormat))
+	backupPath := filepath.Join(dir, name)
+
+	// The backup only shows up under its final name once it's complete
+	//
+	file, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = db.writeSnapshot(file); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.Rename(file.Name(), backupPath); err != nil {
+		return "", err
+	}
+
+	return backupPath, rotateBackups(dir, base+"-", retain)
+}
+
+// Removes the oldest files in "dir" named with "prefix" so that at most
+// "retain" are left
+//
+func rotateBackups(dir string, prefix string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > retain {
+		if err = os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Replaces the whole database with the snapshot read from "r", as written by
+// Backup(). The snapshot is validated before anything is replaced, and returns
+// ErrInvalidSnapshot if it isn't usable. Transactions in progress are allowed
+// to complete first, and later ones see the restored database, through every
+// handle derived from the Db. The change log is restarted, so that whoever
+// follows it starts over from the restored messages.
+//
+func (db *Db) Restore(r io.Reader) error {
+	// The snapshot is written next to the database file so that it can be
+	// renamed over it
+	//
+	file, err := os.CreateTemp(filepath.Dir(db.FilePath), "."+filepath.Base(db.FilePath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = io.Copy(file, r); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = db.validateSnapshot(file.Name()); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	var lastSequence uint64
+	if db.boltDb() != nil {
+		err = db.boltDb().View(func(tx *bolt.Tx) error {
+			lastSequence = tx.Bucket(changeLogBucketKey).Sequence()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = db.replaceFile(file.Name()); err != nil {
+		return err
+	}
+
+	err = db.boltDb().Update(func(tx *bolt.Tx) error {
+		return restartChangeLog(tx, lastSequence)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wakes up event streams so that they find out they have to start over
+	//
+	db.store.changes.notify()
+	return nil
+}
+
+// Closes the bbolt DB, moves the file at "filePath" over the database file and
+// opens it in its place. The caller must hold the store's write lock.
+//
+func (db *Db) replaceFile(filePath string) error {
+	if db.boltDb() != nil {
+		if err := db.boltDb().Close(); err != nil {
+			return err
+		}
+	}
+
+	// Whatever happens, the Db is left with a database open, the new one if
+	// possible
+	//
+	renameErr := os.Rename(filePath, db.FilePath)
+
+	var err error
+	db.store.boltDb, err = db.open(db.FilePath)
+	if err != nil {
+		db.store.boltDb = nil
+		return fmt.Errorf("%w: unable to reopen database: %w", ErrUnavailable, err)
+	}
+
+	return renameErr
+}
+
+// Checks that the bbolt DB at "filePath" is consistent and holds messages
+//
+func (db *Db) validateSnapshot(filePath string) error {
+	boltDb, err := bolt.Open(filePath, 0600, &bolt.Options{ReadOnly: true, Timeout: OpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer boltDb.Close()
+
+	return boltDb.View(func(tx *bolt.Tx) error {
+		// Every error has to be read for the check to complete
+		//
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+
+		if tx.Bucket([]byte(db.BucketName)) == nil {
+			return fmt.Errorf("bucket %q doesn't exist", db.BucketName)
+		}
+
+		return nil
+	})
+}
+
+// Backs up the database on a schedule until closed
+//
+type BackupScheduler struct {
+	db   *Db
+	cfg  BackupConfig
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Starts backing up the database to "cfg.Dir" every "cfg.Interval"
+//
+func (db *Db) ScheduleBackups(cfg BackupConfig) (*BackupScheduler, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	scheduler := &BackupScheduler{db: db, cfg: cfg, done: make(chan struct{})}
+	scheduler.wg.Add(1)
+	go scheduler.run()
+
+	return scheduler, nil
+}
+
+func (scheduler *BackupScheduler) run() {
+	defer scheduler.wg.Done()
+
+	ticker := time.NewTicker(scheduler.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-scheduler.done:
+			return
+		case <-ticker.C:
+			backupPath, err := scheduler.db.BackupToDir(scheduler.cfg.Dir, scheduler.cfg.Retain)
+			if err != nil {
+				slog.Error("Unable to back up database", "error", err)
+			} else {
+				slog.Info("Backed up database", "path", backupPath)
+			}
+		}
+	}
+}
+
+// Stops backing up the database, waiting for a backup in progress to complete
+//
+func (scheduler *BackupScheduler) Close() {
+	close(scheduler.done)
+	scheduler.wg.Wait()
+}
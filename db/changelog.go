@@ -0,0 +1,458 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Consumers reading the change log from outside the service, keyed by name,
+// each with the offset it committed. Alongside them, the state of the change
+// log: the sequence number of the last change removed by the retention policy,
+// before which the log is no longer complete.
+//
+var consumerBucketKey = []byte("_consumers")
+var changeLogStateBucketKey = []byte("_changestate")
+
+var truncatedThroughKey = []byte("truncatedThrough")
+
+const ConsumerNamePattern = `^[a-z0-9][a-z0-9_-]{0,62}$`
+
+var consumerNameRegexp = regexp.MustCompile(ConsumerNamePattern)
+
+var ErrInvalidConsumerName = errors.New("Invalid consumer name")
+var ErrConsumerNotFound = errors.New("Consumer not found")
+var ErrInvalidOffset = errors.New("Offset is past the last change")
+var ErrChangesExpired = errors.New("Changes no longer retained")
+
+// Number of changes the change log policies go through per transaction
+//
+var changeLogBatchSize = 1000
+
+// Structure to encapsulate the policies applied to the change log on a
+// schedule. Nothing is applied unless an interval and at least one policy are
+// configured.
+//
+type ChangeLogConfig struct {
+	Retention  time.Duration `yaml:"retention"`  // Age past which changes are removed, 0 keeps them forever
+	MaxChanges uint64        `yaml:"maxChanges"` // Most recent changes kept, 0 keeps them all
+	Compact    bool          `yaml:"compact"`    // Only keep the last change of every message
+	Interval   time.Duration `yaml:"interval"`
+
+	// Expire changes regardless of the offsets committed by consumers, rather
+	// than keeping those any of them hasn't read yet
+	//
+	ExpireUnread bool `yaml:"expireUnread"`
+}
+
+func (cfg *ChangeLogConfig) Enabled() bool {
+	return cfg.Interval > 0 && (cfg.Retention > 0 || cfg.MaxChanges > 0 || cfg.Compact)
+}
+
+// Describes what applying the change log policies removed
+//
+type ChangeLogReport struct {
+	Expired   uint64 `json:"expired"`   // Changes past retention
+	Compacted uint64 `json:"compacted"` // Changes superseded by a later one
+}
+
+// Consumer names follow the same rules as tenant names
+//
+func ValidConsumerName(name string) bool {
+	return consumerNameRegexp.MatchString(name)
+}
+
+// Returns a list of up to "limit" changes made after sequence number "since",
+// to every message of every tenant. A non-0 "afterSequence" returned indicates
+// that there are more changes left to retrieve, after that sequence number.
+// Returns ErrChangesExpired if changes after "since" were removed by the
+// retention policy, in which case the consumer has to start over.
+//
+func (db *Db) ReadChangeLog(since uint64, limit uint64) ([]*model.Change, uint64, error) {
+	changes := []*model.Change{}
+	afterSequence := uint64(0)
+
+	err := db.view("read_change_log", func(tx *bolt.Tx) error {
+		if err := checkChangesRetained(tx, since); err != nil {
+			return err
+		}
+
+		cursor := tx.Bucket(changeLogBucketKey).Cursor()
+		for k, v := cursor.Seek(uint64ToBytes(since + 1)); k != nil; k, v = cursor.Next() {
+			if uint64(len(changes)) == limit {
+				afterSequence = changes[len(changes)-1].Sequence
+				break
+			}
+
+			change := &model.Change{}
+			if err := json.Unmarshal(v, change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+
+	return changes, afterSequence, err
+}
+
+// Returns every consumer, ordered by name
+//
+func (db *Db) ListChangeConsumers() ([]*model.ChangeConsumer, error) {
+	consumers := []*model.ChangeConsumer{}
+
+	err := db.view("list_change_consumers", func(tx *bolt.Tx) error {
+		return tx.Bucket(consumerBucketKey).ForEach(func(k, v []byte) error {
+			consumer := &model.ChangeConsumer{}
+			if err := json.Unmarshal(v, consumer); err != nil {
+				return err
+			}
+
+			consumers = append(consumers, consumer)
+			return nil
+		})
+	})
+
+	return consumers, err
+}
+
+// Returns consumer "name", or ErrConsumerNotFound if it never committed an
+// offset
+//
+func (db *Db) GetChangeConsumer(name string) (*model.ChangeConsumer, error) {
+	if !ValidConsumerName(name) {
+		return nil, ErrInvalidConsumerName
+	}
+
+	consumer := &model.ChangeConsumer{}
+
+	err := db.view("get_change_consumer", func(tx *bolt.Tx) error {
+		v := tx.Bucket(consumerBucketKey).Get([]byte(name))
+		if v == nil {
+			return ErrConsumerNotFound
+		}
+
+		return json.Unmarshal(v, consumer)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer, nil
+}
+
+// Records that consumer "name" processed every change up to sequence number
+// "offset", creating the consumer if needed. Offsets may move backwards, to
+// process changes again, but not past the last change.
+//
+func (db *Db) CommitChangeOffset(name string, offset uint64) (*model.ChangeConsumer, error) {
+	if !ValidConsumerName(name) {
+		return nil, ErrInvalidConsumerName
+	}
+
+	consumer := &model.ChangeConsumer{Name: name, Offset: offset}
+
+	err := db.update("commit_change_offset", func(tx *bolt.Tx) error {
+		if offset > tx.Bucket(changeLogBucketKey).Sequence() {
+			return ErrInvalidOffset
+		}
+
+		consumer.UpdatedAt = time.Now().UTC()
+		buf, err := json.Marshal(consumer)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(consumerBucketKey).Put([]byte(name), buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer, nil
+}
+
+// Forgets consumer "name" and its offset
+//
+func (db *Db) DeleteChangeConsumer(name string) error {
+	if !ValidConsumerName(name) {
+		return ErrInvalidConsumerName
+	}
+
+	return db.update("delete_change_consumer", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(consumerBucketKey)
+		if bucket.Get([]byte(name)) == nil {
+			return ErrConsumerNotFound
+		}
+
+		return bucket.Delete([]byte(name))
+	})
+}
+
+// Applies the retention and compaction policies of "cfg" to the change log as
+// of "now". Retention removes the oldest changes, moving the point before which
+// the log is incomplete, but not the changes a consumer hasn't committed yet
+// unless "cfg.ExpireUnread" is set. Compaction removes every change to a
+// message but the last one, so that reading the whole log still yields the
+// latest state of every message, deleted ones included.
+//
+// The log is processed in batches of changeLogBatchSize, each in its own
+// transaction, so that writers are only held up for as long as a batch takes.
+// Changes made meanwhile are left for the next run.
+//
+func (db *Db) ApplyChangeLogPolicies(cfg ChangeLogConfig, now time.Time) (*ChangeLogReport, error) {
+	report := &ChangeLogReport{}
+
+	// Changes are visited newest first, so the first change seen for a
+	// message is the one compaction keeps
+	//
+	latest := map[string]bool{}
+	kept := uint64(0)
+	before := uint64(0)
+
+	for done := false; !done; {
+		err := db.update("apply_change_log_policies", func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(changeLogBucketKey)
+
+			// Offsets may be moved back at any time, so the oldest one is
+			// looked up for every batch
+			//
+			unreadAfter, err := oldestConsumerOffset(tx)
+			if err != nil {
+				return err
+			}
+
+			// Keys can't be deleted while iterating, so they're collected
+			// first
+			//
+			var expired, compacted [][]byte
+			visited := 0
+
+			// Every batch picks up before the last change the previous one
+			// visited
+			//
+			cursor := bucket.Cursor()
+			k, v := cursor.Last()
+			if before != 0 {
+				if k, v = cursor.Seek(uint64ToBytes(before)); k != nil {
+					k, v = cursor.Prev()
+				} else {
+					k, v = cursor.Last()
+				}
+			}
+
+			for ; k != nil && visited < changeLogBatchSize; k, v = cursor.Prev() {
+				visited += 1
+				before = binary.BigEndian.Uint64(k)
+
+				change := &model.Change{}
+				if err := json.Unmarshal(v, change); err != nil {
+					return err
+				}
+
+				tooOld := cfg.Retention > 0 && change.Timestamp.Before(now.Add(-cfg.Retention))
+				tooMany := cfg.MaxChanges > 0 && kept >= cfg.MaxChanges
+				unread := !cfg.ExpireUnread && unreadAfter != nil && change.Sequence > *unreadAfter
+				if (tooOld || tooMany) && !unread {
+					expired = append(expired, append([]byte{}, k...))
+					continue
+				}
+
+				key := fmt.Sprintf("%s/%d", change.Tenant, change.Message.Message.Id)
+				if cfg.Compact && latest[key] {
+					compacted = append(compacted, append([]byte{}, k...))
+					continue
+				}
+
+				latest[key] = true
+				kept += 1
+			}
+			done = k == nil
+
+			for _, k := range append(expired, compacted...) {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			// The newest change expired is the first one collected, in the
+			// first batch that expires any
+			//
+			if len(expired) != 0 && report.Expired == 0 {
+				if err := tx.Bucket(changeLogStateBucketKey).Put(truncatedThroughKey, expired[0]); err != nil {
+					return err
+				}
+			}
+
+			report.Expired += uint64(len(expired))
+			report.Compacted += uint64(len(compacted))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// Returns the oldest offset committed by a consumer within transaction "tx",
+// nil if there are no consumers
+//
+func oldestConsumerOffset(tx *bolt.Tx) (*uint64, error) {
+	var oldest *uint64
+
+	err := tx.Bucket(consumerBucketKey).ForEach(func(k, v []byte) error {
+		consumer := &model.ChangeConsumer{}
+		if err := json.Unmarshal(v, consumer); err != nil {
+			return err
+		}
+
+		if oldest == nil || consumer.Offset < *oldest {
+			oldest = &consumer.Offset
+		}
+		return nil
+	})
+
+	return oldest, err
+}
+
+// Returns ErrChangesExpired if changes made after sequence number "since" were
+// removed by the retention policy, in which case whoever read up to "since"
+// has to start over. Starting over, from 0, is always possible.
+//
+func (db *Db) CheckChangesRetained(since uint64) error {
+	return db.view("check_changes_retained", func(tx *bolt.Tx) error {
+		return checkChangesRetained(tx, since)
+	})
+}
+
+// Same as CheckChangesRetained(), within transaction "tx"
+//
+func checkChangesRetained(tx *bolt.Tx, since uint64) error {
+	if truncatedThrough := changeLogTruncatedThrough(tx); since != 0 && since < truncatedThrough {
+		return fmt.Errorf("%w: changes through %d were removed", ErrChangesExpired, truncatedThrough)
+	}
+	return nil
+}
+
+// Restarts the change log of a database just restored over one whose last
+// change had sequence number "lastSequence", within transaction "tx". Every
+// change up to the restore is considered removed, so that whoever read any of
+// them starts over, and the changes restored are moved after them so that
+// starting over yields the restored messages.
+//
+func restartChangeLog(tx *bolt.Tx, lastSequence uint64) error {
+	bucket := tx.Bucket(changeLogBucketKey)
+
+	var changes []*model.Change
+	err := bucket.ForEach(func(k, v []byte) error {
+		change := &model.Change{}
+		if err := json.Unmarshal(v, change); err != nil {
+			return err
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The restore itself takes a sequence number, so that followers that
+	// were up to date before it have to start over too
+	//
+	truncatedThrough := max(lastSequence, bucket.Sequence()) + 1
+
+	if err = tx.DeleteBucket(changeLogBucketKey); err != nil {
+		return err
+	}
+	if bucket, err = tx.CreateBucket(changeLogBucketKey); err != nil {
+		return err
+	}
+	if err = bucket.SetSequence(truncatedThrough); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if change.Sequence, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(uint64ToBytes(change.Sequence), buf); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(changeLogStateBucketKey).Put(truncatedThroughKey, uint64ToBytes(truncatedThrough))
+}
+
+// Returns the sequence number of the last change removed by the retention
+// policy within transaction "tx", 0 if there was none
+//
+func changeLogTruncatedThrough(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(changeLogStateBucketKey).Get(truncatedThroughKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+type ChangeLogScheduler struct {
+	db   *Db
+	cfg  ChangeLogConfig
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Starts applying the change log policies of "cfg" every "cfg.Interval"
+//
+func (db *Db) ScheduleChangeLogPolicies(cfg ChangeLogConfig) *ChangeLogScheduler {
+	scheduler := &ChangeLogScheduler{db: db, cfg: cfg, done: make(chan struct{})}
+	scheduler.wg.Add(1)
+	go scheduler.run()
+
+	return scheduler
+}
+
+func (scheduler *ChangeLogScheduler) run() {
+	defer scheduler.wg.Done()
+
+	ticker := time.NewTicker(scheduler.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-scheduler.done:
+			return
+		case <-ticker.C:
+			report, err := scheduler.db.ApplyChangeLogPolicies(scheduler.cfg, time.Now())
+			if err != nil {
+				slog.Error("Unable to apply change log policies", "error", err)
+			} else if report.Expired != 0 || report.Compacted != 0 {
+				slog.Info("Applied change log policies", "expired", report.Expired, "compacted", report.Compacted)
+			}
+		}
+	}
+}
+
+// Stops applying the change log policies, waiting for a run in progress to
+// complete
+//
+func (scheduler *ChangeLogScheduler) Close() {
+	close(scheduler.done)
+	scheduler.wg.Wait()
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Log of every change made to a message, shared by the default bucket and every
+// tenant. Records are keyed by sequence number, and written in the same
+// transaction as the change they record. They are kept until removed by the
+// change log policies, see ApplyChangeLogPolicies().
+//
+var changeLogBucketKey = []byte("_changes")
+
+const ChangeCreated = "created"
+const ChangeUpdated = "updated"
+const ChangeDeleted = "deleted"
+
+// Predicate used to narrow down the changes returned by ListChanges. A nil
+// ChangeFilter matches every change.
+//
+type ChangeFilter func(change *model.Change) bool
+
+// Wakes up whoever is waiting on new changes once they're committed. Shared by
+// a Db and every handle derived from it.
+//
+type changeNotifier struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]bool
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{subscribers: make(map[chan struct{}]bool)}
+}
+
+// Signals every subscriber without ever waiting on one. A subscriber that
+// hasn't picked up the previous signal yet has nothing more to learn from this
+// one, since it reads the changes from the log.
+//
+func (notifier *changeNotifier) notify() {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	for ch := range notifier.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns a channel signaled whenever changes are committed, through any
+// handle derived from the same Db, along with the function to call once done
+// with it. Signals are coalesced: the subscriber is expected to read every
+// change after the last one it saw with ListChanges once signaled.
+//
+func (db *Db) SubscribeChanges() (<-chan struct{}, func()) {
+	notifier := db.store.changes
+	ch := make(chan struct{}, 1)
+
+	notifier.mu.Lock()
+	notifier.subscribers[ch] = true
+	notifier.mu.Unlock()
+
+	return ch, func() {
+		notifier.mu.Lock()
+		delete(notifier.subscribers, ch)
+		notifier.mu.Unlock()
+	}
+}
+
+// Returns the sequence number of the last change recorded, 0 if there was none
+//
+func (db *Db) LastChangeSequence() (uint64, error) {
+	sequence := uint64(0)
+
+	err := db.view("last_change_sequence", func(tx *bolt.Tx) error {
+		sequence = tx.Bucket(changeLogBucketKey).Sequence()
+		return nil
+	})
+
+	return sequence, err
+}
+
+// Returns a list of up to "limit" number of changes to the messages the Db is
+// scoped to, matching "filter", starting with sequence number "sequence". A
+// non-0 "afterSequence" returned indicates that there are more matching
+// changes left to retrieve. Returns ErrChangesExpired if changes from
+// "sequence" on were removed by the retention policy, since whoever is reading
+// them would otherwise miss them.
+//
+func (db *Db) ListChanges(limit uint64, sequence uint64, filter ChangeFilter) ([]*model.Change, uint64, error) {
+	changes := []*model.Change{}
+	afterSequence := uint64(0)
+
+	err := db.view("list_changes", func(tx *bolt.Tx) error {
+		since := sequence
+		if since != 0 {
+			since -= 1
+		}
+		if err := checkChangesRetained(tx, since); err != nil {
+			return err
+		}
+		cursor := tx.Bucket(changeLogBucketKey).Cursor()
+		for k, v := cursor.Seek(uint64ToBytes(sequence)); k != nil; k, v = cursor.Next() {
+			change := &model.Change{}
+			if err := json.Unmarshal(v, change); err != nil {
+				return err
+			}
+
+			if change.Tenant != db.tenant || (filter != nil && !filter(change)) {
+				continue
+			}
+
+			// Found the first matching change of the next page
+			//
+			if limit != 0 && uint64(len(changes)) == limit {
+				afterSequence = changes[len(changes)-1].Sequence
+				break
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+
+	return changes, afterSequence, err
+}
+
+// Appends a change of type "changeType" to "detailedMessage" to the change log
+// within transaction "tx". Subscribers are notified once it's committed.
+//
+func (db *Db) appendChange(tx *bolt.Tx, changeType string, detailedMessage *model.DetailedMessage) error {
+	bucket := tx.Bucket(changeLogBucketKey)
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	change := &model.Change{
+		Sequence:  sequence,
+		Type:      changeType,
+		Tenant:    db.tenant,
+		Timestamp: time.Now().UTC(),
+		Message:   detailedMessage,
+	}
+
+	buf, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	if err = bucket.Put(uint64ToBytes(sequence), buf); err != nil {
+		return err
+	}
+
+	// Webhooks are delivered the change from the outbox, so that it is queued
+	// if and only if the change is committed
+	//
+	if err = enqueueDeliveries(tx, change); err != nil {
+		return err
+	}
+
+	tx.OnCommit(db.store.changes.notify)
+	return nil
+}
@@ -1,124 +1,406 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/brandonto/rest-api-microservice-demo/model"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// Buckets kept alongside the one holding messages, e.g. tenants, the audit log
+// or the change log, are named with this prefix, which the bucket holding
+// messages therefore can't start with
+//
+const ReservedBucketPrefix = "_"
+
+// Returned when the bucket holding messages has disappeared from under the Db,
+// e.g. because the database file was tampered with
+//
+var ErrBucketMissing = errors.New("Bucket is missing")
+
+// Returned when a record can't be decoded into a message
+//
+var ErrCorruptRecord = errors.New("Corrupt record")
+
+// Returned when there is no message at the requested index
+//
+var ErrNotFound = errors.New("Message not found")
+
+// Returned when the database can't be reached at the moment, e.g. because it's
+// closed while shutting down, as opposed to being broken
+//
+var ErrUnavailable = errors.New("Database unavailable")
+
+// Error returned by an operation on the message at index "Id", wrapping what
+// caused it to fail, e.g. ErrNotFound or ErrCorruptRecord
+//
+type MessageError struct {
+	Id  uint64
+	Err error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("message %d: %v", e.Id, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
 // Structure to abtract away the underlying database implementation. This is the
 // main handle into the database.
 //
 type Db struct {
-	boltDb    *bolt.DB
-	bucketKey []byte
+	store            *store
+	bucketKey        []byte
+	tenant           string
+	noTenantCreation bool
+	auditCtx         *AuditContext
+	observer         OperationObserver
+	ctx              context.Context
 	Config
 }
 
 // Structure to encapsulate configuration needed to initialize the Db
 //
 type Config struct {
-	FilePath   string
-	BucketName string
+	FilePath   string `yaml:"path"`
+	BucketName string `yaml:"bucket"`
+
+	// Maximum number of messages allowed in a tenant that was created lazily
+	// rather than explicitly. 0 means unlimited.
+	//
+	DefaultTenantMaxMessages uint64 `yaml:"defaultTenantMaxMessages"`
+
+	// Storage limits applied to every principal, enforced when creating
+	// messages
+	//
+	Quota Quota `yaml:"quota"`
+
+	// Repairs the database on initialization, and whenever an operation runs
+	// into a missing bucket or a corrupt record, rather than failing. See
+	// Repair().
+	//
+	RepairMode bool `yaml:"repairMode"`
+
+	// Backups taken on a schedule, see ScheduleBackups()
+	//
+	Backup BackupConfig `yaml:"backup"`
+
+	// Retention and compaction of the change log, applied on a schedule, see
+	// ScheduleChangeLogPolicies()
+	//
+	ChangeLog ChangeLogConfig `yaml:"changeLog"`
+}
+
+// How long opening the database file waits for another process holding it to
+// let go of it
+//
+const OpenTimeout = 5 * time.Second
+
+// The bbolt DB shared by a Db and every handle derived from it. Transactions
+// hold the read lock so that Restore() can swap the bbolt DB for another one
+// once they're all done.
+//
+type store struct {
+	mu      sync.RWMutex
+	boltDb  *bolt.DB
+	changes *changeNotifier
 }
 
 // Constructor for Db object
 //
 func NewDb(config Config) *Db {
-	return &Db{Config: config}
+	return &Db{Config: config, store: &store{changes: newChangeNotifier()}}
 }
 
 // Creates/opens and initializes a bbolt DB
 //
 func (db *Db) Initialize() error {
-	boltDb, err := bolt.Open(db.FilePath, 0600, nil)
+	db.bucketKey = []byte(db.BucketName)
+
+	boltDb, err := db.open(db.FilePath)
 	if err != nil {
 		return err
 	}
 
-	db.boltDb = boltDb
+	db.store.mu.Lock()
+	db.store.boltDb = boltDb
+	db.store.mu.Unlock()
+
+	if !db.RepairMode {
+		return nil
+	}
+
+	report, err := db.Repair()
+	if err == nil && (len(report.RecreatedBuckets) != 0 || report.QuarantinedRecords != 0) {
+		slog.Warn("Repaired database",
+			"recreated_buckets", report.RecreatedBuckets,
+			"quarantined_records", report.QuarantinedRecords,
+		)
+	}
+
+	return err
+}
+
+// Opens the existing bbolt DB read-only and as is: no bucket is created, usage
+// isn't rebuilt and nothing is repaired, even in repair mode. Meant for
+// inspecting the database file, every write fails.
+//
+func (db *Db) InitializeReadOnly() error {
 	db.bucketKey = []byte(db.BucketName)
+	db.RepairMode = false
+
+	boltDb, err := bolt.Open(db.FilePath, 0600, &bolt.Options{Timeout: OpenTimeout, ReadOnly: true})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("database file %s is in use by another process: %w", db.FilePath, err)
+	} else if err != nil {
+		return err
+	}
 
-	err = db.boltDb.Update(func(tx *bolt.Tx) error {
+	db.store.mu.Lock()
+	db.store.boltDb = boltDb
+	db.store.mu.Unlock()
+
+	return nil
+}
+
+// Opens the bbolt DB at "filePath", creating any bucket it's missing
+//
+func (db *Db) open(filePath string) (*bolt.DB, error) {
+	boltDb, err := bolt.Open(filePath, 0600, &bolt.Options{Timeout: OpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("database file %s is in use by another process: %w", filePath, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = boltDb.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(db.bucketKey)
 		if err != nil {
 			return err
 		}
 
+		_, err = tx.CreateBucketIfNotExists(tenantRegistryBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(deletedTenantBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(auditBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(changeLogBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(consumerBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(changeLogStateBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(webhookBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(outboxBucketKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(deadLetterBucketKey)
+		if err != nil {
+			return err
+		}
+
+		// Usage needs to be computed from scratch the first time around, in
+		// case there are messages from before it was being tracked
+		//
+		if tx.Bucket(usageBucketKey) == nil {
+			if _, err = tx.CreateBucket(usageBucketKey); err != nil {
+				return err
+			}
+
+			return db.rebuildUsage(tx)
+		}
+
 		return nil
 	})
+	if err != nil {
+		boltDb.Close()
+		return nil, err
+	}
 
-	return err
+	return boltDb, nil
 }
 
 // Closes the Db. Not strictly necessary in this application, but good practice
 // regardless
 //
 func (db *Db) Close() {
-	db.boltDb.Close()
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	if db.store.boltDb != nil {
+		db.store.boltDb.Close()
+	}
+}
+
+// Returns the bbolt DB currently in use. The caller must hold the store's lock
+// for as long as it's using it.
+//
+func (db *Db) boltDb() *bolt.DB {
+	return db.store.boltDb
+}
+
+// Returns a handle into the database whose operations are carried out on
+// behalf of "ctx", e.g. so that they are traced as part of the request that
+// triggered them. The handle shares the underlying bbolt DB and must not be
+// closed.
+//
+func (db *Db) WithContext(ctx context.Context) *Db {
+	contextDb := *db
+	contextDb.ctx = ctx
+	return &contextDb
+}
+
+func (db *Db) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+
+	return db.ctx
+}
+
+// Checks that the database is usable by running a read transaction against the
+// bucket holding messages
+//
+func (db *Db) Ping() error {
+	return db.view("ping", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(db.bucketKey)
+		if bucket == nil {
+			return fmt.Errorf("bucket %q doesn't exist", db.bucketKey)
+		}
+
+		// Reading a key makes sure the bucket's pages are actually readable
+		//
+		bucket.Cursor().First()
+
+		return nil
+	})
+}
+
+// Retrieves the bucket the Db is scoped to. Tenant buckets are created lazily
+// on first write, so nil is returned if the tenant hasn't been created yet.
+// Returns ErrBucketMissing if the default bucket doesn't exist, since it
+// should have been created on initialization.
+//
+func (db *Db) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	bucket := tx.Bucket(db.bucketKey)
+	if bucket == nil && db.tenant == "" {
+		return nil, fmt.Errorf("%w: %q", ErrBucketMissing, db.bucketKey)
+	}
+
+	return bucket, nil
 }
 
+// Retrieves the bucket the Db is scoped to, creating the tenant first if it
+// doesn't exist yet. Returns ErrTenantNotFound instead if the handle doesn't
+// create tenants, or if the tenant was deleted, since only explicitly creating
+// it again brings it back.
+//
+func (db *Db) writableBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	bucket, err := db.bucket(tx)
+	if bucket != nil || err != nil {
+		return bucket, err
+	}
+
+	if db.noTenantCreation || tx.Bucket(deletedTenantBucketKey).Get([]byte(db.tenant)) != nil {
+		return nil, ErrTenantNotFound
+	}
+
+	tenant := &model.Tenant{
+		Name:        db.tenant,
+		MaxMessages: db.DefaultTenantMaxMessages,
+	}
+	return createTenant(tx, tenant)
+}
+
+// Predicate used to narrow down the messages returned by ListMessages. A nil
+// MessageFilter matches every message.
+//
+type MessageFilter func(detailedMessage *model.DetailedMessage) bool
+
 // Returns a list of up to "limit" number of DetailedMessage starting with the
-// first entry from index "id". A non-0 "afterId" returned indicates that there
-// are more messages left to retrieve from the database.
+// first entry from index "id" that matches "filter". A non-0 "afterId"
+// returned indicates that there are more matching messages left to retrieve
+// from the database.
 //
-func (db *Db) ListMessages(limit uint64, id uint64) ([]*model.DetailedMessage, uint64, error) {
+func (db *Db) ListMessages(limit uint64, id uint64, filter MessageFilter) ([]*model.DetailedMessage, uint64, error) {
 	var detailedMessages []*model.DetailedMessage
 	afterId := uint64(0)
 
-	err := db.boltDb.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(db.bucketKey)
+	err := db.repairingView("list_messages", func(tx *bolt.Tx) error {
+		// Starts over if the transaction is retried after a repair
+		//
+		detailedMessages = nil
+
+		bucket, err := db.bucket(tx)
 		if bucket == nil {
-			// This shouldn't be possible as the bucket should have been created
-			// on initialization. Fundamental flaw in program operation... so
-			// lets just die
+			// Tenant hasn't been written to yet... so there is nothing to list
 			//
-			log.Fatal(errors.New("Irrecoverable state"))
+			return err
 		}
 
 		cursor := bucket.Cursor()
 		numMessagesRetrieved := uint64(0)
 		for k, v := cursor.Seek(uint64ToBytes(id)); k != nil; k, v = cursor.Next() {
-			detailedMessage := &model.DetailedMessage{}
-
-			if v == nil {
-				// This shouldn't be possible. A nil value for a non-nil key is
-				// only returned from Seek() if the key is associated with a
-				// bucket value. This application should never store a bucket
-				// here as only message blobs should have been stored. This is a
-				// fundamental flaw in program operation... so lets just die.
-				//
-				log.Fatal(errors.New("Irrecoverable state"))
-			}
-
 			// Converts message data blob into application data structure
 			//
-			err := json.Unmarshal(v, detailedMessage)
+			detailedMessage, err := decodeMessage(k, v)
 			if err != nil {
 				return err
 			}
 
-			// Add message to list of returned messages
+			// Skip over any message the caller isn't interested in
 			//
-			detailedMessages = append(detailedMessages, detailedMessage)
+			if filter != nil && !filter(detailedMessage) {
+				continue
+			}
 
-			// We've reached our limit for messages. Do one quick peek at the
-			// next message to see if any more exists. If one does exist, we'll
-			// set the next "afterId" to use.
+			// We've already reached our limit for messages, so this is the
+			// first matching message of the next page. Set the next "afterId"
+			// to the last message returned and stop here.
 			//
-			numMessagesRetrieved += 1
-			if numMessagesRetrieved == limit {
-				testKey, _ := cursor.Next()
-				if testKey != nil {
-					afterId = detailedMessage.Message.Id
-				}
+			if limit != 0 && numMessagesRetrieved == limit {
+				afterId = detailedMessages[len(detailedMessages)-1].Message.Id
 				break
 			}
+
+			// Add message to list of returned messages
+			//
+			detailedMessages = append(detailedMessages, detailedMessage)
+			numMessagesRetrieved += 1
 		}
 
 		return nil
@@ -132,14 +414,21 @@ func (db *Db) ListMessages(limit uint64, id uint64) ([]*model.DetailedMessage, u
 // during the transaction.
 //
 func (db *Db) CreateMessage(detailedMessage *model.DetailedMessage) error {
-	return db.boltDb.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(db.bucketKey)
-		if bucket == nil {
-			// This shouldn't be possible as the bucket should have been created
-			// on initialization. Fundamental flaw in program operation... so
-			// lets just die
-			//
-			log.Fatal(errors.New("Irrecoverable state"))
+	return db.repairingUpdate("create_message", func(tx *bolt.Tx) error {
+		bucket, err := db.writableBucket(tx)
+		if err != nil {
+			return err
+		}
+
+		// Refuse to grow a tenant or the owner's usage past their quota
+		//
+		if err = db.checkTenantQuota(tx, bucket); err != nil {
+			return err
+		}
+
+		payloadBytes := int64(len(detailedMessage.Message.Payload))
+		if err = db.adjustUsage(tx, detailedMessage.Owner, 1, payloadBytes); err != nil {
+			return err
 		}
 
 		// Get the next unique integer identifier from the database to use as
@@ -160,38 +449,46 @@ func (db *Db) CreateMessage(detailedMessage *model.DetailedMessage) error {
 
 		// Persists message data blob to database
 		//
-		return bucket.Put(uint64ToBytes(id), buf)
+		if err = bucket.Put(uint64ToBytes(id), buf); err != nil {
+			return err
+		}
+
+		if err = db.appendChange(tx, ChangeCreated, detailedMessage); err != nil {
+			return err
+		}
+
+		after := detailedMessage.Message.Payload
+		return db.appendAuditRecord(tx, AuditOperationCreate, id, nil, &after)
 	})
 }
 
-// Retrieves a DetailedMessage from the database at index "id". Returns an error
+// Retrieves a DetailedMessage from the database at index "id". Returns a
+// MessageError wrapping ErrNotFound if there is no such message, or an error
 // if something went wrong during the transaction.
 //
 func (db *Db) GetMessage(id uint64) (*model.DetailedMessage, error) {
-	detailedMessage := &model.DetailedMessage{}
+	var detailedMessage *model.DetailedMessage
 
-	err := db.boltDb.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(db.bucketKey)
-		if bucket == nil {
-			// This shouldn't be possible as the bucket should have been created
-			// on initialization. Fundamental flaw in program operation... so
-			// lets just die
-			//
-			log.Fatal(errors.New("Irrecoverable state"))
+	err := db.repairingView("get_message", func(tx *bolt.Tx) error {
+		bucket, err := db.bucket(tx)
+		if err != nil {
+			return err
 		}
 
 		// Retrieves message data blob from database
 		//
-		buf := bucket.Get(uint64ToBytes(id))
+		var buf []byte
+		if bucket != nil {
+			buf = bucket.Get(uint64ToBytes(id))
+		}
 		if buf == nil {
-			return fmt.Errorf("Unable to retrieve message (id=%d) from database.", id)
+			return &MessageError{Id: id, Err: ErrNotFound}
 		}
 
 		// Converts message data blob into application data structure
 		//
-		err := json.Unmarshal(buf, detailedMessage)
-		if err != nil {
-			return err
+		if detailedMessage, err = decodeMessage(uint64ToBytes(id), buf); err != nil {
+			return &MessageError{Id: id, Err: err}
 		}
 
 		return nil
@@ -201,18 +498,35 @@ func (db *Db) GetMessage(id uint64) (*model.DetailedMessage, error) {
 }
 
 // Replaces a DetailedMessage in the database with "detailedMessage" at the
-// index specified in the message. Returns an error if something went wrong
-// during the transaction.
+// index specified in the message. Returns a MessageError wrapping ErrNotFound
+// if there is no message to replace, e.g. because it was deleted since it was
+// retrieved, or an error if something went wrong during the transaction.
 //
 func (db *Db) UpdateMessage(detailedMessage *model.DetailedMessage) error {
-	return db.boltDb.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(db.bucketKey)
-		if bucket == nil {
-			// This shouldn't be possible as the bucket should have been created
-			// on initialization. Fundamental flaw in program operation... so
-			// lets just die
-			//
-			log.Fatal(errors.New("Irrecoverable state"))
+	return db.repairingUpdate("update_message", func(tx *bolt.Tx) error {
+		bucket, err := db.writableBucket(tx)
+		if err != nil {
+			return err
+		}
+
+		// Accounts for the change in payload size against the owner's quota
+		//
+		id := detailedMessage.Message.Id
+		payloadBytes := int64(len(detailedMessage.Message.Payload))
+		previous := bucket.Get(uint64ToBytes(id))
+		if previous == nil {
+			return &MessageError{Id: id, Err: ErrNotFound}
+		}
+
+		previousDetailedMessage, err := decodeMessage(uint64ToBytes(id), previous)
+		if err != nil {
+			return &MessageError{Id: id, Err: err}
+		}
+		payloadBytes -= int64(len(previousDetailedMessage.Message.Payload))
+		before := &previousDetailedMessage.Message.Payload
+
+		if err = db.adjustUsage(tx, detailedMessage.Owner, 0, payloadBytes); err != nil {
+			return err
 		}
 
 		// Converts application data structure into message data blob
@@ -224,45 +538,96 @@ func (db *Db) UpdateMessage(detailedMessage *model.DetailedMessage) error {
 
 		// Persists message data blob to database
 		//
-		id := detailedMessage.Message.Id
-		return bucket.Put(uint64ToBytes(id), buf)
+		if err = bucket.Put(uint64ToBytes(id), buf); err != nil {
+			return err
+		}
+
+		if err = db.appendChange(tx, ChangeUpdated, detailedMessage); err != nil {
+			return err
+		}
+
+		after := detailedMessage.Message.Payload
+		return db.appendAuditRecord(tx, AuditOperationUpdate, id, before, &after)
 	})
 }
 
-// Deletes a DetailedMessage from the database at index "id". Returns an error
-// if something went wrong during the transaction.
+// Deletes a DetailedMessage from the database at index "id". Returns whether
+// there was a message to delete, or an error if something went wrong during
+// the transaction.
 //
-func (db *Db) DeleteMessage(id uint64) error {
-	return db.boltDb.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(db.bucketKey)
+func (db *Db) DeleteMessage(id uint64) (bool, error) {
+	deleted := false
+
+	err := db.repairingUpdate("delete_message", func(tx *bolt.Tx) error {
+		bucket, err := db.bucket(tx)
 		if bucket == nil {
-			// This shouldn't be possible as the bucket should have been created
-			// on initialization. Fundamental flaw in program operation... so
-			// lets just die
+			// Tenant hasn't been written to yet... so there is nothing to
+			// delete
 			//
-			log.Fatal(errors.New("Irrecoverable state"))
+			return err
 		}
 
-		// Deletes message data blob from database. A nil error is returned if
-		// there is nothing to be deleted.
+		// Nothing to delete if the message doesn't exist
 		//
-		err := bucket.Delete(uint64ToBytes(id))
-		if err != nil {
-			return fmt.Errorf("Unable to delete message (id=%d) from database.", id)
+		buf := bucket.Get(uint64ToBytes(id))
+		if buf == nil {
+			return nil
 		}
 
-		return nil
+		// Releases the message from its owner's usage. A corrupt message is
+		// deleted all the same, there is no usage to release for it and only
+		// its ID is recorded as deleted.
+		//
+		var before *string
+		deletedMessage := &model.DetailedMessage{Message: &model.Message{Id: id}}
+		if detailedMessage, err := decodeMessage(uint64ToBytes(id), buf); err == nil {
+			payloadBytes := int64(len(detailedMessage.Message.Payload))
+			if err = db.adjustUsage(tx, detailedMessage.Owner, -1, -payloadBytes); err != nil {
+				return err
+			}
+			before = &detailedMessage.Message.Payload
+			deletedMessage = detailedMessage
+		}
+
+		// Deletes message data blob from database
+		//
+		if err = bucket.Delete(uint64ToBytes(id)); err != nil {
+			return &MessageError{Id: id, Err: err}
+		}
+
+		if err = db.appendChange(tx, ChangeDeleted, deletedMessage); err != nil {
+			return err
+		}
+
+		deleted = true
+		return db.appendAuditRecord(tx, AuditOperationDelete, id, before, nil)
 	})
+
+	return deleted, err
 }
 
 // Delete all Messages from the database. Fast way of doing so is to just delete
-// and re create the bucket.
+// and re create the bucket. Their deletion is still recorded in the change log
+// one message at a time, so that its followers and webhooks learn of it.
 //
-// This function isn't called in the core application. It's created to be called
-// by the unit testing code.
+// This function isn't called by the service. It's called by the "clear"
+// subcommand and the unit testing code.
 //
 func (db *Db) ClearMessages() error {
-	return db.boltDb.Update(func(tx *bolt.Tx) error {
+	return db.update("clear_messages", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(db.bucketKey)
+		if bucket == nil && db.tenant != "" {
+			// Tenants are only created on their first write
+			//
+			return nil
+		}
+
+		if bucket != nil {
+			if err := db.releaseMessages(tx, bucket); err != nil {
+				return err
+			}
+		}
+
 		err := tx.DeleteBucket(db.bucketKey)
 		if err != nil && err != bolt.ErrBucketNotFound {
 			return err
@@ -276,3 +641,26 @@ func (db *Db) ClearMessages() error {
 		return nil
 	})
 }
+
+// Converts message data blob "v" stored at key "k" into application data
+// structure. Returns ErrCorruptRecord if it isn't a message.
+//
+func decodeMessage(k []byte, v []byte) (*model.DetailedMessage, error) {
+	// A nil value is returned for keys holding a nested bucket rather than a
+	// message blob, which this application never stores
+	//
+	if v == nil {
+		return nil, fmt.Errorf("%w: key %x holds a bucket", ErrCorruptRecord, k)
+	}
+
+	detailedMessage := &model.DetailedMessage{}
+	if err := json.Unmarshal(v, detailedMessage); err != nil {
+		return nil, fmt.Errorf("%w: key %x: %v", ErrCorruptRecord, k, err)
+	}
+
+	if detailedMessage.Message == nil {
+		return nil, fmt.Errorf("%w: key %x holds no message", ErrCorruptRecord, k)
+	}
+
+	return detailedMessage, nil
+}
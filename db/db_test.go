@@ -1,15 +1,22 @@
 package db
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/brandonto/rest-api-microservice-demo/model"
 
 	"github.com/stretchr/testify/assert"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 var testDbCfg = Config{
-	FilePath:   "/home/brandonto/rest-api-microservice-demo.db",
+	FilePath:   filepath.Join(os.TempDir(), "rest-api-microservice-demo.db"),
 	BucketName: "UnitTestBucket",
 }
 
@@ -71,12 +78,25 @@ func TestBasicFunctionality(t *testing.T) {
 
 	// Try to delete a message at id=1, should succeed
 	//
-	assert.Nil(t, db.DeleteMessage(1), "DeleteMessage() failed")
+	deleted, err := db.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+	assert.True(t, deleted, "There should have been a message to delete")
 
 	// Try to retrieve a message at id=1, should fail
 	//
 	detailedMessageFromDb, err = db.GetMessage(1)
-	assert.NotNil(t, err, "There should not be a message returned from this call")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Try to delete or replace a message at id=1 again, should report that
+	// there is no such message
+	//
+	deleted, err = db.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+	assert.False(t, deleted, "There should not have been a message to delete")
+	messageErr := &MessageError{}
+	assert.ErrorAs(t, db.UpdateMessage(detailedMessage), &messageErr)
+	assert.Equal(t, uint64(1), messageErr.Id, "Unexpected MessageId")
+	assert.ErrorIs(t, messageErr, ErrNotFound)
 
 	// Try to create a message at id=1, should succeed but id should be ignored
 	//
@@ -107,14 +127,14 @@ func TestBasicFunctionality(t *testing.T) {
 
 	// Get a list of 20 messages starting AFTER message id=2
 	//
-	detailedList, afterId, err := db.ListMessages(20, 2+1)
+	detailedList, afterId, err := db.ListMessages(20, 2+1, nil)
 	assert.Nil(t, err, "ListMessages() failed")
 	assert.Equal(t, afterId, uint64(22), "unexpected afterId")
 	assert.Equal(t, len(detailedList), 20, "unexpected list size")
 
 	// Get a list of the next 20 messages starting after message id=22
 	//
-	detailedList, afterId, err = db.ListMessages(20, afterId+1)
+	detailedList, afterId, err = db.ListMessages(20, afterId+1, nil)
 	assert.Nil(t, err, "ListMessages() failed")
 	assert.Equal(t, afterId, uint64(42), "unexpected afterId")
 	assert.Equal(t, len(detailedList), 20, "unexpected list size")
@@ -124,8 +144,922 @@ func TestBasicFunctionality(t *testing.T) {
 	// afterId returned should be 0 to indicate that we're finished iterating
 	// through the database.
 	//
-	detailedList, afterId, err = db.ListMessages(20, afterId+1)
+	detailedList, afterId, err = db.ListMessages(20, afterId+1, nil)
 	assert.Nil(t, err, "ListMessages() failed")
 	assert.Equal(t, afterId, uint64(0), "unexpected afterId")
 	assert.Equal(t, len(detailedList), 1, "unexpected list size")
 }
+
+func TestListMessagesFilter(t *testing.T) {
+	db := NewDb(testDbCfg)
+	db.Initialize()
+	defer db.Close()
+
+	assert.Nil(t, db.ClearMessages(), "ClearMessages() failed")
+
+	// Create 10 messages alternating between 2 owners
+	//
+	for i := 0; i < 10; i++ {
+		owner := "alice"
+		if i%2 == 1 {
+			owner = "bob"
+		}
+		message := &model.Message{Payload: owner}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		detailedMessage := &model.DetailedMessage{Message: message, Metadata: metadata, Owner: owner}
+		assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	}
+
+	ownedByBob := func(detailedMessage *model.DetailedMessage) bool {
+		return detailedMessage.Owner == "bob"
+	}
+
+	// Bob owns messages 2, 4, 6, 8 and 10
+	//
+	detailedList, afterId, err := db.ListMessages(3, 1, ownedByBob)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, uint64(6), afterId, "unexpected afterId")
+	assert.Equal(t, 3, len(detailedList), "unexpected list size")
+
+	// The last page shouldn't return an afterId even though there are non
+	// matching messages left in the database
+	//
+	detailedList, afterId, err = db.ListMessages(2, afterId+1, ownedByBob)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, uint64(0), afterId, "unexpected afterId")
+	assert.Equal(t, 2, len(detailedList), "unexpected list size")
+	assert.Equal(t, uint64(10), detailedList[1].Message.Id, "Unexpected MessageId")
+}
+
+func TestTenants(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:                 filepath.Join(t.TempDir(), "tenants.db"),
+		BucketName:               "UnitTestBucket",
+		DefaultTenantMaxMessages: 2,
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	newMessage := func(payload string) *model.DetailedMessage {
+		message := &model.Message{Payload: payload}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		return &model.DetailedMessage{Message: message, Metadata: metadata}
+	}
+
+	// Tenants that were never written to are empty
+	//
+	detailedList, _, err := db.ForTenant("red").ListMessages(20, 1, nil)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, 0, len(detailedList), "unexpected list size")
+
+	// Writing to a tenant creates it lazily, with its own sequence
+	//
+	assert.Nil(t, db.ForTenant("red").CreateMessage(newMessage("red")), "CreateMessage() failed")
+	assert.Nil(t, db.ForTenant("blue").CreateMessage(newMessage("blue")), "CreateMessage() failed")
+	assert.Nil(t, db.CreateMessage(newMessage("default")), "CreateMessage() failed")
+
+	for _, name := range []string{"red", "blue"} {
+		detailedMessage, err := db.ForTenant(name).GetMessage(1)
+		assert.Nil(t, err, "There should be a message returned from this call")
+		assert.Equal(t, name, detailedMessage.Message.Payload, "Unexpected Payload")
+	}
+
+	detailedMessage, err := db.GetMessage(1)
+	assert.Nil(t, err, "There should be a message returned from this call")
+	assert.Equal(t, "default", detailedMessage.Message.Payload, "Unexpected Payload")
+
+	// Lazily created tenants get the default quota
+	//
+	assert.Nil(t, db.ForTenant("red").CreateMessage(newMessage("red")), "CreateMessage() failed")
+	assert.ErrorIs(t, db.ForTenant("red").CreateMessage(newMessage("red")), ErrTenantQuotaExceeded)
+
+	// Explicitly created tenants get their own quota
+	//
+	assert.Nil(t, db.CreateTenant(&model.Tenant{Name: "green"}), "CreateTenant() failed")
+	assert.ErrorIs(t, db.CreateTenant(&model.Tenant{Name: "green"}), ErrTenantExists)
+	assert.ErrorIs(t, db.CreateTenant(&model.Tenant{Name: "../red"}), ErrInvalidTenantName)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.ForTenant("green").CreateMessage(newMessage("green")), "CreateMessage() failed")
+	}
+
+	tenants, err := db.ListTenants()
+	assert.Nil(t, err, "ListTenants() failed")
+	assert.Equal(t, 3, len(tenants), "unexpected number of tenants")
+	assert.Equal(t, "blue", tenants[0].Name, "unexpected tenant name")
+
+	// Deleting a tenant deletes its messages and nothing else
+	//
+	assert.Nil(t, db.DeleteTenant("red"), "DeleteTenant() failed")
+	assert.ErrorIs(t, db.DeleteTenant("red"), ErrTenantNotFound)
+	_, err = db.ForTenant("red").GetMessage(1)
+	assert.NotNil(t, err, "There should not be a message returned from this call")
+	_, err = db.ForTenant("blue").GetMessage(1)
+	assert.Nil(t, err, "There should be a message returned from this call")
+
+	// The messages deleted along with the tenant are recorded as deleted
+	//
+	changes, _, err := db.ForTenant("red").ListChanges(10, 1, func(change *model.Change) bool { return change.Type == ChangeDeleted })
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, 2, len(changes), "unexpected number of changes")
+	assert.Equal(t, "red", changes[0].Message.Message.Payload, "unexpected payload")
+
+	// Deleted tenants stay deleted until they're explicitly created again
+	//
+	assert.ErrorIs(t, db.ForTenant("red").CreateMessage(newMessage("red")), ErrTenantNotFound)
+	assert.Nil(t, db.CreateTenant(&model.Tenant{Name: "red"}), "CreateTenant() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(newMessage("red")), "CreateMessage() failed")
+
+	// Handles that don't create tenants only write to existing ones
+	//
+	assert.ErrorIs(t, db.ForTenant("yellow").WithoutTenantCreation().CreateMessage(newMessage("yellow")), ErrTenantNotFound)
+	assert.Nil(t, db.ForTenant("blue").WithoutTenantCreation().CreateMessage(newMessage("blue")), "CreateMessage() failed")
+}
+
+func TestQuota(t *testing.T) {
+	cfg := Config{
+		FilePath:   filepath.Join(t.TempDir(), "quota.db"),
+		BucketName: "UnitTestBucket",
+		Quota:      Quota{MaxMessages: 3, MaxPayloadBytes: 10},
+	}
+	db := NewDb(cfg)
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+
+	newMessage := func(owner string, payload string) *model.DetailedMessage {
+		message := &model.Message{Payload: payload}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		return &model.DetailedMessage{Message: message, Metadata: metadata, Owner: owner}
+	}
+
+	// Payload bytes are counted across tenants
+	//
+	assert.Nil(t, db.CreateMessage(newMessage("alice", "12345")), "CreateMessage() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(newMessage("alice", "1234")), "CreateMessage() failed")
+	assert.ErrorIs(t, db.CreateMessage(newMessage("alice", "12")), ErrQuotaExceeded)
+	assert.Nil(t, db.CreateMessage(newMessage("bob", "12")), "CreateMessage() failed")
+
+	usage, err := db.GetUsage("alice")
+	assert.Nil(t, err, "GetUsage() failed")
+	assert.Equal(t, Usage{Messages: 2, PayloadBytes: 9}, *usage, "unexpected usage")
+
+	// Updates can't be used to get around the payload quota
+	//
+	detailedMessage, err := db.GetMessage(1)
+	assert.Nil(t, err, "There should be a message returned from this call")
+	detailedMessage.Message.Payload = "1234567"
+	assert.ErrorIs(t, db.UpdateMessage(detailedMessage), ErrQuotaExceeded)
+	detailedMessage.Message.Payload = "1"
+	assert.Nil(t, db.UpdateMessage(detailedMessage), "UpdateMessage() failed")
+
+	// Deleting messages frees up quota
+	//
+	assert.Nil(t, db.CreateMessage(newMessage("alice", "1")), "CreateMessage() failed")
+	assert.ErrorIs(t, db.CreateMessage(newMessage("alice", "1")), ErrQuotaExceeded)
+	_, err = db.ForTenant("red").DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+	assert.Nil(t, db.CreateMessage(newMessage("alice", "1")), "CreateMessage() failed")
+
+	// Usage is rebuilt from scratch if it's missing
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(usageBucketKey)
+	}), "Deleting usage failed")
+	db.Close()
+	db = NewDb(cfg)
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	usage, err = db.GetUsage("alice")
+	assert.Nil(t, err, "GetUsage() failed")
+	assert.Equal(t, Usage{Messages: 3, PayloadBytes: 3}, *usage, "unexpected usage")
+}
+
+func TestAuditLog(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "audit.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	// Changes made through an unaudited handle aren't recorded
+	//
+	message := &model.Message{Payload: "unaudited"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	detailedMessage := &model.DetailedMessage{Message: message, Metadata: metadata}
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+
+	aliceDb := db.WithAuditContext(&AuditContext{Principal: "alice", RemoteAddr: "127.0.0.1:1234", RequestId: "req-1"})
+	bobDb := db.ForTenant("red").WithAuditContext(&AuditContext{Principal: "bob"})
+
+	message.Payload = "foo"
+	assert.Nil(t, aliceDb.CreateMessage(detailedMessage), "CreateMessage() failed")
+	message.Payload = "bar"
+	assert.Nil(t, aliceDb.UpdateMessage(detailedMessage), "UpdateMessage() failed")
+	_, err := aliceDb.DeleteMessage(detailedMessage.Message.Id)
+	assert.Nil(t, err, "DeleteMessage() failed")
+	assert.Nil(t, bobDb.CreateMessage(detailedMessage), "CreateMessage() failed")
+
+	records, afterSequence, err := db.ListAuditRecords(10, 1, AuditFilter{})
+	assert.Nil(t, err, "ListAuditRecords() failed")
+	assert.Equal(t, uint64(0), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, 4, len(records), "unexpected number of records")
+	assert.Equal(t, AuditOperationCreate, records[0].Operation, "unexpected operation")
+	assert.Equal(t, "req-1", records[0].RequestId, "unexpected request ID")
+	assert.Equal(t, uint64(2), records[0].MessageId, "unexpected message ID")
+	assert.Equal(t, "", records[0].BeforeHash, "unexpected before hash")
+	assert.Equal(t, records[0].AfterHash, records[1].BeforeHash, "unexpected before hash")
+	assert.Equal(t, AuditOperationDelete, records[2].Operation, "unexpected operation")
+	assert.Equal(t, "", records[2].AfterHash, "unexpected after hash")
+	assert.Equal(t, "red", records[3].Tenant, "unexpected tenant")
+	assert.Equal(t, records[2].Hash, records[3].PrevHash, "unexpected previous hash")
+
+	records, afterSequence, err = db.ListAuditRecords(2, 1, AuditFilter{Principal: "alice"})
+	assert.Nil(t, err, "ListAuditRecords() failed")
+	assert.Equal(t, uint64(2), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, 2, len(records), "unexpected number of records")
+
+	numRecords, err := db.VerifyAuditLog()
+	assert.Nil(t, err, "VerifyAuditLog() failed")
+	assert.Equal(t, uint64(4), numRecords, "unexpected number of records")
+
+	// Rewriting history is detected
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucketKey)
+		buf := bytes.Replace(bucket.Get(uint64ToBytes(2)), []byte("alice"), []byte("carol"), 1)
+		return bucket.Put(uint64ToBytes(2), buf)
+	}), "Tampering failed")
+
+	numRecords, err = db.VerifyAuditLog()
+	assert.ErrorIs(t, err, ErrAuditChainBroken)
+	assert.Equal(t, uint64(1), numRecords, "unexpected number of records")
+}
+
+func TestChanges(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "changes.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	notified, unsubscribe := db.SubscribeChanges()
+	defer unsubscribe()
+
+	message := &model.Message{Payload: "foo"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	detailedMessage := &model.DetailedMessage{Message: message, Metadata: metadata, Owner: "alice"}
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	message.Payload = "bar"
+	assert.Nil(t, db.UpdateMessage(detailedMessage), "UpdateMessage() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(detailedMessage), "CreateMessage() failed")
+	_, err := db.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+
+	// Subscribers are signaled once for as many changes as they missed, and
+	// never hold up the writers
+	//
+	assert.Len(t, notified, 1, "subscriber wasn't signaled")
+	<-notified
+
+	// Changes are listed for the tenant the Db is scoped to only
+	//
+	changes, afterSequence, err := db.ListChanges(10, 1, nil)
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, uint64(0), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, 3, len(changes), "unexpected number of changes")
+	assert.Equal(t, ChangeCreated, changes[0].Type, "unexpected change type")
+	assert.Equal(t, "foo", changes[0].Message.Message.Payload, "unexpected payload")
+	assert.Equal(t, ChangeUpdated, changes[1].Type, "unexpected change type")
+	assert.Equal(t, "bar", changes[1].Message.Message.Payload, "unexpected payload")
+	assert.Equal(t, ChangeDeleted, changes[2].Type, "unexpected change type")
+	assert.Equal(t, uint64(4), changes[2].Sequence, "unexpected sequence")
+	assert.Equal(t, "alice", changes[2].Message.Owner, "unexpected owner")
+
+	changes, _, err = db.ForTenant("red").ListChanges(10, 1, nil)
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, 1, len(changes), "unexpected number of changes")
+	assert.Equal(t, "red", changes[0].Tenant, "unexpected tenant")
+
+	changes, afterSequence, err = db.ListChanges(1, 2, func(change *model.Change) bool { return change.Type != ChangeUpdated })
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, uint64(0), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, uint64(4), changes[0].Sequence, "unexpected sequence")
+
+	sequence, err := db.LastChangeSequence()
+	assert.Nil(t, err, "LastChangeSequence() failed")
+	assert.Equal(t, uint64(4), sequence, "unexpected sequence")
+
+	// Nothing is recorded, nor signaled, for changes that are rolled back
+	//
+	_, err = db.ImportMessages([]*model.DetailedMessage{detailedMessage}, ImportOptions{DryRun: true})
+	assert.Nil(t, err, "ImportMessages() failed")
+	assert.Len(t, notified, 0, "subscriber was signaled")
+	sequence, err = db.LastChangeSequence()
+	assert.Nil(t, err, "LastChangeSequence() failed")
+	assert.Equal(t, uint64(4), sequence, "unexpected sequence")
+
+	// Messages cleared all at once are still recorded as deleted one at a time
+	//
+	message.Id = 0
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	assert.Nil(t, db.ClearMessages(), "ClearMessages() failed")
+	changes, _, err = db.ListChanges(10, 6, nil)
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, 1, len(changes), "unexpected number of changes")
+	assert.Equal(t, ChangeDeleted, changes[0].Type, "unexpected change type")
+	assert.Equal(t, "bar", changes[0].Message.Message.Payload, "unexpected payload")
+}
+
+func TestChangeLog(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "changelog.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	message := &model.Message{Payload: "foo"}
+	detailedMessage := &model.DetailedMessage{Message: message, Metadata: &model.MessageMetadata{}, Owner: "alice"}
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	message.Payload = "bar"
+	assert.Nil(t, db.UpdateMessage(detailedMessage), "UpdateMessage() failed")
+	message.Id = 0
+	assert.Nil(t, db.ForTenant("red").CreateMessage(detailedMessage), "CreateMessage() failed")
+	message.Id = 0
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	_, err := db.DeleteMessage(2)
+	assert.Nil(t, err, "DeleteMessage() failed")
+
+	// The change log is read across tenants, in pages
+	//
+	changes, afterSequence, err := db.ReadChangeLog(0, 3)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, uint64(3), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, 3, len(changes), "unexpected number of changes")
+	assert.Equal(t, "red", changes[2].Tenant, "unexpected tenant")
+
+	changes, afterSequence, err = db.ReadChangeLog(afterSequence, 3)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, uint64(0), afterSequence, "unexpected afterSequence")
+	assert.Equal(t, 2, len(changes), "unexpected number of changes")
+	assert.Equal(t, ChangeDeleted, changes[1].Type, "unexpected change type")
+
+	// Consumers commit offsets, up to the last change
+	//
+	consumer, err := db.CommitChangeOffset("indexer", 3)
+	assert.Nil(t, err, "CommitChangeOffset() failed")
+	assert.Equal(t, uint64(3), consumer.Offset, "unexpected offset")
+	_, err = db.CommitChangeOffset("indexer", 6)
+	assert.Equal(t, ErrInvalidOffset, err, "unexpected error")
+	_, err = db.CommitChangeOffset("Indexer!", 1)
+	assert.Equal(t, ErrInvalidConsumerName, err, "unexpected error")
+	_, err = db.CommitChangeOffset("cache", 0)
+	assert.Nil(t, err, "CommitChangeOffset() failed")
+
+	consumers, err := db.ListChangeConsumers()
+	assert.Nil(t, err, "ListChangeConsumers() failed")
+	assert.Equal(t, 2, len(consumers), "unexpected number of consumers")
+	assert.Equal(t, "cache", consumers[0].Name, "unexpected consumer")
+	consumer, err = db.GetChangeConsumer("indexer")
+	assert.Nil(t, err, "GetChangeConsumer() failed")
+	assert.Equal(t, uint64(3), consumer.Offset, "unexpected offset")
+
+	assert.Nil(t, db.DeleteChangeConsumer("cache"), "DeleteChangeConsumer() failed")
+	_, err = db.GetChangeConsumer("cache")
+	assert.Equal(t, ErrConsumerNotFound, err, "unexpected error")
+	assert.Equal(t, ErrConsumerNotFound, db.DeleteChangeConsumer("cache"), "unexpected error")
+
+	// Compaction only keeps the last change of every message, deletions
+	// included, even across batches
+	//
+	changeLogBatchSize = 2
+	t.Cleanup(func() { changeLogBatchSize = 1000 })
+	report, err := db.ApplyChangeLogPolicies(ChangeLogConfig{Compact: true}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	assert.Equal(t, &ChangeLogReport{Compacted: 2}, report, "unexpected report")
+
+	changes, _, err = db.ReadChangeLog(0, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, 3, len(changes), "unexpected number of changes")
+	assert.Equal(t, uint64(2), changes[0].Sequence, "unexpected sequence")
+	assert.Equal(t, "bar", changes[0].Message.Message.Payload, "unexpected payload")
+	assert.Equal(t, uint64(5), changes[2].Sequence, "unexpected sequence")
+
+	// Retention removes the oldest changes, after which they can no longer be
+	// read from before them
+	//
+	report, err = db.ApplyChangeLogPolicies(ChangeLogConfig{MaxChanges: 2}, time.Now())
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	assert.Equal(t, &ChangeLogReport{Expired: 1}, report, "unexpected report")
+
+	_, _, err = db.ReadChangeLog(1, 10)
+	assert.ErrorIs(t, err, ErrChangesExpired, "unexpected error")
+	changes, _, err = db.ReadChangeLog(2, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, 2, len(changes), "unexpected number of changes")
+	changes, _, err = db.ReadChangeLog(0, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, 2, len(changes), "unexpected number of changes")
+
+	// Likewise when listed, or checked for, by those streaming them, even if
+	// none of the changes removed were to their messages
+	//
+	_, _, err = db.ForTenant("red").ListChanges(10, 2, nil)
+	assert.ErrorIs(t, err, ErrChangesExpired, "unexpected error")
+	assert.ErrorIs(t, db.CheckChangesRetained(1), ErrChangesExpired, "unexpected error")
+	changes, _, err = db.ListChanges(10, 3, nil)
+	assert.Nil(t, err, "ListChanges() failed")
+	assert.Equal(t, 1, len(changes), "unexpected number of changes")
+	assert.Nil(t, db.CheckChangesRetained(2), "CheckChangesRetained() failed")
+
+	// Changes a consumer hasn't committed yet are kept, unless asked otherwise
+	//
+	report, err = db.ApplyChangeLogPolicies(ChangeLogConfig{Retention: time.Hour}, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	assert.Equal(t, &ChangeLogReport{Expired: 1}, report, "unexpected report")
+	changes, _, err = db.ReadChangeLog(3, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, 1, len(changes), "unexpected number of changes")
+
+	report, err = db.ApplyChangeLogPolicies(ChangeLogConfig{Retention: time.Hour, ExpireUnread: true}, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err, "ApplyChangeLogPolicies() failed")
+	assert.Equal(t, &ChangeLogReport{Expired: 1}, report, "unexpected report")
+	_, _, err = db.ReadChangeLog(3, 10)
+	assert.ErrorIs(t, err, ErrChangesExpired, "unexpected error")
+	changes, _, err = db.ReadChangeLog(5, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Empty(t, changes, "unexpected changes")
+
+	// Sequence numbers carry on from where they were
+	//
+	message.Id = 0
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	changes, _, err = db.ReadChangeLog(5, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, uint64(6), changes[0].Sequence, "unexpected sequence")
+
+	verifyReport, err := db.Verify()
+	assert.Nil(t, err, "Verify() failed")
+	assert.Empty(t, verifyReport.Problems, "unexpected problems")
+}
+
+func TestWebhooks(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "webhooks.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	all := &model.Webhook{Url: "http://localhost/all", Secret: "foo"}
+	assert.Nil(t, db.CreateWebhook(all), "CreateWebhook() failed")
+	deleted := &model.Webhook{Url: "http://localhost/deleted", Types: []string{ChangeDeleted}, Secret: "bar"}
+	assert.Nil(t, db.CreateWebhook(deleted), "CreateWebhook() failed")
+	assert.Equal(t, uint64(2), deleted.Id, "unexpected ID")
+
+	webhooks, err := db.ListWebhooks()
+	assert.Nil(t, err, "ListWebhooks() failed")
+	assert.Equal(t, 2, len(webhooks), "unexpected number of webhooks")
+	webhook, err := db.GetWebhook(2)
+	assert.Nil(t, err, "GetWebhook() failed")
+	assert.Equal(t, "bar", webhook.Secret, "unexpected secret")
+
+	// Deliveries are queued along with changes, for the webhooks interested in
+	// them, from every tenant
+	//
+	message := &model.Message{Payload: "foo"}
+	detailedMessage := &model.DetailedMessage{Message: message, Metadata: &model.MessageMetadata{}, Owner: "alice"}
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	_, err = db.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(detailedMessage), "CreateMessage() failed")
+
+	deliveries, next, err := db.DueDeliveries(all.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.True(t, next.IsZero(), "no delivery should be pending")
+	assert.Equal(t, 3, len(deliveries), "unexpected number of deliveries")
+	assert.Equal(t, uint64(1), deliveries[0].WebhookId, "unexpected webhook")
+	assert.Equal(t, "red", deliveries[2].Change.Tenant, "unexpected tenant")
+
+	deletions, _, err := db.DueDeliveries(deleted.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Equal(t, 1, len(deletions), "unexpected number of deliveries")
+	assert.Equal(t, ChangeDeleted, deletions[0].Change.Type, "unexpected change type")
+	assert.Equal(t, uint64(2), deletions[0].WebhookId, "unexpected webhook")
+
+	// Nothing is queued for changes that are rolled back
+	//
+	_, err = db.ImportMessages([]*model.DetailedMessage{detailedMessage}, ImportOptions{DryRun: true})
+	assert.Nil(t, err, "ImportMessages() failed")
+	deliveries, _, err = db.DueDeliveries(all.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Equal(t, 3, len(deliveries), "unexpected number of deliveries")
+
+	// Deliveries leave the outbox once completed, or dead lettered, and are
+	// due again once retried
+	//
+	assert.Nil(t, db.CompleteDelivery(deliveries[0]), "CompleteDelivery() failed")
+	deliveries[1].Attempts = 1
+	nextAttemptAt := time.Now().Add(time.Hour)
+	assert.Nil(t, db.RetryDelivery(deliveries[1], nextAttemptAt), "RetryDelivery() failed")
+	deletions[0].Attempts = 3
+	assert.Nil(t, db.DeadLetterDelivery(deletions[0]), "DeadLetterDelivery() failed")
+
+	pending, next, err := db.DueDeliveries(all.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Equal(t, 1, len(pending), "unexpected number of deliveries")
+	assert.Equal(t, deliveries[2].Id, pending[0].Id, "unexpected delivery")
+	assert.WithinDuration(t, nextAttemptAt, next, time.Millisecond, "unexpected next attempt")
+
+	// Whether anything is due can be looked up without loading any delivery
+	//
+	pending, next, err = db.DueDeliveries(all.Id, time.Now(), 0)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Empty(t, pending, "unexpected deliveries")
+	assert.WithinDuration(t, deliveries[2].NextAttemptAt, next, time.Millisecond, "unexpected next attempt")
+
+	deadLetters, afterId, err := db.ListDeadLetters(10, 0)
+	assert.Nil(t, err, "ListDeadLetters() failed")
+	assert.Equal(t, uint64(0), afterId, "unexpected afterId")
+	assert.Equal(t, 1, len(deadLetters), "unexpected number of dead letters")
+	assert.Equal(t, uint64(3), deadLetters[0].Attempts, "unexpected attempts")
+
+	// Redelivered dead letters are due right away, with a clean slate
+	//
+	notified, unsubscribe := db.SubscribeChanges()
+	defer unsubscribe()
+	redelivered, err := db.RedeliverDeadLetter(deadLetters[0].Id)
+	assert.Nil(t, err, "RedeliverDeadLetter() failed")
+	assert.Equal(t, uint64(0), redelivered.Attempts, "unexpected attempts")
+	assert.Len(t, notified, 1, "subscriber wasn't signaled")
+	_, err = db.RedeliverDeadLetter(deadLetters[0].Id)
+	assert.Equal(t, ErrDeliveryNotFound, err, "unexpected error")
+
+	// Deleting a webhook drops its queued deliveries
+	//
+	assert.Nil(t, db.DeleteWebhook(1), "DeleteWebhook() failed")
+	assert.Equal(t, ErrWebhookNotFound, db.DeleteWebhook(1), "unexpected error")
+	_, err = db.GetWebhook(1)
+	assert.Equal(t, ErrWebhookNotFound, err, "unexpected error")
+
+	pending, next, err = db.DueDeliveries(all.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Empty(t, pending, "unexpected deliveries")
+	assert.True(t, next.IsZero(), "no delivery should be pending")
+
+	pending, next, err = db.DueDeliveries(deleted.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Equal(t, 1, len(pending), "unexpected number of deliveries")
+	assert.Equal(t, redelivered.Id, pending[0].Id, "unexpected delivery")
+	assert.True(t, next.IsZero(), "no delivery should be pending")
+
+	report, err := db.Verify()
+	assert.Nil(t, err, "Verify() failed")
+	assert.Empty(t, report.Problems, "unexpected problems")
+}
+
+func TestRepair(t *testing.T) {
+	cfg := Config{
+		FilePath:   filepath.Join(t.TempDir(), "repair.db"),
+		BucketName: "UnitTestBucket",
+	}
+	db := NewDb(cfg)
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+
+	message := &model.Message{Payload: "foo"}
+	metadata := &model.MessageMetadata{Palindrome: false}
+	detailedMessage := &model.DetailedMessage{Message: message, Metadata: metadata}
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(detailedMessage), "CreateMessage() failed")
+
+	// Corrupt records are reported rather than crashing
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(db.bucketKey).Put(uint64ToBytes(2), []byte("garbage")); err != nil {
+			return err
+		}
+		_, err := tx.Bucket([]byte(tenantBucketPrefix+"red")).CreateBucket(uint64ToBytes(2))
+		return err
+	}), "Tampering failed")
+
+	_, _, err := db.ListMessages(0, 0, nil)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = db.GetMessage(2)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+	_, _, err = db.ForTenant("red").ListMessages(0, 0, nil)
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = db.GetMessage(3)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// So is a missing bucket
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(db.bucketKey)
+	}), "Tampering failed")
+
+	_, _, err = db.ListMessages(0, 0, nil)
+	assert.ErrorIs(t, err, ErrBucketMissing)
+	assert.ErrorIs(t, db.CreateMessage(detailedMessage), ErrBucketMissing)
+	_, err = db.DeleteMessage(1)
+	assert.ErrorIs(t, err, ErrBucketMissing)
+
+	// In repair mode, the missing bucket is recreated as soon as it's needed...
+	//
+	db.RepairMode = true
+	messages, _, err := db.ListMessages(0, 0, nil)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, 0, len(messages), "unexpected number of messages")
+
+	// ...and corrupt records are quarantined
+	//
+	messages, _, err = db.ForTenant("red").ListMessages(0, 0, nil)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, 1, len(messages), "unexpected number of messages")
+
+	assert.Nil(t, db.boltDb().View(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket(quarantineBucketKey).Bucket([]byte(tenantBucketPrefix + "red"))
+		assert.NotNil(t, quarantine.Bucket(uint64ToBytes(2)), "Record wasn't quarantined")
+		return nil
+	}), "Reading quarantine failed")
+
+	// Corrupt records are also quarantined on initialization
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucketKey).Put(uint64ToBytes(7), []byte("{}"))
+	}), "Tampering failed")
+	db.Close()
+
+	cfg.RepairMode = true
+	db = NewDb(cfg)
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	report, err := db.Repair()
+	assert.Nil(t, err, "Repair() failed")
+	assert.Equal(t, RepairReport{RecreatedBuckets: []string{}}, *report, "Nothing should have been left to repair")
+
+	assert.Nil(t, db.boltDb().View(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket(quarantineBucketKey).Bucket(db.bucketKey)
+		assert.Equal(t, []byte("{}"), quarantine.Get(uint64ToBytes(7)), "Record wasn't quarantined")
+		return nil
+	}), "Reading quarantine failed")
+}
+
+func TestUnavailable(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "unavailable.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	db.Close()
+
+	// A closed database is reported as unavailable rather than broken
+	//
+	_, err := db.GetMessage(1)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, err, bolt.ErrDatabaseNotOpen)
+	_, err = db.DeleteMessage(1)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, db.Ping(), ErrUnavailable)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) {
+	return fn(p)
+}
+
+func TestBackupRestore(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "backup.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	newMessage := func(payload string) *model.DetailedMessage {
+		message := &model.Message{Payload: payload}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		return &model.DetailedMessage{Message: message, Metadata: metadata}
+	}
+	assert.Nil(t, db.CreateMessage(newMessage("foo")), "CreateMessage() failed")
+	assert.Nil(t, db.ForTenant("red").CreateMessage(newMessage("bar")), "CreateMessage() failed")
+
+	snapshot := &bytes.Buffer{}
+	n, err := db.Backup(snapshot)
+	assert.Nil(t, err, "Backup() failed")
+	assert.Equal(t, int64(snapshot.Len()), n, "unexpected number of bytes written")
+
+	// The database isn't held on to while the snapshot is being written out,
+	// so compacting it in the meantime doesn't deadlock
+	//
+	compacted := false
+	_, err = db.Backup(writerFunc(func(p []byte) (int, error) {
+		if !compacted {
+			compacted = true
+			if _, _, err := db.Compact(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}))
+	assert.Nil(t, err, "Backup() failed")
+	assert.True(t, compacted, "snapshot should have been written")
+
+	// Changes made after the backup are undone by restoring it, including
+	// through handles derived before the restore
+	//
+	redDb := db.ForTenant("red")
+	assert.Nil(t, db.CreateMessage(newMessage("baz")), "CreateMessage() failed")
+	_, err = redDb.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+
+	assert.Nil(t, db.Restore(bytes.NewReader(snapshot.Bytes())), "Restore() failed")
+
+	messages, _, err := db.ListMessages(0, 0, nil)
+	assert.Nil(t, err, "ListMessages() failed")
+	assert.Equal(t, 1, len(messages), "unexpected number of messages")
+	detailedMessage, err := redDb.GetMessage(1)
+	assert.Nil(t, err, "There should be a message returned from this call")
+	assert.Equal(t, "bar", detailedMessage.Message.Payload, "unexpected payload")
+
+	// The change log starts over after the restore, with the changes restored
+	//
+	assert.ErrorIs(t, db.CheckChangesRetained(4), ErrChangesExpired, "unexpected error")
+	changes, _, err := db.ReadChangeLog(0, 10)
+	assert.Nil(t, err, "ReadChangeLog() failed")
+	assert.Equal(t, 2, len(changes), "unexpected number of changes")
+	assert.Equal(t, uint64(6), changes[0].Sequence, "unexpected sequence")
+	assert.Equal(t, "red", changes[1].Tenant, "unexpected tenant")
+	assert.Nil(t, db.CheckChangesRetained(changes[1].Sequence), "CheckChangesRetained() failed")
+
+	// Invalid snapshots are rejected, leaving the database untouched
+	//
+	assert.ErrorIs(t, db.Restore(bytes.NewReader([]byte("garbage"))), ErrInvalidSnapshot)
+
+	otherDb := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "other.db"),
+		BucketName: "OtherBucket",
+	})
+	assert.Nil(t, otherDb.Initialize(), "Initialize() failed")
+	otherSnapshot := &bytes.Buffer{}
+	_, err = otherDb.Backup(otherSnapshot)
+	assert.Nil(t, err, "Backup() failed")
+	otherDb.Close()
+	assert.ErrorIs(t, db.Restore(otherSnapshot), ErrInvalidSnapshot)
+
+	_, err = db.GetMessage(1)
+	assert.Nil(t, err, "There should be a message returned from this call")
+
+	// Only the most recent backups written to a directory are kept
+	//
+	backupDir := t.TempDir()
+	var backupPaths []string
+	for i := 0; i < 3; i++ {
+		backupPath, err := db.BackupToDir(backupDir, 2)
+		assert.Nil(t, err, "BackupToDir() failed")
+		backupPaths = append(backupPaths, backupPath)
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	assert.Nil(t, err, "Unable to read backup directory")
+	assert.Equal(t, 2, len(entries), "unexpected number of backups")
+	assert.Equal(t, filepath.Base(backupPaths[1]), entries[0].Name(), "unexpected backup")
+	assert.Equal(t, filepath.Base(backupPaths[2]), entries[1].Name(), "unexpected backup")
+}
+
+func TestImportMessages(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "import.db"),
+		BucketName: "UnitTestBucket",
+		Quota:      Quota{MaxMessages: 3},
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	newMessage := func(id uint64, owner string) *model.DetailedMessage {
+		message := &model.Message{Id: id, Payload: "foo"}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		return &model.DetailedMessage{Message: message, Metadata: metadata, Owner: owner}
+	}
+	assert.Nil(t, db.CreateMessage(newMessage(0, "alice")), "CreateMessage() failed")
+
+	// A dry run reports what would happen without changing anything
+	//
+	results, err := db.ImportMessages([]*model.DetailedMessage{newMessage(1, "alice"), newMessage(10, "alice")}, ImportOptions{PreserveIds: true, DryRun: true})
+	assert.Nil(t, err, "ImportMessages() failed")
+	assert.ErrorIs(t, results[0], ErrMessageExists)
+	assert.Nil(t, results[1], "unexpected import error")
+	_, err = db.GetMessage(10)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Preserved IDs advance the sequence, so messages created later don't
+	// collide with them
+	//
+	results, err = db.ImportMessages([]*model.DetailedMessage{newMessage(1, "alice"), newMessage(10, "alice"), newMessage(5, "bob")}, ImportOptions{PreserveIds: true})
+	assert.Nil(t, err, "ImportMessages() failed")
+	assert.ErrorIs(t, results[0], ErrMessageExists)
+	assert.Nil(t, results[1], "unexpected import error")
+	assert.Nil(t, results[2], "unexpected import error")
+
+	detailedMessage, err := db.GetMessage(5)
+	assert.Nil(t, err, "There should be a message returned from this call")
+	assert.Equal(t, "bob", detailedMessage.Owner, "unexpected owner")
+
+	detailedMessage = newMessage(0, "alice")
+	assert.Nil(t, db.CreateMessage(detailedMessage), "CreateMessage() failed")
+	assert.Equal(t, uint64(11), detailedMessage.Message.Id, "unexpected message ID")
+
+	// Reassigned IDs ignore the ones the messages came with, and messages over
+	// quota are skipped without failing the others
+	//
+	imported := []*model.DetailedMessage{newMessage(1, "alice"), newMessage(1, "bob")}
+	results, err = db.ImportMessages(imported, ImportOptions{})
+	assert.Nil(t, err, "ImportMessages() failed")
+	assert.ErrorIs(t, results[0], ErrQuotaExceeded)
+	assert.Nil(t, results[1], "unexpected import error")
+	assert.Equal(t, uint64(12), imported[1].Message.Id, "unexpected message ID")
+
+	// No transaction is held while the caller handles a message, so the
+	// database can even be compacted in the meantime
+	//
+	var ids []uint64
+	err = db.ForEachMessage(nil, func(detailedMessage *model.DetailedMessage) error {
+		ids = append(ids, detailedMessage.Message.Id)
+		_, _, err := db.Compact()
+		return err
+	})
+	assert.Nil(t, err, "ForEachMessage() failed")
+	assert.Equal(t, []uint64{1, 5, 10, 11, 12}, ids, "unexpected messages")
+}
+
+func TestMaintenance(t *testing.T) {
+	db := NewDb(Config{
+		FilePath:   filepath.Join(t.TempDir(), "maintenance.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, db.Initialize(), "Initialize() failed")
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		message := &model.Message{Payload: strings.Repeat("foo", 100)}
+		metadata := &model.MessageMetadata{Palindrome: false}
+		assert.Nil(t, db.CreateMessage(&model.DetailedMessage{Message: message, Metadata: metadata}), "CreateMessage() failed")
+	}
+	for i := uint64(1); i < 100; i++ {
+		_, err := db.DeleteMessage(i)
+		assert.Nil(t, err, "DeleteMessage() failed")
+	}
+
+	buckets, err := db.Inspect()
+	assert.Nil(t, err, "Inspect() failed")
+	assert.Equal(t, "UnitTestBucket", buckets[0].Name, "unexpected bucket")
+	assert.Equal(t, 1, buckets[0].Keys, "unexpected number of keys")
+	assert.Equal(t, uint64(100), buckets[0].Sequence, "unexpected sequence")
+
+	// Compacting reclaims the space of the deleted messages, keeping the rest.
+	// The change log keeps a copy of them, so it's emptied first.
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(changeLogBucketKey); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(changeLogBucketKey)
+		return err
+	}), "Emptying the change log failed")
+
+	before, after, err := db.Compact()
+	assert.Nil(t, err, "Compact() failed")
+	assert.Less(t, after, before, "Compact() should have shrunk the file")
+
+	buf, err := db.GetRawMessage(100)
+	assert.Nil(t, err, "GetRawMessage() failed")
+	assert.Contains(t, string(buf), `"id":100`, "unexpected message")
+	_, err = db.GetRawMessage(1)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	report, err := db.Verify()
+	assert.Nil(t, err, "Verify() failed")
+	assert.Equal(t, uint64(2), report.Records, "unexpected number of records")
+	assert.Empty(t, report.Problems, "unexpected problems")
+
+	// Records that can't be decoded are reported, and can still be dumped
+	//
+	assert.Nil(t, db.boltDb().Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(db.bucketKey).Put(uint64ToBytes(101), []byte("garbage")); err != nil {
+			return err
+		}
+		return tx.Bucket(tenantRegistryBucketKey).Put([]byte("red"), []byte("{"))
+	}), "Tampering failed")
+
+	report, err = db.Verify()
+	assert.Nil(t, err, "Verify() failed")
+	assert.Equal(t, 2, len(report.Problems), "unexpected number of problems")
+	assert.Contains(t, report.Problems[0], `bucket "UnitTestBucket", key 101`, "unexpected problem")
+	assert.Contains(t, report.Problems[1], `bucket "_tenants", key "red"`, "unexpected problem")
+
+	buf, err = db.GetRawMessage(101)
+	assert.Nil(t, err, "GetRawMessage() failed")
+	assert.Equal(t, "garbage", string(buf), "unexpected message")
+}
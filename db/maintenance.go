@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bytes copied between each commit while compacting, same as the bbolt CLI
+//
+const compactTxMaxSize = 65536
+
+// Describes one of the top level buckets of the database
+//
+type BucketInfo struct {
+	Name       string `json:"name"`
+	Keys       int    `json:"keys"`     // Keys, including those of nested buckets
+	Sequence   uint64 `json:"sequence"` // Last ID handed out
+	Depth      int    `json:"depth"`
+	Pages      int    `json:"pages"`      // Branch and leaf pages, overflow included
+	InuseBytes int    `json:"inuseBytes"` // Bytes actually used by those pages
+}
+
+// Describes every top level bucket of the database, in name order
+//
+func (db *Db) Inspect() ([]*BucketInfo, error) {
+	var buckets []*BucketInfo
+
+	err := db.view("inspect", func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			stats := bucket.Stats()
+			buckets = append(buckets, &BucketInfo{
+				Name:       string(name),
+				Keys:       stats.KeyN,
+				Sequence:   bucket.Sequence(),
+				Depth:      stats.Depth,
+				Pages:      stats.BranchPageN + stats.BranchOverflowN + stats.LeafPageN + stats.LeafOverflowN,
+				InuseBytes: stats.BranchInuse + stats.LeafInuse,
+			})
+			return nil
+		})
+	})
+
+	return buckets, err
+}
+
+// Returns the message with ID "id" as stored, whether or not it can be decoded
+//
+func (db *Db) GetRawMessage(id uint64) ([]byte, error) {
+	var buf []byte
+
+	err := db.view("get_raw_message", func(tx *bolt.Tx) error {
+		bucket, err := db.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		if bucket != nil {
+			if v := bucket.Get(uint64ToBytes(id)); v != nil {
+				buf = append([]byte{}, v...)
+			} else if bucket.Bucket(uint64ToBytes(id)) != nil {
+				return &MessageError{Id: id, Err: fmt.Errorf("%w: value is a bucket", ErrCorruptRecord)}
+			}
+		}
+		if buf == nil {
+			return &MessageError{Id: id, Err: ErrNotFound}
+		}
+
+		return nil
+	})
+
+	return buf, err
+}
+
+// Rewrites the database file without its free pages, reclaiming the space they
+// take on disk. Every other transaction waits for the compaction to complete.
+// Returns the size of the file before and after.
+//
+func (db *Db) Compact() (int64, int64, error) {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	if db.boltDb() == nil {
+		return 0, 0, fmt.Errorf("%w: database isn't open", ErrUnavailable)
+	}
+
+	before, err := os.Stat(db.FilePath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The compacted copy is written next to the database file so that it can
+	// be renamed over it
+	//
+	file, err := os.CreateTemp(filepath.Dir(db.FilePath), "."+filepath.Base(db.FilePath)+".compact-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	dst, err := bolt.Open(file.Name(), 0600, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = bolt.Compact(dst, db.boltDb(), compactTxMaxSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after, err := os.Stat(file.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return before.Size(), after.Size(), db.replaceFile(file.Name())
+}
+
+// Describes the problems found by Verify()
+//
+type VerifyReport struct {
+	Records  uint64   `json:"records"` // Records checked
+	Problems []string `json:"problems"`
+}
+
+// Checks the consistency of the database file, that none of the buckets
+// created on initialization is missing, that every record of the default
+// bucket, of tenant buckets, of the tenant registry, of deleted tenants, of the
+// usage bucket, of the audit log, of the change log and its consumers, of
+// webhooks, of the outbox and of dead letters can be decoded, and that the
+// audit log's chain is unbroken. Problems found are reported rather than
+// returned as errors.
+//
+func (db *Db) Verify() (*VerifyReport, error) {
+	report := &VerifyReport{Problems: []string{}}
+	auditLogMissing := false
+
+	err := db.view("verify", func(tx *bolt.Tx) error {
+		// Every error has to be read for the check to complete
+		//
+		for err := range tx.Check() {
+			report.Problems = append(report.Problems, err.Error())
+		}
+
+		for _, name := range [][]byte{
+			db.bucketKey,
+			tenantRegistryBucketKey,
+			deletedTenantBucketKey,
+			usageBucketKey,
+			auditBucketKey,
+			changeLogBucketKey,
+			consumerBucketKey,
+			changeLogStateBucketKey,
+			webhookBucketKey,
+			outboxBucketKey,
+			deadLetterBucketKey,
+		} {
+			if tx.Bucket(name) == nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("bucket %q is missing", name))
+				auditLogMissing = auditLogMissing || bytes.Equal(name, auditBucketKey)
+			}
+		}
+
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			var decode func(k []byte, v []byte) error
+			switch {
+			case bytes.Equal(name, []byte(db.BucketName)) || bytes.HasPrefix(name, []byte(tenantBucketPrefix)):
+				decode = func(k []byte, v []byte) error {
+					_, err := decodeMessage(k, v)
+					return err
+				}
+			case bytes.Equal(name, tenantRegistryBucketKey):
+				decode = decodeJSON(&model.Tenant{})
+			case bytes.Equal(name, deletedTenantBucketKey):
+				decode = decodeJSON(&time.Time{})
+			case bytes.Equal(name, usageBucketKey):
+				decode = decodeJSON(&Usage{})
+			case bytes.Equal(name, auditBucketKey):
+				decode = decodeJSON(&model.AuditRecord{})
+			case bytes.Equal(name, changeLogBucketKey):
+				decode = decodeJSON(&model.Change{})
+			case bytes.Equal(name, consumerBucketKey):
+				decode = decodeJSON(&model.ChangeConsumer{})
+			case bytes.Equal(name, changeLogStateBucketKey):
+				decode = func(k []byte, v []byte) error {
+					if len(v) != 8 {
+						return errors.New("not a sequence number")
+					}
+					return nil
+				}
+			case bytes.Equal(name, webhookBucketKey):
+				decode = decodeJSON(&model.Webhook{})
+			case bytes.Equal(name, outboxBucketKey) || bytes.Equal(name, deadLetterBucketKey):
+				decode = decodeJSON(&model.WebhookDelivery{})
+			default:
+				return nil
+			}
+
+			return bucket.ForEach(func(k, v []byte) error {
+				report.Records += 1
+				if err := decode(k, v); err != nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("bucket %q, key %s: %v", name, formatKey(name, k), err))
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if auditLogMissing {
+		return report, nil
+	}
+
+	if _, err = db.VerifyAuditLog(); errors.Is(err, ErrAuditChainBroken) {
+		report.Problems = append(report.Problems, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Returns a function decoding a JSON record into "record"
+//
+func decodeJSON(record interface{}) func(k []byte, v []byte) error {
+	return func(k []byte, v []byte) error {
+		if v == nil {
+			return errors.New("value is a bucket")
+		}
+		return json.Unmarshal(v, record)
+	}
+}
+
+// Formats key "k" of bucket "name" the way it's encoded: IDs for messages,
+// audit records, changes, webhooks and deliveries, strings otherwise
+//
+func formatKey(name []byte, k []byte) string {
+	if len(k) == 8 && !bytes.Equal(name, tenantRegistryBucketKey) && !bytes.Equal(name, deletedTenantBucketKey) && !bytes.Equal(name, usageBucketKey) && !bytes.Equal(name, consumerBucketKey) {
+		return strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+	}
+	return strconv.Quote(string(k))
+}
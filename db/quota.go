@@ -0,0 +1,157 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Usage of every principal, across all tenants, keyed by principal name
+//
+var usageBucketKey = []byte("_usage")
+
+var ErrQuotaExceeded = errors.New("Principal quota exceeded")
+
+// Storage limits applied to every principal. A 0 limit means unlimited.
+//
+type Quota struct {
+	MaxMessages     uint64 `yaml:"maxMessages"`
+	MaxPayloadBytes uint64 `yaml:"maxPayloadBytes"`
+}
+
+// Storage used by a principal
+//
+type Usage struct {
+	Messages     uint64 `json:"messages"`
+	PayloadBytes uint64 `json:"payloadBytes"`
+}
+
+// Retrieves the storage used by "principal"
+//
+func (db *Db) GetUsage(principal string) (*Usage, error) {
+	var usage *Usage
+
+	err := db.view("get_usage", func(tx *bolt.Tx) error {
+		var err error
+		usage, err = getUsage(tx, principal)
+		return err
+	})
+
+	return usage, err
+}
+
+func getUsage(tx *bolt.Tx, principal string) (*Usage, error) {
+	usage := &Usage{}
+
+	buf := tx.Bucket(usageBucketKey).Get(usageKey(principal))
+	if buf == nil {
+		return usage, nil
+	}
+
+	err := json.Unmarshal(buf, usage)
+	return usage, err
+}
+
+// Adds "messages" and "payloadBytes" (either of which may be negative) to the
+// usage of "principal" within transaction "tx". Returns ErrQuotaExceeded,
+// leaving the usage untouched, if growing the usage would exceed the quota.
+//
+func (db *Db) adjustUsage(tx *bolt.Tx, principal string, messages int64, payloadBytes int64) error {
+	usage, err := getUsage(tx, principal)
+	if err != nil {
+		return err
+	}
+
+	newMessages := addClamped(usage.Messages, messages)
+	if messages > 0 && db.Quota.MaxMessages != 0 && newMessages > db.Quota.MaxMessages {
+		return ErrQuotaExceeded
+	}
+
+	newPayloadBytes := addClamped(usage.PayloadBytes, payloadBytes)
+	if payloadBytes > 0 && db.Quota.MaxPayloadBytes != 0 && newPayloadBytes > db.Quota.MaxPayloadBytes {
+		return ErrQuotaExceeded
+	}
+
+	usage.Messages = newMessages
+	usage.PayloadBytes = newPayloadBytes
+	buf, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(usageBucketKey).Put(usageKey(principal), buf)
+}
+
+// Releases every message in "bucket" within transaction "tx", as if they were
+// deleted one at a time: their usage is released and their deletion recorded
+// in the change log. Called prior to dropping a bucket wholesale, through a Db
+// scoped to it. Corrupt messages only have their ID recorded as deleted.
+//
+func (db *Db) releaseMessages(tx *bolt.Tx, bucket *bolt.Bucket) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		deletedMessage := &model.DetailedMessage{Message: &model.Message{Id: bytesToUint64(k)}}
+		if detailedMessage, err := decodeMessage(k, v); err == nil {
+			payloadBytes := int64(len(detailedMessage.Message.Payload))
+			if err = db.adjustUsage(tx, detailedMessage.Owner, -1, -payloadBytes); err != nil {
+				return err
+			}
+			deletedMessage = detailedMessage
+		}
+
+		return db.appendChange(tx, ChangeDeleted, deletedMessage)
+	})
+}
+
+// Recomputes the usage of every principal from the default bucket and every
+// tenant bucket within transaction "tx". Used to account for messages created
+// before usage was being tracked.
+//
+func (db *Db) rebuildUsage(tx *bolt.Tx) error {
+	return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		if !bytes.Equal(name, db.bucketKey) && !bytes.HasPrefix(name, []byte(tenantBucketPrefix)) {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			detailedMessage := &model.DetailedMessage{}
+			if v == nil || json.Unmarshal(v, detailedMessage) != nil || detailedMessage.Message == nil {
+				return nil
+			}
+
+			usage, err := getUsage(tx, detailedMessage.Owner)
+			if err != nil {
+				return err
+			}
+
+			usage.Messages += 1
+			usage.PayloadBytes += uint64(len(detailedMessage.Message.Payload))
+			buf, err := json.Marshal(usage)
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(usageBucketKey).Put(usageKey(detailedMessage.Owner), buf)
+		})
+	})
+}
+
+// Messages created without an owner still need to be accounted for, but bbolt
+// doesn't allow empty keys
+//
+func usageKey(principal string) []byte {
+	return []byte("principal:" + principal)
+}
+
+// Adds a signed "delta" to "v", bottoming out at 0
+//
+func addClamped(v uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > v {
+		return 0
+	}
+
+	return uint64(int64(v) + delta)
+}
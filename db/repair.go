@@ -0,0 +1,178 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Records that can't be decoded are moved out of the way rather than deleted,
+// into a bucket named after the bucket they were found in, nested in this one
+//
+var quarantineBucketKey = []byte("_quarantine")
+
+// Describes what was done to repair the database
+//
+type RepairReport struct {
+	RecreatedBuckets   []string `json:"recreatedBuckets"`
+	QuarantinedRecords uint64   `json:"quarantinedRecords"`
+}
+
+// Repairs the database: recreates the default bucket if it's missing, and moves
+// every record of the default bucket and of tenant buckets that can't be
+// decoded into the quarantine bucket
+//
+func (db *Db) Repair() (*RepairReport, error) {
+	report := &RepairReport{RecreatedBuckets: []string{}}
+
+	err := db.update("repair", func(tx *bolt.Tx) error {
+		defaultDb := *db
+		defaultDb.bucketKey = []byte(db.BucketName)
+		defaultDb.tenant = ""
+		if err := defaultDb.repairBucket(tx, report); err != nil {
+			return err
+		}
+
+		// Buckets can't be created or deleted while iterating over them
+		//
+		var tenantBucketKeys [][]byte
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte(tenantBucketPrefix)) {
+				tenantBucketKeys = append(tenantBucketKeys, append([]byte{}, name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, bucketKey := range tenantBucketKeys {
+			tenantDb := *db
+			tenantDb.bucketKey = bucketKey
+			tenantDb.tenant = string(bytes.TrimPrefix(bucketKey, []byte(tenantBucketPrefix)))
+			if err = tenantDb.repairBucket(tx, report); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// Repairs the bucket the Db is scoped to within transaction "tx", adding what
+// was done to "report"
+//
+func (db *Db) repairBucket(tx *bolt.Tx, report *RepairReport) error {
+	bucket, err := db.bucket(tx)
+	if errors.Is(err, ErrBucketMissing) {
+		if bucket, err = tx.CreateBucket(db.bucketKey); err != nil {
+			return err
+		}
+		report.RecreatedBuckets = append(report.RecreatedBuckets, string(db.bucketKey))
+	}
+	if bucket == nil || err != nil {
+		return err
+	}
+
+	// Records are only moved once they've all been looked at, since the
+	// bucket can't be modified while iterating over it
+	//
+	var corruptKeys [][]byte
+	err = bucket.ForEach(func(k, v []byte) error {
+		if _, err := decodeMessage(k, v); err != nil {
+			corruptKeys = append(corruptKeys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil || len(corruptKeys) == 0 {
+		return err
+	}
+
+	quarantine, err := tx.CreateBucketIfNotExists(quarantineBucketKey)
+	if err != nil {
+		return err
+	}
+	quarantine, err = quarantine.CreateBucketIfNotExists(db.bucketKey)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range corruptKeys {
+		if nested := bucket.Bucket(k); nested != nil {
+			if err = copyBucket(quarantine, k, nested); err != nil {
+				return err
+			}
+			err = bucket.DeleteBucket(k)
+		} else {
+			if err = quarantine.Put(k, bucket.Get(k)); err != nil {
+				return err
+			}
+			err = bucket.Delete(k)
+		}
+		if err != nil {
+			return err
+		}
+
+		report.QuarantinedRecords += 1
+	}
+
+	return nil
+}
+
+// Recursively copies bucket "src" into a bucket named "name" nested in "dst"
+//
+func copyBucket(dst *bolt.Bucket, name []byte, src *bolt.Bucket) error {
+	copied, err := dst.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return copyBucket(copied, k, src.Bucket(k))
+		}
+		return copied.Put(k, v)
+	})
+}
+
+// Runs "fn" in a read-only transaction like view(). In repair mode, if "fn"
+// runs into a missing bucket or a corrupt record, the bucket the Db is scoped
+// to is repaired and "fn" is run again.
+//
+func (db *Db) repairingView(operation string, fn func(*bolt.Tx) error) error {
+	return db.repairing(func() error { return db.view(operation, fn) })
+}
+
+// Same as repairingView(), in a read-write transaction like update()
+//
+func (db *Db) repairingUpdate(operation string, fn func(*bolt.Tx) error) error {
+	return db.repairing(func() error { return db.update(operation, fn) })
+}
+
+func (db *Db) repairing(transaction func() error) error {
+	err := transaction()
+	if !db.RepairMode || !(errors.Is(err, ErrBucketMissing) || errors.Is(err, ErrCorruptRecord)) {
+		return err
+	}
+
+	report := &RepairReport{RecreatedBuckets: []string{}}
+	repairErr := db.update("repair", func(tx *bolt.Tx) error {
+		return db.repairBucket(tx, report)
+	})
+	if repairErr != nil {
+		return errors.Join(err, repairErr)
+	}
+
+	slog.Warn("Repaired database",
+		"error", err,
+		"bucket", string(db.bucketKey),
+		"recreated_buckets", report.RecreatedBuckets,
+		"quarantined_records", report.QuarantinedRecords,
+	)
+
+	return transaction()
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/tracing"
+
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Bucket name the default bucket's message count is reported under by Stats,
+// which can't clash with a tenant name
+//
+const DefaultBucketStatsName = "_default"
+
+// Called once every Db operation completes, with the name of the operation,
+// whether it ran in a writable transaction, how long it took and the error it
+// failed with, if any
+//
+type OperationObserver func(operation string, writable bool, duration time.Duration, err error)
+
+// Sets the observer notified of every operation. Must be called before the Db
+// is used concurrently, and before any handle is derived from it with
+// ForTenant or WithAuditContext.
+//
+func (db *Db) SetOperationObserver(observer OperationObserver) {
+	db.observer = observer
+}
+
+// Runs "fn" in a read transaction on behalf of "operation"
+//
+func (db *Db) view(operation string, fn func(tx *bolt.Tx) error) error {
+	return db.transaction(operation, false, fn)
+}
+
+// Runs "fn" in a writable transaction on behalf of "operation"
+//
+func (db *Db) update(operation string, fn func(tx *bolt.Tx) error) error {
+	return db.transaction(operation, true, fn)
+}
+
+// Runs "fn" in a transaction, traced as a child of the span in the Db's
+// context and reported to the observer
+//
+func (db *Db) transaction(operation string, writable bool, fn func(tx *bolt.Tx) error) error {
+	_, span := tracing.Tracer().Start(db.context(), "bbolt "+operation, trace.WithAttributes(
+		semconv.DBSystemKey.String("bbolt"),
+		attribute.String("db.operation.name", operation),
+		attribute.Bool("db.bbolt.writable", writable),
+	))
+	defer span.End()
+	if db.tenant != "" {
+		span.SetAttributes(attribute.String("rdemo.tenant", db.tenant))
+	}
+
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	start := time.Now()
+	var err error
+	if boltDb := db.boltDb(); boltDb == nil {
+		err = fmt.Errorf("%w: database isn't open", ErrUnavailable)
+	} else if writable {
+		err = boltDb.Update(fn)
+	} else {
+		err = boltDb.View(fn)
+	}
+
+	// A closed database is a temporary condition, e.g. while shutting down,
+	// rather than a broken one
+	//
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) || errors.Is(err, bolt.ErrTimeout) {
+		err = fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	if db.observer != nil {
+		db.observer(operation, writable, time.Since(start), err)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// Snapshot of the state of the database
+//
+type Stats struct {
+	// Counters since the database was opened
+	//
+	ReadTxN        uint64 // Read transactions started
+	PageCount      uint64 // Page allocations
+	PageAllocBytes uint64 // Bytes allocated to pages
+
+	OpenReadTxN        uint64 // Read transactions currently open
+	FreePageN          uint64 // Pages on the freelist
+	PendingPageN       uint64 // Pages freed but still in use by an open transaction
+	FreeAllocBytes     uint64 // Bytes allocated to free pages
+	FreelistInuseBytes uint64 // Bytes used by the freelist itself
+	FileSizeBytes      uint64
+
+	// Number of messages in the default bucket, keyed by
+	// DefaultBucketStatsName, and in every tenant's bucket, keyed by tenant
+	// name
+	//
+	Messages map[string]uint64
+}
+
+// Returns a snapshot of the state of the database. Reading message counts is
+// done in a read transaction, which isn't reported to the observer.
+//
+func (db *Db) Stats() (*Stats, error) {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+
+	if db.boltDb() == nil {
+		return nil, fmt.Errorf("%w: database isn't open", ErrUnavailable)
+	}
+
+	boltStats := db.boltDb().Stats()
+	stats := &Stats{
+		ReadTxN:            uint64(boltStats.TxN),
+		PageCount:          uint64(boltStats.TxStats.GetPageCount()),
+		PageAllocBytes:     uint64(boltStats.TxStats.GetPageAlloc()),
+		OpenReadTxN:        uint64(boltStats.OpenTxN),
+		FreePageN:          uint64(boltStats.FreePageN),
+		PendingPageN:       uint64(boltStats.PendingPageN),
+		FreeAllocBytes:     uint64(boltStats.FreeAlloc),
+		FreelistInuseBytes: uint64(boltStats.FreelistInuse),
+		Messages:           make(map[string]uint64),
+	}
+
+	err := db.boltDb().View(func(tx *bolt.Tx) error {
+		stats.FileSizeBytes = uint64(tx.Size())
+
+		if bucket := tx.Bucket([]byte(db.BucketName)); bucket != nil {
+			stats.Messages[DefaultBucketStatsName] = uint64(bucket.Stats().KeyN)
+		}
+
+		prefix := []byte(tenantBucketPrefix)
+		cursor := tx.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			stats.Messages[string(k[len(prefix):])] = uint64(tx.Bucket(k).Stats().KeyN)
+		}
+
+		return nil
+	})
+
+	return stats, err
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every tenant gets its own bucket (and therefore its own sequence) named after
+// the tenant, alongside a registry bucket recording each tenant's settings
+//
+const tenantBucketPrefix = "_tenant/"
+
+var tenantRegistryBucketKey = []byte("_tenants")
+
+// Tenants that were deleted, keyed by name, along with the time they were
+// deleted. They aren't created again on first write, but only explicitly.
+//
+var deletedTenantBucketKey = []byte("_deletedTenants")
+
+const TenantNamePattern = `^[a-z0-9][a-z0-9_-]{0,62}$`
+
+var tenantNameRegexp = regexp.MustCompile(TenantNamePattern)
+
+var ErrInvalidTenantName = errors.New("Invalid tenant name")
+var ErrTenantExists = errors.New("Tenant already exists")
+var ErrTenantNotFound = errors.New("Tenant not found")
+var ErrTenantQuotaExceeded = errors.New("Tenant message quota exceeded")
+
+// Tenant names are restricted to lowercase alphanumeric characters, '-' and
+// '_' so they can't be used to escape into another bucket
+//
+func ValidTenantName(name string) bool {
+	return tenantNameRegexp.MatchString(name)
+}
+
+// Returns a handle into the database scoped to the messages of tenant "name".
+// The handle shares the underlying bbolt DB and must not be closed. The tenant
+// is created lazily on first write, unless it was deleted.
+//
+func (db *Db) ForTenant(name string) *Db {
+	scopedDb := *db
+	scopedDb.bucketKey = []byte(tenantBucketPrefix + name)
+	scopedDb.tenant = name
+	return &scopedDb
+}
+
+// Returns a handle into the database that doesn't create the tenant it's
+// scoped to on first write, failing with ErrTenantNotFound instead, e.g. on
+// behalf of principals that aren't allowed to manage tenants. The handle shares
+// the underlying bbolt DB and must not be closed.
+//
+func (db *Db) WithoutTenantCreation() *Db {
+	scopedDb := *db
+	scopedDb.noTenantCreation = true
+	return &scopedDb
+}
+
+// Explicitly creates a new tenant, including one that was deleted. Returns
+// ErrTenantExists if the tenant was already created, explicitly or lazily.
+//
+func (db *Db) CreateTenant(tenant *model.Tenant) error {
+	if !ValidTenantName(tenant.Name) {
+		return ErrInvalidTenantName
+	}
+
+	return db.update("create_tenant", func(tx *bolt.Tx) error {
+		if _, err := createTenant(tx, tenant); err != nil {
+			return err
+		}
+
+		return tx.Bucket(deletedTenantBucketKey).Delete([]byte(tenant.Name))
+	})
+}
+
+// Returns every tenant, ordered by name
+//
+func (db *Db) ListTenants() ([]*model.Tenant, error) {
+	tenants := []*model.Tenant{}
+
+	err := db.view("list_tenants", func(tx *bolt.Tx) error {
+		return tx.Bucket(tenantRegistryBucketKey).ForEach(func(k, v []byte) error {
+			tenant := &model.Tenant{}
+			if err := json.Unmarshal(v, tenant); err != nil {
+				return err
+			}
+
+			tenants = append(tenants, tenant)
+			return nil
+		})
+	})
+
+	return tenants, err
+}
+
+// Deletes a tenant along with every one of its messages, each of which is
+// recorded as deleted in the change log. The tenant is remembered as deleted so
+// that writes racing the deletion don't bring it back.
+//
+func (db *Db) DeleteTenant(name string) error {
+	if !ValidTenantName(name) {
+		return ErrInvalidTenantName
+	}
+
+	return db.update("delete_tenant", func(tx *bolt.Tx) error {
+		registry := tx.Bucket(tenantRegistryBucketKey)
+		if registry.Get([]byte(name)) == nil {
+			return ErrTenantNotFound
+		}
+
+		// Releases every message in the tenant, recording their deletion,
+		// prior to deleting them all at once
+		//
+		if bucket := tx.Bucket([]byte(tenantBucketPrefix + name)); bucket != nil {
+			if err := db.ForTenant(name).releaseMessages(tx, bucket); err != nil {
+				return err
+			}
+		}
+
+		err := tx.DeleteBucket([]byte(tenantBucketPrefix + name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		if err = registry.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(deletedTenantBucketKey).Put([]byte(name), buf)
+	})
+}
+
+// Creates the bucket for "tenant" and records it in the tenant registry within
+// transaction "tx"
+//
+func createTenant(tx *bolt.Tx, tenant *model.Tenant) (*bolt.Bucket, error) {
+	registry := tx.Bucket(tenantRegistryBucketKey)
+	if registry.Get([]byte(tenant.Name)) != nil {
+		return nil, ErrTenantExists
+	}
+
+	bucket, err := tx.CreateBucket([]byte(tenantBucketPrefix + tenant.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	tenant.CreatedAt = time.Now().UTC()
+	buf, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket, registry.Put([]byte(tenant.Name), buf)
+}
+
+// Returns ErrTenantQuotaExceeded if adding a message to "bucket" would exceed
+// the quota of the tenant the Db is scoped to
+//
+func (db *Db) checkTenantQuota(tx *bolt.Tx, bucket *bolt.Bucket) error {
+	if db.tenant == "" {
+		return nil
+	}
+
+	buf := tx.Bucket(tenantRegistryBucketKey).Get([]byte(db.tenant))
+	if buf == nil {
+		return ErrTenantNotFound
+	}
+
+	tenant := &model.Tenant{}
+	if err := json.Unmarshal(buf, tenant); err != nil {
+		return err
+	}
+
+	if tenant.MaxMessages != 0 && uint64(bucket.Stats().KeyN) >= tenant.MaxMessages {
+		return ErrTenantQuotaExceeded
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrMessageExists = errors.New("Message already exists")
+
+// errDryRun rolls back the transaction of a dry run import
+//
+var errDryRun = errors.New("dry run")
+
+// Messages read in each transaction by ForEachMessage()
+//
+const forEachMessagePageSize = 500
+
+// Calls "fn" with every message matching "filter", in ID order. Messages are
+// read a page at a time, each in a transaction of its own, and "fn" is only
+// called in between, so that a slow caller, e.g. one writing to a client,
+// never holds a transaction open. Iteration stops at the first error returned
+// by "fn".
+//
+func (db *Db) ForEachMessage(filter MessageFilter, fn func(detailedMessage *model.DetailedMessage) error) error {
+	for id := uint64(0); ; {
+		detailedMessages, afterId, err := db.ListMessages(forEachMessagePageSize, id, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, detailedMessage := range detailedMessages {
+			if err = fn(detailedMessage); err != nil {
+				return err
+			}
+		}
+
+		if afterId == 0 {
+			return nil
+		}
+		id = afterId + 1
+	}
+}
+
+// Options controlling how messages are imported
+//
+type ImportOptions struct {
+	// Keeps the ID each message comes with rather than assigning a new one,
+	// in which case the bucket's sequence is advanced past the largest ID
+	// imported
+	//
+	PreserveIds bool
+
+	// Checks what importing would do without changing anything
+	//
+	DryRun bool
+}
+
+// Inserts every message of "detailedMessages" in a single transaction, owned by
+// whoever their "Owner" is. Returns one error per message, nil for the ones
+// that were imported: ErrMessageExists if its ID is preserved but already
+// taken, ErrQuotaExceeded or ErrTenantQuotaExceeded. Messages refused this way
+// are skipped without failing the others. Any other error fails the whole
+// transaction, in which case nothing is imported.
+//
+func (db *Db) ImportMessages(detailedMessages []*model.DetailedMessage, options ImportOptions) ([]error, error) {
+	var results []error
+
+	err := db.repairingUpdate("import_messages", func(tx *bolt.Tx) error {
+		// Starts over if the transaction is retried after a repair
+		//
+		results = make([]error, len(detailedMessages))
+
+		bucket, err := db.writableBucket(tx)
+		if err != nil {
+			return err
+		}
+
+		maxId := uint64(0)
+		for i, detailedMessage := range detailedMessages {
+			err = db.importMessage(tx, bucket, detailedMessage, options)
+			if errors.Is(err, ErrMessageExists) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrTenantQuotaExceeded) {
+				results[i] = err
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if detailedMessage.Message.Id > maxId {
+				maxId = detailedMessage.Message.Id
+			}
+		}
+
+		// New messages must never be given a preserved ID
+		//
+		if options.PreserveIds && maxId > bucket.Sequence() {
+			if err = bucket.SetSequence(maxId); err != nil {
+				return err
+			}
+		}
+
+		if options.DryRun {
+			return errDryRun
+		}
+
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Inserts "detailedMessage" in "bucket" within transaction "tx". Returns an
+// error without changing anything if the message can't be imported.
+//
+func (db *Db) importMessage(tx *bolt.Tx, bucket *bolt.Bucket, detailedMessage *model.DetailedMessage, options ImportOptions) error {
+	if options.PreserveIds {
+		if bucket.Get(uint64ToBytes(detailedMessage.Message.Id)) != nil {
+			return &MessageError{Id: detailedMessage.Message.Id, Err: ErrMessageExists}
+		}
+	}
+
+	if err := db.checkTenantQuota(tx, bucket); err != nil {
+		return err
+	}
+
+	payloadBytes := int64(len(detailedMessage.Message.Payload))
+	if err := db.adjustUsage(tx, detailedMessage.Owner, 1, payloadBytes); err != nil {
+		return err
+	}
+
+	if !options.PreserveIds {
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		detailedMessage.Message.Id = id
+	}
+
+	buf, err := json.Marshal(detailedMessage)
+	if err != nil {
+		return err
+	}
+
+	if err = bucket.Put(uint64ToBytes(detailedMessage.Message.Id), buf); err != nil {
+		return err
+	}
+
+	if err = db.appendChange(tx, ChangeCreated, detailedMessage); err != nil {
+		return err
+	}
+
+	after := detailedMessage.Message.Payload
+	return db.appendAuditRecord(tx, AuditOperationCreate, detailedMessage.Message.Id, nil, &after)
+}
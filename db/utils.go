@@ -11,3 +11,13 @@ func uint64ToBytes(v uint64) []byte {
 	binary.BigEndian.PutUint64(b, v)
 	return b
 }
+
+// Simple helper function to convert an array of bytes back into a uint64, 0 if
+// it isn't one
+//
+func bytesToUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,353 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Webhooks subscribed to changes, keyed by ID. Changes are delivered to them
+// from the outbox, in which a delivery is queued for every webhook interested
+// in a change, in the same transaction as the change. The outbox is keyed by
+// webhook ID, then by the time the delivery is due, then by delivery ID, so
+// that the deliveries due for a webhook are found by seeking rather than
+// scanning. Deliveries that failed too many times are moved to the dead
+// letter bucket, keyed by their ID.
+//
+var webhookBucketKey = []byte("_webhooks")
+var outboxBucketKey = []byte("_outbox")
+var deadLetterBucketKey = []byte("_deadletters")
+
+var ErrWebhookNotFound = errors.New("Webhook not found")
+var ErrDeliveryNotFound = errors.New("Delivery not found")
+
+// Records a new webhook, setting its ID
+//
+func (db *Db) CreateWebhook(webhook *model.Webhook) error {
+	return db.update("create_webhook", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhookBucketKey)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		webhook.Id = id
+		webhook.CreatedAt = time.Now().UTC()
+		return putJSON(bucket, id, webhook)
+	})
+}
+
+// Returns every webhook, ordered by ID
+//
+func (db *Db) ListWebhooks() ([]*model.Webhook, error) {
+	webhooks := []*model.Webhook{}
+
+	err := db.view("list_webhooks", func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookBucketKey).ForEach(func(k, v []byte) error {
+			webhook := &model.Webhook{}
+			if err := json.Unmarshal(v, webhook); err != nil {
+				return err
+			}
+
+			webhooks = append(webhooks, webhook)
+			return nil
+		})
+	})
+
+	return webhooks, err
+}
+
+// Returns the webhook with ID "id", or ErrWebhookNotFound if there is none
+//
+func (db *Db) GetWebhook(id uint64) (*model.Webhook, error) {
+	webhook := &model.Webhook{}
+
+	err := db.view("get_webhook", func(tx *bolt.Tx) error {
+		v := tx.Bucket(webhookBucketKey).Get(uint64ToBytes(id))
+		if v == nil {
+			return ErrWebhookNotFound
+		}
+
+		return json.Unmarshal(v, webhook)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+// Deletes the webhook with ID "id" along with the deliveries still queued for
+// it. Its dead letters are kept until redelivered, which drops them.
+//
+func (db *Db) DeleteWebhook(id uint64) error {
+	return db.update("delete_webhook", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhookBucketKey)
+		if bucket.Get(uint64ToBytes(id)) == nil {
+			return ErrWebhookNotFound
+		}
+
+		// Keys can't be deleted while iterating, so they're collected first
+		//
+		var queued [][]byte
+		outbox := tx.Bucket(outboxBucketKey)
+		prefix := uint64ToBytes(id)
+		cursor := outbox.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			queued = append(queued, append([]byte{}, k...))
+		}
+
+		for _, k := range queued {
+			if err := outbox.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return bucket.Delete(uint64ToBytes(id))
+	})
+}
+
+// Returns up to "limit" deliveries queued in the outbox for webhook
+// "webhookId" that are due at "now", earliest due first, along with the time
+// the first delivery left out is due. The time is zero if there is no such
+// delivery, and may be no later than "now" if "limit" was reached.
+//
+func (db *Db) DueDeliveries(webhookId uint64, now time.Time, limit uint64) ([]*model.WebhookDelivery, time.Time, error) {
+	deliveries := []*model.WebhookDelivery{}
+	var next time.Time
+
+	err := db.view("due_deliveries", func(tx *bolt.Tx) error {
+		prefix := uint64ToBytes(webhookId)
+		cursor := tx.Bucket(outboxBucketKey).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			due := outboxKeyDue(k)
+			if due.After(now) || uint64(len(deliveries)) == limit {
+				next = due
+				break
+			}
+
+			delivery := &model.WebhookDelivery{}
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+
+		return nil
+	})
+
+	return deliveries, next, err
+}
+
+// Removes a delivery that succeeded, or that is no longer wanted, from the
+// outbox
+//
+func (db *Db) CompleteDelivery(delivery *model.WebhookDelivery) error {
+	return db.update("complete_delivery", func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucketKey).Delete(outboxKey(delivery))
+	})
+}
+
+// Records a failed attempt at a delivery, as loaded from the outbox with its
+// attempts and last error updated, and schedules the next one at
+// "nextAttemptAt", unless the delivery was removed from the outbox in the
+// meantime
+//
+func (db *Db) RetryDelivery(delivery *model.WebhookDelivery, nextAttemptAt time.Time) error {
+	return db.update("retry_delivery", func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucketKey)
+		if outbox.Get(outboxKey(delivery)) == nil {
+			return nil
+		}
+
+		if err := outbox.Delete(outboxKey(delivery)); err != nil {
+			return err
+		}
+
+		delivery.NextAttemptAt = nextAttemptAt
+		return putDelivery(outbox, delivery)
+	})
+}
+
+// Moves a delivery that failed too many times from the outbox to the dead
+// letters, unless it was removed from the outbox in the meantime
+//
+func (db *Db) DeadLetterDelivery(delivery *model.WebhookDelivery) error {
+	return db.update("dead_letter_delivery", func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucketKey)
+		if outbox.Get(outboxKey(delivery)) == nil {
+			return nil
+		}
+
+		if err := outbox.Delete(outboxKey(delivery)); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(deadLetterBucketKey), delivery.Id, delivery)
+	})
+}
+
+// Returns a list of up to "limit" dead letters, starting with ID "id". A non-0
+// "afterId" returned indicates that there are more dead letters left to
+// retrieve.
+//
+func (db *Db) ListDeadLetters(limit uint64, id uint64) ([]*model.WebhookDelivery, uint64, error) {
+	deliveries := []*model.WebhookDelivery{}
+	afterId := uint64(0)
+
+	err := db.view("list_dead_letters", func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(deadLetterBucketKey).Cursor()
+		for k, v := cursor.Seek(uint64ToBytes(id)); k != nil; k, v = cursor.Next() {
+			if uint64(len(deliveries)) == limit {
+				afterId = deliveries[len(deliveries)-1].Id
+				break
+			}
+
+			delivery := &model.WebhookDelivery{}
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+
+		return nil
+	})
+
+	return deliveries, afterId, err
+}
+
+// Moves dead letter "id" back to the outbox, due right away with a clean slate.
+// Returns ErrDeliveryNotFound if there is no such dead letter, and
+// ErrWebhookNotFound, after dropping the dead letter, if its webhook was
+// deleted.
+//
+func (db *Db) RedeliverDeadLetter(id uint64) (*model.WebhookDelivery, error) {
+	delivery := &model.WebhookDelivery{}
+	dropped := false
+
+	err := db.update("redeliver_dead_letter", func(tx *bolt.Tx) error {
+		deadLetters := tx.Bucket(deadLetterBucketKey)
+		v := deadLetters.Get(uint64ToBytes(id))
+		if v == nil {
+			return ErrDeliveryNotFound
+		}
+		if err := json.Unmarshal(v, delivery); err != nil {
+			return err
+		}
+		if err := deadLetters.Delete(uint64ToBytes(id)); err != nil {
+			return err
+		}
+
+		if tx.Bucket(webhookBucketKey).Get(uint64ToBytes(delivery.WebhookId)) == nil {
+			dropped = true
+			return nil
+		}
+
+		delivery.Attempts = 0
+		delivery.NextAttemptAt = time.Now().UTC()
+		delivery.LastError = ""
+		if err := putDelivery(tx.Bucket(outboxBucketKey), delivery); err != nil {
+			return err
+		}
+
+		tx.OnCommit(db.store.changes.notify)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dropped {
+		return nil, ErrWebhookNotFound
+	}
+	return delivery, nil
+}
+
+// Queues a delivery of "change" for every webhook interested in it within
+// transaction "tx"
+//
+func enqueueDeliveries(tx *bolt.Tx, change *model.Change) error {
+	outbox := tx.Bucket(outboxBucketKey)
+
+	return tx.Bucket(webhookBucketKey).ForEach(func(k, v []byte) error {
+		webhook := &model.Webhook{}
+		if err := json.Unmarshal(v, webhook); err != nil {
+			return err
+		}
+
+		if !webhookWants(webhook, change.Type) {
+			return nil
+		}
+
+		id, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return putDelivery(outbox, &model.WebhookDelivery{
+			Id:            id,
+			WebhookId:     webhook.Id,
+			Change:        change,
+			NextAttemptAt: change.Timestamp,
+			CreatedAt:     change.Timestamp,
+		})
+	})
+}
+
+// Returns the key "delivery" is stored under in the outbox: the ID of its
+// webhook, the time it's due in nanoseconds since the epoch, and its ID
+//
+func outboxKey(delivery *model.WebhookDelivery) []byte {
+	k := make([]byte, 0, 24)
+	k = append(k, uint64ToBytes(delivery.WebhookId)...)
+	k = append(k, uint64ToBytes(uint64(delivery.NextAttemptAt.UnixNano()))...)
+	return append(k, uint64ToBytes(delivery.Id)...)
+}
+
+// Returns the time the delivery stored under outbox key "k" is due
+//
+func outboxKeyDue(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[8:16]))).UTC()
+}
+
+// Stores "delivery" as JSON in "outbox", under the key it's due at
+//
+func putDelivery(outbox *bolt.Bucket, delivery *model.WebhookDelivery) error {
+	buf, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return outbox.Put(outboxKey(delivery), buf)
+}
+
+// Whether "webhook" is delivered changes of type "changeType"
+//
+func webhookWants(webhook *model.Webhook, changeType string) bool {
+	if len(webhook.Types) == 0 {
+		return true
+	}
+
+	for _, t := range webhook.Types {
+		if t == changeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores "record" as JSON under key "id" of "bucket"
+//
+func putJSON(bucket *bolt.Bucket, id uint64, record interface{}) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(uint64ToBytes(id), buf)
+}
@@ -0,0 +1,15 @@
+// The OpenAPI document is generated from the routes of the api package, see
+// gen.go
+//
+//go:generate go run gen.go
+package docs
+
+import (
+	_ "embed"
+)
+
+// The OpenAPI document describing the REST API, embedded so that the binary
+// can serve it from any working directory
+//
+//go:embed openapi.json
+var OpenApi []byte
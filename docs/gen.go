@@ -0,0 +1,24 @@
+//go:build ignore
+
+// Writes openapi.json, generated from the routes registered by the api package
+// and the types they take and return. Run with "go generate ./docs".
+//
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+)
+
+func main() {
+	buf, err := api.GenerateOpenApi()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = os.WriteFile("openapi.json", buf, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
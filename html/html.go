@@ -0,0 +1,17 @@
+package html
+
+import (
+	"embed"
+)
+
+// Static assets of the Swagger UI, embedded so that the binary can serve them
+// from any working directory
+//
+//go:embed *.html *.css *.js *.map *.png
+var SwaggerUI embed.FS
+
+// Template of the script pointing the Swagger UI at the OpenAPI document,
+// which depends on where the service is reached
+//
+//go:embed swagger-initializer.js.tmpl
+var SwaggerInitializerTemplate string
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const FormatJSON = "json"
+const FormatText = "text"
+
+const DefaultFormat = FormatJSON
+const DefaultLevel = "info"
+
+// Structure to encapsulate logging configuration. Empty settings fall back on
+// their default.
+//
+type Config struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // json or text
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Level == "" {
+		cfg.Level = DefaultLevel
+	}
+	if cfg.Format == "" {
+		cfg.Format = DefaultFormat
+	}
+
+	return cfg
+}
+
+func (cfg *Config) Validate() error {
+	_, _, err := New(io.Discard, *cfg)
+	return err
+}
+
+// Parses a level name such as "debug" or "WARN", or an offset from one such as
+// "info+2"
+//
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", s)
+	}
+
+	return level, nil
+}
+
+// Creates a logger writing to "w" as configured by "cfg". The returned LevelVar
+// controls the logger's level and can be changed at any time.
+//
+func New(w io.Writer, cfg Config) (*slog.Logger, *slog.LevelVar, error) {
+	cfg = cfg.withDefaults()
+
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	levelVar := &slog.LevelVar{}
+	levelVar.Set(level)
+	options := &slog.HandlerOptions{Level: levelVar}
+
+	var handler slog.Handler
+	switch cfg.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	case FormatText:
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	return slog.New(handler), levelVar, nil
+}
+
+// Returns a logger discarding everything, for when logging isn't configured
+//
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
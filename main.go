@@ -1,68 +1,57 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-	"strconv"
 
 	"github.com/brandonto/rest-api-microservice-demo/core"
-	"github.com/brandonto/rest-api-microservice-demo/db"
 )
 
-const defaultDbBucketName = "DetailedMessageBucket"
-const defaultPort = uint64(55555)
-
 func main() {
-	// Outputs usage if number of arguments are off
+	// A subcommand other than "serve" works on the database rather than
+	// serving it
 	//
-	if len(os.Args) > 4 || len(os.Args) < 2 {
-		fmt.Println("usage: " + os.Args[0] + " db_path [port] [db_bucket_name]")
-		return
+	command, args, err := core.ParseCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		fmt.Fprintln(os.Stderr)
+		core.PrintUsage(os.Stderr, os.Args[0])
+		os.Exit(2)
 	}
 
-	// First argument is the filepath of the database
-	//
-	dbFile := os.Args[1]
-
-	// Second (optional) argument is the the port number
+	// Builds the configuration from the config file, environment variables
+	// and command line flags. Outputs usage if something is off.
 	//
-	port := defaultPort
-	if len(os.Args) > 2 {
-		// Some sanity check for the port argument before using
-		//
-		var err error
-		port, err = strconv.ParseUint(os.Args[2], 10, 64)
-		if err != nil {
-			fmt.Println("port argument must be an unsigned integer")
-			return
-		}
-
-		if port < uint64(49152) || port > uint64(65535) {
-			fmt.Println("port argument must be a value between 49152–65535")
-			return
-		}
+	coreCfg, printConfig, err := core.LoadConfig(args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		core.PrintUsage(os.Stdout, os.Args[0])
+		return
 	}
-
-	// Third (optional) argument is the the bucket name
-	//
-	dbBucketName := defaultDbBucketName
-	if len(os.Args) > 3 {
-		dbBucketName = os.Args[3]
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		fmt.Fprintln(os.Stderr)
+		core.PrintUsage(os.Stderr, os.Args[0])
+		os.Exit(2)
 	}
 
-	// Configure and run the application
+	// Dumps the effective configuration instead of running if asked to
 	//
-	dbCfg := db.Config{
-		FilePath:   dbFile,
-		BucketName: dbBucketName,
+	if printConfig {
+		fmt.Print(coreCfg.String())
+		return
 	}
 
-	coreCfg := core.Config{
-		DbCfg:        dbCfg,
-		Port:         port,
-		EnableLogger: true,
-		Standalone:   true,
+	if command.Name != core.CommandServe {
+		if err = core.RunCommand(coreCfg, command, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
+	// Run the application
+	//
 	core.Run(coreCfg)
 }
@@ -0,0 +1,5 @@
+// The gRPC messages API, generated from messages.proto with protoc-gen-go and
+// protoc-gen-go-grpc. The server is api.NewGrpcServer.
+//
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative messages.proto
+package messagespb
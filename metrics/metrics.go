@@ -0,0 +1,404 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Histogram buckets, in seconds, suited to request and database latencies
+//
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Content type of the Prometheus text exposition format
+//
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Every kind of metric knows how to write its own samples
+//
+type metric interface {
+	write(w *bufio.Writer, name string, labels string)
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Collection of metrics exposed together. Metrics are meant to be registered
+// once on startup, so registering an invalid or duplicate metric panics.
+//
+type Registry struct {
+	mu          sync.Mutex
+	families    []family
+	names       map[string]bool
+	scrapeHooks []func()
+}
+
+// Constructor for Registry object
+//
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (registry *Registry) register(name string, labelNames []string, f family) {
+	if !metricNameRegex.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	for _, labelName := range labelNames {
+		if !labelNameRegex.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+			panic(fmt.Sprintf("invalid label name %q for metric %s", labelName, name))
+		}
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if registry.names[name] {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry.names[name] = true
+	registry.families = append(registry.families, f)
+}
+
+// Registers "hook" to be called before every scrape, e.g. to refresh gauges
+// whose values are expensive to keep up to date. Scrapes are serialized, so
+// hooks never run concurrently with each other.
+//
+func (registry *Registry) OnScrape(hook func()) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.scrapeHooks = append(registry.scrapeHooks, hook)
+}
+
+func (registry *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, "counter", labelNames, func() metric { return &Counter{} })}
+	registry.register(name, labelNames, v)
+	return v
+}
+
+func (registry *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, "gauge", labelNames, func() metric { return &Gauge{} })}
+	registry.register(name, labelNames, v)
+	return v
+}
+
+// Registers a histogram with the given bucket upper bounds, which must be
+// sorted in increasing order. The "+Inf" bucket is implicit.
+//
+func (registry *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram %s aren't sorted", name))
+	}
+	for _, labelName := range labelNames {
+		if labelName == "le" {
+			panic(fmt.Sprintf("histogram %s can't have a label named \"le\"", name))
+		}
+	}
+
+	v := &HistogramVec{newVec(name, help, "histogram", labelNames, func() metric {
+		return &Histogram{upperBounds: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	registry.register(name, labelNames, v)
+	return v
+}
+
+// Registers a counter whose value is read from "fn" on every scrape
+//
+func (registry *Registry) NewCounterFunc(name string, help string, fn func() float64) {
+	registry.register(name, nil, &funcFamily{name: name, help: help, typ: "counter", fn: fn})
+}
+
+// Registers a gauge whose value is read from "fn" on every scrape
+//
+func (registry *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	registry.register(name, nil, &funcFamily{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// Writes every metric in the Prometheus text exposition format
+//
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for _, hook := range registry.scrapeHooks {
+		hook()
+	}
+
+	bufWriter := bufio.NewWriter(w)
+	for _, f := range registry.families {
+		f.write(bufWriter)
+	}
+
+	return bufWriter.Flush()
+}
+
+// Returns a handler serving every metric in the Prometheus text exposition
+// format
+//
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		registry.Write(w)
+	})
+}
+
+// Metrics of a single name, one per distinct combination of label values
+//
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	newMetric  func() metric
+
+	mu       sync.Mutex
+	children map[string]*child
+}
+
+type child struct {
+	labels string // Already formatted, e.g. `{method="GET"}`
+	metric metric
+}
+
+func newVec(name string, help string, typ string, labelNames []string, newMetric func() metric) vec {
+	return vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		newMetric:  newMetric,
+		children:   make(map[string]*child),
+	}
+}
+
+func (v *vec) get(labelValues []string) metric {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.children[key]
+	if !ok {
+		pairs := make([]string, len(labelValues))
+		for i, value := range labelValues {
+			pairs[i] = fmt.Sprintf("%s=\"%s\"", v.labelNames[i], escapeLabelValue(value))
+		}
+
+		c = &child{metric: v.newMetric()}
+		if len(pairs) != 0 {
+			c.labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+		v.children[key] = c
+	}
+
+	return c.metric
+}
+
+// Drops every child, e.g. to stop exposing label values that no longer exist
+//
+func (v *vec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.children = make(map[string]*child)
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, v.typ)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Sorted so that the output is stable between scrapes
+	//
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		c := v.children[key]
+		c.metric.write(w, v.name, c.labels)
+	}
+}
+
+type CounterVec struct{ vec }
+
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.get(labelValues).(*Counter)
+}
+
+type GaugeVec struct{ vec }
+
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.get(labelValues).(*Gauge)
+}
+
+type HistogramVec struct{ vec }
+
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.get(labelValues).(*Histogram)
+}
+
+// Monotonically increasing value
+//
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("counters can't decrease")
+	}
+
+	counter.mu.Lock()
+	counter.value += delta
+	counter.mu.Unlock()
+}
+
+func (counter *Counter) write(w *bufio.Writer, name string, labels string) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	writeSample(w, name, labels, counter.value)
+}
+
+// Value that can go up and down
+//
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (gauge *Gauge) Set(value float64) {
+	gauge.mu.Lock()
+	gauge.value = value
+	gauge.mu.Unlock()
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.Add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.Add(-1)
+}
+
+func (gauge *Gauge) Add(delta float64) {
+	gauge.mu.Lock()
+	gauge.value += delta
+	gauge.mu.Unlock()
+}
+
+func (gauge *Gauge) write(w *bufio.Writer, name string, labels string) {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+
+	writeSample(w, name, labels, gauge.value)
+}
+
+// Distribution of observed values, counted in cumulative buckets
+//
+type Histogram struct {
+	mu          sync.Mutex
+	upperBounds []float64
+	counts      []uint64 // Per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(histogram.upperBounds, value)
+
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	if i < len(histogram.counts) {
+		histogram.counts[i] += 1
+	}
+	histogram.count += 1
+	histogram.sum += value
+}
+
+func (histogram *Histogram) write(w *bufio.Writer, name string, labels string) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	// The "le" label goes last, within the same braces as the other labels
+	//
+	bucketLabels := func(le string) string {
+		if labels == "" {
+			return `{le="` + le + `"}`
+		}
+		return labels[:len(labels)-1] + `,le="` + le + `"}`
+	}
+
+	cumulative := uint64(0)
+	for i, upperBound := range histogram.upperBounds {
+		cumulative += histogram.counts[i]
+		writeSample(w, name+"_bucket", bucketLabels(formatFloat(upperBound)), float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", bucketLabels("+Inf"), float64(histogram.count))
+	writeSample(w, name+"_sum", labels, histogram.sum)
+	writeSample(w, name+"_count", labels, float64(histogram.count))
+}
+
+type funcFamily struct {
+	name string
+	help string
+	typ  string
+	fn   func() float64
+}
+
+func (f *funcFamily) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	writeSample(w, f.name, "", f.fn())
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
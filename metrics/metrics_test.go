@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounterVec("requests_total", "Requests.\nBy path.", "path")
+	requests.WithLabelValues("/b").Inc()
+	requests.WithLabelValues("/a \"quoted\" \\").Add(2.5)
+
+	temperature := registry.NewGaugeVec("temperature", "Temperature.")
+	temperature.WithLabelValues().Set(-1)
+	temperature.WithLabelValues().Inc()
+	temperature.WithLabelValues().Dec()
+
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	latency.WithLabelValues("get").Observe(0.05)
+	latency.WithLabelValues("get").Observe(0.1)
+	latency.WithLabelValues("get").Observe(5)
+
+	scrapes := 0
+	registry.OnScrape(func() { scrapes += 1 })
+	registry.NewGaugeFunc("scrapes", "Scrapes.", func() float64 { return float64(scrapes) })
+	registry.NewCounterFunc("infinite_total", "Infinity.", func() float64 { return math.Inf(1) })
+
+	expected := `# HELP requests_total Requests.\nBy path.
+# TYPE requests_total counter
+requests_total{path="/a \"quoted\" \\"} 2.5
+requests_total{path="/b"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature -1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.1"} 2
+latency_seconds_bucket{op="get",le="1"} 2
+latency_seconds_bucket{op="get",le="+Inf"} 3
+latency_seconds_sum{op="get"} 5.15
+latency_seconds_count{op="get"} 3
+# HELP scrapes Scrapes.
+# TYPE scrapes gauge
+scrapes 1
+# HELP infinite_total Infinity.
+# TYPE infinite_total counter
+infinite_total +Inf
+`
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, registry.Write(buf), "Write() failed")
+	assert.Equal(t, expected, buf.String(), "Unexpected exposition")
+
+	// Resetting drops every label value
+	//
+	requests.Reset()
+	response := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, ContentType, response.Header().Get("Content-Type"), "Unexpected content type")
+	assert.NotContains(t, response.Body.String(), "requests_total{", "Reset() didn't drop label values")
+	assert.Contains(t, response.Body.String(), "scrapes 2\n", "Scrape hook wasn't called")
+}
+
+func TestInvalidRegistrations(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("requests_total", "Requests.")
+
+	assert.Panics(t, func() { registry.NewCounterVec("requests_total", "Again.") }, "Duplicate name should panic")
+	assert.Panics(t, func() { registry.NewGaugeVec("bad-name", "Bad.") }, "Invalid name should panic")
+	assert.Panics(t, func() { registry.NewGaugeVec("bad_label", "Bad.", "0label") }, "Invalid label should panic")
+	assert.Panics(t, func() { registry.NewHistogramVec("bad_le", "Bad.", DefaultBuckets, "le") }, "\"le\" label should panic")
+	assert.Panics(t, func() { registry.NewHistogramVec("unsorted", "Bad.", []float64{1, 0.1}) }, "Unsorted buckets should panic")
+
+	counter := registry.NewCounterVec("counter_total", "Counter.", "label")
+	assert.Panics(t, func() { counter.WithLabelValues() }, "Missing label value should panic")
+	assert.Panics(t, func() { counter.WithLabelValues("value").Add(-1) }, "Decreasing a counter should panic")
+}
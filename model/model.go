@@ -1,7 +1,11 @@
 package model
 
+import (
+	"time"
+)
+
 type Message struct {
-	Id      uint64 `json:"id"`
+	Id      uint64 `json:"id" openapi:"optional"`
 	Payload string `json:"payload"`
 }
 
@@ -12,4 +16,58 @@ type MessageMetadata struct {
 type DetailedMessage struct {
 	Message  *Message         `json:"message"`
 	Metadata *MessageMetadata `json:"metadata"`
+	Owner    string           `json:"owner" description:"Name of the principal that created the message"`
+}
+
+type Tenant struct {
+	Name        string    `json:"name" openapi:"ref=TenantName"`
+	MaxMessages uint64    `json:"maxMessages" openapi:"optional" description:"Maximum number of messages in the tenant, 0 means unlimited"`
+	CreatedAt   time.Time `json:"createdAt" openapi:"optional,readOnly"`
+}
+
+type AuditRecord struct {
+	Sequence   uint64    `json:"sequence"`
+	Timestamp  time.Time `json:"timestamp"`
+	Principal  string    `json:"principal"`
+	RemoteAddr string    `json:"remoteAddr"`
+	RequestId  string    `json:"requestId"`
+	Tenant     string    `json:"tenant,omitempty"`
+	MessageId  uint64    `json:"messageId"`
+	Operation  string    `json:"operation" openapi:"enum=create|update|delete"`
+	BeforeHash string    `json:"beforeHash,omitempty" description:"SHA-256 of the payload before the change"`
+	AfterHash  string    `json:"afterHash,omitempty" description:"SHA-256 of the payload after the change"`
+	PrevHash   string    `json:"prevHash" description:"Hash of the previous record"`
+	Hash       string    `json:"hash" description:"SHA-256 of this record, excluding this field"`
+}
+
+type Change struct {
+	Sequence  uint64           `json:"sequence"`
+	Type      string           `json:"type" openapi:"enum=created|updated|deleted"`
+	Tenant    string           `json:"tenant,omitempty"`
+	Timestamp time.Time        `json:"timestamp"`
+	Message   *DetailedMessage `json:"message" description:"The message after the change, or before it for a deletion"`
+}
+
+type Webhook struct {
+	Id        uint64    `json:"id" openapi:"optional,readOnly"`
+	Url       string    `json:"url" openapi:"example=https://example.com/hooks/messages" description:"Where changes are POSTed to"`
+	Types     []string  `json:"types" openapi:"optional" description:"Types of changes delivered: created, updated and/or deleted. Every type if empty."`
+	Secret    string    `json:"secret,omitempty" openapi:"writeOnly" description:"Key every delivery is signed with"`
+	CreatedAt time.Time `json:"createdAt" openapi:"optional,readOnly"`
+}
+
+type WebhookDelivery struct {
+	Id            uint64    `json:"id" description:"Also sent in the X-Webhook-Id header, for receivers to deduplicate deliveries"`
+	WebhookId     uint64    `json:"webhookId"`
+	Change        *Change   `json:"change" description:"The change delivered, which is the body POSTed"`
+	Attempts      uint64    `json:"attempts" description:"Failed attempts so far"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LastError     string    `json:"lastError,omitempty" description:"Why the last attempt failed"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type ChangeConsumer struct {
+	Name      string    `json:"name" openapi:"ref=ConsumerName"`
+	Offset    uint64    `json:"offset" description:"Sequence number of the last change the consumer processed"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
@@ -0,0 +1,610 @@
+// Package msgctl implements msgctl, a command-line client of the messages API
+//
+package msgctl
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/client"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Exit codes, so that scripts can tell failures apart
+//
+const ExitOk = 0
+const ExitError = 1       // Anything not covered below
+const ExitUsage = 2       // Invalid command line or config file
+const ExitNotFound = 3    // The message doesn't exist
+const ExitDenied = 4      // Unauthenticated, or not allowed to
+const ExitUnavailable = 5 // The service couldn't be reached, or failed
+
+const DefaultTimeout = 30 * time.Second
+const DefaultTailLines = 10
+const DefaultTailInterval = 2 * time.Second
+
+// Error in how msgctl was invoked
+//
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &usageError{err: fmt.Errorf(format, a...)}
+}
+
+// What every command runs with
+//
+type env struct {
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type command struct {
+	synopsis string
+	run      func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = map[string]*command{
+	"list":   {synopsis: "list [--detailed] [--owner name] [--after-id id] [--page-size n] [--max n] [-o table|json|csv]", run: list},
+	"get":    {synopsis: "get [--detailed] [-o table|json|csv] <id>", run: get},
+	"create": {synopsis: "create [-f file|-] [-o table|json|csv] [payload|-]", run: create},
+	"update": {synopsis: "update [-f file|-] <id> [payload|-]", run: update},
+	"delete": {synopsis: "delete <id>...", run: remove},
+	"tail":   {synopsis: "tail [--detailed] [--owner name] [-n lines] [--interval duration] [-o table|json|csv]", run: tail},
+}
+
+var commandNames = []string{"list", "get", "create", "update", "delete", "tail"}
+
+// Outputs usage of msgctl to "w"
+//
+func PrintUsage(w io.Writer, name string) {
+	fmt.Fprintf(w, "usage: %s [global flags] <command> [flags] [args]\n\n", name)
+	fmt.Fprintf(w, "commands:\n")
+	for _, commandName := range commandNames {
+		fmt.Fprintf(w, "  %s\n", commands[commandName].synopsis)
+	}
+	fmt.Fprintf(w, "\nglobal flags:\n")
+
+	flagSet, _ := newGlobalFlags(name)
+	flagSet.SetOutput(w)
+	flagSet.PrintDefaults()
+
+	fmt.Fprintf(w, "\nEvery global flag but --config and --profile overrides the selected profile, and\n")
+	fmt.Fprintf(w, "can also be set with an environment variable named after it (e.g. --server can\n")
+	fmt.Fprintf(w, "be set with %sSERVER).\n\n", EnvVarPrefix)
+	fmt.Fprintf(w, "exit codes: %d ok, %d error, %d usage, %d not found, %d denied, %d unavailable\n",
+		ExitOk, ExitError, ExitUsage, ExitNotFound, ExitDenied, ExitUnavailable)
+}
+
+type globalFlags struct {
+	configFile string
+	profile    string
+	server     string
+	apiKey     string
+	tenant     string
+	timeout    time.Duration
+}
+
+func newGlobalFlags(name string) (*flag.FlagSet, *globalFlags) {
+	g := &globalFlags{}
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagSet.StringVar(&g.configFile, "config", "", "`path` of the config file (default "+DefaultConfigFilePath()+")")
+	flagSet.StringVar(&g.profile, "profile", "", "`name` of the profile to use (default: the config file's \"profile\")")
+	flagSet.StringVar(&g.server, "server", "", "`URL` of the service (default "+DefaultServer+")")
+	flagSet.StringVar(&g.apiKey, "api-key", "", "API `key` to authenticate with")
+	flagSet.StringVar(&g.tenant, "tenant", "", "`name` of the tenant to work on")
+	flagSet.DurationVar(&g.timeout, "timeout", DefaultTimeout, "time limit of a single request, 0 for none")
+	return flagSet, g
+}
+
+// Runs msgctl with the command line "args", excluding the program name, and
+// returns its exit code. Errors are reported on "stderr".
+//
+func Run(ctx context.Context, name string, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, getenv func(string) string) int {
+	err := run(ctx, name, args, stdin, stdout, getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		PrintUsage(stdout, name)
+		return ExitOk
+	}
+	if err == nil {
+		return ExitOk
+	}
+
+	fmt.Fprintln(stderr, "error: "+err.Error())
+	code := exitCode(err)
+	if code == ExitUsage {
+		fmt.Fprintln(stderr)
+		PrintUsage(stderr, name)
+	}
+	return code
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.Is(err, client.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, client.ErrUnauthenticated), errors.Is(err, client.ErrForbidden):
+		return ExitDenied
+	case errors.Is(err, client.ErrServer), errors.Is(err, client.ErrRateLimited), errors.As(err, &urlErr):
+		return ExitUnavailable
+	}
+	return ExitError
+}
+
+func run(ctx context.Context, name string, args []string, stdin io.Reader, stdout io.Writer, getenv func(string) string) error {
+	flagSet, g := newGlobalFlags(name)
+	flagSet.SetOutput(io.Discard)
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err: err}
+	}
+	if flagSet.NArg() == 0 {
+		return usageErrorf("missing command")
+	}
+
+	cmd, ok := commands[flagSet.Arg(0)]
+	if !ok {
+		return usageErrorf("unknown command %q", flagSet.Arg(0))
+	}
+
+	profile, err := loadProfile(flagSet, g, getenv)
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := profile.httpClient(g.timeout)
+	if err != nil {
+		return &usageError{err: err}
+	}
+	options := []client.Option{client.WithHTTPClient(httpClient), client.WithTenant(profile.Tenant)}
+	if profile.ApiKey != "" {
+		options = append(options, client.WithBearerToken(profile.ApiKey))
+	}
+	c, err := client.New(profile.Server, options...)
+	if err != nil {
+		return &usageError{err: err}
+	}
+
+	e := &env{client: c, stdin: stdin, stdout: stdout}
+	if err = cmd.run(ctx, e, flagSet.Args()[1:]); err != nil {
+		return fmt.Errorf("%s: %w", flagSet.Arg(0), err)
+	}
+	return nil
+}
+
+// Builds the effective profile from, in increasing order of precedence: the
+// selected profile of the config file, "MSGCTL_*" environment variables and
+// the global flags that were explicitly set
+//
+func loadProfile(flagSet *flag.FlagSet, g *globalFlags, getenv func(string) string) (*Profile, error) {
+	configFilePath := g.configFile
+	if configFilePath == "" {
+		configFilePath = getenv(EnvVarPrefix + "CONFIG")
+	}
+	required := configFilePath != ""
+	if configFilePath == "" {
+		configFilePath = DefaultConfigFilePath()
+	}
+
+	configFile, err := LoadConfigFile(configFilePath, required)
+	if err != nil {
+		return nil, &usageError{err: err}
+	}
+
+	profileName := g.profile
+	if profileName == "" {
+		profileName = getenv(EnvVarPrefix + "PROFILE")
+	}
+	profile, err := configFile.SelectProfile(profileName)
+	if err != nil {
+		return nil, &usageError{err: err}
+	}
+
+	overrides := map[string]*string{"server": &profile.Server, "api-key": &profile.ApiKey, "tenant": &profile.Tenant}
+	for flagName, setting := range overrides {
+		if value := getenv(EnvVarPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))); value != "" {
+			*setting = value
+		}
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		if setting, ok := overrides[f.Name]; ok {
+			*setting = f.Value.String()
+		}
+	})
+
+	if profile.Server == "" {
+		profile.Server = DefaultServer
+	}
+	return profile, nil
+}
+
+// Parses the flags of a command wherever they are among its positional
+// arguments, which are returned. Arguments after "--" are never flags.
+//
+func parseArgs(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	flagSet.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := flagSet.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &usageError{err: err}
+		}
+
+		consumed := len(args) - flagSet.NArg()
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, flagSet.Args()...), nil
+		}
+
+		args = flagSet.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func outputFlag(flagSet *flag.FlagSet, output *string) {
+	flagSet.StringVar(output, "o", OutputTable, "")
+	flagSet.StringVar(output, "output", OutputTable, "")
+}
+
+func checkOutput(output string) error {
+	if !validOutput(output) {
+		return usageErrorf("invalid output format %q", output)
+	}
+	return nil
+}
+
+func parseId(arg string) (uint64, error) {
+	id, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || id == 0 {
+		return 0, usageErrorf("invalid message ID %q", arg)
+	}
+	return id, nil
+}
+
+// Lists every message, fetching one page after the other
+//
+func list(ctx context.Context, e *env, args []string) error {
+	var opts client.ListOptions
+	var output string
+	var max uint64
+	flagSet := flag.NewFlagSet("list", flag.ContinueOnError)
+	flagSet.BoolVar(&opts.Detailed, "detailed", false, "")
+	flagSet.StringVar(&opts.Owner, "owner", "", "")
+	flagSet.Uint64Var(&opts.AfterId, "after-id", 0, "")
+	flagSet.Uint64Var(&opts.Limit, "page-size", 0, "")
+	flagSet.Uint64Var(&max, "max", 0, "")
+	outputFlag(flagSet, &output)
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected argument %q", positional[0])
+	}
+	if err = checkOutput(output); err != nil {
+		return err
+	}
+
+	p := newPrinter(e.stdout, output, opts.Detailed, false)
+	count := uint64(0)
+	it := e.client.Iterate(ctx, opts)
+	for (max == 0 || count < max) && it.Next() {
+		if err = p.print(iteratedMessage(it, opts.Detailed)); err != nil {
+			return err
+		}
+		count++
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+
+	return p.flush()
+}
+
+// Messages are printed as DetailedMessages whether they're detailed or not
+//
+func iteratedMessage(it *client.Iterator, detailed bool) *model.DetailedMessage {
+	if detailed {
+		return it.DetailedMessage()
+	}
+	return &model.DetailedMessage{Message: it.Message()}
+}
+
+func get(ctx context.Context, e *env, args []string) error {
+	var detailed bool
+	var output string
+	flagSet := flag.NewFlagSet("get", flag.ContinueOnError)
+	flagSet.BoolVar(&detailed, "detailed", false, "")
+	outputFlag(flagSet, &output)
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("expected a single message ID")
+	}
+	if err = checkOutput(output); err != nil {
+		return err
+	}
+	id, err := parseId(positional[0])
+	if err != nil {
+		return err
+	}
+
+	var detailedMessage *model.DetailedMessage
+	if detailed {
+		detailedMessage, err = e.client.GetDetailedMessage(ctx, id)
+	} else {
+		var message *model.Message
+		message, err = e.client.GetMessage(ctx, id)
+		detailedMessage = &model.DetailedMessage{Message: message}
+	}
+	if err != nil {
+		return err
+	}
+
+	// A single message is printed as an object rather than an array
+	//
+	if output == OutputJson {
+		if detailed {
+			return printJson(e.stdout, detailedMessage)
+		}
+		return printJson(e.stdout, detailedMessage.Message)
+	}
+
+	p := newPrinter(e.stdout, output, detailed, false)
+	if err = p.print(detailedMessage); err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+// Reads the payload from, in order: the file given with "-f", the argument,
+// or stdin if neither was given. "-" is stdin in both cases. The trailing
+// newline of a file or stdin isn't part of the payload.
+//
+func readPayload(e *env, fileName string, args []string) (string, error) {
+	if fileName != "" && len(args) != 0 {
+		return "", usageErrorf("the payload can't be both an argument and a file")
+	}
+	if fileName == "" && len(args) != 0 && args[0] != "-" {
+		return args[0], nil
+	}
+
+	r := e.stdin
+	if fileName != "" && fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	payload := strings.TrimSuffix(strings.TrimSuffix(string(buf), "\n"), "\r")
+	if payload == "" {
+		return "", usageErrorf("empty payload")
+	}
+	return payload, nil
+}
+
+// Creates a message and prints its ID
+//
+func create(ctx context.Context, e *env, args []string) error {
+	var fileName string
+	var output string
+	flagSet := flag.NewFlagSet("create", flag.ContinueOnError)
+	flagSet.StringVar(&fileName, "f", "", "")
+	flagSet.StringVar(&fileName, "file", "", "")
+	outputFlag(flagSet, &output)
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return usageErrorf("unexpected argument %q", positional[1])
+	}
+	if err = checkOutput(output); err != nil {
+		return err
+	}
+	payload, err := readPayload(e, fileName, positional)
+	if err != nil {
+		return err
+	}
+
+	id, err := e.client.CreateMessage(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	if output == OutputJson {
+		return printJson(e.stdout, &model.Message{Id: id, Payload: payload})
+	}
+	_, err = fmt.Fprintln(e.stdout, id)
+	return err
+}
+
+func update(ctx context.Context, e *env, args []string) error {
+	var fileName string
+	flagSet := flag.NewFlagSet("update", flag.ContinueOnError)
+	flagSet.StringVar(&fileName, "f", "", "")
+	flagSet.StringVar(&fileName, "file", "", "")
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageErrorf("missing message ID")
+	}
+	if len(positional) > 2 {
+		return usageErrorf("unexpected argument %q", positional[2])
+	}
+	id, err := parseId(positional[0])
+	if err != nil {
+		return err
+	}
+	payload, err := readPayload(e, fileName, positional[1:])
+	if err != nil {
+		return err
+	}
+
+	return e.client.UpdateMessage(ctx, id, payload)
+}
+
+// Deletes every message given, stopping at the first one that can't be
+// deleted
+//
+func remove(ctx context.Context, e *env, args []string) error {
+	flagSet := flag.NewFlagSet("delete", flag.ContinueOnError)
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageErrorf("missing message ID")
+	}
+
+	ids := make([]uint64, 0, len(positional))
+	for _, arg := range positional {
+		id, err := parseId(arg)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		if err = e.client.DeleteMessage(ctx, id); err != nil {
+			return fmt.Errorf("message %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Prints the last messages, then the ones created from then on as they're
+// found, until interrupted. The service is polled for new messages.
+//
+func tail(ctx context.Context, e *env, args []string) error {
+	var opts client.ListOptions
+	var output string
+	var lines uint64
+	var interval time.Duration
+	flagSet := flag.NewFlagSet("tail", flag.ContinueOnError)
+	flagSet.BoolVar(&opts.Detailed, "detailed", false, "")
+	flagSet.StringVar(&opts.Owner, "owner", "", "")
+	flagSet.Uint64Var(&lines, "n", DefaultTailLines, "")
+	flagSet.DurationVar(&interval, "interval", DefaultTailInterval, "")
+	outputFlag(flagSet, &output)
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected argument %q", positional[0])
+	}
+	if err = checkOutput(output); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return usageErrorf("invalid interval %s", interval)
+	}
+
+	// Messages are printed as they come, so JSON ones are printed one per
+	// line
+	//
+	p := newPrinter(e.stdout, output, opts.Detailed, true)
+
+	// Goes through every message once to find the last ones
+	//
+	var last []*model.DetailedMessage
+	it := e.client.Iterate(ctx, opts)
+	for it.Next() {
+		detailedMessage := iteratedMessage(it, opts.Detailed)
+		opts.AfterId = detailedMessage.Message.Id
+		if lines == 0 {
+			continue
+		}
+		if uint64(len(last)) == lines {
+			last = last[1:]
+		}
+		last = append(last, detailedMessage)
+	}
+	if err = it.Err(); err != nil {
+		return tailErr(ctx, err)
+	}
+	if err = p.print(last...); err != nil {
+		return err
+	}
+	if err = p.flush(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		it = e.client.Iterate(ctx, opts)
+		for it.Next() {
+			detailedMessage := iteratedMessage(it, opts.Detailed)
+			opts.AfterId = detailedMessage.Message.Id
+			if err = p.print(detailedMessage); err != nil {
+				return err
+			}
+		}
+		if err = it.Err(); err != nil {
+			return tailErr(ctx, err)
+		}
+		if err = p.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// Being interrupted is how tail is meant to stop
+//
+func tailErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
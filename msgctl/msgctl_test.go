@@ -0,0 +1,198 @@
+package msgctl
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRun struct {
+	t      *testing.T
+	svcDb  *db.Db
+	server string
+	env    map[string]string
+}
+
+func newTestRun(t *testing.T) *testRun {
+	svcDb := db.NewDb(db.Config{
+		FilePath:   filepath.Join(t.TempDir(), "msgctl-test.db"),
+		BucketName: "MsgctlTestBucket",
+	})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	t.Cleanup(svcDb.Close)
+
+	apiKeys := map[string]*api.Principal{"alice-key": {Name: "alice"}, "bob-key": {Name: "bob"}}
+	server := httptest.NewServer(api.NewRouter(svcDb, api.Config{ApiKeys: apiKeys}))
+	t.Cleanup(server.Close)
+
+	// Never picks up the config file of whoever runs the tests
+	//
+	env := map[string]string{"MSGCTL_CONFIG": filepath.Join(t.TempDir(), "none.yaml")}
+	assert.Nil(t, os.WriteFile(env["MSGCTL_CONFIG"], nil, 0600), "Unable to write config file")
+
+	return &testRun{t: t, svcDb: svcDb, server: server.URL, env: env}
+}
+
+// Runs msgctl against the test server as alice, returning its exit code and
+// output
+//
+func (r *testRun) run(ctx context.Context, stdin string, args ...string) (int, string, string) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	args = append([]string{"--server", r.server, "--api-key", "alice-key"}, args...)
+	code := Run(ctx, "msgctl", args, strings.NewReader(stdin), stdout, stderr, func(key string) string { return r.env[key] })
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRun(t)
+
+	// The payload comes from the argument, stdin or a file
+	//
+	code, stdout, _ := r.run(ctx, "", "create", "kayak")
+	assert.Equal(t, ExitOk, code, "create failed")
+	assert.Equal(t, "1\n", stdout, "Unexpected create output")
+	code, stdout, _ = r.run(ctx, "foo\n", "create", "-o", "json")
+	assert.Equal(t, ExitOk, code, "create failed")
+	assert.JSONEq(t, `{"id":2,"payload":"foo"}`, stdout, "Unexpected create output")
+	payloadFile := filepath.Join(t.TempDir(), "payload.txt")
+	assert.Nil(t, os.WriteFile(payloadFile, []byte("bar,baz\n"), 0600), "Unable to write payload file")
+	code, _, _ = r.run(ctx, "", "create", "-f", payloadFile)
+	assert.Equal(t, ExitOk, code, "create failed")
+
+	code, stdout, _ = r.run(ctx, "", "list")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.Equal(t, "ID  PAYLOAD\n1   kayak\n2   foo\n3   bar,baz\n", stdout, "Unexpected list output")
+
+	// Every page is listed
+	//
+	code, stdout, _ = r.run(ctx, "", "list", "--page-size", "1", "--detailed", "-o", "csv")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.Equal(t, "ID,PAYLOAD,PALINDROME,OWNER\n1,kayak,true,alice\n2,foo,false,alice\n3,\"bar,baz\",false,alice\n", stdout, "Unexpected list output")
+	code, stdout, _ = r.run(ctx, "", "list", "--page-size", "1", "--max", "2", "-o", "json")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.JSONEq(t, `[{"id":1,"payload":"kayak"},{"id":2,"payload":"foo"}]`, stdout, "Unexpected list output")
+
+	code, _, _ = r.run(ctx, "qux", "update", "2", "-")
+	assert.Equal(t, ExitOk, code, "update failed")
+	code, stdout, _ = r.run(ctx, "", "get", "2", "--detailed", "-o", "json")
+	assert.Equal(t, ExitOk, code, "get failed")
+	assert.JSONEq(t, `{"message":{"id":2,"payload":"qux"},"metadata":{"palindrome":false},"owner":"alice"}`, stdout, "Unexpected get output")
+
+	code, _, _ = r.run(ctx, "", "delete", "1", "2")
+	assert.Equal(t, ExitOk, code, "delete failed")
+	code, stdout, _ = r.run(ctx, "", "list", "-o", "json")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.JSONEq(t, `[{"id":3,"payload":"bar,baz"}]`, stdout, "Unexpected list output")
+}
+
+func TestExitCodes(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRun(t)
+
+	code, _, stderr := r.run(ctx, "", "get", "1")
+	assert.Equal(t, ExitNotFound, code, "Unexpected exit code")
+	assert.Contains(t, stderr, "get: 404 Not Found", "Unexpected error")
+
+	code, _, _ = r.run(ctx, "", "frobnicate")
+	assert.Equal(t, ExitUsage, code, "Unexpected exit code")
+	code, _, _ = r.run(ctx, "", "get", "one")
+	assert.Equal(t, ExitUsage, code, "Unexpected exit code")
+	code, _, _ = r.run(ctx, "", "list", "-o", "xml")
+	assert.Equal(t, ExitUsage, code, "Unexpected exit code")
+	code, _, _ = r.run(ctx, "", "create", "foo", "-f", "payload.txt")
+	assert.Equal(t, ExitUsage, code, "Unexpected exit code")
+
+	code, _, _ = r.run(ctx, "", "--api-key", "nobody-key", "list")
+	assert.Equal(t, ExitDenied, code, "Unexpected exit code")
+
+	code, _, _ = r.run(ctx, "", "--server", "http://127.0.0.1:1", "list")
+	assert.Equal(t, ExitUnavailable, code, "Unexpected exit code")
+
+	code, stdout, _ := r.run(ctx, "", "--help")
+	assert.Equal(t, ExitOk, code, "Unexpected exit code")
+	assert.Contains(t, stdout, "exit codes:", "Unexpected usage")
+}
+
+func TestProfiles(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRun(t)
+	assert.Nil(t, r.svcDb.CreateTenant(&model.Tenant{Name: "acme"}), "CreateTenant() failed")
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(strings.Join([]string{
+		"profile: bob",
+		"profiles:",
+		"  bob:",
+		"    server: " + r.server,
+		"    apiKey: bob-key",
+		"  acme:",
+		"    server: " + r.server,
+		"    apiKey: alice-key",
+		"    tenant: acme",
+	}, "\n")), 0600)
+	assert.Nil(t, err, "Unable to write config file")
+
+	runWithProfile := func(args ...string) (int, string) {
+		stdout := &bytes.Buffer{}
+		env := map[string]string{"MSGCTL_CONFIG": configFile}
+		code := Run(ctx, "msgctl", args, strings.NewReader(""), stdout, &bytes.Buffer{}, func(key string) string { return env[key] })
+		return code, stdout.String()
+	}
+
+	// The config file's profile is used unless another one is asked for
+	//
+	code, _ := runWithProfile("create", "foo")
+	assert.Equal(t, ExitOk, code, "create failed")
+	code, _ = runWithProfile("--profile", "acme", "create", "bar")
+	assert.Equal(t, ExitOk, code, "create failed")
+
+	code, stdout := runWithProfile("list", "--detailed")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.Regexp(t, `1 +foo +false +bob`, stdout, "Unexpected list output")
+	code, stdout = runWithProfile("--profile", "acme", "list")
+	assert.Equal(t, ExitOk, code, "list failed")
+	assert.Regexp(t, `1 +bar`, stdout, "Unexpected list output")
+
+	// Flags override the profile
+	//
+	code, _ = runWithProfile("--profile", "acme", "--tenant", "other", "get", "1")
+	assert.Equal(t, ExitNotFound, code, "Unexpected exit code")
+
+	code, _ = runWithProfile("--profile", "missing", "list")
+	assert.Equal(t, ExitUsage, code, "Unexpected exit code")
+}
+
+func TestTail(t *testing.T) {
+	r := newTestRun(t)
+	for _, payload := range []string{"a", "b", "c"} {
+		code, _, _ := r.run(context.Background(), "", "create", payload)
+		assert.Equal(t, ExitOk, code, "create failed")
+	}
+
+	// Creates a message while tail is polling, then stops it
+	//
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.run(context.Background(), "", "create", "d")
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	code, stdout, _ := r.run(ctx, "", "tail", "-n", "2", "--interval", "10ms", "-o", "json")
+	assert.Equal(t, ExitOk, code, "tail failed")
+	assert.Equal(t, "{\"id\":2,\"payload\":\"b\"}\n{\"id\":3,\"payload\":\"c\"}\n{\"id\":4,\"payload\":\"d\"}\n", stdout, "Unexpected tail output")
+}
@@ -0,0 +1,137 @@
+package msgctl
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Output formats of the commands printing messages
+//
+const OutputTable = "table"
+const OutputJson = "json"
+const OutputCsv = "csv"
+
+func validOutput(output string) bool {
+	return output == OutputTable || output == OutputJson || output == OutputCsv
+}
+
+// Prints messages in one of the output formats. Messages are always given as
+// DetailedMessages, of which only the message is printed unless "detailed" is
+// set. Nothing is guaranteed to be written until flush() is called.
+//
+type printer struct {
+	w        io.Writer
+	output   string
+	detailed bool
+
+	// Whether JSON messages are printed one per line as they come, rather than
+	// as a single array
+	//
+	stream bool
+
+	tw          *tabwriter.Writer
+	csvWriter   *csv.Writer
+	wroteHeader bool
+	buffered    []interface{}
+}
+
+func newPrinter(w io.Writer, output string, detailed bool, stream bool) *printer {
+	p := &printer{w: w, output: output, detailed: detailed, stream: stream}
+	switch output {
+	case OutputTable:
+		p.tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	case OutputCsv:
+		p.csvWriter = csv.NewWriter(w)
+	}
+	return p
+}
+
+func (p *printer) header() []string {
+	if p.detailed {
+		return []string{"ID", "PAYLOAD", "PALINDROME", "OWNER"}
+	}
+	return []string{"ID", "PAYLOAD"}
+}
+
+func (p *printer) row(detailedMessage *model.DetailedMessage) []string {
+	row := []string{strconv.FormatUint(detailedMessage.Message.Id, 10), detailedMessage.Message.Payload}
+	if p.detailed {
+		row = append(row, strconv.FormatBool(detailedMessage.Metadata.Palindrome), detailedMessage.Owner)
+	}
+	return row
+}
+
+func (p *printer) print(detailedMessages ...*model.DetailedMessage) error {
+	for _, detailedMessage := range detailedMessages {
+		var err error
+		switch p.output {
+		case OutputTable:
+			if !p.wroteHeader {
+				fmt.Fprintln(p.tw, strings.Join(p.header(), "\t"))
+			}
+			// Payloads with tabs or newlines would break the table, those are
+			// quoted
+			//
+			row := p.row(detailedMessage)
+			if strings.ContainsAny(row[1], "\t\r\n") {
+				row[1] = strconv.Quote(row[1])
+			}
+			_, err = fmt.Fprintln(p.tw, strings.Join(row, "\t"))
+		case OutputCsv:
+			if !p.wroteHeader {
+				p.csvWriter.Write(p.header())
+			}
+			err = p.csvWriter.Write(p.row(detailedMessage))
+		case OutputJson:
+			var v interface{} = detailedMessage.Message
+			if p.detailed {
+				v = detailedMessage
+			}
+			if p.stream {
+				err = json.NewEncoder(p.w).Encode(v)
+			} else {
+				p.buffered = append(p.buffered, v)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		p.wroteHeader = true
+	}
+	return nil
+}
+
+func (p *printer) flush() error {
+	switch p.output {
+	case OutputTable:
+		return p.tw.Flush()
+	case OutputCsv:
+		p.csvWriter.Flush()
+		return p.csvWriter.Error()
+	case OutputJson:
+		if p.stream {
+			return nil
+		}
+		if p.buffered == nil {
+			p.buffered = []interface{}{}
+		}
+		return printJson(p.w, p.buffered)
+	}
+	return nil
+}
+
+func printJson(w io.Writer, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(buf))
+	return err
+}
@@ -0,0 +1,147 @@
+package msgctl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables overriding the config file, and overridden by the
+// global flags, e.g. "--server" is overridden by "MSGCTL_SERVER"
+//
+const EnvVarPrefix = "MSGCTL_"
+
+const DefaultServer = "http://localhost:55555"
+const DefaultProfileName = "default"
+
+// Where to reach the service and how to authenticate to it
+//
+type Profile struct {
+	Server string `yaml:"server"`
+	ApiKey string `yaml:"apiKey"`
+	Tenant string `yaml:"tenant,omitempty"`
+
+	// PEM files, for a service presenting a certificate signed by a private CA
+	// or authenticating clients by certificate
+	//
+	CACert     string `yaml:"caCert,omitempty"`
+	ClientCert string `yaml:"clientCert,omitempty"`
+	ClientKey  string `yaml:"clientKey,omitempty"`
+}
+
+// Contents of the config file, such as:
+//
+//   profile: local
+//   profiles:
+//     local:
+//       server: http://localhost:55555
+//       apiKey: alice-key
+//     prod:
+//       server: https://messages.example.com
+//       apiKey: ...
+//       tenant: acme
+//
+type ConfigFile struct {
+	Profile  string              `yaml:"profile"` // Used unless another one is asked for
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// Path of the config file used when none is given
+//
+func DefaultConfigFilePath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "msgctl", "config.yaml")
+}
+
+// Loads the config file at "filePath". A missing file is only an error if
+// "required" is set, otherwise it's treated as empty.
+//
+func LoadConfigFile(filePath string, required bool) (*ConfigFile, error) {
+	configFile := &ConfigFile{}
+
+	buf, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return configFile, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown fields are rejected so that typos don't go unnoticed
+	//
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(configFile); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	return configFile, nil
+}
+
+// Returns a copy of the profile named "name", or of the file's own profile if
+// empty. Only a profile that was asked for by name has to exist.
+//
+func (configFile *ConfigFile) SelectProfile(name string) (*Profile, error) {
+	required := name != ""
+	if name == "" {
+		name = configFile.Profile
+	}
+	if name == "" {
+		name = DefaultProfileName
+	}
+
+	profile, ok := configFile.Profiles[name]
+	if !ok {
+		if required {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		return &Profile{}, nil
+	}
+
+	selected := *profile
+	return &selected, nil
+}
+
+// Builds the HTTP client trusting the profile's CA and presenting its client
+// certificate, if it has them. Requests time out after "timeout", unless 0.
+//
+func (profile *Profile) httpClient(timeout time.Duration) (*http.Client, error) {
+	if profile.CACert == "" && profile.ClientCert == "" {
+		return &http.Client{Timeout: timeout}, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if profile.CACert != "" {
+		buf, err := os.ReadFile(profile.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("%s: no certificate found", profile.CACert)
+		}
+	}
+	if profile.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(profile.ClientCert, profile.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
@@ -1,17 +1,18 @@
 package test
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/brandonto/rest-api-microservice-demo/api"
+	"github.com/brandonto/rest-api-microservice-demo/client"
 	"github.com/brandonto/rest-api-microservice-demo/core"
 	"github.com/brandonto/rest-api-microservice-demo/db"
 	"github.com/brandonto/rest-api-microservice-demo/model"
@@ -33,7 +34,7 @@ type EndToEndTestSuite struct {
 // One time set up function called when the test suite is started
 //
 func (suite *EndToEndTestSuite) SetupSuite() {
-	suite.dbFilePath = "/home/brandonto/rest-api-microservice-demo-test.db"
+	suite.dbFilePath = filepath.Join(os.TempDir(), "rest-api-microservice-demo-test.db")
 	suite.dbBucketName = "E2ETestBucket"
 	suite.dbBucketKey = []byte(suite.dbBucketName)
 	suite.port = 54321
@@ -79,9 +80,13 @@ func (suite *EndToEndTestSuite) SetupTest() {
 
 	coreCfg := core.Config{
 		DbCfg:        dbCfg,
-		Port:         suite.port,
+		ListenAddr:   fmt.Sprintf("localhost:%d", suite.port),
 		EnableLogger: true,
 		Standalone:   false,
+
+		// The responses have to match the OpenAPI document too
+		//
+		OpenApiValidation: api.OpenApiValidationStrict,
 	}
 
 	go core.Run(coreCfg)
@@ -108,165 +113,97 @@ func (suite *EndToEndTestSuite) TearDownTest() {
 	time.Sleep(time.Duration(sleepTimeInSeconds) * time.Second)
 }
 
-func (suite *EndToEndTestSuite) makeRequestURL(path string) string {
-	return fmt.Sprintf("http://localhost:%d%s", suite.port, path)
+func (suite *EndToEndTestSuite) newClient() *client.Client {
+	c, err := client.New(fmt.Sprintf("http://localhost:%d", suite.port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
 }
 
 func (suite *EndToEndTestSuite) TestBasicFunctionality() {
-	var response *http.Response
-	var err error
 	var message *model.Message
-	var buf []byte
-	var listMessagesResponse api.ListMessagesResponse
-	var getMessageResponse api.GetMessageResponse
-	var request *http.Request
-	client := &http.Client{}
-
-	response, err = http.Get(suite.makeRequestURL("/messages"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-
-	response, err = http.Get(suite.makeRequestURL("/messages/1"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNotFound, "Unexpected HTTP status code")
-
-	message = &model.Message{
-		Payload: "foo",
-	}
-	buf, err = json.Marshal(message)
-	assert.Nil(suite.T(), err, "Error encoding json")
-	response, err = http.Post(suite.makeRequestURL("/messages"), "application/json", bytes.NewReader(buf))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusCreated, "Unexpected HTTP status code")
-
-	response, err = http.Get(suite.makeRequestURL("/messages"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &listMessagesResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.Equal(suite.T(), len(listMessagesResponse), 1, "Unexpected number of messages in response")
-	assert.Equal(suite.T(), listMessagesResponse[0].Id, uint64(1), "Unexpected message id in response")
-	assert.Equal(suite.T(), listMessagesResponse[0].Payload, "foo", "Unexpected message payload response")
-
-	response, err = http.Get(suite.makeRequestURL("/messages/1"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &getMessageResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.NotNil(suite.T(), getMessageResponse.Message, "Response did not include valid message")
-	assert.Equal(suite.T(), getMessageResponse.Id, uint64(1), "Unexpected message id in response")
-	assert.Equal(suite.T(), getMessageResponse.Payload, "foo", "Unexpected message payload response")
-
-	message.Payload = "bar"
-	buf, err = json.Marshal(message)
-	assert.Nil(suite.T(), err, "Error encoding json")
-	request, err = http.NewRequest(http.MethodPut, suite.makeRequestURL("/messages/1"), bytes.NewReader(buf))
-	assert.Nil(suite.T(), err, "Error creating HTTP request")
-	request.Header.Set("Content-Type", "application/json")
-	response, err = client.Do(request)
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNoContent, "Unexpected HTTP status code")
-
-	response, err = http.Get(suite.makeRequestURL("/messages/1"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &getMessageResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.NotNil(suite.T(), getMessageResponse.Message, "Response did not include valid message")
-	assert.Equal(suite.T(), getMessageResponse.Id, uint64(1), "Unexpected message id in response")
-	assert.Equal(suite.T(), getMessageResponse.Payload, "bar", "Unexpected message payload response")
-
-	request, err = http.NewRequest(http.MethodDelete, suite.makeRequestURL("/messages/1"), nil)
-	assert.Nil(suite.T(), err, "Error creating HTTP request")
-	response, err = client.Do(request)
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNoContent, "Unexpected HTTP status code")
-
-	response, err = http.Get(suite.makeRequestURL("/messages/1"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNotFound, "Unexpected HTTP status code")
-
-	message.Payload = "foo"
-	buf, err = json.Marshal(message)
-	assert.Nil(suite.T(), err, "Error encoding json")
-	response, err = http.Post(suite.makeRequestURL("/messages"), "application/json", bytes.NewReader(buf))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusCreated, "Unexpected HTTP status code")
-
-	message.Payload = "bar"
-	buf, err = json.Marshal(message)
-	assert.Nil(suite.T(), err, "Error encoding json")
-	request, err = http.NewRequest(http.MethodPut, suite.makeRequestURL("/messages/1"), bytes.NewReader(buf))
-	assert.Nil(suite.T(), err, "Error creating HTTP request")
-	request.Header.Set("Content-Type", "application/json")
-	response, err = client.Do(request)
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNotFound, "Unexpected HTTP status code")
-
-	request, err = http.NewRequest(http.MethodDelete, suite.makeRequestURL("/messages/1"), nil)
-	assert.Nil(suite.T(), err, "Error creating HTTP request")
-	response, err = client.Do(request)
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusNotFound, "Unexpected HTTP status code")
-
-	response, err = http.Get(suite.makeRequestURL("/messages/2"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &getMessageResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.NotNil(suite.T(), getMessageResponse.Message, "Response did not include valid message")
-	assert.Equal(suite.T(), getMessageResponse.Id, uint64(2), "Unexpected message id in response")
-	assert.Equal(suite.T(), getMessageResponse.Payload, "foo", "Unexpected message payload response")
-
-	message.Payload = "test"
-	buf, err = json.Marshal(message)
-	assert.Nil(suite.T(), err, "Error encoding json")
+	var page *client.Page
+	var id uint64
+	var err error
+	ctx := context.Background()
+	c := suite.newClient()
+
+	page, err = c.ListMessages(ctx, client.ListOptions{})
+	assert.Nil(suite.T(), err, "Error listing messages")
+	assert.Equal(suite.T(), len(page.Messages), 0, "Unexpected number of messages in response")
+
+	_, err = c.GetMessage(ctx, 1)
+	assert.True(suite.T(), errors.Is(err, client.ErrNotFound), "Unexpected error %v", err)
+
+	id, err = c.CreateMessage(ctx, "foo")
+	assert.Nil(suite.T(), err, "Error creating message")
+	assert.Equal(suite.T(), id, uint64(1), "Unexpected message id")
+
+	page, err = c.ListMessages(ctx, client.ListOptions{})
+	assert.Nil(suite.T(), err, "Error listing messages")
+	assert.Equal(suite.T(), len(page.Messages), 1, "Unexpected number of messages in response")
+	assert.Equal(suite.T(), page.Messages[0].Id, uint64(1), "Unexpected message id in response")
+	assert.Equal(suite.T(), page.Messages[0].Payload, "foo", "Unexpected message payload response")
+
+	message, err = c.GetMessage(ctx, 1)
+	assert.Nil(suite.T(), err, "Error getting message")
+	assert.Equal(suite.T(), message.Id, uint64(1), "Unexpected message id in response")
+	assert.Equal(suite.T(), message.Payload, "foo", "Unexpected message payload response")
+
+	err = c.UpdateMessage(ctx, 1, "bar")
+	assert.Nil(suite.T(), err, "Error updating message")
+
+	message, err = c.GetMessage(ctx, 1)
+	assert.Nil(suite.T(), err, "Error getting message")
+	assert.Equal(suite.T(), message.Id, uint64(1), "Unexpected message id in response")
+	assert.Equal(suite.T(), message.Payload, "bar", "Unexpected message payload response")
+
+	err = c.DeleteMessage(ctx, 1)
+	assert.Nil(suite.T(), err, "Error deleting message")
+
+	_, err = c.GetMessage(ctx, 1)
+	assert.True(suite.T(), errors.Is(err, client.ErrNotFound), "Unexpected error %v", err)
+
+	id, err = c.CreateMessage(ctx, "foo")
+	assert.Nil(suite.T(), err, "Error creating message")
+	assert.Equal(suite.T(), id, uint64(2), "Unexpected message id")
+
+	err = c.UpdateMessage(ctx, 1, "bar")
+	assert.True(suite.T(), errors.Is(err, client.ErrNotFound), "Unexpected error %v", err)
+
+	err = c.DeleteMessage(ctx, 1)
+	assert.True(suite.T(), errors.Is(err, client.ErrNotFound), "Unexpected error %v", err)
+
+	message, err = c.GetMessage(ctx, 2)
+	assert.Nil(suite.T(), err, "Error getting message")
+	assert.Equal(suite.T(), message.Id, uint64(2), "Unexpected message id in response")
+	assert.Equal(suite.T(), message.Payload, "foo", "Unexpected message payload response")
+
 	for i := 0; i < 20; i++ {
-		response, err = http.Post(suite.makeRequestURL("/messages"), "application/json", bytes.NewReader(buf))
-		assert.Nil(suite.T(), err, "Error making HTTP request")
-		assert.Equal(suite.T(), response.StatusCode, http.StatusCreated, "Unexpected HTTP status code")
+		_, err = c.CreateMessage(ctx, "test")
+		assert.Nil(suite.T(), err, "Error creating message")
 	}
 
-	response, err = http.Get(suite.makeRequestURL("/messages"))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	nextRelativeUrl := response.Header.Get("x-next-relative-url")
-	assert.Equal(suite.T(), nextRelativeUrl, "/messages?afterId=21&limit=20", "Unexpected x-next-relative-url")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &listMessagesResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.Equal(suite.T(), len(listMessagesResponse), 20, "Unexpected number of messages in response")
-
-	response, err = http.Get(suite.makeRequestURL(nextRelativeUrl))
-	assert.Nil(suite.T(), err, "Error making HTTP request")
-	assert.Equal(suite.T(), response.StatusCode, http.StatusOK, "Unexpected HTTP status code")
-	assert.Equal(suite.T(), response.Header.Get("content-type"), "application/json", "Unexpected content-type")
-	assert.Equal(suite.T(), response.Header.Get("x-next-relative-url"), "", "Unexpected x-next-relative-url")
-	buf, err = ioutil.ReadAll(response.Body)
-	assert.Nil(suite.T(), err, "Error reading response body")
-	response.Body.Close()
-	err = json.Unmarshal(buf, &listMessagesResponse)
-	assert.Nil(suite.T(), err, "Error decoding json")
-	assert.Equal(suite.T(), len(listMessagesResponse), 1, "Unexpected number of messages in response")
+	page, err = c.ListMessages(ctx, client.ListOptions{})
+	assert.Nil(suite.T(), err, "Error listing messages")
+	assert.Equal(suite.T(), page.NextRelativeUrl, "/messages?afterId=21&limit=20", "Unexpected x-next-relative-url")
+	assert.Equal(suite.T(), len(page.Messages), 20, "Unexpected number of messages in response")
+
+	page, err = c.ListMessages(ctx, client.ListOptions{AfterId: 21})
+	assert.Nil(suite.T(), err, "Error listing messages")
+	assert.Equal(suite.T(), page.NextRelativeUrl, "", "Unexpected x-next-relative-url")
+	assert.Equal(suite.T(), len(page.Messages), 1, "Unexpected number of messages in response")
+
+	// Iterating follows every page
+	//
+	count := 0
+	it := c.Iterate(ctx, client.ListOptions{})
+	for it.Next() {
+		count++
+	}
+	assert.Nil(suite.T(), it.Err(), "Error iterating over messages")
+	assert.Equal(suite.T(), count, 21, "Unexpected number of messages")
 }
 
 func TestSuite(t *testing.T) {
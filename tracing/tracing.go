@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation scope every span of the service is created under
+//
+const InstrumentationName = "github.com/brandonto/rest-api-microservice-demo"
+
+const DefaultServiceName = "rest-api-microservice-demo"
+
+// Where finished spans are sent
+//
+const ExporterNone = "none"
+const ExporterStdout = "stdout" // One JSON document per span, on stdout
+const ExporterFile = "file"     // Same as stdout, appended to FilePath
+const ExporterOtlp = "otlp"     // OTLP over HTTP to OtlpEndpoint
+
+// Structure to encapsulate tracing configuration. Tracing is disabled unless
+// an exporter is configured.
+//
+type Config struct {
+	Exporter     string  `yaml:"exporter"`
+	FilePath     string  `yaml:"filePath"`
+	OtlpEndpoint string  `yaml:"otlpEndpoint"` // e.g. "localhost:4318"
+	OtlpInsecure bool    `yaml:"otlpInsecure"` // Use HTTP rather than HTTPS
+	SampleRatio  float64 `yaml:"sampleRatio"`  // Of traces started here
+	ServiceName  string  `yaml:"serviceName"`
+}
+
+func (cfg *Config) Validate() error {
+	switch cfg.Exporter {
+	case "", ExporterNone, ExporterStdout:
+	case ExporterFile:
+		if cfg.FilePath == "" {
+			return errors.New("the file trace exporter requires a file path")
+		}
+	case ExporterOtlp:
+		if cfg.OtlpEndpoint == "" {
+			return errors.New("the OTLP trace exporter requires an endpoint")
+		}
+	default:
+		return fmt.Errorf("invalid trace exporter %q", cfg.Exporter)
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("trace sample ratio must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Returns the tracer every span of the service is started with
+//
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Installs the global tracer provider and W3C trace context propagator as
+// configured by "cfg". The returned function flushes any buffered span and
+// must be called before exiting.
+//
+func Setup(cfg Config) (func(context.Context) error, error) {
+	// Trace context is propagated even when tracing is disabled, so that this
+	// service doesn't break the chain between its callers and callees
+	//
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var file *os.File
+		file, err = os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case ExporterOtlp:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OtlpEndpoint)}
+		if cfg.OtlpInsecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	// Sampling decisions already made by callers are honoured
+	//
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+)
+
+func TestFileExporter(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	filePath := filepath.Join(t.TempDir(), "traces.json")
+	cfg := Config{Exporter: ExporterFile, FilePath: filePath, SampleRatio: 1}
+	assert.Nil(t, cfg.Validate(), "Validate() failed")
+
+	shutdown, err := Setup(cfg)
+	assert.Nil(t, err, "Setup() failed")
+
+	_, span := Tracer().Start(context.Background(), "test-span")
+	span.End()
+
+	// Spans are buffered until shutdown
+	//
+	assert.Nil(t, shutdown(context.Background()), "shutdown() failed")
+
+	contents, err := os.ReadFile(filePath)
+	assert.Nil(t, err, "Unable to read trace file")
+	assert.True(t, strings.Contains(string(contents), `"Name":"test-span"`), "Span wasn't exported")
+	assert.True(t, strings.Contains(string(contents), DefaultServiceName), "Service name wasn't exported")
+}
+
+func TestConfigValidation(t *testing.T) {
+	assert.Nil(t, (&Config{}).Validate(), "Tracing should be disabled by default")
+	assert.NotNil(t, (&Config{Exporter: "jaeger"}).Validate(), "Unknown exporter should be rejected")
+	assert.NotNil(t, (&Config{Exporter: ExporterFile}).Validate(), "Missing file path should be rejected")
+	assert.NotNil(t, (&Config{Exporter: ExporterOtlp}).Validate(), "Missing endpoint should be rejected")
+	assert.NotNil(t, (&Config{SampleRatio: 2}).Validate(), "Out of range sample ratio should be rejected")
+}
@@ -0,0 +1,340 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+)
+
+// Headers sent along with every delivery. Receivers check the signature by
+// computing Sign() over the timestamp and the body with the webhook's secret,
+// and deduplicate redelivered changes by ID.
+//
+const IdHeader = "X-Webhook-Id"
+const EventHeader = "X-Webhook-Event" // Type of the change
+const TimestampHeader = "X-Webhook-Timestamp"
+const SignatureHeader = "X-Webhook-Signature"
+
+const signaturePrefix = "sha256="
+
+const DefaultMaxAttempts = 8
+const DefaultInitialBackoff = time.Second
+const DefaultMaxBackoff = 10 * time.Minute
+const DefaultTimeout = 10 * time.Second
+const DefaultConcurrency = 4
+
+// Deliveries loaded from the outbox at a time
+//
+const dispatchBatchSize = 100
+
+// Structure to encapsulate the configuration of webhook deliveries. Failed
+// deliveries are retried after InitialBackoff, doubling every attempt up to
+// MaxBackoff, and are dead lettered after MaxAttempts attempts. Deliveries to
+// up to Concurrency webhooks are made at the same time.
+//
+type Config struct {
+	MaxAttempts    uint64        `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Timeout        time.Duration `yaml:"timeout"` // Of every attempt
+	Concurrency    int           `yaml:"concurrency"`
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.MaxAttempts == 0 {
+		return errors.New("webhook deliveries need at least one attempt")
+	}
+	if cfg.InitialBackoff <= 0 || cfg.MaxBackoff < cfg.InitialBackoff {
+		return errors.New("webhook backoff must be positive, and the maximum no less than the initial backoff")
+	}
+	if cfg.Timeout <= 0 {
+		return errors.New("webhook timeout must be positive")
+	}
+	if cfg.Concurrency <= 0 {
+		return errors.New("webhook concurrency must be positive")
+	}
+
+	return nil
+}
+
+// Returns the signature of a delivery of "body" at "timestamp", in the form
+// sent in the X-Webhook-Signature header: "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed by "secret"
+//
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether "signature" is the signature of a delivery of "body" at "timestamp"
+// by a webhook with secret "secret"
+//
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Delivers the changes queued in the outbox to the webhooks they're for. Every
+// webhook is delivered its changes from a goroutine of its own, in the order
+// they're due, so that a webhook that is slow to answer only holds up its own
+// deliveries.
+//
+type Dispatcher struct {
+	db       *db.Db
+	cfg      Config
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	finished chan uint64 // IDs of the webhooks done being delivered to
+	wg       sync.WaitGroup
+}
+
+// Starts delivering the changes queued in the outbox of "svcDb", as they are
+// queued
+//
+func Start(svcDb *db.Db, cfg Config) *Dispatcher {
+	dispatcher := &Dispatcher{
+		db:       svcDb,
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		done:     make(chan struct{}),
+		finished: make(chan uint64),
+	}
+	dispatcher.ctx, dispatcher.cancel = context.WithCancel(context.Background())
+
+	dispatcher.wg.Add(1)
+	go dispatcher.run()
+
+	return dispatcher
+}
+
+func (dispatcher *Dispatcher) run() {
+	defer dispatcher.wg.Done()
+
+	// Changes, and redelivered dead letters, wake the dispatcher up as they are
+	// committed. Retries wake it up once they're due, and webhooks it's done
+	// delivering to once they're done, since they may have more due by then.
+	//
+	notified, unsubscribe := dispatcher.db.SubscribeChanges()
+	defer unsubscribe()
+
+	busy := map[uint64]bool{}
+	for {
+		next := dispatcher.dispatch(busy)
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+
+		select {
+		case <-dispatcher.done:
+		case <-notified:
+		case <-due:
+		case webhookId := <-dispatcher.finished:
+			delete(busy, webhookId)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if dispatcher.closed() {
+			return
+		}
+	}
+}
+
+// Starts delivering to every webhook that has deliveries due and isn't in
+// "busy", the webhooks being delivered to, as long as fewer than
+// "cfg.Concurrency" are. Returns when the earliest delivery that isn't due yet
+// will be, or zero if there is none.
+//
+func (dispatcher *Dispatcher) dispatch(busy map[uint64]bool) time.Time {
+	webhooks, err := dispatcher.db.ListWebhooks()
+	if err != nil {
+		slog.Error("Unable to load webhooks", "error", err)
+		return time.Now().Add(dispatcher.cfg.InitialBackoff)
+	}
+
+	now := time.Now()
+	var next time.Time
+	for _, webhook := range webhooks {
+		if busy[webhook.Id] {
+			continue
+		}
+
+		// Only looks up when the first delivery queued for the webhook is due
+		//
+		_, due, err := dispatcher.db.DueDeliveries(webhook.Id, now, 0)
+		if err != nil {
+			slog.Error("Unable to load webhook deliveries", "webhook_id", webhook.Id, "error", err)
+			return time.Now().Add(dispatcher.cfg.InitialBackoff)
+		}
+
+		switch {
+		case due.IsZero():
+		case due.After(now):
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+		case len(busy) < dispatcher.cfg.Concurrency:
+			busy[webhook.Id] = true
+			dispatcher.wg.Add(1)
+			go dispatcher.deliver(webhook)
+		}
+	}
+
+	return next
+}
+
+// Attempts every delivery to "webhook" that is due until none is left
+//
+func (dispatcher *Dispatcher) deliver(webhook *model.Webhook) {
+	defer dispatcher.wg.Done()
+	defer func() {
+		select {
+		case dispatcher.finished <- webhook.Id:
+		case <-dispatcher.done:
+		}
+	}()
+
+	for !dispatcher.closed() {
+		deliveries, _, err := dispatcher.db.DueDeliveries(webhook.Id, time.Now(), dispatchBatchSize)
+		if err != nil {
+			slog.Error("Unable to load webhook deliveries", "webhook_id", webhook.Id, "error", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		for _, delivery := range deliveries {
+			if dispatcher.closed() {
+				return
+			}
+			dispatcher.attempt(webhook, delivery)
+		}
+	}
+}
+
+// Attempts "delivery" to "webhook", then removes it from the outbox if it
+// succeeded, or schedules its next attempt if it failed. A delivery failing its
+// last attempt is dead lettered.
+//
+func (dispatcher *Dispatcher) attempt(webhook *model.Webhook, delivery *model.WebhookDelivery) {
+	var err error
+	if err = dispatcher.post(webhook, delivery); err == nil {
+		err = dispatcher.db.CompleteDelivery(delivery)
+	} else if dispatcher.closed() {
+		// Interrupted by Close(), which doesn't count as an attempt
+		//
+		return
+	} else {
+		delivery.Attempts += 1
+		delivery.LastError = err.Error()
+
+		if delivery.Attempts >= dispatcher.cfg.MaxAttempts {
+			slog.Warn("Webhook delivery failed, dead lettering it",
+				"webhook_id", webhook.Id,
+				"delivery_id", delivery.Id,
+				"attempts", delivery.Attempts,
+				"error", err,
+			)
+			err = dispatcher.db.DeadLetterDelivery(delivery)
+		} else {
+			err = dispatcher.db.RetryDelivery(delivery, time.Now().UTC().Add(dispatcher.backoff(delivery.Attempts)))
+		}
+	}
+
+	if err != nil {
+		slog.Error("Unable to update webhook delivery", "delivery_id", delivery.Id, "error", err)
+	}
+}
+
+// POSTs the change of "delivery" to "webhook", signed with its secret. Only 2xx
+// responses count as successful.
+//
+func (dispatcher *Dispatcher) post(webhook *model.Webhook, delivery *model.WebhookDelivery) error {
+	body, err := json.Marshal(delivery.Change)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(dispatcher.ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(IdHeader, strconv.FormatUint(delivery.Id, 10))
+	request.Header.Set(EventHeader, delivery.Change.Type)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// The connection can only be reused once the body is drained
+	//
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Returns how long to wait after failed attempt number "attempts"
+//
+func (dispatcher *Dispatcher) backoff(attempts uint64) time.Duration {
+	backoff := dispatcher.cfg.InitialBackoff
+	for i := uint64(1); i < attempts && backoff < dispatcher.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > dispatcher.cfg.MaxBackoff {
+		return dispatcher.cfg.MaxBackoff
+	}
+	return backoff
+}
+
+func (dispatcher *Dispatcher) closed() bool {
+	select {
+	case <-dispatcher.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stops delivering changes, interrupting a delivery in progress. Interrupted
+// deliveries are attempted again once started again.
+//
+func (dispatcher *Dispatcher) Close() {
+	close(dispatcher.done)
+	dispatcher.cancel()
+	dispatcher.wg.Wait()
+}
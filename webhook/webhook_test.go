@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandonto/rest-api-microservice-demo/db"
+	"github.com/brandonto/rest-api-microservice-demo/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testCfg = Config{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     20 * time.Millisecond,
+	Timeout:        time.Second,
+	Concurrency:    2,
+}
+
+// Receives deliveries, answering with "status"
+//
+type testReceiver struct {
+	t      *testing.T
+	secret string
+	status atomic.Int32
+
+	mu       sync.Mutex
+	attempts int
+	received []*model.Change
+}
+
+func newTestReceiver(t *testing.T, secret string) (*testReceiver, *httptest.Server) {
+	receiver := &testReceiver{t: t, secret: secret}
+	receiver.status.Store(http.StatusNoContent)
+
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	return receiver, server
+}
+
+func (receiver *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	assert.Nil(receiver.t, err, "Error reading delivery")
+
+	timestamp := r.Header.Get(TimestampHeader)
+	assert.True(receiver.t, Verify(receiver.secret, timestamp, body, r.Header.Get(SignatureHeader)), "Invalid signature")
+	assert.False(receiver.t, Verify("wrong", timestamp, body, r.Header.Get(SignatureHeader)), "Signature should depend on the secret")
+	_, err = strconv.ParseUint(r.Header.Get(IdHeader), 10, 64)
+	assert.Nil(receiver.t, err, "Invalid delivery ID")
+
+	change := &model.Change{}
+	assert.Nil(receiver.t, json.Unmarshal(body, change), "Invalid delivery")
+	assert.Equal(receiver.t, change.Type, r.Header.Get(EventHeader), "Unexpected event")
+
+	status := int(receiver.status.Load())
+
+	receiver.mu.Lock()
+	receiver.attempts++
+	if status < 300 {
+		receiver.received = append(receiver.received, change)
+	}
+	receiver.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (receiver *testReceiver) counts() (int, []*model.Change) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return receiver.attempts, append([]*model.Change{}, receiver.received...)
+}
+
+func newTestDb(t *testing.T) *db.Db {
+	svcDb := db.NewDb(db.Config{
+		FilePath:   filepath.Join(t.TempDir(), "webhook.db"),
+		BucketName: "UnitTestBucket",
+	})
+	assert.Nil(t, svcDb.Initialize(), "Initialize() failed")
+	t.Cleanup(svcDb.Close)
+
+	return svcDb
+}
+
+func createMessage(t *testing.T, svcDb *db.Db, payload string) {
+	detailedMessage := &model.DetailedMessage{
+		Message:  &model.Message{Payload: payload},
+		Metadata: &model.MessageMetadata{},
+		Owner:    "alice",
+	}
+	assert.Nil(t, svcDb.CreateMessage(detailedMessage), "CreateMessage() failed")
+}
+
+func TestSign(t *testing.T) {
+	signature := Sign("secret", "1700000000", []byte(`{"sequence":1}`))
+	assert.Equal(t, "sha256=", signature[:7], "Unexpected signature prefix")
+	assert.Len(t, signature, 7+64, "Unexpected signature length")
+	assert.True(t, Verify("secret", "1700000000", []byte(`{"sequence":1}`), signature), "Signature should verify")
+	assert.False(t, Verify("secret", "1700000001", []byte(`{"sequence":1}`), signature), "Signature should depend on the timestamp")
+	assert.False(t, Verify("secret", "1700000000", []byte(`{"sequence":2}`), signature), "Signature should depend on the body")
+}
+
+func TestDispatcher(t *testing.T) {
+	svcDb := newTestDb(t)
+	receiver, server := newTestReceiver(t, "s3cret")
+
+	webhook := &model.Webhook{Url: server.URL, Types: []string{db.ChangeCreated}, Secret: "s3cret"}
+	assert.Nil(t, svcDb.CreateWebhook(webhook), "CreateWebhook() failed")
+
+	dispatcher := Start(svcDb, testCfg)
+	defer dispatcher.Close()
+
+	// Changes are delivered as they're made, to the webhooks interested in them
+	//
+	createMessage(t, svcDb, "foo")
+	createMessage(t, svcDb, "bar")
+	_, err := svcDb.DeleteMessage(1)
+	assert.Nil(t, err, "DeleteMessage() failed")
+
+	assert.Eventually(t, func() bool {
+		_, received := receiver.counts()
+		return len(received) == 2
+	}, 5*time.Second, 10*time.Millisecond, "Changes weren't delivered")
+
+	_, received := receiver.counts()
+	assert.Equal(t, "foo", received[0].Message.Message.Payload, "Unexpected payload")
+	assert.Equal(t, "bar", received[1].Message.Message.Payload, "Unexpected payload")
+
+	deliveries, _, err := svcDb.DueDeliveries(webhook.Id, time.Now(), 10)
+	assert.Nil(t, err, "DueDeliveries() failed")
+	assert.Empty(t, deliveries, "Outbox should be empty")
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	svcDb := newTestDb(t)
+	receiver, server := newTestReceiver(t, "s3cret")
+	receiver.status.Store(http.StatusServiceUnavailable)
+
+	assert.Nil(t, svcDb.CreateWebhook(&model.Webhook{Url: server.URL, Secret: "s3cret"}), "CreateWebhook() failed")
+
+	dispatcher := Start(svcDb, testCfg)
+	defer dispatcher.Close()
+
+	// Failed deliveries are retried, then dead lettered
+	//
+	createMessage(t, svcDb, "foo")
+
+	var deadLetters []*model.WebhookDelivery
+	assert.Eventually(t, func() bool {
+		var err error
+		deadLetters, _, err = svcDb.ListDeadLetters(10, 0)
+		assert.Nil(t, err, "ListDeadLetters() failed")
+		return len(deadLetters) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Delivery wasn't dead lettered")
+
+	attempts, _ := receiver.counts()
+	assert.Equal(t, int(testCfg.MaxAttempts), attempts, "Unexpected number of attempts")
+	assert.Equal(t, testCfg.MaxAttempts, deadLetters[0].Attempts, "Unexpected number of attempts")
+	assert.Equal(t, "unexpected HTTP status 503", deadLetters[0].LastError, "Unexpected error")
+
+	// Dead letters are delivered again once redelivered
+	//
+	receiver.status.Store(http.StatusOK)
+	_, err := svcDb.RedeliverDeadLetter(deadLetters[0].Id)
+	assert.Nil(t, err, "RedeliverDeadLetter() failed")
+
+	assert.Eventually(t, func() bool {
+		_, received := receiver.counts()
+		return len(received) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Change wasn't redelivered")
+
+	deadLetters, _, err = svcDb.ListDeadLetters(10, 0)
+	assert.Nil(t, err, "ListDeadLetters() failed")
+	assert.Empty(t, deadLetters, "Dead letters should be empty")
+}
+
+func TestDispatcherSlowWebhook(t *testing.T) {
+	svcDb := newTestDb(t)
+	receiver, server := newTestReceiver(t, "s3cret")
+
+	// The slow webhook answers once the test is done
+	//
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slowServer.Close)
+	t.Cleanup(func() { close(release) })
+
+	assert.Nil(t, svcDb.CreateWebhook(&model.Webhook{Url: slowServer.URL, Secret: "s3cret"}), "CreateWebhook() failed")
+	assert.Nil(t, svcDb.CreateWebhook(&model.Webhook{Url: server.URL, Secret: "s3cret"}), "CreateWebhook() failed")
+
+	dispatcher := Start(svcDb, testCfg)
+	defer dispatcher.Close()
+
+	// Other webhooks are delivered to while the slow one holds up its own
+	// deliveries
+	//
+	createMessage(t, svcDb, "foo")
+	createMessage(t, svcDb, "bar")
+
+	assert.Eventually(t, func() bool {
+		_, received := receiver.counts()
+		return len(received) == 2
+	}, testCfg.Timeout/2, 10*time.Millisecond, "Changes weren't delivered")
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := &Dispatcher{cfg: Config{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1), "Unexpected backoff")
+	assert.Equal(t, 2*time.Second, dispatcher.backoff(2), "Unexpected backoff")
+	assert.Equal(t, 8*time.Second, dispatcher.backoff(4), "Unexpected backoff")
+	assert.Equal(t, 10*time.Second, dispatcher.backoff(5), "Unexpected backoff")
+	assert.Equal(t, 10*time.Second, dispatcher.backoff(100), "Unexpected backoff")
+}